@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// The alerts active as of the latest poll of each feed, replaced on every poll. An alert is active if it was
+// in the feed and one of its active periods, if it has any, contains the feed's timestamp.
+// Rows whose active_end has passed are expired, even before the next poll replaces them.
+var activeAlertColumns = []ColumnInfo{
+	{Name: "feed_id", Type: "TEXT NOT NULL"},
+	{Name: "alert_id", Type: "TEXT NOT NULL"},
+	{Name: "content_hash", Type: "TEXT NOT NULL"},
+	// The active period containing the poll, NULL where it's open-ended
+	{Name: "active_start", Type: "DATETIME"},
+	{Name: "active_end", Type: "DATETIME"},
+	{Name: "updated_at", Type: "DATETIME"},
+}
+
+func createActiveAlertsTableQuery() string {
+	return createTableIfNotExistsQuery("active_alerts", activeAlertColumns, "feed_id, alert_id")
+}
+
+// ActiveAlert refers to the version of an alert in the alerts table which is currently active.
+type ActiveAlert struct {
+	FeedId      string `db:"feed_id"`
+	AlertId     string `db:"alert_id"`
+	ContentHash string `db:"content_hash"`
+	ActiveStart *int64 `db:"active_start"`
+	ActiveEnd   *int64 `db:"active_end"`
+	UpdatedAt   int64  `db:"updated_at"`
+}
+
+// timeRange is a GTFS-RT active period as stored in active_periods, where a missing bound is open.
+type timeRange struct {
+	Start *int64 `json:"start"`
+	End   *int64 `json:"end"`
+}
+
+// activeAt finds the active period of an alert containing a Unix time. Alerts without active periods are always active.
+func (a *Alert) activeAt(t int64) (period timeRange, active bool) {
+	if a.ActivePeriods == nil {
+		return period, true
+	}
+	var periods []timeRange
+	if err := json.Unmarshal([]byte(*a.ActivePeriods), &periods); err != nil || len(periods) == 0 {
+		return period, true
+	}
+	for _, p := range periods {
+		if (p.Start == nil || *p.Start <= t) && (p.End == nil || t < *p.End) {
+			return p, true
+		}
+	}
+	return period, false
+}
+
+// replaceActiveAlerts sets the active alerts of a feed to those in a poll active at its timestamp,
+// dropping alerts which expired or left the feed.
+func replaceActiveAlerts(ctx context.Context, tx *sqlx.Tx, feedId string, alerts []Alert, seen int64) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM active_alerts WHERE feed_id = ?", feedId); err != nil {
+		return err
+	}
+	insert, err := tx.PrepareNamedContext(ctx, insertIntoQuery("active_alerts", activeAlertColumns))
+	if err != nil {
+		return err
+	}
+	for i := range alerts {
+		period, ok := alerts[i].activeAt(seen)
+		if !ok {
+			continue
+		}
+		row := ActiveAlert{
+			FeedId:      feedId,
+			AlertId:     alerts[i].AlertId,
+			ContentHash: alerts[i].ContentHash,
+			ActiveStart: period.Start,
+			ActiveEnd:   period.End,
+			UpdatedAt:   seen,
+		}
+		if _, err := insert.ExecContext(ctx, &row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectActiveAlertsQuery selects the given columns and every alert column of the alerts active at a Unix time,
+// which is its one parameter. Further conditions can be appended with AND.
+func selectActiveAlertsQuery(extraColumns string) string {
+	return "SELECT " + extraColumns + selectColumns(alertColumns) +
+		" FROM alerts JOIN active_alerts USING (feed_id, alert_id, content_hash) WHERE (active_end IS NULL OR active_end > ?)"
+}
+
+// isMissingTable tests whether a query failed because a table doesn't exist yet, as in databases from before it was added.
+func isMissingTable(err error, table string) bool {
+	return err != nil && strings.Contains(err.Error(), "no such table: "+table)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AdminConfig serves an API for controlling a running daemon, to pause and resume feeds, poll or archive one
+// straight away, and change the log level, without restarting it and losing its loaded static GTFS.
+type AdminConfig struct {
+	// Listen is a TCP address such as "127.0.0.1:8091", or "unix:" and the path of a Unix socket, which only the
+	// daemon's user can connect to. Empty disables the API. --admin overrides it.
+	Listen string
+	// Token must be sent with every request as "Authorization: Bearer <token>". It's a template, so it can come from
+	// {{env "NAME"}}, and is required on a TCP address, while a Unix socket is protected by its permissions.
+	Token string
+}
+
+// pollStatus is the outcome of a feed type's last poll.
+type pollStatus struct {
+	Polled time.Time `json:"polled"`
+	Error  string    `json:"error,omitempty"`
+}
+
+type daemonFeedStatus struct {
+	FeedId string                 `json:"feed_id"`
+	Paused bool                   `json:"paused"`
+	Polls  map[string]*pollStatus `json:"polls"`
+}
+
+// adminRequest is work for the daemon's loop, which runs it between cycles so it never overlaps a poll or archive
+// on the database's one connection.
+type adminRequest struct {
+	do     func() error
+	result chan error
+}
+
+// daemonAdmin serves the admin API of a daemon.
+type daemonAdmin struct {
+	token    string
+	runs     []*daemonRun
+	feeds    []string
+	requests chan adminRequest
+	// Done when the daemon is stopping, so requests don't wait on a loop which has exited
+	ctx context.Context
+}
+
+// listenAdmin opens the admin API's listener. A Unix socket left behind by a daemon which didn't exit cleanly
+// is replaced.
+// A socket is created in a private directory the daemon makes next to it, and only moved into place once only the
+// daemon's user can connect, as it's created open to anyone the umask allows.
+func listenAdmin(config AdminConfig) (net.Listener, string, error) {
+	token, err := expandSecret(config.Token)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: Daemon.Admin.Token: %w", ErrConfig, err)
+	}
+	socketPath, isSocket := strings.CutPrefix(config.Listen, "unix:")
+	if !isSocket {
+		if token == "" {
+			return nil, "", fmt.Errorf("%w: Daemon.Admin.Token is required to listen on %s", ErrConfig, config.Listen)
+		}
+		listener, err := net.Listen("tcp", config.Listen)
+		return listener, token, err
+	}
+	if info, err := os.Lstat(socketPath); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		if _, err := net.Dial("unix", socketPath); err == nil {
+			return nil, "", fmt.Errorf("%s is in use by another daemon", socketPath)
+		}
+		os.Remove(socketPath)
+	}
+	// MkdirTemp makes the directory with permissions 0700
+	privateDir, err := os.MkdirTemp(filepath.Dir(socketPath), ".admin-")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.RemoveAll(privateDir)
+	privatePath := filepath.Join(privateDir, "admin.sock")
+	listener, err := net.Listen("unix", privatePath)
+	if err != nil {
+		return nil, "", err
+	}
+	// The socket is unlinked by the daemon at its final path, not where it was created
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(privatePath, 0o600); err != nil {
+		listener.Close()
+		return nil, "", err
+	}
+	if err := os.Rename(privatePath, socketPath); err != nil {
+		listener.Close()
+		return nil, "", err
+	}
+	return &unixSocketListener{listener, socketPath}, token, nil
+}
+
+// unixSocketListener removes its socket when closed, from where it was moved to.
+type unixSocketListener struct {
+	net.Listener
+	path string
+}
+
+func (l *unixSocketListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// authorized checks a request's bearer token, in constant time.
+func (a *daemonAdmin) authorized(r *http.Request) bool {
+	if a.token == "" {
+		return true
+	}
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// call runs work on the daemon's loop, waiting for the poll cycle in progress to finish.
+func (a *daemonAdmin) call(r *http.Request, do func() error) error {
+	request := adminRequest{do: do, result: make(chan error, 1)}
+	select {
+	case a.requests <- request:
+	case <-a.ctx.Done():
+		return &apiError{status: http.StatusServiceUnavailable, message: "the daemon is stopping"}
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+	return <-request.result
+}
+
+func (a *daemonAdmin) run(feedId string) (*daemonRun, error) {
+	for _, d := range a.runs {
+		if d.config.FeedId == feedId {
+			return d, nil
+		}
+	}
+	return nil, &apiError{status: http.StatusNotFound, message: fmt.Sprintf("no feed %q", feedId)}
+}
+
+func (a *daemonAdmin) status() map[string]any {
+	feeds := make([]daemonFeedStatus, len(a.runs))
+	for i, d := range a.runs {
+		feeds[i] = d.status()
+	}
+	return map[string]any{"log_level": strings.ToLower(logLevel.Level().String()), "feeds": feeds}
+}
+
+// ServeHTTP routes the admin API's requests:
+//
+//	GET  /status                   whether each feed is paused and the outcome of its last polls
+//	POST /feeds/{FeedId}/pause     skips the feed in poll cycles until it's resumed
+//	POST /feeds/{FeedId}/resume
+//	POST /feeds/{FeedId}/poll      polls the feed's feed types, or the one given as ?feed=, after the cycle in progress
+//	POST /feeds/{FeedId}/archive   archives the feed's database after the cycle in progress
+//	GET  /log-level
+//	PUT  /log-level?level=debug    changes the log level until the daemon restarts
+func (a *daemonAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !a.authorized(r) {
+		writeAPIError(w, &apiError{status: http.StatusUnauthorized, message: "missing or invalid admin token"})
+		return
+	}
+	result, err := a.route(r)
+	if err != nil {
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) {
+			// Admins need the reason a poll or archive they asked for failed
+			err = &apiError{status: http.StatusInternalServerError, message: err.Error()}
+		}
+		writeAPIError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (a *daemonAdmin) route(r *http.Request) (any, error) {
+	path := strings.Trim(r.URL.Path, "/")
+	method := http.MethodPost
+	switch {
+	case path == "status":
+		method = http.MethodGet
+	case path == "log-level" && r.Method != http.MethodGet:
+		method = http.MethodPut
+	case path == "log-level":
+		method = http.MethodGet
+	}
+	if r.Method != method {
+		return nil, &apiError{status: http.StatusMethodNotAllowed, message: fmt.Sprintf("%s /%s is not allowed", r.Method, path)}
+	}
+
+	switch path {
+	case "status":
+		return a.status(), nil
+	case "log-level":
+		if method == http.MethodPut {
+			level, err := parseLogLevel(r.URL.Query().Get("level"))
+			if err != nil {
+				return nil, badRequest("%s", err)
+			}
+			logLevel.Set(level)
+			slog.Info("Log level changed through the admin API", "level", level)
+		}
+		return map[string]any{"log_level": strings.ToLower(logLevel.Level().String())}, nil
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || parts[0] != "feeds" {
+		return nil, &apiError{status: http.StatusNotFound, message: fmt.Sprintf("no endpoint /%s", path)}
+	}
+	d, err := a.run(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	switch parts[2] {
+	case "pause", "resume":
+		d.setPaused(parts[2] == "pause")
+		d.config.log().Info("Feed " + parts[2] + "d through the admin API")
+	case "poll":
+		feeds := a.feeds
+		if feed := r.URL.Query().Get("feed"); feed != "" {
+			if !contains(daemonFeeds, feed) {
+				return nil, badRequest("can't poll %q, expected one of %s", feed, strings.Join(daemonFeeds, ", "))
+			}
+			feeds = []string{feed}
+		}
+		err = a.call(r, func() error {
+			var failures []error
+			for _, feed := range feeds {
+				if len(a.runs) == 1 || hasURLFor(d.config, feed) {
+					if err := d.poll(feed); err != nil {
+						failures = append(failures, fmt.Errorf("%s: %w", feed, err))
+					}
+				}
+			}
+			return errors.Join(failures...)
+		})
+	case "archive":
+		err = a.call(r, func() error {
+			if d.archive == nil {
+				// Without thresholds, archives are only made on request
+				d.archive = newDaemonArchive(d.config, d.db)
+			}
+			return d.archive.run()
+		})
+	default:
+		return nil, &apiError{status: http.StatusNotFound, message: fmt.Sprintf("no endpoint /%s", path)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.status(), nil
+}
+
+// serveAdmin serves the admin API until the returned function is called, which removes its Unix socket.
+// Requests waiting on the daemon's loop are turned away once ctx is done.
+func serveAdmin(ctx context.Context, config AdminConfig, admin *daemonAdmin) (func(), error) {
+	listener, token, err := listenAdmin(config)
+	if err != nil {
+		return nil, err
+	}
+	admin.token, admin.ctx = token, ctx
+	server := &http.Server{Handler: admin, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("The admin API stopped", "err", err)
+		}
+	}()
+	slog.Info("Serving the admin API", "on", config.Listen)
+	return func() { server.Close() }, nil
+}
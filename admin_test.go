@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestAdminAuthorized(t *testing.T) {
+	tests := []struct {
+		token  string
+		header string
+		want   bool
+	}{
+		// A socket without a token relies on its permissions
+		{"", "", true},
+		{"secret", "Bearer secret", true},
+		{"secret", "", false},
+		{"secret", "Bearer wrong", false},
+		{"secret", "Bearer secret2", false},
+		{"secret", "secret", false},
+		{"secret", "Basic secret", false},
+		{"secret", "bearer secret", false},
+	}
+	for _, test := range tests {
+		admin := &daemonAdmin{token: test.token}
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if got := admin.authorized(r); got != test.want {
+			t.Errorf("token %q with %q: authorized %t, want %t", test.token, test.header, got, test.want)
+		}
+	}
+}
+
+func TestAdminRoute(t *testing.T) {
+	level := logLevel.Level()
+	t.Cleanup(func() { logLevel.Set(level) })
+	// The daemon has stopped, so requests for its loop are turned away rather than waiting
+	stopped, cancel := context.WithCancel(context.Background())
+	cancel()
+	run := &daemonRun{config: Config{FeedId: "transit"}}
+	admin := &daemonAdmin{runs: []*daemonRun{run}, feeds: []string{"vehicleupdates"}, ctx: stopped}
+
+	tests := []struct {
+		method string
+		target string
+		status int
+		paused bool
+	}{
+		{http.MethodGet, "/status", http.StatusOK, false},
+		{http.MethodPost, "/status", http.StatusMethodNotAllowed, false},
+		{http.MethodPost, "/feeds/transit/pause", http.StatusOK, true},
+		{http.MethodGet, "/feeds/transit/pause", http.StatusMethodNotAllowed, true},
+		{http.MethodPost, "/feeds/transit/resume/", http.StatusOK, false},
+		{http.MethodPost, "/feeds/other/pause", http.StatusNotFound, false},
+		{http.MethodPost, "/feeds/transit/restart", http.StatusNotFound, false},
+		{http.MethodPost, "/feeds/transit", http.StatusNotFound, false},
+		{http.MethodPost, "/feeds/transit/pause/now", http.StatusNotFound, false},
+		{http.MethodPost, "/feeds/transit/poll?feed=static", http.StatusBadRequest, false},
+		{http.MethodPost, "/feeds/transit/poll", http.StatusServiceUnavailable, false},
+		{http.MethodPost, "/feeds/transit/archive", http.StatusServiceUnavailable, false},
+		{http.MethodGet, "/log-level", http.StatusOK, false},
+		{http.MethodPut, "/log-level?level=debug", http.StatusOK, false},
+		{http.MethodPut, "/log-level?level=verbose", http.StatusBadRequest, false},
+		{http.MethodPost, "/", http.StatusNotFound, false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		status := http.StatusOK
+		if _, err := admin.route(r); err != nil {
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("%s %s: got %v, want an API error", test.method, test.target, err)
+			}
+			status = apiErr.status
+		}
+		if status != test.status {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.target, status, test.status)
+		}
+		if run.isPaused() != test.paused {
+			t.Errorf("%s %s: feed paused is %t, want %t", test.method, test.target, run.isPaused(), test.paused)
+		}
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("log level is %s, want DEBUG", logLevel.Level())
+	}
+}
+
+func TestListenAdminSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket permissions aren't enforced on Windows")
+	}
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "admin.sock")
+	// A socket left behind by a daemon which didn't exit cleanly
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, _, err := listenAdmin(AdminConfig{Listen: "unix:" + socketPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("socket has permissions %o, want 600", perm)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("left %d entries next to the socket, want only the socket", len(entries))
+	}
+	if _, _, err := listenAdmin(AdminConfig{Listen: "unix:" + socketPath}); err == nil {
+		t.Error("listened on a socket in use by another daemon")
+	}
+	go http.Serve(listener, http.NotFoundHandler())
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	listener.Close()
+	if _, err := os.Lstat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("socket remains after closing: %v", err)
+	}
+
+	if _, _, err := listenAdmin(AdminConfig{Listen: "127.0.0.1:0"}); !errors.Is(err, ErrConfig) {
+		t.Errorf("TCP without a token: got %v, want ErrConfig", err)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/jmoiron/sqlx"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Alerts are republished on every poll, so a row is kept for each version of an alert
+// along with when it was first and last seen.
+var alertColumns = []ColumnInfo{
+	{Name: "feed_id", Type: "TEXT NOT NULL"},
+	{Name: "alert_id", Type: "TEXT NOT NULL"},
+	{Name: "content_hash", Type: "TEXT NOT NULL"},
+	{Name: "first_seen", Type: "DATETIME"},
+	{Name: "last_seen", Type: "DATETIME"},
+	{Name: "active_periods", Type: "TEXT"},
+	{Name: "informed_entities", Type: "TEXT"},
+	{Name: "cause", Type: "INT8"},
+	{Name: "cause_detail", Type: "TEXT"},
+	{Name: "effect", Type: "INT8"},
+	{Name: "effect_detail", Type: "TEXT"},
+	{Name: "severity_level", Type: "INT8"},
+	{Name: "url", Type: "TEXT"},
+	{Name: "header_text", Type: "TEXT"},
+	{Name: "description_text", Type: "TEXT"},
+	{Name: "tts_header_text", Type: "TEXT"},
+	{Name: "tts_description_text", Type: "TEXT"},
+	{Name: "image", Type: "TEXT"},
+	{Name: "image_alternative_text", Type: "TEXT"},
+}
+
+func createAlertsTableQuery() string {
+	return createTableIfNotExistsQuery("alerts", alertColumns, "feed_id, alert_id, content_hash")
+}
+
+// selectAlertsQuery selects every alert column.
+func selectAlertsQuery() string {
+	return "SELECT " + selectColumns(alertColumns) + " FROM alerts"
+}
+
+// Alert is a flattened GTFS-RT Alert.
+// Repeated and translated fields are stored as JSON, e.g. [{"text": "Detour", "language": "en"}].
+type Alert struct {
+	FeedId               string  `db:"feed_id" json:"feed_id"`
+	AlertId              string  `db:"alert_id" json:"alert_id"`
+	ContentHash          string  `db:"content_hash" json:"-"`
+	FirstSeen            int64   `db:"first_seen" json:"first_seen"`
+	LastSeen             int64   `db:"last_seen" json:"last_seen"`
+	ActivePeriods        *string `db:"active_periods" json:"active_periods"`
+	InformedEntities     *string `db:"informed_entities" json:"informed_entities"`
+	Cause                *int32  `db:"cause" json:"cause"`
+	CauseDetail          *string `db:"cause_detail" json:"cause_detail"`
+	Effect               *int32  `db:"effect" json:"effect"`
+	EffectDetail         *string `db:"effect_detail" json:"effect_detail"`
+	SeverityLevel        *int32  `db:"severity_level" json:"severity_level"`
+	URL                  *string `db:"url" json:"url"`
+	HeaderText           *string `db:"header_text" json:"header_text"`
+	DescriptionText      *string `db:"description_text" json:"description_text"`
+	TtsHeaderText        *string `db:"tts_header_text" json:"tts_header_text"`
+	TtsDescriptionText   *string `db:"tts_description_text" json:"tts_description_text"`
+	Image                *string `db:"image" json:"image"`
+	ImageAlternativeText *string `db:"image_alternative_text" json:"image_alternative_text"`
+}
+
+type translation struct {
+	Text     string `json:"text"`
+	Language string `json:"language,omitempty"`
+}
+
+type localizedImage struct {
+	URL       string `json:"url"`
+	MediaType string `json:"media_type"`
+	Language  string `json:"language,omitempty"`
+}
+
+// Alert fields added to the spec after the bindings were generated, which are read from the unknown fields.
+const (
+	alertImageField                protowire.Number = 15
+	alertImageAlternativeTextField protowire.Number = 16
+	alertCauseDetailField          protowire.Number = 17
+	alertEffectDetailField         protowire.Number = 18
+)
+
+// newerAlertFields holds the alert fields which aren't in the bindings.
+type newerAlertFields struct {
+	image                []localizedImage
+	imageAlternativeText []translation
+	causeDetail          []translation
+	effectDetail         []translation
+}
+
+// parseNewerAlertFields decodes the newer alert fields from the unknown fields of an alert.
+func parseNewerAlertFields(alert *gtfs.Alert) (newerAlertFields, error) {
+	var fields newerAlertFields
+	b := alert.ProtoReflect().GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fields, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType || num < alertImageField || num > alertEffectDetailField {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return fields, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return fields, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if num == alertImageField {
+			images, err := parseTranslatedImage(value)
+			if err != nil {
+				return fields, fmt.Errorf("image: %w", err)
+			}
+			fields.image = append(fields.image, images...)
+			continue
+		}
+		text := &gtfs.TranslatedString{}
+		if err := proto.Unmarshal(value, text); err != nil {
+			return fields, err
+		}
+		// Repeated occurrences of a message field are merged, which appends their translations
+		switch num {
+		case alertImageAlternativeTextField:
+			fields.imageAlternativeText = append(fields.imageAlternativeText, translations(text)...)
+		case alertCauseDetailField:
+			fields.causeDetail = append(fields.causeDetail, translations(text)...)
+		case alertEffectDetailField:
+			fields.effectDetail = append(fields.effectDetail, translations(text)...)
+		}
+	}
+	return fields, nil
+}
+
+// parseTranslatedImage decodes a TranslatedImage, which has a repeated LocalizedImage
+// with url = 1, media_type = 2 and language = 3.
+func parseTranslatedImage(b []byte) ([]localizedImage, error) {
+	var images []localizedImage
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num != 1 || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var image localizedImage
+		for len(value) > 0 {
+			num, typ, n := protowire.ConsumeTag(value)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			value = value[n:]
+			if typ != protowire.BytesType {
+				n = protowire.ConsumeFieldValue(num, typ, value)
+			} else {
+				var s string
+				s, n = protowire.ConsumeString(value)
+				switch num {
+				case 1:
+					image.URL = s
+				case 2:
+					image.MediaType = s
+				case 3:
+					image.Language = s
+				}
+			}
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			value = value[n:]
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+func translations(text *gtfs.TranslatedString) []translation {
+	var result []translation
+	for _, t := range text.GetTranslation() {
+		result = append(result, translation{Text: t.GetText(), Language: t.GetLanguage()})
+	}
+	return result
+}
+
+// jsonColumn encodes a repeated field as JSON into a column, leaving it NULL if the field is empty.
+func jsonColumn[T any](column **string, name string, values []T) error {
+	if len(values) == 0 {
+		*column = nil
+		return nil
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("%w %s: %w", errColumnEncoding, name, err)
+	}
+	s := string(encoded)
+	*column = &s
+	return nil
+}
+
+// fromFeedEntity reads a ProtoBuf Alert, seen at the given Unix time, into a package-local Alert.
+func (a *Alert) fromFeedEntity(alertId string, alert *gtfs.Alert, seen int64) error {
+	// Deterministic so that an unchanged alert always hashes the same
+	encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(encoded)
+	newer, err := parseNewerAlertFields(alert)
+	if err != nil {
+		return err
+	}
+
+	a.AlertId = alertId
+	a.ContentHash = hex.EncodeToString(hash[:])
+	a.FirstSeen = seen
+	a.LastSeen = seen
+	a.Cause = optionalInt32(alert.Cause)
+	a.Effect = optionalInt32(alert.Effect)
+	a.SeverityLevel = optionalInt32(alert.SeverityLevel)
+
+	// The generated structs have JSON tags with the GTFS-RT field names
+	return errors.Join(
+		jsonColumn(&a.ActivePeriods, "active_periods", alert.ActivePeriod),
+		jsonColumn(&a.InformedEntities, "informed_entities", alert.InformedEntity),
+		jsonColumn(&a.CauseDetail, "cause_detail", newer.causeDetail),
+		jsonColumn(&a.EffectDetail, "effect_detail", newer.effectDetail),
+		jsonColumn(&a.URL, "url", translations(alert.Url)),
+		jsonColumn(&a.HeaderText, "header_text", translations(alert.HeaderText)),
+		jsonColumn(&a.DescriptionText, "description_text", translations(alert.DescriptionText)),
+		jsonColumn(&a.TtsHeaderText, "tts_header_text", translations(alert.TtsHeaderText)),
+		jsonColumn(&a.TtsDescriptionText, "tts_description_text", translations(alert.TtsDescriptionText)),
+		jsonColumn(&a.Image, "image", newer.image),
+		jsonColumn(&a.ImageAlternativeText, "image_alternative_text", newer.imageAlternativeText),
+	)
+}
+
+// addAlerts inserts new versions of the alerts in a feed, updates when existing versions were last seen,
+// and replaces the feed's active alerts.
+// Returns the number of new versions.
+func addAlerts(feed *gtfs.FeedMessage, db *sqlx.DB, feedId string) (int, error) {
+	seen := int64(feed.GetHeader().GetTimestamp())
+	if seen == 0 {
+		seen = time.Now().Unix()
+	}
+
+	var batch []Alert
+	for _, entity := range feed.Entity {
+		if entity.Alert == nil {
+			continue
+		}
+		a := Alert{FeedId: feedId}
+		if err := a.fromFeedEntity(entity.GetId(), entity.Alert, seen); err != nil {
+			return 0, fmt.Errorf("alert %s: %w", entity.GetId(), err)
+		}
+		batch = append(batch, a)
+	}
+	batch, err := alertHooks.filter(batch)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := dbContext()
+	defer cancel()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.PrepareNamedContext(ctx, insertIntoQuery("alerts", alertColumns))
+	if err != nil {
+		return 0, err
+	}
+	update, err := tx.PrepareNamedContext(ctx, `UPDATE alerts SET last_seen = MAX(last_seen, :last_seen)
+		WHERE feed_id = :feed_id AND alert_id = :alert_id AND content_hash = :content_hash`)
+	if err != nil {
+		return 0, err
+	}
+
+	var inserted []Alert
+	for _, a := range batch {
+		result, err := insert.ExecContext(ctx, &a)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			inserted = append(inserted, a)
+		} else if _, err := update.ExecContext(ctx, &a); err != nil {
+			return 0, err
+		}
+	}
+	if err := replaceActiveAlerts(ctx, tx, feedId, batch, seen); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	alertHooks.notify(inserted)
+	return len(inserted), nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type AlertsConfig struct {
+	// Languages are BCP-47 codes in order of preference, e.g. ["fr", "en"].
+	// Every translation is stored regardless, these only pick the text which exports show.
+	Languages []string
+}
+
+// ResolvedAlert is an alert with each translated field resolved to a single language.
+type ResolvedAlert struct {
+	FeedId               string          `json:"feed_id"`
+	AlertId              string          `json:"alert_id"`
+	FirstSeen            int64           `json:"first_seen"`
+	LastSeen             int64           `json:"last_seen"`
+	ActivePeriods        json.RawMessage `json:"active_periods,omitempty"`
+	InformedEntities     json.RawMessage `json:"informed_entities,omitempty"`
+	Cause                *int32          `json:"cause"`
+	Effect               *int32          `json:"effect"`
+	SeverityLevel        *int32          `json:"severity_level"`
+	CauseDetail          *string         `json:"cause_detail"`
+	EffectDetail         *string         `json:"effect_detail"`
+	URL                  *string         `json:"url"`
+	HeaderText           *string         `json:"header_text"`
+	DescriptionText      *string         `json:"description_text"`
+	TtsHeaderText        *string         `json:"tts_header_text"`
+	TtsDescriptionText   *string         `json:"tts_description_text"`
+	ImageURL             *string         `json:"image_url"`
+	ImageAlternativeText *string         `json:"image_alternative_text"`
+}
+
+// languageRank orders a translation's language against the preferred languages, lower is better.
+// Exact matches come first, then matches on the primary subtag (e.g. "en" for "en-CA"),
+// then untagged text, then anything else in the order it was published.
+func languageRank(language string, preferred []string) int {
+	language = strings.ToLower(language)
+	primary, _, _ := strings.Cut(language, "-")
+	for i, p := range preferred {
+		p = strings.ToLower(p)
+		if language == p {
+			return 2 * i
+		}
+		if pPrimary, _, _ := strings.Cut(p, "-"); primary == pPrimary && language != "" {
+			return 2*i + 1
+		}
+	}
+	if language == "" {
+		return 2 * len(preferred)
+	}
+	return 2*len(preferred) + 1
+}
+
+// resolveTranslation picks the text in the most preferred language from a JSON translated string column.
+func resolveTranslation(column *string, preferred []string) *string {
+	if column == nil {
+		return nil
+	}
+	var translations []translation
+	if err := json.Unmarshal([]byte(*column), &translations); err != nil || len(translations) == 0 {
+		return nil
+	}
+	best := 0
+	for i, t := range translations {
+		if languageRank(t.Language, preferred) < languageRank(translations[best].Language, preferred) {
+			best = i
+		}
+	}
+	return &translations[best].Text
+}
+
+// resolveImage picks the image URL in the most preferred language from the JSON image column.
+func resolveImage(column *string, preferred []string) *string {
+	if column == nil {
+		return nil
+	}
+	var images []localizedImage
+	if err := json.Unmarshal([]byte(*column), &images); err != nil || len(images) == 0 {
+		return nil
+	}
+	best := 0
+	for i, image := range images {
+		if languageRank(image.Language, preferred) < languageRank(images[best].Language, preferred) {
+			best = i
+		}
+	}
+	return &images[best].URL
+}
+
+func rawJSON(column *string) json.RawMessage {
+	if column == nil {
+		return nil
+	}
+	return json.RawMessage(*column)
+}
+
+// resolve picks the text of each translated field in the preferred languages.
+func (a *Alert) resolve(preferred []string) ResolvedAlert {
+	return ResolvedAlert{
+		FeedId:               a.FeedId,
+		AlertId:              a.AlertId,
+		FirstSeen:            a.FirstSeen,
+		LastSeen:             a.LastSeen,
+		ActivePeriods:        rawJSON(a.ActivePeriods),
+		InformedEntities:     rawJSON(a.InformedEntities),
+		Cause:                a.Cause,
+		Effect:               a.Effect,
+		SeverityLevel:        a.SeverityLevel,
+		CauseDetail:          resolveTranslation(a.CauseDetail, preferred),
+		EffectDetail:         resolveTranslation(a.EffectDetail, preferred),
+		URL:                  resolveTranslation(a.URL, preferred),
+		HeaderText:           resolveTranslation(a.HeaderText, preferred),
+		DescriptionText:      resolveTranslation(a.DescriptionText, preferred),
+		TtsHeaderText:        resolveTranslation(a.TtsHeaderText, preferred),
+		TtsDescriptionText:   resolveTranslation(a.TtsDescriptionText, preferred),
+		ImageURL:             resolveImage(a.Image, preferred),
+		ImageAlternativeText: resolveTranslation(a.ImageAlternativeText, preferred),
+	}
+}
+
+// exportAlerts writes every stored alert version, or the active alerts, as JSON lines, with text in the preferred languages.
+func exportAlerts(config Config, args []string) (err error) {
+	flags := flag.NewFlagSet("export alerts", flag.ExitOnError)
+	dbPath := flags.String("db", filepath.Join(config.DataDir, "realtime.db"), "realtime database")
+	output := flags.String("output", filepath.Join(config.DataDir, "alerts.jsonl"), "output file")
+	language := flags.String("language", "", "preferred language, falling back to Alerts.Languages from the config")
+	active := flags.Bool("active", false, "only export the currently active alerts")
+	flags.Parse(args)
+
+	preferred := config.Alerts.Languages
+	if *language != "" {
+		preferred = append([]string{*language}, preferred...)
+	}
+
+	db, err := openDatabase(*dbPath, config.FeedId)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// Not bounded by dbTimeout, as the rows are read while writing the export
+	query, queryArgs := selectAlertsQuery(), []any{}
+	if *active {
+		query, queryArgs = selectActiveAlertsQuery(""), []any{time.Now().Unix()}
+	}
+	rows, err := db.QueryxContext(context.Background(), query+" ORDER BY first_seen, feed_id, alert_id", queryArgs...)
+	if isMissingTable(err, "active_alerts") {
+		return errors.New("no active alerts recorded yet, run the alerts command first")
+	} else if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	stagingPath := *output + ".tmp"
+	f, err := os.Create(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(stagingPath)
+		}
+	}()
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+
+	var total int
+	for rows.Next() {
+		var a Alert
+		if err = rows.StructScan(&a); err != nil {
+			return err
+		}
+		if err = encoder.Encode(a.resolve(preferred)); err != nil {
+			return err
+		}
+		total++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	config.log().Info("Exported alerts", "alerts", total, "output", *output)
+	return os.Rename(stagingPath, *output)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// analysisInput selects the positions read by an analyze command.
+type analysisInput struct {
+	dbPath     *string
+	archiveDir *string
+	from       *string
+	to         *string
+	// Drop positions flagged by the GPS anomaly detectors
+	excludeAnomalies *bool
+	maxSpeedKmh      *float64
+}
+
+func addAnalysisFlags(flags *flag.FlagSet, config Config) *analysisInput {
+	return &analysisInput{
+		dbPath:           flags.String("db", filepath.Join(config.DataDir, "realtime.db"), "realtime database"),
+		archiveDir:       flags.String("archive", feedArchiveDir(config), "archive directory"),
+		from:             flags.String("from", "", "first date to analyze, as YYYY-MM-DD (default: start of the data)"),
+		to:               flags.String("to", "", "date to analyze up to, exclusive, as YYYY-MM-DD (default: end of the data)"),
+		excludeAnomalies: flags.Bool("exclude-anomalies", false, "skip positions from frozen or drifting GPS units"),
+		maxSpeedKmh:      flags.Float64("max-speed", 120, "speed in km/h between consecutive positions beyond which a position counts as GPS drift"),
+	}
+}
+
+// forEachPosition calls fn with every position between the dates, from the archive as well as rows not yet archived.
+// Positions are in timestamp order, then by vehicle. Only one month is held in memory at a time.
+func (in *analysisInput) forEachPosition(config Config, location *time.Location, fn func(vp *VehiclePosition)) error {
+	if *in.maxSpeedKmh <= 0 {
+		return fmt.Errorf("invalid --max-speed: %v", *in.maxSpeedKmh)
+	}
+	fromTime, err := parseExportDate(*in.from, location)
+	if err != nil {
+		return fmt.Errorf("invalid --from: %w", err)
+	}
+	toTime, err := parseExportDate(*in.to, location)
+	if err != nil {
+		return fmt.Errorf("invalid --to: %w", err)
+	}
+
+	db, err := openDatabase(*in.dbPath, config.FeedId)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	schema, err := newArchiveSchema(config.Archive, config.FeedId)
+	if err != nil {
+		return err
+	}
+	startMonth, endMonth, err := exportRange(db, *in.archiveDir, config.Archive)
+	if err != nil {
+		return err
+	} else if startMonth.IsZero() {
+		return errors.New("no data to analyze")
+	}
+	if !fromTime.IsZero() {
+		if month := time.Date(fromTime.Year(), fromTime.Month(), 1, 0, 0, 0, 0, time.UTC); month.After(startMonth) {
+			startMonth = month
+		}
+	}
+	if !toTime.IsZero() {
+		if month := time.Date(toTime.Year(), toTime.Month(), 1, 0, 0, 0, 0, time.UTC); month.Before(endMonth) {
+			endMonth = month
+		}
+	}
+	compare := schema.schema.Comparator(parquet.Ascending(schema.timestampName), parquet.Ascending(schema.vehicleIdName))
+	var detector *gpsAnomalyDetector
+	if *in.excludeAnomalies {
+		detector = newGPSAnomalyDetector(*in.maxSpeedKmh)
+	}
+
+	var vp VehiclePosition
+	var excluded int
+	for period := startMonth; !period.After(endMonth); period = period.AddDate(0, 1, 0) {
+		rows, err := readSnapshotMonth(db, *in.archiveDir, config.Archive, period, schema)
+		if err != nil {
+			return err
+		}
+		sort.Slice(rows, func(i, j int) bool { return compare(rows[i], rows[j]) < 0 })
+		for _, row := range rows {
+			if err := schema.position(row, &vp); err != nil {
+				return err
+			}
+			if (!fromTime.IsZero() && vp.Timestamp.Before(fromTime)) || (!toTime.IsZero() && !vp.Timestamp.Before(toTime)) {
+				continue
+			}
+			if detector != nil {
+				if anomaly, _ := detector.check(&vp); anomaly != "" {
+					excluded++
+					continue
+				}
+			}
+			fn(&vp)
+		}
+		config.log().Debug("Analyzed a month", "month", period.Format(yearMonthLayout), "rows", len(rows))
+	}
+	if detector != nil {
+		config.log().Info("Excluded positions with GPS anomalies", "positions", excluded)
+	}
+	return nil
+}
+
+// timeOfDayBucket returns the local time of day at the start of the interval containing t, as HH:MM.
+func timeOfDayBucket(t time.Time, location *time.Location, interval time.Duration) string {
+	local := t.In(location)
+	sinceMidnight := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+	bucket := sinceMidnight.Truncate(interval)
+	return fmt.Sprintf("%02d:%02d", int(bucket.Hours()), int(bucket.Minutes())%60)
+}
+
+// writeAnalysis writes the results of an analysis as Parquet if the output ends in .parquet, or CSV otherwise.
+// CSV columns are named after the parquet tags of T, with nulls left empty.
+func writeAnalysis[T any](output string, results []T) (err error) {
+	stagingPath := output + ".tmp"
+	f, err := os.Create(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(stagingPath)
+		}
+	}()
+
+	if filepath.Ext(output) == ".parquet" {
+		writer := parquet.NewGenericWriter[T](f)
+		if _, err = writer.Write(results); err != nil {
+			return err
+		}
+		if err = writer.Close(); err != nil {
+			return err
+		}
+	} else {
+		w := bufio.NewWriter(f)
+		if err = writeAnalysisCSV(w, results); err != nil {
+			return err
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	slog.Info("Wrote the analysis", "rows", len(results), "output", output)
+	return os.Rename(stagingPath, output)
+}
+
+func writeAnalysisCSV[T any](w *bufio.Writer, results []T) error {
+	resultType := reflect.TypeOf(results).Elem()
+	var fields []int
+	var header []string
+	for i := 0; i < resultType.NumField(); i++ {
+		if name := parquetName(resultType.Field(i)); name != "" {
+			fields = append(fields, i)
+			header = append(header, name)
+		}
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	record := make([]string, len(fields))
+	for _, result := range results {
+		v := reflect.ValueOf(result)
+		for i, field := range fields {
+			record[i] = csvValue(v.Field(field))
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func csvValue(v reflect.Value) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	switch value := v.Interface().(type) {
+	case float32, float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	case time.Time:
+		return value.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v.Interface())
+}
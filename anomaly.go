@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// The coordinates haven't changed although the vehicle reports moving
+	frozenGPS = "frozen"
+	// The vehicle would have to move implausibly fast to reach the coordinates
+	driftGPS = "drift"
+)
+
+// After this many drifting positions in a row, the vehicle is assumed to really be at the new location
+const maxConsecutiveDrift = 3
+
+type lastFix struct {
+	latitude, longitude float32
+	timestamp           time.Time
+	drifts              int
+}
+
+// gpsAnomalyDetector flags positions from frozen or drifting GPS units, comparing each vehicle's positions in time order.
+type gpsAnomalyDetector struct {
+	maxSpeedKmh float64
+	last        map[string]*lastFix
+}
+
+func newGPSAnomalyDetector(maxSpeedKmh float64) *gpsAnomalyDetector {
+	return &gpsAnomalyDetector{maxSpeedKmh: maxSpeedKmh, last: make(map[string]*lastFix)}
+}
+
+// check returns the kind of anomaly in a position, or "" if it looks fine,
+// along with the speed implied by the distance from the vehicle's previous position.
+func (d *gpsAnomalyDetector) check(vp *VehiclePosition) (anomaly string, impliedSpeedKmh float64) {
+	if vp.VehicleId == "" || vp.Latitude == nil || vp.Longitude == nil {
+		return "", 0
+	}
+	previous, found := d.last[vp.VehicleId]
+	if !found {
+		d.last[vp.VehicleId] = &lastFix{latitude: *vp.Latitude, longitude: *vp.Longitude, timestamp: vp.Timestamp}
+		return "", 0
+	}
+	elapsed := vp.Timestamp.Sub(previous.timestamp)
+	if elapsed <= 0 {
+		return "", 0
+	}
+
+	if *vp.Latitude == previous.latitude && *vp.Longitude == previous.longitude {
+		previous.timestamp = vp.Timestamp
+		if valueOf(vp.Speed) > 0 {
+			return frozenGPS, 0
+		}
+		return "", 0
+	}
+	meters := haversineMeters(float64(previous.latitude), float64(previous.longitude), float64(*vp.Latitude), float64(*vp.Longitude))
+	impliedSpeedKmh = meters / elapsed.Seconds() * 3.6
+	if impliedSpeedKmh > d.maxSpeedKmh && previous.drifts+1 < maxConsecutiveDrift {
+		// Keep comparing against the last good fix, so one outlier doesn't flag the position after it too
+		previous.drifts++
+		return driftGPS, impliedSpeedKmh
+	}
+	*previous = lastFix{latitude: *vp.Latitude, longitude: *vp.Longitude, timestamp: vp.Timestamp}
+	return "", impliedSpeedKmh
+}
+
+// GPSAnomaly is a position flagged by the GPS anomaly detectors.
+type GPSAnomaly struct {
+	VehicleId       string    `parquet:"vehicle_id"`
+	TripId          string    `parquet:"trip_id"`
+	Timestamp       time.Time `parquet:"timestamp,timestamp(millisecond)"`
+	Anomaly         string    `parquet:"anomaly"`
+	Latitude        float32   `parquet:"latitude"`
+	Longitude       float32   `parquet:"longitude"`
+	Speed           *float32  `parquet:"speed,optional"`
+	ImpliedSpeedKmh float64   `parquet:"implied_speed_kmh"`
+}
+
+// analyzeGPSAnomalies lists positions from frozen or drifting GPS units.
+// The other analyses can leave these out with --exclude-anomalies.
+func analyzeGPSAnomalies(config Config, args []string) error {
+	flags := flag.NewFlagSet("analyze gps-anomalies", flag.ExitOnError)
+	input := addAnalysisFlags(flags, config)
+	output := flags.String("output", filepath.Join(config.DataDir, "gps-anomalies.csv"), "output file, as Parquet if it ends in .parquet and CSV otherwise")
+	flags.Parse(args)
+
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+	// Anomalies are what's being looked for here, so don't filter them out
+	*input.excludeAnomalies = false
+	detector := newGPSAnomalyDetector(*input.maxSpeedKmh)
+	var anomalies []GPSAnomaly
+	err = input.forEachPosition(config, location, func(vp *VehiclePosition) {
+		anomaly, impliedSpeed := detector.check(vp)
+		if anomaly == "" {
+			return
+		}
+		anomalies = append(anomalies, GPSAnomaly{
+			VehicleId:       vp.VehicleId,
+			TripId:          vp.TripId,
+			Timestamp:       vp.Timestamp,
+			Anomaly:         anomaly,
+			Latitude:        *vp.Latitude,
+			Longitude:       *vp.Longitude,
+			Speed:           vp.Speed,
+			ImpliedSpeedKmh: impliedSpeed,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return writeAnalysis(*output, anomalies)
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"time"
@@ -12,48 +14,395 @@ import (
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+	"github.com/parquet-go/parquet-go/compress/brotli"
+	"github.com/parquet-go/parquet-go/compress/gzip"
+	"github.com/parquet-go/parquet-go/compress/zstd"
 )
 
-// timestamp > 0 avoids the occasional row with no timestamp set (i.e. invalid data)
+type ArchiveConfig struct {
+	// ExcludeColumns lists Parquet columns which are left out of the archive.
+	ExcludeColumns []string
+	// RenameColumns maps Parquet column names to the names written to the archive.
+	RenameColumns map[string]string
+	// TimestampUnit is the precision of Parquet timestamp columns, which are always adjusted to UTC.
+	// One of "millisecond" (default), "microsecond" or "nanosecond".
+	TimestampUnit string
+	// LegacyInt96Timestamps writes timestamps using the deprecated INT96 type instead,
+	// for engines such as Spark 2, Hive and Impala which misread INT64 timestamps.
+	LegacyInt96Timestamps bool
+	// PartitionBy chooses the month each row is archived in: "timestamp" (default) for the UTC calendar month of its
+	// timestamp, or "service_date" for the month of its trip's GTFS service day, so trips running past midnight
+	// stay with the day they operated. Positions without a trip start date fall back to their timestamp.
+	// Service days end after midnight, so sealing these months needs a SealAfterDays of at least 1.
+	PartitionBy string
+	// PartitionTimeZone is the IANA time zone in which months begin and end, e.g. the agency's TimeZone.
+	// Defaults to UTC. Partitions keep the same year and month names in any time zone, so changing it
+	// on an existing archive only moves rows near month boundaries.
+	PartitionTimeZone string
+	// RoutePartitioning adds a route partition level below each month.
+	// One of "" (disabled), "bucket" (hash routes into RouteBuckets partitions)
+	// or "top" (one partition for each of the TopRoutes busiest routes, plus one for all others).
+	RoutePartitioning string
+	RouteBuckets      int
+	TopRoutes         int
+	// RowGroupSize is the maximum number of rows in each Parquet row group.
+	RowGroupSize int64
+	// PageSize is the target size in bytes of uncompressed data pages.
+	PageSize int
+	// NoDictionaryColumns disables dictionary encoding for the given columns.
+	// Dictionaries span a whole column chunk without a size cap, so this is the way to bound them
+	// for high cardinality columns (besides a smaller RowGroupSize).
+	NoDictionaryColumns []string
+	// Compression is the Parquet codec: one of "zstd" (default), "snappy", "gzip", "brotli", "lz4" or "uncompressed".
+	// ORC archives only support "gzip" (zlib, the default for ORC) and "uncompressed",
+	// and csv.gz archives only "gzip".
+	Compression string
+	// CompressionLevel is passed to codecs which support levels (zstd 1-4, gzip 1-9, brotli 0-11).
+	// Zero uses the codec's default level.
+	CompressionLevel int
+	// Profile adjusts timestamp types, encodings, statistics and page settings to a combination known to work with
+	// a query engine: one of "athena", "spark2" or "duckdb". Its timestamp settings take precedence over
+	// TimestampUnit and LegacyInt96Timestamps.
+	Profile string
+	// Format is the archive file format: "parquet" (default), "orc" or "csv.gz".
+	// Partitions in formats other than Parquet can't be appended to, so they are rewritten
+	// in full from the database on each run.
+	Format string
+	// Encryption optionally writes encrypted copies of updated partitions.
+	Encryption EncryptionConfig
+	// ManifestSigningKey is an Ed25519 private key (PKCS #8 PEM) used to sign the archive manifest
+	// after every run. The manifest is left unsigned if empty.
+	ManifestSigningKey string
+	// ManifestPublicKey is the matching public key (PKIX PEM) used by the verify command.
+	ManifestPublicKey string
+	// CheckpointRows makes rewrites of Parquet partitions resumable. Every this many rows, the rows written so far
+	// are closed off in a segment file next to the partition file and the progress is recorded, so a rerun after
+	// an interruption continues from the last checkpoint instead of starting over. The segments are joined into the
+	// partition file once the month is complete, which costs an extra local copy. Zero writes partitions in one pass.
+	CheckpointRows int64
+	// SealAfterDays seals each month this many days after it ends, when no more data for it is expected.
+	// Its partitions are rewritten one final time at the codec's highest compression level, the month is
+	// recorded as sealed in the manifest, and later runs skip it. Zero disables sealing.
+	SealAfterDays int
+	// Dedup is how rows appended to an existing Parquet file are told apart from those already in it.
+	// "trip" (default) skips rows no newer than the archived file's last update from the same vehicle and trip
+	// (and other PositionKey columns). "vehicle" only tracks each vehicle's last update, which drops rows from
+	// a vehicle reassigned to another trip at the time of its last update. "hash" skips only rows identical to
+	// an archived row, which needs a hash of every archived row in memory and reads the whole month's rows.
+	Dedup string
+	// Sink optionally uploads the archive to remote storage after each run.
+	Sink ArchiveSinkConfig
+	// Catalog optionally publishes a catalog of the archive's files at its root.
+	Catalog CatalogConfig
+	// ColdShards keeps the vehicle positions of each month pruned by archive --prune in a SQLite file of its own,
+	// shards/<YYYY-MM>.db.zst in the data directory, compressed with zstd. Unlike the Parquet archive it keeps the
+	// database's schema, so a closed month can be decompressed and queried with sqlite3 again.
+	ColdShards bool
+	// feedId limits the archive to one feed's rows, for each of several feeds sharing a database
+	feedId string
+	// logger logs the archive's messages, set along with the logger of its feed's config
+	logger *slog.Logger
+}
+
+const (
+	defaultRowGroupSize = 1_000_000
+	defaultPageSize     = parquet.DefaultPageBufferSize
+	// Key of the Parquet file metadata recording which build wrote the file
+	versionMetadataKey = "gtfs-scraper.version"
+)
+
+// compressionCodec looks up a Parquet compression codec by name.
+func compressionCodec(name string, level int) (compress.Codec, error) {
+	switch name {
+	case "", "zstd":
+		if level == 0 {
+			return &parquet.Zstd, nil
+		}
+		return &zstd.Codec{Level: zstd.Level(level)}, nil
+	case "gzip":
+		if level == 0 {
+			return &parquet.Gzip, nil
+		}
+		return &gzip.Codec{Level: level}, nil
+	case "brotli":
+		if level == 0 {
+			return &parquet.Brotli, nil
+		}
+		return &brotli.Codec{Quality: level, LGWin: parquet.Brotli.LGWin}, nil
+	case "snappy":
+		return &parquet.Snappy, nil
+	case "lz4":
+		return &parquet.Lz4Raw, nil
+	case "uncompressed":
+		return &parquet.Uncompressed, nil
+	}
+	return nil, fmt.Errorf("invalid compression codec: %q", name)
+}
+
+// sealingConfig returns the archive settings for sealing a month, with the codec's highest compression level.
+// Codecs without levels are unchanged.
+func sealingConfig(config ArchiveConfig) ArchiveConfig {
+	switch config.Format {
+	case "orc", "csv.gz":
+		if config.Compression != "uncompressed" {
+			config.CompressionLevel = gzip.BestCompression
+		}
+		return config
+	}
+	switch config.Compression {
+	case "", "zstd":
+		config.CompressionLevel = int(zstd.SpeedBestCompression)
+	case "gzip":
+		config.CompressionLevel = gzip.BestCompression
+	case "brotli":
+		config.CompressionLevel = 11
+	}
+	return config
+}
+
+// rowWriter is implemented by the writer for each archive file format.
+type rowWriter interface {
+	WriteRows(rows []parquet.Row) (int, error)
+	Close() error
+}
+
+// archiveFileName returns the name of the file in each partition for an archive format.
+func archiveFileName(format string) (string, error) {
+	switch format {
+	case "", "parquet":
+		return "vehicle_positions.parquet", nil
+	case "orc":
+		return "vehicle_positions.orc", nil
+	case "csv.gz":
+		return "vehicle_positions.csv.gz", nil
+	}
+	return "", fmt.Errorf("invalid archive format: %q", format)
+}
+
+// archiver holds the settings shared by every partition written in an archive run.
+type archiver struct {
+	db           *sqlx.DB
+	dir          string
+	config       ArchiveConfig
+	schema       *archiveSchema
+	writerConfig *parquet.WriterConfig
+	fileName     string
+	encryptor    *encryptor
+}
+
+func newArchiver(db *sqlx.DB, archiveDir string, config ArchiveConfig, provenance archiveProvenance) (*archiver, error) {
+	config, profile, err := applyArchiveProfile(config)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := newArchiveSchema(config, provenance.FeedId)
+	if err != nil {
+		return nil, err
+	}
+	fileName, err := archiveFileName(config.Format)
+	if err != nil {
+		return nil, err
+	}
+	rowGroupSize := config.RowGroupSize
+	if rowGroupSize == 0 {
+		rowGroupSize = defaultRowGroupSize
+	}
+	pageSize := config.PageSize
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	rowGroupSize, pageSize = budgetRowGroupSize(rowGroupSize), budgetPageSize(pageSize)
+	// Compression for other formats is validated up front, since their writers are only created per partition
+	var codec compress.Codec = &parquet.Uncompressed
+	switch config.Format {
+	case "orc":
+		_, err = orcCompression(config)
+	case "csv.gz":
+		_, err = csvGzipLevel(config)
+	default:
+		codec, err = compressionCodec(config.Compression, config.CompressionLevel)
+	}
+	if err != nil {
+		return nil, err
+	}
+	encryptor, err := newEncryptor(archiveDir, config.Encryption, config.log())
+	if err != nil {
+		return nil, err
+	}
+	options := []parquet.WriterOption{
+		parquet.MaxRowsPerRowGroup(rowGroupSize),
+		parquet.PageBufferSize(pageSize),
+		parquet.Compression(codec),
+	}
+	options = append(options, profile.writerOptions()...)
+	writerConfig, err := parquet.NewWriterConfig(append(options, provenance.writerOptions()...)...)
+	if err != nil {
+		return nil, err
+	}
+	return &archiver{
+		db:           db,
+		dir:          archiveDir,
+		config:       config,
+		schema:       schema,
+		writerConfig: writerConfig,
+		fileName:     fileName,
+		encryptor:    encryptor,
+	}, nil
+}
+
+// timestamp > 0 avoids the occasional row with no timestamp set (i.e. invalid data).
+// The table is filled in, as vehicle positions and trip updates are partitioned alike.
 const archiveRangeQuery = `
 	SELECT
-		COALESCE(strftime('%Y-%m', MIN(timestamp), 'unixepoch'),'') AS min_ym,
-		COALESCE(strftime('%Y-%m', MAX(timestamp), 'unixepoch'),'') AS max_ym
-	FROM vehicle_positions where timestamp > 0
+		MIN(timestamp) AS min_timestamp,
+		MAX(timestamp) AS max_timestamp,
+		NULL AS min_date,
+		NULL AS max_date
+	FROM %s where timestamp > 0
+`
+
+// Rows without a trip start date are partitioned by their timestamp instead
+const serviceDateRangeQuery = `
+	SELECT
+		MIN(CASE WHEN start_date IS NULL THEN timestamp END) AS min_timestamp,
+		MAX(CASE WHEN start_date IS NULL THEN timestamp END) AS max_timestamp,
+		MIN(start_date) AS min_date,
+		MAX(start_date) AS max_date
+	FROM %s where timestamp > 0
 `
 
-const yearMonthLayout = "2006-01"
+const (
+	yearMonthLayout = "2006-01"
+	// GTFS date format
+	serviceDateLayout = "20060102"
+)
 
-func findArchiveRange(db *sqlx.DB) (startMonth time.Time, endMonth time.Time, err error) {
-	var mm struct {
-		MinYM string `db:"min_ym"`
-		MaxYM string `db:"max_ym"`
+// checkPartitioning validates the PartitionBy and PartitionTimeZone settings.
+func checkPartitioning(config ArchiveConfig) error {
+	switch config.PartitionBy {
+	case "", "timestamp", "service_date":
+	default:
+		return fmt.Errorf("invalid archive PartitionBy: %q", config.PartitionBy)
 	}
-	err = db.Get(&mm, archiveRangeQuery)
-	if err != nil || mm.MinYM == "" || mm.MaxYM == "" {
-		return
+	if _, err := time.LoadLocation(config.PartitionTimeZone); err != nil {
+		return fmt.Errorf("invalid archive PartitionTimeZone: %w", err)
 	}
+	return nil
+}
 
-	startMonth, err = time.Parse(yearMonthLayout, mm.MinYM)
+// partitionLocation returns the time zone of month boundaries, which is UTC unless configured.
+// Invalid names are rejected by checkPartitioning before any partition is written.
+func partitionLocation(config ArchiveConfig) *time.Location {
+	location, err := time.LoadLocation(config.PartitionTimeZone)
 	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// monthOf returns the month label (the first of the month in UTC) which a time in the partition time zone falls in.
+func monthOf(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// partitionMonth returns the start and end of a month in the partition time zone.
+// Months are labelled (i.e. named in directories, manifests and the year and month columns)
+// by the first of the month in UTC, regardless of time zone.
+func partitionMonth(config ArchiveConfig, period time.Time) (start time.Time, end time.Time) {
+	start = time.Date(period.Year(), period.Month(), 1, 0, 0, 0, 0, partitionLocation(config))
+	return start, start.AddDate(0, 1, 0)
+}
+
+// partitionStart returns the earliest timestamp which rows of a month's partition can have.
+// A month's first service day is local to the agency, so it can start up to a day or so before the month
+// begins in the partition time zone.
+func partitionStart(config ArchiveConfig, period time.Time) time.Time {
+	start, _ := partitionMonth(config, period)
+	if config.PartitionBy == "service_date" {
+		return start.AddDate(0, 0, -2)
+	}
+	return start
+}
+
+// feedCondition limits a query's rows to the archive's feed, if it has one, as a condition to AND with others.
+// The alias qualifies feed_id in queries which join tables.
+func feedCondition(config ArchiveConfig, alias string) (string, []any) {
+	if config.feedId == "" {
+		return "", nil
+	}
+	if alias != "" {
+		alias += "."
+	}
+	return " AND " + alias + "feed_id = ?", []any{config.feedId}
+}
+
+func findArchiveRange(db *sqlx.DB, config ArchiveConfig) (startMonth time.Time, endMonth time.Time, err error) {
+	return findTableRange(db, config, "vehicle_positions")
+}
+
+// findTableRange finds the first and last months with rows in a table partitioned like vehicle_positions,
+// or returns zero times if it's empty.
+func findTableRange(db *sqlx.DB, config ArchiveConfig, table string) (startMonth time.Time, endMonth time.Time, err error) {
+	if err = checkPartitioning(config); err != nil {
 		return
 	}
-	endMonth, err = time.Parse(yearMonthLayout, mm.MaxYM)
-	if err != nil {
+	var mm struct {
+		MinTimestamp sql.NullInt64  `db:"min_timestamp"`
+		MaxTimestamp sql.NullInt64  `db:"max_timestamp"`
+		MinDate      sql.NullString `db:"min_date"`
+		MaxDate      sql.NullString `db:"max_date"`
+	}
+	query := archiveRangeQuery
+	if config.PartitionBy == "service_date" {
+		query = serviceDateRangeQuery
+	}
+	condition, args := feedCondition(config, "")
+	ctx, cancel := dbContext()
+	defer cancel()
+	if err = db.GetContext(ctx, &mm, fmt.Sprintf(query, table)+condition, args...); err != nil {
 		return
 	}
+
+	var months []time.Time
+	location := partitionLocation(config)
+	for _, t := range []sql.NullInt64{mm.MinTimestamp, mm.MaxTimestamp} {
+		if t.Valid {
+			months = append(months, monthOf(time.Unix(t.Int64, 0).In(location)))
+		}
+	}
+	for _, d := range []sql.NullString{mm.MinDate, mm.MaxDate} {
+		if d.Valid {
+			date, err := time.Parse(serviceDateLayout, d.String)
+			if err != nil {
+				return startMonth, endMonth, fmt.Errorf("invalid start_date: %w", err)
+			}
+			months = append(months, monthOf(date))
+		}
+	}
+	for _, month := range months {
+		if startMonth.IsZero() || month.Before(startMonth) {
+			startMonth = month
+		}
+		if month.After(endMonth) {
+			endMonth = month
+		}
+	}
 	return startMonth, endMonth, nil
 }
 
 const partitionQuery = `
 	SELECT
+		feed_id,
 		trip_id,
 		route_id,
 		direction_id,
 		CAST(start_time as INT) AS start_time,
+		start_date,
 		schedule_relationship,
 		latitude,
 		longitude,
+		bearing,
 		odometer,
 		speed,
 		current_stop_sequence,
@@ -62,175 +411,530 @@ const partitionQuery = `
 		CAST(timestamp AS INT) AS timestamp,
 		congestion_level,
 		occupancy_status,
+		occupancy_percentage,
 		vehicle_id,
 		vehicle_label,
-		license_plate
-	FROM vehicle_positions WHERE timestamp >= ? AND timestamp < ?
+		license_plate,
+		wheelchair_accessible,
+		nearest_stop_id,
+		agency_id
+	FROM vehicle_positions WHERE timestamp >= ?
 `
 
-func queryPartition(db *sqlx.DB, startTime time.Time, endTime time.Time) (*sqlx.Rows, error) {
-	rows, err := db.Queryx(partitionQuery, startTime.Unix(), endTime.Unix())
+// queryPartition selects the rows of a month's partition with a timestamp from startTime onwards.
+// It isn't bounded by dbTimeout, as its rows are read while writing the partition,
+// which can take longer for a busy month. Ordered rows are sorted by timestamp, so a checkpoint can resume after one.
+func queryPartition(db *sqlx.DB, config ArchiveConfig, period time.Time, startTime time.Time, ordered bool) (*sqlx.Rows, error) {
+	query := partitionQuery
+	args := []any{startTime.Unix()}
+	start, end := partitionMonth(config, period)
+	if config.PartitionBy == "service_date" {
+		query += " AND (start_date >= ? AND start_date < ? OR start_date IS NULL AND timestamp >= ? AND timestamp < ?)"
+		args = append(args, period.Format(serviceDateLayout), period.AddDate(0, 1, 0).Format(serviceDateLayout), start.Unix(), end.Unix())
+	} else {
+		query += " AND timestamp < ?"
+		args = append(args, end.Unix())
+	}
+	condition, feedArgs := feedCondition(config, "")
+	query += condition
+	args = append(args, feedArgs...)
+	if ordered {
+		query += " ORDER BY timestamp"
+	}
+	rows, err := db.QueryxContext(context.Background(), query, args...)
 	return rows, err
 }
 
-const rowGroupSize = 1_000_000
+// scanPartitionRow reads a row returned by queryPartition, filling in the Parquet-only fields for the period.
+func scanPartitionRow(rows *sqlx.Rows, vp *VehiclePosition, period time.Time) error {
+	if err := rows.StructScan(vp); err != nil {
+		return err
+	}
+	vp.StartTime = time.Unix(vp.StartTimeUnix, 0)
+	vp.Timestamp = time.Unix(vp.TimestampUnix, 0)
+	vp.Year = period.Year()
+	vp.Month = int(period.Month())
+	return nil
+}
+
+// partitionFile appends rows to a single archive file.
+// Rows from an existing Parquet file are carried over, and new rows are skipped if the file already
+// contains a newer update from the same vehicle and trip, or as set by Dedup.
+type partitionFile struct {
+	label       string
+	path        string
+	stagingPath string
+	logger      *slog.Logger
 
-func findLastUpdates(reader *parquet.GenericReader[VehiclePosition], lastVehicleUpdates map[string]time.Time) (validCount int64, err error) {
-	buffer := make([]VehiclePosition, rowGroupSize)
-	for eof := false; !eof; {
-		n, err := reader.Read(buffer)
-		if errors.Is(err, io.EOF) {
-			eof = true
-		} else if err != nil {
-			return 0, err
+	schema             *archiveSchema
+	newWriter          func(w io.Writer) (rowWriter, error)
+	oldFile            *os.File
+	oldReader          *parquet.Reader
+	oldSize            int64
+	oldModified        time.Time
+	oldRows            int64
+	validCount         int64
+	lastVehicleUpdates map[string]time.Time
+	// Content hashes of the existing file's rows, with Dedup "hash"
+	hashes     map[uint64]bool
+	timestamps timestampRange
+
+	file     *os.File
+	writer   rowWriter
+	buffer   []parquet.Row
+	nNew     int
+	nSkipped int
+
+	// With checkpoints, rows are written to numbered segments which are joined when the partition is committed
+	checkpointing bool
+	segments      int
+	segmentRows   int64
+}
+
+// newRowWriter creates a writer for the configured archive format.
+func (a *archiver) newRowWriter(w io.Writer) (rowWriter, error) {
+	switch a.config.Format {
+	case "orc":
+		writer, err := newORCWriter(w, a.schema, a.config)
+		if err != nil {
+			return nil, err
+		}
+		return writer, nil
+	case "csv.gz":
+		writer, err := newCSVWriter(w, a.schema, a.config)
+		if err != nil {
+			return nil, err
 		}
+		return writer, nil
+	}
+	return parquet.NewWriter(w, a.schema.schema, a.writerConfig), nil
+}
 
-		for _, vp := range buffer[:n] {
-			if vp.VehicleId == "" {
-				continue
-			}
-			validCount++
-			if lastUpdate, found := lastVehicleUpdates[vp.VehicleId]; !found || vp.Timestamp.After(lastUpdate) {
-				lastVehicleUpdates[vp.VehicleId] = vp.Timestamp
+// openPartitionFile finds the last update time for each vehicle in an existing partition file, if any.
+// When resuming from a checkpoint, they're taken from the checkpoint instead, and the existing file is read
+// from the first row which wasn't copied yet. The file's messages are logged through logger.
+func (a *archiver) openPartitionFile(filePath string, label string, logger *slog.Logger, resume *fileCheckpoint) (*partitionFile, error) {
+	p := &partitionFile{
+		label:              label,
+		logger:             logger,
+		schema:             a.schema,
+		newWriter:          a.newRowWriter,
+		path:               filePath,
+		stagingPath:        filePath + ".tmp",
+		lastVehicleUpdates: make(map[string]time.Time),
+		checkpointing:      a.checkpointing(),
+	}
+	if a.schema.hashDedup {
+		p.hashes = make(map[uint64]bool)
+	}
+	if resume != nil {
+		p.oldRows, p.validCount, p.segments = resume.OldRows, resume.ValidCount, resume.Segments
+		p.nNew, p.nSkipped, p.timestamps = resume.New, resume.Skipped, resume.Timestamps
+		if resume.LastVehicleUpdates != nil {
+			p.lastVehicleUpdates = resume.LastVehicleUpdates
+		}
+	}
+	if filepath.Ext(filePath) != ".parquet" {
+		// Other formats are rewritten from scratch
+		return p, nil
+	}
+
+	oldFile, err := os.Open(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	file, err := openParquetFile(oldFile)
+	if err != nil {
+		oldFile.Close()
+		return nil, err
+	}
+	p.oldFile = oldFile
+	p.oldReader = parquet.NewReader(file)
+	if info, err := oldFile.Stat(); err == nil {
+		p.oldSize, p.oldModified = info.Size(), info.ModTime().UTC()
+	}
+	if resume != nil {
+		// Hashes aren't checkpointed, as they'd be as large as the file's key columns
+		if p.hashes != nil {
+			if _, err := p.schema.findLastUpdates(p.oldReader, make(map[string]time.Time), &timestampRange{}, p.hashes); err != nil {
+				p.closeOld()
+				return nil, err
 			}
+			p.oldReader.Reset()
+		}
+		if err := p.oldReader.SeekToRow(p.oldRows); err != nil {
+			p.closeOld()
+			return nil, err
 		}
+		logger.Info("Resuming after the rows of the existing file copied so far", "rows", p.oldRows)
+		return p, nil
 	}
-	return validCount, nil
+
+	logger.Debug("Found rows in the existing file", "rows", p.oldReader.NumRows())
+	p.validCount, err = p.schema.findLastUpdates(p.oldReader, p.lastVehicleUpdates, &p.timestamps, p.hashes)
+	if err != nil {
+		p.closeOld()
+		return nil, err
+	}
+	p.oldReader.Reset()
+	logger.Debug("Found the last updates of vehicles or trips in the existing file", "series", len(p.lastVehicleUpdates))
+	return p, nil
 }
 
-func writePartition(db *sqlx.DB, archiveDir string, period time.Time) (err error) {
-	ym := period.Format(yearMonthLayout)
-	partitionDir := filepath.Join(archiveDir, fmt.Sprintf("year=%04d", period.Year()), fmt.Sprintf("month=%02d", int(period.Month())))
-	err = os.MkdirAll(partitionDir, 0775)
+// minUpdateTime returns the earliest of the last vehicle updates in the existing file,
+// or the zero time if there is no existing data. With Dedup "hash" it's always zero,
+// as new rows aren't assumed to be newer than archived ones.
+func (p *partitionFile) minUpdateTime() time.Time {
+	var minUpdateTime time.Time
+	if p.hashes != nil {
+		return minUpdateTime
+	}
+	for _, t := range p.lastVehicleUpdates {
+		if minUpdateTime.IsZero() || t.Before(minUpdateTime) {
+			minUpdateTime = t
+		}
+	}
+	return minUpdateTime
+}
+
+// begin creates the staging file and copies over rows from the existing file.
+func (p *partitionFile) begin() error {
+	f, err := os.Create(p.stagingPath)
+	if err != nil {
+		return err
+	}
+	p.file = f
+	p.writer, err = p.newWriter(f)
 	if err != nil {
 		return err
 	}
-	filePath := filepath.Join(partitionDir, "vehicle_positions.parquet")
-
-	// Find last update times for each vehicle in existing file
-	lastVehicleUpdates := make(map[string]time.Time)
-	var oldReader *parquet.GenericReader[VehiclePosition]
 
-	stagingPath := filePath
-	oldFile, err := os.Open(filePath)
-	var validCount int64
-	if err == nil {
-		defer oldFile.Close()
-		oldReader = parquet.NewGenericReader[VehiclePosition](oldFile)
-		defer oldReader.Close()
-
-		log.Printf("%s: found %d rows in existing file\n", ym, oldReader.NumRows())
-		validCount, err = findLastUpdates(oldReader, lastVehicleUpdates)
+	if p.oldReader != nil {
+		n, err := p.schema.copyRows(p.writer, p.oldReader)
+		p.logger.Debug("Copied rows from the existing file", "rows", n)
 		if err != nil {
 			return err
+		} else if p.validCount != n {
+			return fmt.Errorf("%s: expected to write %d parquet rows, wrote %d", p.label, p.validCount, n)
+		}
+	}
+	return nil
+}
+
+// add appends a row unless the existing file already has a newer update for its series,
+// or with Dedup "hash", an identical row.
+func (p *partitionFile) add(vp VehiclePosition) error {
+	row := p.schema.row(&vp)
+	// Don't append duplicate rows to existing files
+	if p.hashes != nil {
+		if p.hashes[rowHash(row)] {
+			p.nSkipped++
+			return nil
 		}
-		oldReader.Reset()
-		log.Printf("%s: found updates for %d vehicles\n", ym, len(lastVehicleUpdates))
-		stagingPath = filePath + ".tmp"
-	} else if !errors.Is(err, os.ErrNotExist) {
+	} else if lastUpdate, found := p.lastVehicleUpdates[p.schema.positionSeries(&vp)]; found && !vp.Timestamp.After(lastUpdate) {
+		p.nSkipped++
+		return nil
+	}
+	p.nNew++
+	p.timestamps.add(vp.Timestamp)
+	p.buffer = append(p.buffer, row)
+	if len(p.buffer) >= writeBatchSize {
+		return p.flush()
+	}
+	return nil
+}
+
+func (p *partitionFile) flush() error {
+	n, err := p.writer.WriteRows(p.buffer)
+	if err != nil {
 		return err
+	} else if n != len(p.buffer) {
+		return fmt.Errorf("%s: expected to write %d parquet rows, wrote %d", p.label, len(p.buffer), n)
 	}
+	p.segmentRows += int64(n)
+	p.buffer = p.buffer[:0]
+	return nil
+}
 
-	f, err := os.Create(stagingPath)
+// commit finishes writing the staging file and moves it over the original file.
+func (p *partitionFile) commit() error {
+	if p.checkpointing {
+		if err := p.closeSegment(); err != nil {
+			return err
+		}
+		if err := p.joinSegments(); err != nil {
+			return err
+		}
+	}
+	if err := p.flush(); err != nil {
+		return err
+	}
+	setContentMetadata(p.writer, p.validCount+int64(p.nNew), p.timestamps)
+	if err := p.writer.Close(); err != nil {
+		return err
+	}
+	p.writer = nil
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	p.file = nil
+	p.closeOld()
+	p.logger.Info("Wrote partition file", "new_rows", p.nNew, "skipped_rows", p.nSkipped)
+	return os.Rename(p.stagingPath, p.path)
+}
+
+// abort discards the staging file, or the unfinished segment, leaving any existing file and checkpoint untouched.
+func (p *partitionFile) abort() {
+	if p.writer != nil {
+		p.writer.Close()
+	}
+	if p.file != nil {
+		p.file.Close()
+		os.Remove(p.file.Name())
+	}
+	p.closeOld()
+}
+
+func (p *partitionFile) closeOld() {
+	if p.oldFile != nil {
+		p.oldReader.Close()
+		p.oldFile.Close()
+		p.oldFile = nil
+	}
+}
+
+// Rows are handed to the Parquet writer in batches of writeBatchSize, which a memory budget may lower.
+// Row groups are still cut at RowGroupSize by the writer itself.
+const defaultWriteBatchSize = 10_000
+
+var writeBatchSize = defaultWriteBatchSize
+
+func (a *archiver) writePartition(period time.Time) (err error) {
+	ym := period.Format(yearMonthLayout)
+	logger := a.config.log().With("month", ym)
+	partitionRoot := monthDir(a.dir, period)
+	err = os.MkdirAll(partitionRoot, 0775)
 	if err != nil {
-		return
+		return err
 	}
-	writerConfig, err := parquet.NewWriterConfig(
-		parquet.MaxRowsPerRowGroup(rowGroupSize),
-		parquet.Compression(&parquet.Zstd),
-	)
+
+	partitioner, err := newRoutePartitioner(a.db, a.config, partitionRoot, period)
 	if err != nil {
 		return err
 	}
-	writer := parquet.NewGenericWriter[VehiclePosition](f, writerConfig)
+
+	paths := make(map[string]string, len(partitioner.keys))
+	labels := make(map[string]string, len(partitioner.keys))
+	loggers := make(map[string]*slog.Logger, len(partitioner.keys))
+	for _, key := range partitioner.keys {
+		partitionDir, label, fileLogger := partitionRoot, ym, logger
+		if key != "" {
+			partitionDir = filepath.Join(partitionRoot, routeDirName(key))
+			label = ym + " " + routeDirName(key)
+			fileLogger = logger.With("route_partition", routeDirName(key))
+			if err = os.MkdirAll(partitionDir, 0775); err != nil {
+				return err
+			}
+		}
+		paths[key], labels[key], loggers[key] = filepath.Join(partitionDir, a.fileName), label, fileLogger
+	}
+	var checkpoint *archiveCheckpoint
+	if a.checkpointing() {
+		checkpoint = loadArchiveCheckpoint(partitionRoot, a.schema, partitioner.keys, paths, logger)
+		if checkpoint != nil {
+			logger.Info("Resuming from checkpoint")
+		}
+	}
+
+	// Find last update times for each vehicle in existing files
+	files := make(map[string]*partitionFile, len(partitioner.keys))
 	defer func() {
-		err = errors.Join(err, writer.Close())
+		if err != nil {
+			for _, p := range files {
+				p.abort()
+			}
+		}
 	}()
-
-	if stagingPath != filePath {
-		n, err := parquet.CopyRows(writer, oldReader)
-		log.Printf("%s: copied %d rows from existing file\n", ym, n)
+	_, minUpdateTime := partitionMonth(a.config, period)
+	for _, key := range partitioner.keys {
+		var resume *fileCheckpoint
+		if checkpoint != nil {
+			resume = checkpoint.Files[key]
+		}
+		p, err := a.openPartitionFile(paths[key], labels[key], loggers[key], resume)
 		if err != nil {
 			return err
-		} else if validCount != n {
-			log.Panicf("%s: expected to write %d parquet rows, wrote %d", ym, validCount, n)
 		}
-	}
+		files[key] = p
 
-	// TODO work this into findLastUpdates?
-	var minUpdateTime time.Time
-	for _, t := range lastVehicleUpdates {
-		if minUpdateTime.IsZero() || t.Before(minUpdateTime) {
+		// Partitions without existing data need the whole month
+		t := p.minUpdateTime()
+		if t.IsZero() {
+			t = partitionStart(a.config, period)
+		}
+		if t.Before(minUpdateTime) {
 			minUpdateTime = t
 		}
 	}
-	if minUpdateTime.IsZero() {
-		minUpdateTime = period
+	if !a.checkpointing() {
+		for _, p := range files {
+			if err = p.begin(); err != nil {
+				return err
+			}
+		}
+	} else if err = a.beginCheckpointed(partitionRoot, partitioner.keys, files, checkpoint); err != nil {
+		return err
+	}
+	if checkpoint != nil && checkpoint.Cursor > 0 {
+		// Rows up to the cursor were already written
+		if t := time.Unix(checkpoint.Cursor+1, 0); t.After(minUpdateTime) {
+			minUpdateTime = t
+		}
 	}
-	log.Printf("%s: querying data from %v to %v\n", ym, minUpdateTime, period.AddDate(0, 1, 0))
-	positions, err := queryPartition(db, minUpdateTime, period.AddDate(0, 1, 0))
+
+	logger.Debug("Querying positions", "from", minUpdateTime)
+	positions, err := queryPartition(a.db, a.config, period, minUpdateTime, a.checkpointing())
 	if err != nil {
-		log.Panicln(err)
 		return err
 	}
-	buffer := make([]VehiclePosition, 0, rowGroupSize)
-	var nNew int
-	var nSkipped int
+	defer positions.Close()
 	var vp VehiclePosition
+	var lastTimestamp, sinceCheckpoint int64
 	for positions.Next() {
-		if err = positions.StructScan(&vp); err != nil {
-			return
-		}
-		vp.StartTime = time.Unix(vp.StartTimeUnix, 0)
-		vp.Timestamp = time.Unix(vp.TimestampUnix, 0)
-		vp.Year = period.Year()
-		vp.Month = int(period.Month())
-
-		// Don't append duplicate rows to existing files
-		if lastUpdate, found := lastVehicleUpdates[vp.VehicleId]; found && !vp.Timestamp.After(lastUpdate) {
-			nSkipped++
-			continue
+		if err = scanPartitionRow(positions, &vp, period); err != nil {
+			return err
 		}
-		nNew++
-		buffer = append(buffer, vp)
-		if len(buffer) >= rowGroupSize {
-			n, err := writer.Write(buffer)
-			if err != nil {
+		// Checkpoints fall between timestamps, so every row up to the cursor has been written
+		if a.checkpointing() && vp.TimestampUnix != lastTimestamp && sinceCheckpoint >= a.config.CheckpointRows {
+			if err = saveArchiveCheckpoint(partitionRoot, a.schema, partitioner.keys, files, lastTimestamp); err != nil {
 				return err
-			} else if n != rowGroupSize {
-				log.Panicf("Expected to write %d parquet rows, wrote %d", rowGroupSize, n)
 			}
-			buffer = make([]VehiclePosition, 0, rowGroupSize)
+			sinceCheckpoint = 0
+		}
+
+		if err = files[partitioner.keyOf(valueOf(vp.RouteId))].add(vp); err != nil {
+			return err
 		}
+		lastTimestamp = vp.TimestampUnix
+		sinceCheckpoint++
 	}
-	n, err := writer.Write(buffer)
-	if err != nil {
+	if err = positions.Err(); err != nil {
 		return err
-	} else if n != len(buffer) {
-		log.Panicf("Expected to write %d parquet rows, wrote %d", rowGroupSize, n)
 	}
-	log.Printf("%s: wrote %d new rows, skipped %d rows\n", ym, nNew, nSkipped)
 
-	// Replace original file (this is probably non-atomic!)
-	return os.Rename(stagingPath, filePath)
+	for _, key := range partitioner.keys {
+		if err = files[key].commit(); err != nil {
+			return err
+		}
+	}
+	if a.checkpointing() {
+		if err = removeArchiveCheckpoint(partitionRoot, files); err != nil {
+			return err
+		}
+	}
+	if a.encryptor != nil {
+		for _, key := range partitioner.keys {
+			if err := a.encryptor.encryptFile(files[key].path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func archivePartitions(db *sqlx.DB, archiveDir string) error {
+func archivePartitions(db *sqlx.DB, archiveDir string, config ArchiveConfig, provenance archiveProvenance) error {
+	logger := config.log()
 	if absPath, err := filepath.Abs(archiveDir); err == nil {
-		log.Println("Archiving to", absPath, "...")
+		logger.Info("Archiving", "to", absPath)
+	}
+	lockPath := filepath.Clean(archiveDir) + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0775); err != nil {
+		return err
 	}
-	startMonth, endMonth, err := findArchiveRange(db)
+	unlock, err := acquireLock(lockPath, "archive")
 	if err != nil {
 		return err
 	}
-	log.Println("Creating partitions from", startMonth, "to", endMonth)
-	for period := startMonth; !period.After(endMonth); period = period.AddDate(0, 1, 0) {
-		log.Println("Writing partition for", period)
-		if err := writePartition(db, archiveDir, period); err != nil {
-			log.Panicln(err)
+	defer unlock()
+	if err := recoverArchive(archiveDir, config); err != nil {
+		return err
+	}
+	a, err := newArchiver(db, archiveDir, config, provenance)
+	if err != nil {
+		return err
+	}
+	var sealer *archiver
+	if config.SealAfterDays > 0 {
+		if sealer, err = newArchiver(db, archiveDir, sealingConfig(config), provenance); err != nil {
 			return err
 		}
-		log.Println("Created partition for", period)
 	}
-	return nil
+	startMonth, endMonth, err := findArchiveRange(db, config)
+	if err != nil {
+		return err
+	}
+	positionsStart, positionsEnd := startMonth, endMonth
+	// Trip updates are only archived in Parquet, where they can be nested
+	var tripsStart, tripsEnd time.Time
+	if config.Format == "" || config.Format == "parquet" {
+		if tripsStart, tripsEnd, err = findTripUpdateRange(db, config); err != nil {
+			return err
+		}
+	} else {
+		logger.Info("Skipping trip updates, which are only archived in Parquet")
+	}
+	if !tripsStart.IsZero() {
+		if startMonth.IsZero() || tripsStart.Before(startMonth) {
+			startMonth = tripsStart
+		}
+		if tripsEnd.After(endMonth) {
+			endMonth = tripsEnd
+		}
+	}
+	inRange := func(period, start, end time.Time) bool {
+		return !start.IsZero() && !period.Before(start) && !period.After(end)
+	}
+	sealed := sealedMonths(archiveDir)
+	// Months ending before this are complete
+	sealBefore := time.Now().AddDate(0, 0, -config.SealAfterDays)
+	logger.Info("Creating partitions", "from", startMonth.Format(yearMonthLayout), "to", endMonth.Format(yearMonthLayout))
+	for period := startMonth; !period.After(endMonth); period = period.AddDate(0, 1, 0) {
+		ym := period.Format(yearMonthLayout)
+		if sealed[ym] {
+			logger.Debug("Skipping sealed partition", "month", ym)
+			continue
+		}
+		writer := a
+		_, monthEnd := partitionMonth(config, period)
+		seal := sealer != nil && !monthEnd.After(sealBefore)
+		if seal {
+			logger.Info("Sealing partition", "month", ym)
+			writer = sealer
+		} else {
+			logger.Info("Writing partition", "month", ym)
+		}
+		if inRange(period, positionsStart, positionsEnd) {
+			if err := writer.writePartition(period); err != nil {
+				return err
+			}
+		}
+		if inRange(period, tripsStart, tripsEnd) {
+			if err := writer.writeTripUpdatePartition(period, provenance.TripUpdatesURLs); err != nil {
+				return err
+			}
+		}
+		if seal {
+			sealed[ym] = true
+		}
+		logger.Info("Created partition", "month", ym)
+	}
+	if err := writeEnumValues(archiveDir); err != nil {
+		return err
+	}
+	if err := updateManifest(archiveDir, config, provenance, sealed); err != nil {
+		return err
+	}
+	return uploadArchive(archiveDir, config)
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// oldArchivedPosition is a row archived before feed_id and the later columns were added,
+// with timestamps in microseconds.
+type oldArchivedPosition struct {
+	TripId    string    `parquet:"trip_id"`
+	Latitude  *float32  `parquet:"latitude,optional"`
+	Bearing   *float32  `parquet:"bearing,optional"`
+	Timestamp time.Time `parquet:"timestamp,timestamp(microsecond)"`
+	VehicleId string    `parquet:"vehicle_id,dict"`
+}
+
+func writeOldArchive(t *testing.T, path string, rows []oldArchivedPosition) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writer := parquet.NewGenericWriter[oldArchivedPosition](f)
+	if _, err := writer.Write(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadOldArchive(t *testing.T) {
+	dataDir := t.TempDir()
+	config := Config{DataDir: dataDir, FeedId: "test"}
+	archiveDir := feedArchiveDir(config)
+	period := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	latitude, bearing := float32(49.25), float32(90)
+	writeOldArchive(t, filepath.Join(monthDir(archiveDir, period), "vehicle_positions.parquet"), []oldArchivedPosition{
+		{TripId: "trip-0", Latitude: &latitude, Bearing: &bearing, Timestamp: time.Unix(1709270000, 0), VehicleId: "bus-0"},
+		{TripId: "trip-0", Timestamp: time.Unix(1709270030, 0), VehicleId: "bus-0"},
+	})
+
+	db, err := createDatabase(filepath.Join(dataDir, "realtime.db"), config.FeedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := addVehiclePositions(positionsFeed(1709280000, "trip-1", "bus-1"), db, config.FeedId, nil, time.UTC, 0); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := newArchiveSchema(config.Archive, config.FeedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read as it is, then after appending rows from the database, which rewrites the old rows in the current schema
+	for _, stage := range []struct {
+		name    string
+		archive bool
+		want    int
+	}{{"old file", false, 2}, {"appended", true, 3}} {
+		if stage.archive {
+			if err := archivePartitions(db, archiveDir, config.Archive, provenanceOf(config)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rows, err := readArchivedMonth(monthDir(archiveDir, period), schema)
+		if err != nil {
+			t.Fatalf("%s: %v", stage.name, err)
+		}
+		if len(rows) != stage.want {
+			t.Fatalf("%s: read %d rows, want %d", stage.name, len(rows), stage.want)
+		}
+		var vp VehiclePosition
+		for _, row := range rows {
+			if err := schema.position(row, &vp); err != nil {
+				t.Fatalf("%s: %v", stage.name, err)
+			}
+			if vp.FeedId != config.FeedId {
+				t.Errorf("%s: %s has feed %q, want the archive's", stage.name, vp.VehicleId, vp.FeedId)
+			}
+			switch vp.TimestampUnix {
+			case 1709270000:
+				if vp.VehicleId != "bus-0" || vp.Latitude == nil || *vp.Latitude != latitude || vp.Bearing == nil || *vp.Bearing != bearing {
+					t.Errorf("%s: old row read as %+v", stage.name, vp)
+				}
+			case 1709270030:
+				if vp.Latitude != nil || vp.Speed != nil || vp.RouteId != nil {
+					t.Errorf("%s: old row has values it didn't archive: %+v", stage.name, vp)
+				}
+			case 1709280000:
+				if vp.VehicleId != "bus-1" || vp.TripId != "trip-1" {
+					t.Errorf("%s: new row read as %+v", stage.name, vp)
+				}
+			default:
+				t.Errorf("%s: read a row at %s", stage.name, vp.Timestamp)
+			}
+		}
+	}
+}
+
+func TestDedupAppend(t *testing.T) {
+	period := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	// A position arriving late, behind the vehicle's last archived update, is only kept when rows are told apart
+	// by their content
+	for _, test := range []struct {
+		dedup string
+		want  []int64
+	}{
+		{"trip", []int64{1709280000, 1709280060}},
+		{"hash", []int64{1709280000, 1709280030, 1709280060}},
+	} {
+		t.Run(test.dedup, func(t *testing.T) {
+			dataDir := t.TempDir()
+			config := Config{DataDir: dataDir, FeedId: "test", Archive: ArchiveConfig{Dedup: test.dedup}}
+			archiveDir := feedArchiveDir(config)
+			db, err := createDatabase(filepath.Join(dataDir, "realtime.db"), config.FeedId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			add := func(timestamp uint64) {
+				if _, err := addVehiclePositions(positionsFeed(timestamp, "trip-0", "bus-0"), db, config.FeedId, nil, time.UTC, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			add(1709280000)
+			add(1709280060)
+			if err := archivePartitions(db, archiveDir, config.Archive, provenanceOf(config)); err != nil {
+				t.Fatal(err)
+			}
+			// The rows archived before are still in the database, so they're appended again
+			add(1709280030)
+			if err := archivePartitions(db, archiveDir, config.Archive, provenanceOf(config)); err != nil {
+				t.Fatal(err)
+			}
+
+			schema, err := newArchiveSchema(config.Archive, config.FeedId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, err := readArchivedMonth(monthDir(archiveDir, period), schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var timestamps []int64
+			var vp VehiclePosition
+			for _, row := range rows {
+				if err := schema.position(row, &vp); err != nil {
+					t.Fatal(err)
+				}
+				timestamps = append(timestamps, vp.Timestamp.Unix())
+			}
+			slices.Sort(timestamps)
+			if !slices.Equal(timestamps, test.want) {
+				t.Errorf("archived positions at %v, want %v", timestamps, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/deprecated"
+	"github.com/parquet-go/parquet-go/encoding"
+)
+
+// archiveSchema maps VehiclePosition rows onto the subset of (possibly renamed) columns written to Parquet.
+type archiveSchema struct {
+	source *parquet.Schema
+	schema *parquet.Schema
+	// For each column of the source schema, the index of the output column or -1 if it is excluded
+	outputColumns []int
+	vehicleIdName string
+	timestampName string
+	feedIdName    string
+	// Output column name of each included column
+	outputNames map[string]string
+	// Columns whose values tell apart the series of updates tracked when appending, from archiveSeriesColumns
+	seriesColumns []string
+	outputKey     keyColumns
+	// hashDedup skips appended rows identical to archived ones, rather than those no newer than their series
+	hashDedup bool
+	// Feed assigned to rows from files written before feed_id was added
+	feedId string
+	// Output columns holding timestamps, which are converted from the nanosecond source values
+	timestampColumns map[int]bool
+	timestampValue   func(t time.Time) parquet.Value
+}
+
+// orderedGroup is a group node which keeps its fields in the given order.
+// parquet.Group always sorts its fields by name.
+type orderedGroup struct {
+	parquet.Node
+	fields []parquet.Field
+}
+
+func (g orderedGroup) Fields() []parquet.Field { return g.fields }
+
+// splitField applies byte stream split encoding to a floating point column.
+// Coordinates compress much better this way, but the split struct tag can't be used on optional fields.
+type splitField struct {
+	parquet.Field
+}
+
+func (splitField) Encoding() encoding.Encoding { return &parquet.ByteStreamSplit }
+
+// Columns which can't be excluded because appending to existing files relies on them
+var requiredArchiveColumns = []string{"vehicle_id", "timestamp"}
+
+// parquetName returns the Parquet column name of a struct field, or "" if it isn't written to Parquet.
+func parquetName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("parquet"), ",")
+	if name == "-" {
+		return ""
+	} else if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// newArchiveSchema derives the Parquet schema from VehiclePosition with columns excluded and renamed per the config.
+// Column order and encoding options of the remaining columns are preserved.
+func newArchiveSchema(config ArchiveConfig, feedId string) (*archiveSchema, error) {
+	config, profile, err := applyArchiveProfile(config)
+	if err != nil {
+		return nil, err
+	}
+	excluded := make(map[string]bool, len(config.ExcludeColumns))
+	for _, name := range config.ExcludeColumns {
+		excluded[name] = true
+	}
+	noDictionary := make(map[string]bool, len(config.NoDictionaryColumns))
+	for _, name := range config.NoDictionaryColumns {
+		noDictionary[name] = true
+	}
+	for _, name := range requiredArchiveColumns {
+		if excluded[name] {
+			return nil, fmt.Errorf("column %s can't be excluded from the archive", name)
+		}
+	}
+	switch config.Dedup {
+	case "", "trip", "vehicle", "hash":
+	default:
+		return nil, fmt.Errorf("invalid archive Dedup: %q", config.Dedup)
+	}
+	seriesColumns := archiveSeriesColumns(config.Dedup)
+	for _, name := range seriesColumns {
+		if excluded[name] {
+			return nil, fmt.Errorf("column %s can't be excluded from the archive, as appends are deduplicated on it (see Dedup)", name)
+		}
+	}
+
+	vpType := reflect.TypeOf(VehiclePosition{})
+	var fields []reflect.StructField
+	known := make(map[string]bool)
+	outputNames := make(map[string]bool)
+	a := &archiveSchema{
+		source:           parquet.SchemaOf(VehiclePosition{}),
+		timestampColumns: make(map[int]bool),
+		feedId:           feedId,
+		outputNames:      make(map[string]string),
+		seriesColumns:    seriesColumns,
+		hashDedup:        config.Dedup == "hash",
+	}
+	unit, err := timestampUnit(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.LegacyInt96Timestamps {
+		a.timestampValue = func(t time.Time) parquet.Value { return parquet.Int96Value(int96Timestamp(t)) }
+	} else {
+		a.timestampValue = func(t time.Time) parquet.Value {
+			switch unit {
+			case "millisecond":
+				return parquet.Int64Value(t.UnixMilli())
+			case "microsecond":
+				return parquet.Int64Value(t.UnixMicro())
+			}
+			return parquet.Int64Value(t.UnixNano())
+		}
+	}
+	for i := 0; i < vpType.NumField(); i++ {
+		field := vpType.Field(i)
+		name := parquetName(field)
+		if name == "" {
+			continue
+		}
+		known[name] = true
+		if excluded[name] {
+			continue
+		}
+
+		outputName := name
+		if newName, found := config.RenameColumns[name]; found {
+			if newName == "" {
+				return nil, fmt.Errorf("column %s can't be renamed to an empty name", name)
+			}
+			outputName = newName
+		}
+		_, options, _ := strings.Cut(field.Tag.Get("parquet"), ",")
+		if profile.plainEncodings {
+			options = strings.ReplaceAll(options, "delta", "")
+		}
+		if slices.Contains(profile.dictionaryColumns, name) && !strings.Contains(options, "dict") {
+			options += ",dict"
+		}
+		if noDictionary[name] {
+			options = strings.ReplaceAll(options, "dict", "")
+		}
+		if profile.signedIntegers {
+			switch field.Type {
+			case reflect.TypeOf(uint32(0)):
+				field.Type = reflect.TypeOf(int32(0))
+			case reflect.TypeOf((*uint32)(nil)):
+				field.Type = reflect.TypeOf((*int32)(nil))
+			}
+		}
+		if field.Type == reflect.TypeOf(time.Time{}) {
+			a.timestampColumns[len(fields)] = true
+			if config.LegacyInt96Timestamps {
+				// INT96 has no logical type or delta encoding
+				field.Type = reflect.TypeOf(deprecated.Int96{})
+				options = ""
+			} else {
+				options += fmt.Sprintf(",timestamp(%s)", unit)
+			}
+		}
+		field.Tag = reflect.StructTag(fmt.Sprintf(`parquet:"%s,%s"`, outputName, options))
+		if outputNames[outputName] {
+			return nil, fmt.Errorf("duplicate archive column name: %s", outputName)
+		}
+		outputNames[outputName] = true
+		a.outputNames[name] = outputName
+		switch name {
+		case "vehicle_id":
+			a.vehicleIdName = outputName
+		case "timestamp":
+			a.timestampName = outputName
+		case "feed_id":
+			a.feedIdName = outputName
+		}
+		fields = append(fields, reflect.StructField{Name: field.Name, Type: field.Type, Tag: field.Tag})
+	}
+	for _, name := range config.ExcludeColumns {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown archive column: %s", name)
+		}
+	}
+	for _, name := range config.NoDictionaryColumns {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown archive column: %s", name)
+		}
+	}
+	for name := range config.RenameColumns {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown archive column: %s", name)
+		}
+	}
+
+	structSchema := parquet.SchemaOf(reflect.New(reflect.StructOf(fields)).Interface())
+	outputFields := structSchema.Fields()
+	for i, field := range outputFields {
+		if kind := field.Type().Kind(); !profile.plainEncodings && (kind == parquet.Float || kind == parquet.Double) {
+			outputFields[i] = splitField{field}
+		}
+	}
+	a.schema = parquet.NewSchema(structSchema.Name(), orderedGroup{Node: structSchema, fields: outputFields})
+
+	// Leaf columns are in field order for both schemas since they're flat
+	a.outputColumns = make([]int, len(a.source.Columns()))
+	j := 0
+	for i, path := range a.source.Columns() {
+		if excluded[path[0]] {
+			a.outputColumns[i] = -1
+		} else {
+			a.outputColumns[i] = j
+			j++
+		}
+	}
+	// The key columns can't be excluded, so are always found
+	a.outputKey, err = a.keyColumns(a.schema)
+	return a, err
+}
+
+// sourceNames returns the VehiclePosition column name of each output column, before renaming.
+func (a *archiveSchema) sourceNames() []string {
+	names := make([]string, len(a.schema.Columns()))
+	for i, path := range a.source.Columns() {
+		if j := a.outputColumns[i]; j >= 0 {
+			names[j] = path[0]
+		}
+	}
+	return names
+}
+
+// row converts a VehiclePosition into a row of the output schema.
+func (a *archiveSchema) row(vp *VehiclePosition) parquet.Row {
+	sourceRow := a.source.Deconstruct(nil, vp)
+	row := make(parquet.Row, 0, len(a.schema.Columns()))
+	for _, v := range sourceRow {
+		i := a.outputColumns[v.Column()]
+		if i < 0 {
+			continue
+		}
+		if a.timestampColumns[i] && !v.IsNull() {
+			v = a.timestampValue(time.Unix(0, v.Int64()))
+		}
+		row = append(row, v.Level(v.RepetitionLevel(), v.DefinitionLevel(), i))
+	}
+	return row
+}
+
+// position converts an archived row back into a VehiclePosition.
+// Excluded columns are left as missing or zero values.
+func (a *archiveSchema) position(row parquet.Row, vp *VehiclePosition) error {
+	sourceRow := a.source.Deconstruct(nil, &VehiclePosition{})
+	sourceColumns := make([]int, len(a.schema.Columns()))
+	for i, j := range a.outputColumns {
+		if j >= 0 {
+			sourceColumns[j] = i
+		}
+	}
+	fields := a.schema.Fields()
+	for _, v := range row {
+		j := v.Column()
+		if a.timestampColumns[j] && !v.IsNull() {
+			v = parquet.Int64Value(timestampOf(v, fields[j]).UnixNano())
+		}
+		i := sourceColumns[j]
+		sourceRow[i] = v.Level(sourceRow[i].RepetitionLevel(), v.DefinitionLevel(), i)
+	}
+	*vp = VehiclePosition{}
+	if err := a.source.Reconstruct(vp, sourceRow); err != nil {
+		return err
+	}
+	vp.StartTimeUnix = vp.StartTime.Unix()
+	vp.TimestampUnix = vp.Timestamp.Unix()
+	return nil
+}
+
+// timestampUnit returns the configured precision of Parquet timestamps, which defaults to milliseconds.
+func timestampUnit(config ArchiveConfig) (string, error) {
+	switch config.TimestampUnit {
+	case "":
+		return "millisecond", nil
+	case "millisecond", "microsecond", "nanosecond":
+		return config.TimestampUnit, nil
+	}
+	return "", fmt.Errorf("invalid TimestampUnit: %q", config.TimestampUnit)
+}
+
+// Julian day number of the Unix epoch
+const julianUnixEpoch = 2440588
+
+const nanosPerDay = int64(24 * time.Hour)
+
+// int96Timestamp encodes a time as a legacy INT96 timestamp,
+// i.e. nanoseconds within the day followed by the Julian day number.
+func int96Timestamp(t time.Time) deprecated.Int96 {
+	nanos := t.UnixNano()
+	days := nanos / nanosPerDay
+	if nanos%nanosPerDay < 0 {
+		days--
+	}
+	nanosOfDay := nanos - days*nanosPerDay
+	return deprecated.Int96{uint32(nanosOfDay), uint32(nanosOfDay >> 32), uint32(days + julianUnixEpoch)}
+}
+
+func int96Time(i deprecated.Int96) time.Time {
+	nanosOfDay := int64(i[1])<<32 | int64(i[0])
+	days := int64(i[2]) - julianUnixEpoch
+	return time.Unix(days*86400, nanosOfDay).UTC()
+}
+
+// timestampOf converts a timestamp column value to a time.Time according to the column's type and unit.
+func timestampOf(v parquet.Value, node parquet.Node) time.Time {
+	if node.Type().Kind() == parquet.Int96 {
+		return int96Time(v.Int96())
+	}
+	if lt := node.Type().LogicalType(); lt != nil && lt.Timestamp != nil {
+		switch {
+		case lt.Timestamp.Unit.Millis != nil:
+			return time.UnixMilli(v.Int64()).UTC()
+		case lt.Timestamp.Unit.Micros != nil:
+			return time.UnixMicro(v.Int64()).UTC()
+		}
+	}
+	return time.Unix(0, v.Int64()).UTC()
+}
+
+// keyColumns locates the columns identifying a position's archive series and time in a file's schema.
+type keyColumns struct {
+	// Series columns in the order of seriesColumns, starting with vehicle_id
+	series    []int
+	timestamp parquet.LeafColumn
+}
+
+// keyColumns looks up the key columns in a schema, which may be an existing file's rather than the output schema.
+func (a *archiveSchema) keyColumns(schema *parquet.Schema) (keyColumns, error) {
+	var k keyColumns
+	for _, name := range a.seriesColumns {
+		outputName := a.outputNames[name]
+		column, found := schema.Lookup(outputName)
+		if !found {
+			return k, fmt.Errorf("%w: existing file has no %s column", ErrSchemaMismatch, outputName)
+		}
+		k.series = append(k.series, column.ColumnIndex)
+	}
+	var found bool
+	if k.timestamp, found = schema.Lookup(a.timestampName); !found {
+		return k, fmt.Errorf("%w: existing file has no %s column", ErrSchemaMismatch, a.timestampName)
+	}
+	return k, nil
+}
+
+// key returns the series and timestamp of a row, in the form of positionSeries.
+// The series is empty for rows without a vehicle ID.
+func (k keyColumns) key(row parquet.Row) (series string, timestamp time.Time) {
+	values := make([]string, len(k.series))
+	for _, v := range row {
+		if v.Column() == k.timestamp.ColumnIndex {
+			timestamp = timestampOf(v, k.timestamp.Node)
+			continue
+		}
+		for i, column := range k.series {
+			if v.Column() == column && !v.IsNull() {
+				values[i] = string(v.ByteArray())
+			}
+		}
+	}
+	if values[0] == "" {
+		return "", timestamp
+	}
+	return strings.Join(values, "\x00"), timestamp
+}
+
+// rowKey returns the series and timestamp of a row in the output schema.
+func (a *archiveSchema) rowKey(row parquet.Row) (series string, timestamp time.Time) {
+	return a.outputKey.key(row)
+}
+
+// rowHash hashes the content of a row in the output schema, for Dedup "hash".
+func rowHash(row parquet.Row) uint64 {
+	h := fnv.New64a()
+	var b []byte
+	for _, v := range row {
+		b = binary.LittleEndian.AppendUint32(b[:0], uint32(v.Column()))
+		if v.IsNull() {
+			b = append(b, 0)
+		} else {
+			b = append(b, 1)
+			b = v.AppendBytes(b)
+		}
+		// Lengths are included, so that adjacent byte arrays can't run into each other
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(b)))
+		h.Write(b)
+	}
+	return h.Sum64()
+}
+
+// archivedKey identifies a row in the output schema when it's compared with database rows:
+// by series and time, or by its content with Dedup "hash".
+func (a *archiveSchema) archivedKey(row parquet.Row) positionKey {
+	if a.hashDedup {
+		return positionKey{hash: rowHash(row)}
+	}
+	series, timestamp := a.rowKey(row)
+	return positionKey{series: series, timestamp: timestamp.Unix()}
+}
+
+// findLastUpdates reads the last update time of each series, and the range of timestamps, from an existing archive file.
+// With Dedup "hash", hashes is filled with the content hash of each row as well.
+// Rows without a vehicle ID are not counted as valid.
+func (a *archiveSchema) findLastUpdates(reader *parquet.Reader, lastVehicleUpdates map[string]time.Time, timestamps *timestampRange, hashes map[uint64]bool) (validCount int64, err error) {
+	k, err := a.keyColumns(reader.Schema())
+	if err != nil {
+		return 0, err
+	}
+	// Hashes are of rows as they're copied to the output schema, so they match new rows
+	var converter *rowConverter
+	if hashes != nil && reader.Schema().String() != a.schema.String() {
+		converter = a.converterFrom(reader.Schema())
+	}
+
+	buffer := make([]parquet.Row, writeBatchSize)
+	for eof := false; !eof; {
+		n, err := reader.ReadRows(buffer)
+		if errors.Is(err, io.EOF) {
+			eof = true
+		} else if err != nil {
+			return 0, err
+		}
+
+		for _, row := range buffer[:n] {
+			series, timestamp := k.key(row)
+			if series == "" {
+				continue
+			}
+			validCount++
+			timestamps.add(timestamp)
+			if lastUpdate, found := lastVehicleUpdates[series]; !found || timestamp.After(lastUpdate) {
+				lastVehicleUpdates[series] = timestamp
+			}
+			if hashes != nil {
+				if converter != nil {
+					row = converter.convert(row)
+				}
+				hashes[rowHash(row)] = true
+			}
+		}
+	}
+	return validCount, nil
+}
+
+// rowConverter converts rows from an existing file written with a different archive schema,
+// e.g. after changing the timestamp unit. Columns are matched by name.
+// parquet.CopyRows can also convert between schemas, but rescales timestamps the wrong way.
+type rowConverter struct {
+	schema  *archiveSchema
+	columns []convertedColumn
+	feedId  parquet.Value
+}
+
+type convertedColumn struct {
+	source   parquet.LeafColumn
+	found    bool
+	target   parquet.LeafColumn
+	optional bool
+}
+
+func (a *archiveSchema) converterFrom(oldSchema *parquet.Schema) *rowConverter {
+	c := &rowConverter{schema: a, feedId: parquet.ByteArrayValue([]byte(a.feedId))}
+	for _, path := range a.schema.Columns() {
+		target, _ := a.schema.Lookup(path...)
+		source, found := oldSchema.Lookup(path...)
+		c.columns = append(c.columns, convertedColumn{
+			source:   source,
+			found:    found,
+			target:   target,
+			optional: target.MaxDefinitionLevel > 0,
+		})
+	}
+	return c
+}
+
+func (c *rowConverter) convert(oldRow parquet.Row) parquet.Row {
+	row := make(parquet.Row, len(c.columns))
+	for i, column := range c.columns {
+		v := parquet.NullValue()
+		if !column.found && column.target.Path[0] == c.schema.feedIdName {
+			v = c.feedId
+		} else if column.found {
+			for _, oldValue := range oldRow {
+				if oldValue.Column() == column.source.ColumnIndex {
+					v = oldValue
+					break
+				}
+			}
+		}
+
+		definitionLevel := 0
+		switch {
+		case v.IsNull() && !column.optional:
+			v = parquet.ZeroValue(column.target.Node.Type().Kind())
+		case v.IsNull():
+		case c.schema.timestampColumns[i]:
+			v = c.schema.timestampValue(timestampOf(v, column.source.Node))
+			fallthrough
+		default:
+			if column.optional {
+				definitionLevel = 1
+			}
+		}
+		row[i] = v.Level(0, definitionLevel, i)
+	}
+	return row
+}
+
+// copyRows copies all rows from an existing file, converting them if its schema differs from the current one.
+func (a *archiveSchema) copyRows(writer parquet.RowWriter, reader parquet.RowReaderWithSchema) (int64, error) {
+	if reader.Schema().String() == a.schema.String() {
+		return parquet.CopyRows(writer, reader)
+	}
+
+	converter := a.converterFrom(reader.Schema())
+	buffer := make([]parquet.Row, writeBatchSize)
+	var copied int64
+	for {
+		n, err := reader.ReadRows(buffer)
+		for i := range buffer[:n] {
+			buffer[i] = converter.convert(buffer[i])
+		}
+		if _, werr := writer.WriteRows(buffer[:n]); werr != nil {
+			return copied, werr
+		}
+		copied += int64(n)
+		if errors.Is(err, io.EOF) {
+			return copied, nil
+		} else if err != nil {
+			return copied, err
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// ArchiveSinkConfig uploads the archive to remote storage after each run, keyed by each file's path in the archive
+// directory, e.g. year=2024/month=05/vehicle_positions.parquet. The local archive is kept, as partitions are
+// appended to from their local copy.
+type ArchiveSinkConfig struct {
+	// S3 uploads to a bucket in S3 or an S3-compatible object store, if its Bucket is set.
+	S3 S3Config
+}
+
+// archiveSink is remote storage for the archive.
+type archiveSink interface {
+	// upload writes a local file to a key.
+	upload(ctx context.Context, key, path string) error
+	// read returns the contents of a key, or errObjectNotFound.
+	read(ctx context.Context, key string) ([]byte, error)
+	remove(ctx context.Context, key string) error
+}
+
+// newArchiveSink returns nil if no sink is configured.
+func newArchiveSink(config ArchiveSinkConfig) (archiveSink, error) {
+	if config.S3.Bucket == "" {
+		return nil, nil
+	}
+	store, err := newObjectStore(config.S3)
+	if err != nil {
+		return nil, err
+	}
+	return s3Sink{store}, nil
+}
+
+type s3Sink struct {
+	store *objectStore
+}
+
+func (s s3Sink) upload(ctx context.Context, key, path string) error {
+	return s.store.putFile(ctx, key, path)
+}
+
+func (s s3Sink) read(ctx context.Context, key string) ([]byte, error) {
+	return s.store.get(ctx, key)
+}
+
+func (s s3Sink) remove(ctx context.Context, key string) error {
+	return s.store.remove(ctx, key)
+}
+
+// uploadArchive brings the sink up to date with the archive's manifest. Only files whose checksum differs from
+// the manifest last uploaded are sent, and the manifest and its signature go last, so the sink's manifest never
+// lists a file which isn't there yet. Files dropped from the manifest are deleted afterwards.
+// With encryption configured, the encrypted copy of a file is uploaded in its place, with the .age suffix.
+func uploadArchive(archiveDir string, config ArchiveConfig) error {
+	sink, err := newArchiveSink(config.Sink)
+	if sink == nil || err != nil {
+		return err
+	}
+	ctx := context.Background()
+	manifest, _, err := readManifest(archiveDir)
+	if err != nil {
+		return err
+	}
+	uploaded := make(map[string]string)
+	remote, err := sink.read(ctx, manifestName)
+	if err == nil {
+		var previous Manifest
+		if err := json.Unmarshal(remote, &previous); err != nil {
+			config.log().Warn("Reuploading the whole archive, as the uploaded manifest is unreadable", "err", err)
+		}
+		for _, file := range previous.Files {
+			uploaded[file.Path] = file.SHA256
+		}
+	} else if !errors.Is(err, errObjectNotFound) {
+		return err
+	}
+	encryptedDir := ""
+	if len(config.Encryption.Recipients) > 0 {
+		if encryptedDir = config.Encryption.Dir; encryptedDir == "" {
+			encryptedDir = filepath.Clean(archiveDir) + "-encrypted"
+		}
+	}
+
+	var n int
+	for _, file := range manifest.Files {
+		sha, found := uploaded[file.Path]
+		delete(uploaded, file.Path)
+		if found && sha == file.SHA256 {
+			continue
+		}
+		key, path := file.Path, filepath.Join(archiveDir, filepath.FromSlash(file.Path))
+		if encryptedDir != "" {
+			encryptedPath := filepath.Join(encryptedDir, filepath.FromSlash(file.Path)) + encryptedSuffix
+			if _, err := os.Stat(encryptedPath); err == nil {
+				key, path = key+encryptedSuffix, encryptedPath
+			}
+		}
+		if err := sink.upload(ctx, key, path); err != nil {
+			return err
+		}
+		n++
+	}
+	if config.ManifestSigningKey != "" {
+		if err := sink.upload(ctx, manifestSignatureName, filepath.Join(archiveDir, manifestSignatureName)); err != nil {
+			return err
+		}
+	}
+	if err := sink.upload(ctx, manifestName, filepath.Join(archiveDir, manifestName)); err != nil {
+		return err
+	}
+	for path := range uploaded {
+		// Either copy may have been uploaded, and deleting a missing key succeeds
+		for _, key := range []string{path, path + encryptedSuffix} {
+			if err := sink.remove(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+	config.log().Info("Uploaded the archive", "uploaded", n, "files", len(manifest.Files), "deleted", len(uploaded))
+	return nil
+}
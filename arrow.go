@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/apache/arrow/go/v16/arrow"
+	"github.com/apache/arrow/go/v16/arrow/array"
+	"github.com/apache/arrow/go/v16/arrow/ipc"
+	"github.com/apache/arrow/go/v16/arrow/memory"
+	"github.com/parquet-go/parquet-go"
+)
+
+// arrowType maps a flat Parquet column to the Arrow type with the same representation.
+func arrowType(node parquet.Node) (arrow.DataType, error) {
+	lt := node.Type().LogicalType()
+	switch node.Type().Kind() {
+	case parquet.Boolean:
+		return arrow.FixedWidthTypes.Boolean, nil
+	case parquet.Int32:
+		if lt != nil && lt.Integer != nil && !lt.Integer.IsSigned {
+			return arrow.PrimitiveTypes.Uint32, nil
+		}
+		return arrow.PrimitiveTypes.Int32, nil
+	case parquet.Int64:
+		if lt != nil && lt.Timestamp != nil {
+			switch {
+			case lt.Timestamp.Unit.Millis != nil:
+				return &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}, nil
+			case lt.Timestamp.Unit.Micros != nil:
+				return &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}, nil
+			}
+			return &arrow.TimestampType{Unit: arrow.Nanosecond, TimeZone: "UTC"}, nil
+		}
+		return arrow.PrimitiveTypes.Int64, nil
+	case parquet.Int96:
+		return &arrow.TimestampType{Unit: arrow.Nanosecond, TimeZone: "UTC"}, nil
+	case parquet.Float:
+		return arrow.PrimitiveTypes.Float32, nil
+	case parquet.Double:
+		return arrow.PrimitiveTypes.Float64, nil
+	case parquet.ByteArray:
+		return arrow.BinaryTypes.String, nil
+	}
+	return nil, fmt.Errorf("unsupported column type for Arrow export: %s", node.Type())
+}
+
+// arrowSchemaOf builds an Arrow schema with the same columns as a flat Parquet schema.
+func arrowSchemaOf(schema *parquet.Schema) (*arrow.Schema, error) {
+	fields := make([]arrow.Field, 0, len(schema.Fields()))
+	for _, node := range schema.Fields() {
+		dataType, err := arrowType(node)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, arrow.Field{Name: node.Name(), Type: dataType, Nullable: node.Optional()})
+	}
+	return arrow.NewSchema(fields, nil), nil
+}
+
+// appendArrowRow appends the values of a Parquet row to the matching column builders.
+func appendArrowRow(builder *array.RecordBuilder, row parquet.Row) {
+	for _, v := range row {
+		field := builder.Field(v.Column())
+		if v.IsNull() {
+			field.AppendNull()
+			continue
+		}
+		switch b := field.(type) {
+		case *array.BooleanBuilder:
+			b.Append(v.Boolean())
+		case *array.Int32Builder:
+			b.Append(v.Int32())
+		case *array.Uint32Builder:
+			b.Append(v.Uint32())
+		case *array.Int64Builder:
+			b.Append(v.Int64())
+		case *array.TimestampBuilder:
+			if v.Kind() == parquet.Int96 {
+				b.Append(arrow.Timestamp(int96Time(v.Int96()).UnixNano()))
+			} else {
+				b.Append(arrow.Timestamp(v.Int64()))
+			}
+		case *array.Float32Builder:
+			b.Append(v.Float())
+		case *array.Float64Builder:
+			b.Append(v.Double())
+		case *array.StringBuilder:
+			b.Append(string(v.ByteArray()))
+		}
+	}
+}
+
+// parseExportDate parses an optional YYYY-MM-DD date in the feed's time zone.
+func parseExportDate(value string, location *time.Location) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(time.DateOnly, value, location)
+}
+
+// exportArrow writes positions between two dates to an Arrow IPC (Feather v2) file,
+// with one record batch per month sorted by timestamp and vehicle.
+// Archived months and rows not yet archived are both included, as for a snapshot.
+func exportArrow(config Config, args []string) (err error) {
+	flags := flag.NewFlagSet("export arrow", flag.ExitOnError)
+	dbPath := flags.String("db", filepath.Join(config.DataDir, "realtime.db"), "realtime database")
+	archiveDir := flags.String("archive", feedArchiveDir(config), "archive directory")
+	output := flags.String("output", filepath.Join(config.DataDir, "export.arrow"), "output file")
+	from := flags.String("from", "", "first date to export, as YYYY-MM-DD (default: start of the data)")
+	to := flags.String("to", "", "date to export up to, exclusive, as YYYY-MM-DD (default: end of the data)")
+	compression := flags.String("compression", "none", "record batch compression: none, lz4 or zstd")
+	enumNames := flags.Bool("enum-names", false, "write enum columns as the names of their values instead of codes")
+	flags.Parse(args)
+
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+	fromTime, err := parseExportDate(*from, location)
+	if err != nil {
+		return fmt.Errorf("invalid --from: %w", err)
+	}
+	toTime, err := parseExportDate(*to, location)
+	if err != nil {
+		return fmt.Errorf("invalid --to: %w", err)
+	}
+	writerOptions := []ipc.Option{}
+	switch *compression {
+	case "none":
+	case "lz4":
+		writerOptions = append(writerOptions, ipc.WithLZ4())
+	case "zstd":
+		writerOptions = append(writerOptions, ipc.WithZstd())
+	default:
+		return fmt.Errorf("unsupported Arrow compression: %s", *compression)
+	}
+
+	db, err := openDatabase(*dbPath, config.FeedId)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	schema, err := newArchiveSchema(config.Archive, config.FeedId)
+	if err != nil {
+		return err
+	}
+	outputSchema := schema.schema
+	var enums *enumNameConverter
+	if *enumNames {
+		enums = newEnumNameConverter(schema)
+		outputSchema = enums.schema
+	}
+	arrowSchema, err := arrowSchemaOf(outputSchema)
+	if err != nil {
+		return err
+	}
+	startMonth, endMonth, err := exportRange(db, *archiveDir, config.Archive)
+	if err != nil {
+		return err
+	} else if startMonth.IsZero() {
+		return errors.New("no data to export")
+	}
+	if !fromTime.IsZero() {
+		if month := time.Date(fromTime.Year(), fromTime.Month(), 1, 0, 0, 0, 0, time.UTC); month.After(startMonth) {
+			startMonth = month
+		}
+	}
+	if !toTime.IsZero() {
+		if month := time.Date(toTime.Year(), toTime.Month(), 1, 0, 0, 0, 0, time.UTC); month.Before(endMonth) {
+			endMonth = month
+		}
+	}
+
+	stagingPath := *output + ".tmp"
+	f, err := os.Create(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(stagingPath)
+		}
+	}()
+	writerOptions = append(writerOptions, ipc.WithSchema(arrowSchema))
+	writer, err := ipc.NewFileWriter(f, writerOptions...)
+	if err != nil {
+		return err
+	}
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, arrowSchema)
+	defer builder.Release()
+	compare := schema.schema.Comparator(parquet.Ascending(schema.timestampName), parquet.Ascending(schema.vehicleIdName))
+
+	var total int
+	for period := startMonth; !period.After(endMonth); period = period.AddDate(0, 1, 0) {
+		rows, err := readSnapshotMonth(db, *archiveDir, config.Archive, period, schema)
+		if err != nil {
+			return err
+		}
+		sort.Slice(rows, func(i, j int) bool { return compare(rows[i], rows[j]) < 0 })
+		n := 0
+		for _, row := range rows {
+			_, timestamp := schema.rowKey(row)
+			if (!fromTime.IsZero() && timestamp.Before(fromTime)) || (!toTime.IsZero() && !timestamp.Before(toTime)) {
+				continue
+			}
+			if enums != nil {
+				enums.convert(row)
+			}
+			appendArrowRow(builder, row)
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		record := builder.NewRecord()
+		err = writer.Write(record)
+		record.Release()
+		if err != nil {
+			return err
+		}
+		total += n
+		config.log().Debug("Exported a month", "month", period.Format(yearMonthLayout), "rows", n)
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	config.log().Info("Exported rows", "rows", total, "output", *output)
+	return os.Rename(stagingPath, *output)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Each row is an interval during which a vehicle served one trip, from the first to the last position reporting it.
+// A vehicle without a trip, e.g. deadheading, has intervals with an empty trip_id.
+var vehicleAssignmentColumns = []ColumnInfo{
+	{Name: "feed_id", Type: "TEXT NOT NULL"},
+	{Name: "vehicle_id", Type: "TEXT NOT NULL"},
+	{Name: "first_seen", Type: "DATETIME"},
+	{Name: "last_seen", Type: "DATETIME"},
+	{Name: "trip_id", Type: "TEXT NOT NULL"},
+	{Name: "route_id", Type: "TEXT"},
+	{Name: "start_date", Type: "TEXT"},
+	{Name: "positions", Type: "INTEGER NOT NULL"},
+}
+
+func createVehicleAssignmentsTableQuery() string {
+	return createTableIfNotExistsQuery("vehicle_assignments", vehicleAssignmentColumns, "feed_id, vehicle_id, first_seen")
+}
+
+// VehicleAssignment is an interval during which a vehicle was assigned to a trip.
+type VehicleAssignment struct {
+	FeedId        string  `db:"feed_id"`
+	VehicleId     string  `db:"vehicle_id"`
+	FirstSeenUnix int64   `db:"first_seen"`
+	LastSeenUnix  int64   `db:"last_seen"`
+	TripId        string  `db:"trip_id"`
+	RouteId       *string `db:"route_id"`
+	StartDate     *string `db:"start_date"`
+	// Positions is the number of positions stored during the interval
+	Positions int `db:"positions"`
+}
+
+func equalOptional(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// servesSameTrip tests whether a position continues an assignment, including the start date
+// since trip IDs repeat on each day they run.
+func (a *VehicleAssignment) servesSameTrip(vp *VehiclePosition) bool {
+	return a.TripId == vp.TripId && equalOptional(a.RouteId, vp.RouteId) && equalOptional(a.StartDate, vp.StartDate)
+}
+
+// upsertVehicleAssignmentQuery extends the interval of an existing assignment, or starts a new one.
+func upsertVehicleAssignmentQuery() string {
+	return strings.TrimSuffix(insertIntoQuery("vehicle_assignments", vehicleAssignmentColumns), " DO NOTHING") +
+		"(feed_id, vehicle_id, first_seen) DO UPDATE SET last_seen = excluded.last_seen, positions = excluded.positions"
+}
+
+// addVehicleAssignments extends each vehicle's latest assignment with newly inserted positions on the same trip,
+// and starts a new assignment when the trip, route or start date changes. Positions older than the latest assignment
+// are left out, so a late report doesn't split an interval. Returns the number of assignment changes, not counting
+// vehicles seen for the first time.
+func addVehicleAssignments(db *sqlx.DB, feedId string, positions []VehiclePosition) (int, error) {
+	var latest []VehicleAssignment
+	// SQLite takes the other columns from the row with the MAX
+	ctx, cancel := dbContext()
+	defer cancel()
+	err := db.SelectContext(ctx, &latest, `SELECT feed_id, vehicle_id, CAST(MAX(first_seen) AS INT) AS first_seen,
+		CAST(last_seen AS INT) AS last_seen, trip_id, route_id, start_date, positions
+		FROM vehicle_assignments WHERE feed_id = ? GROUP BY vehicle_id`, feedId)
+	if err != nil {
+		return 0, err
+	}
+	current := make(map[string]*VehicleAssignment, len(latest))
+	for i := range latest {
+		current[latest[i].VehicleId] = &latest[i]
+	}
+
+	sorted := make([]VehiclePosition, len(positions))
+	copy(sorted, positions)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].TimestampUnix < sorted[j].TimestampUnix })
+
+	var changed []*VehicleAssignment
+	seen := make(map[*VehicleAssignment]bool)
+	changes := 0
+	for i := range sorted {
+		vp := &sorted[i]
+		if vp.VehicleId == "" {
+			continue
+		}
+		a := current[vp.VehicleId]
+		switch {
+		case a != nil && vp.TimestampUnix < a.LastSeenUnix:
+			continue
+		case a != nil && a.servesSameTrip(vp):
+			a.LastSeenUnix = vp.TimestampUnix
+			a.Positions++
+		case a != nil && vp.TimestampUnix == a.FirstSeenUnix:
+			// Another trip reported at the very start of an assignment can't be ordered after it
+			continue
+		default:
+			if a != nil {
+				changes++
+			}
+			a = &VehicleAssignment{
+				FeedId:        feedId,
+				VehicleId:     vp.VehicleId,
+				FirstSeenUnix: vp.TimestampUnix,
+				LastSeenUnix:  vp.TimestampUnix,
+				TripId:        vp.TripId,
+				RouteId:       vp.RouteId,
+				StartDate:     vp.StartDate,
+				Positions:     1,
+			}
+			current[vp.VehicleId] = a
+		}
+		if !seen[a] {
+			seen[a] = true
+			changed = append(changed, a)
+		}
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareNamedContext(ctx, upsertVehicleAssignmentQuery())
+	if err != nil {
+		return 0, err
+	}
+	for _, a := range changed {
+		if _, err := stmt.ExecContext(ctx, a); err != nil {
+			return 0, err
+		}
+	}
+	return changes, tx.Commit()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteConn runs f with the underlying SQLite connection of a database handle.
+func sqliteConn(ctx context.Context, db *sqlx.DB, f func(conn *sqlite3.SQLiteConn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Raw(func(driverConn any) error {
+		sqliteConn, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+		return f(sqliteConn)
+	})
+}
+
+// backupDatabase copies a database using SQLite's online backup API.
+// The copy is made in a single read transaction, so it is consistent even while another
+// process is writing to a WAL-mode database. The destination is replaced atomically.
+func backupDatabase(dbPath string, destPath string) (err error) {
+	src, err := sqlx.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stagingPath := destPath + ".tmp"
+	os.Remove(stagingPath)
+	dest, err := sqlx.Open("sqlite3", stagingPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		dest.Close()
+		if err != nil {
+			os.Remove(stagingPath)
+		}
+	}()
+
+	ctx := context.Background()
+	var pages int
+	err = sqliteConn(ctx, dest, func(destConn *sqlite3.SQLiteConn) error {
+		return sqliteConn(ctx, src, func(srcConn *sqlite3.SQLiteConn) error {
+			backup, err := destConn.Backup("main", srcConn, "main")
+			if err != nil {
+				return err
+			}
+			// Copying every page in one step avoids restarting when the source is written to
+			done, stepErr := backup.Step(-1)
+			pages = backup.PageCount()
+			if err := backup.Finish(); err != nil {
+				return err
+			} else if stepErr != nil {
+				return stepErr
+			} else if !done {
+				return errors.New("backup did not complete")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err = dest.Close(); err != nil {
+		return err
+	}
+	slog.Info("Backed up the database", "pages", pages, "database", dbPath, "destination", destPath)
+	return os.Rename(stagingPath, destPath)
+}
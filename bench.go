@@ -0,0 +1,366 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/parquet-go/parquet-go"
+	"google.golang.org/protobuf/proto"
+)
+
+type benchCodec struct {
+	name  string
+	level int
+}
+
+var benchCodecs = []benchCodec{
+	{"uncompressed", 0},
+	{"snappy", 0},
+	{"lz4", 0},
+	{"gzip", 1},
+	{"gzip", 6},
+	{"gzip", 9},
+	{"brotli", 1},
+	{"brotli", 6},
+	{"brotli", 11},
+	{"zstd", 1},
+	{"zstd", 2},
+	{"zstd", 3},
+	{"zstd", 4},
+}
+
+// Sort orders to try, as lists of columns. Columns missing from the archive are skipped.
+var benchSortings = [][]string{
+	nil,
+	{"timestamp"},
+	{"vehicle_id", "timestamp"},
+	{"route_id", "trip_id", "timestamp"},
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// readArchivedMonth reads every row archived for a month, including all route partitions.
+// Rows are converted to the current archive schema if necessary.
+func readArchivedMonth(monthDir string, schema *archiveSchema) ([]parquet.Row, error) {
+	var rows []parquet.Row
+	found := false
+	err := filepath.WalkDir(monthDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".parquet" {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		file, err := openParquetFile(f)
+		if err != nil {
+			return err
+		}
+		reader := parquet.NewReader(file)
+		defer reader.Close()
+		found = true
+		var converter *rowConverter
+		if reader.Schema().String() != schema.schema.String() {
+			converter = schema.converterFrom(reader.Schema())
+		}
+
+		buffer := make([]parquet.Row, writeBatchSize)
+		for {
+			n, err := reader.ReadRows(buffer)
+			for _, row := range buffer[:n] {
+				if converter != nil {
+					rows = append(rows, converter.convert(row))
+				} else {
+					rows = append(rows, row.Clone())
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return &PartitionError{Path: path, Err: err}
+			}
+		}
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("no Parquet files found in %s", monthDir)
+	}
+	return rows, err
+}
+
+// benchWrite writes rows with the given settings, returning the file size and time taken.
+func benchWrite(schema *parquet.Schema, rows []parquet.Row, config ArchiveConfig, codec benchCodec) (int64, time.Duration, error) {
+	compression, err := compressionCodec(codec.name, codec.level)
+	if err != nil {
+		return 0, 0, err
+	}
+	rowGroupSize := config.RowGroupSize
+	if rowGroupSize == 0 {
+		rowGroupSize = defaultRowGroupSize
+	}
+	pageSize := config.PageSize
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	rowGroupSize, pageSize = budgetRowGroupSize(rowGroupSize), budgetPageSize(pageSize)
+
+	var output countingWriter
+	start := time.Now()
+	writer := parquet.NewWriter(&output, schema,
+		parquet.MaxRowsPerRowGroup(rowGroupSize),
+		parquet.PageBufferSize(pageSize),
+		parquet.Compression(compression),
+	)
+	if _, err := writer.WriteRows(rows); err != nil {
+		return 0, 0, err
+	}
+	if err := writer.Close(); err != nil {
+		return 0, 0, err
+	}
+	return output.n, time.Since(start), nil
+}
+
+// archiveBench rewrites one archived month with each combination of codec and sort order,
+// and reports the resulting file sizes and write times.
+func archiveBench(config Config, args []string) error {
+	flags := flag.NewFlagSet("archive bench", flag.ExitOnError)
+	month := flags.String("month", "", "month to benchmark, as YYYY-MM")
+	archiveDir := flags.String("archive", feedArchiveDir(config), "archive directory")
+	flags.Parse(args)
+
+	period, err := time.Parse(yearMonthLayout, *month)
+	if err != nil {
+		return fmt.Errorf("invalid --month: %w", err)
+	}
+	dir := monthDir(*archiveDir, period)
+	// Files carry their codec in the schema of each column, so rewrite them using the schema derived from the config
+	a, err := newArchiveSchema(config.Archive, config.FeedId)
+	if err != nil {
+		return err
+	}
+	schema := a.schema
+	rows, err := readArchivedMonth(dir, a)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Benchmarking %d rows from %s\n\n", len(rows), dir)
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "Compression\tCompressionLevel\tSort\tSize (MiB)\tRatio\tWrite time\t")
+	var baseline int64
+	for _, sorting := range benchSortings {
+		var sortingColumns []parquet.SortingColumn
+		for _, name := range sorting {
+			if _, found := schema.Lookup(name); found {
+				sortingColumns = append(sortingColumns, parquet.Ascending(name))
+			}
+		}
+		if len(sortingColumns) != len(sorting) {
+			continue
+		}
+		sortLabel := "none"
+		if len(sorting) > 0 {
+			compare := schema.Comparator(sortingColumns...)
+			sort.SliceStable(rows, func(i, j int) bool { return compare(rows[i], rows[j]) < 0 })
+			sortLabel = fmt.Sprint(sorting)
+		}
+
+		for _, codec := range benchCodecs {
+			size, elapsed, err := benchWrite(schema, rows, config.Archive, codec)
+			if err != nil {
+				return err
+			}
+			if baseline == 0 {
+				baseline = size
+			}
+			fmt.Fprintf(table, "%s\t%d\t%s\t%.2f\t%.2f\t%v\t\n",
+				codec.name, codec.level, sortLabel, float64(size)/(1<<20), float64(baseline)/float64(size), elapsed.Round(time.Millisecond))
+		}
+	}
+	return table.Flush()
+}
+
+// syntheticFeed generates a vehicle positions feed for benchmarks, with each vehicle on its own trip
+// and moving a little each poll, so rows vary as much as in a real feed.
+func syntheticFeed(vehicles int, timestamp time.Time, rng *rand.Rand) *gtfs.FeedMessage {
+	feed := &gtfs.FeedMessage{
+		Header: &gtfs.FeedHeader{
+			GtfsRealtimeVersion: proto.String("2.0"),
+			Timestamp:           proto.Uint64(uint64(timestamp.Unix())),
+		},
+	}
+	startDate := timestamp.Format("20060102")
+	for i := 0; i < vehicles; i++ {
+		id := fmt.Sprintf("bench-%d", i)
+		feed.Entity = append(feed.Entity, &gtfs.FeedEntity{
+			Id: proto.String(id),
+			Vehicle: &gtfs.VehiclePosition{
+				Trip: &gtfs.TripDescriptor{
+					TripId:    proto.String(fmt.Sprintf("trip-%d", i)),
+					RouteId:   proto.String(fmt.Sprintf("route-%d", i%50)),
+					StartDate: proto.String(startDate),
+					StartTime: proto.String(fmt.Sprintf("%02d:%02d:00", 5+i%18, i%60)),
+				},
+				Vehicle: &gtfs.VehicleDescriptor{Id: proto.String(id), Label: proto.String(strconv.Itoa(1000 + i))},
+				Position: &gtfs.Position{
+					Latitude:  proto.Float32(48.4 + rng.Float32()/10),
+					Longitude: proto.Float32(-123.4 + rng.Float32()/10),
+					Bearing:   proto.Float32(rng.Float32() * 360),
+					Speed:     proto.Float32(rng.Float32() * 20),
+				},
+				CurrentStopSequence: proto.Uint32(uint32(rng.Intn(60))),
+				StopId:              proto.String(strconv.Itoa(rng.Intn(5000))),
+				Timestamp:           proto.Uint64(uint64(timestamp.Unix() - int64(rng.Intn(30)))),
+			},
+		})
+	}
+	return feed
+}
+
+// reportThroughput prints the rate of a benchmark.
+func reportThroughput(rows int, elapsed time.Duration) {
+	fmt.Printf("%d rows in %v: %.0f rows/s\n", rows, elapsed.Round(time.Millisecond), float64(rows)/elapsed.Seconds())
+}
+
+// benchIngest inserts synthetic polls into a scratch database through the same path as vehicleupdates,
+// measuring the insert rate with the current database settings on the disk holding the data directory.
+func benchIngest(config Config, args []string) error {
+	flags := flag.NewFlagSet("bench ingest", flag.ExitOnError)
+	vehicles := flags.Int("vehicles", 500, "vehicles in each synthetic poll")
+	polls := flags.Int("polls", 100, "synthetic polls to insert")
+	dir := flags.String("dir", config.DataDir, "directory for the scratch database, which should be on the same disk as the real one")
+	flags.Parse(args)
+	if *vehicles < 1 || *polls < 1 {
+		return errors.New("--vehicles and --polls must be at least 1")
+	}
+
+	scratchDir, err := os.MkdirTemp(*dir, "bench-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratchDir)
+	db, err := setupDatabase(scratchDir, config.FeedId)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	fmt.Printf("Inserting %d polls of %d vehicles into %s\n", *polls, *vehicles, scratchDir)
+	if sqliteCacheKiB > 0 {
+		fmt.Printf("SQLite cache: %d KiB per connection\n", sqliteCacheKiB)
+	}
+	fmt.Println()
+	rng := rand.New(rand.NewSource(1))
+	timestamp := time.Now().Add(-time.Duration(*polls) * 30 * time.Second)
+	minInterval := time.Duration(config.MinPositionIntervalSeconds) * time.Second
+	var elapsed, slowest time.Duration
+	inserted := 0
+	for i := 0; i < *polls; i++ {
+		// Feeds are generated outside the timing, which only covers the database
+		feed := syntheticFeed(*vehicles, timestamp, rng)
+		start := time.Now()
+		positions, err := addVehiclePositions(feed, db, config.FeedId, nil, time.UTC, minInterval)
+		if err != nil {
+			return err
+		}
+		poll := time.Since(start)
+		elapsed += poll
+		slowest = max(slowest, poll)
+		inserted += len(positions)
+		timestamp = timestamp.Add(30 * time.Second)
+	}
+	reportThroughput(inserted, elapsed)
+	fmt.Printf("Mean poll: %v, slowest poll: %v\n", (elapsed / time.Duration(*polls)).Round(time.Microsecond), slowest.Round(time.Microsecond))
+	return nil
+}
+
+// benchArchiveWrite converts synthetic positions to archive rows and writes them with the configured format,
+// compression, row group and page sizes, measuring the rate without touching the disk.
+func benchArchiveWrite(config Config, args []string) error {
+	flags := flag.NewFlagSet("bench archive", flag.ExitOnError)
+	rows := flags.Int("rows", 1_000_000, "synthetic rows to write")
+	vehicles := flags.Int("vehicles", 500, "vehicles the rows are spread over")
+	flags.Parse(args)
+	if *rows < 1 || *vehicles < 1 {
+		return errors.New("--rows and --vehicles must be at least 1")
+	}
+
+	a, err := newArchiver(nil, feedArchiveDir(config), config.Archive, provenanceOf(config))
+	if err != nil {
+		return err
+	}
+	var output countingWriter
+	writer, err := a.newRowWriter(&output)
+	if err != nil {
+		return err
+	}
+	format, compression := a.config.Format, a.config.Compression
+	if format == "" {
+		format = "parquet"
+	}
+	if compression == "" {
+		compression = "default"
+	}
+	fmt.Printf("Writing %d rows of %d vehicles as %s with %s compression (level %d), in batches of %d\n\n",
+		*rows, *vehicles, format, compression, a.config.CompressionLevel, writeBatchSize)
+
+	rng := rand.New(rand.NewSource(1))
+	timestamp := time.Now().Add(-time.Duration(*rows / *vehicles) * 30 * time.Second)
+	batch := make([]parquet.Row, 0, writeBatchSize)
+	var pending []VehiclePosition
+	var elapsed time.Duration
+	for written := 0; written < *rows; {
+		if len(pending) == 0 {
+			// Positions are generated outside the timing, which covers converting and writing them
+			for _, entity := range syntheticFeed(*vehicles, timestamp, rng).Entity {
+				var vp VehiclePosition
+				if err := vp.fromFeedEntity(entity.Vehicle, time.UTC); err != nil {
+					return err
+				}
+				vp.FeedId = config.FeedId
+				pending = append(pending, vp)
+			}
+			timestamp = timestamp.Add(30 * time.Second)
+		}
+		n := min(len(pending), writeBatchSize-len(batch), *rows-written)
+		start := time.Now()
+		for i := range pending[:n] {
+			batch = append(batch, a.schema.row(&pending[i]))
+		}
+		if len(batch) == writeBatchSize || written+n == *rows {
+			if _, err := writer.WriteRows(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+		elapsed += time.Since(start)
+		pending = pending[n:]
+		written += n
+	}
+	start := time.Now()
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	elapsed += time.Since(start)
+	reportThroughput(*rows, elapsed)
+	fmt.Printf("Output: %.2f MiB, %.1f bytes/row\n", float64(output.n)/(1<<20), float64(output.n)/float64(*rows))
+	return nil
+}
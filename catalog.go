@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// CatalogConfig publishes a catalog of the archive at its root, datapackage.json, so published copies describe
+// themselves: a Frictionless Data Package (https://specs.frictionlessdata.io/) with a resource for each archive file,
+// giving its schema, checksum, row count and the time it covers, and the feeds and license of the whole archive.
+// It's rewritten with the manifest after each run and listed in it, so it's signed and uploaded with the archive.
+type CatalogConfig struct {
+	Enabled bool
+	// Name identifies the package, in lower case letters, digits, "-", "_" and ".". Defaults to gtfs-realtime-<FeedId>.
+	Name        string
+	Title       string
+	Description string
+	// License is the SPDX identifier of the license the archive is published under, e.g. "CC-BY-4.0" or "ODbL-1.0".
+	License string
+	// LicenseURL links to the license, e.g. the agency's terms of use where it has no SPDX identifier.
+	LicenseURL string
+}
+
+const catalogName = "datapackage.json"
+
+// Characters which aren't allowed in the names of packages and resources
+var catalogNameInvalid = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// catalogResourceName names an archive file after its table and partition values,
+// e.g. year=2024/month=06/vehicle_positions.parquet is vehicle_positions-2024-06.
+func catalogResourceName(rel string) string {
+	base := path.Base(rel)
+	parts := []string{strings.TrimSuffix(base, archiveFileExt(base))}
+	for _, dir := range strings.Split(path.Dir(rel), "/") {
+		if _, value, found := strings.Cut(dir, "="); found {
+			if unescaped, err := url.PathUnescape(value); err == nil {
+				value = unescaped
+			}
+			parts = append(parts, value)
+		}
+	}
+	return strings.Trim(catalogNameInvalid.ReplaceAllString(strings.ToLower(strings.Join(parts, "-")), "_"), "_")
+}
+
+// archiveFileExt returns the extension of an archive file, including .csv.gz in full.
+func archiveFileExt(name string) string {
+	if strings.HasSuffix(name, ".csv.gz") {
+		return ".csv.gz"
+	}
+	return path.Ext(name)
+}
+
+// partitionMonthOf returns the month of a file's year=/month= partition.
+func partitionMonthOf(rel string) (time.Time, bool) {
+	var year, month int
+	for _, dir := range strings.Split(path.Dir(rel), "/") {
+		if value, found := strings.CutPrefix(dir, "year="); found {
+			year, _ = strconv.Atoi(value)
+		} else if value, found := strings.CutPrefix(dir, "month="); found {
+			month, _ = strconv.Atoi(value)
+		}
+	}
+	if year == 0 || month < 1 || month > 12 {
+		return time.Time{}, false
+	}
+	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC), true
+}
+
+// parquetColumns describes the columns of a Parquet file's schema, with the units and enums of the columns they
+// were renamed from.
+func parquetColumns(schema *parquet.Schema, sourceNames map[string]string) []columnDescription {
+	var columns []columnDescription
+	for _, field := range schema.Fields() {
+		source := field.Name()
+		if name, found := sourceNames[source]; found {
+			source = name
+		}
+		column := columnDescription{
+			Name:     field.Name(),
+			Type:     "GROUP",
+			Required: field.Required(),
+			Unit:     columnUnits[source],
+			Enum:     columnEnum(source),
+		}
+		if field.Leaf() {
+			column.Type = field.Type().Kind().String()
+		}
+		if lt := field.Type().LogicalType(); lt != nil {
+			column.LogicalType = lt.String()
+		} else if children := field.Fields(); !field.Leaf() && len(children) == 1 && children[0].Repeated() {
+			// Schemas read back from files keep the layout of lists but not their annotation
+			column.LogicalType = "LIST"
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// describeParquetFile reads the schema, row count and timestamp range of an archived Parquet file from its footer.
+// Files written before the range was recorded have none.
+func describeParquetFile(filePath string, sourceNames map[string]string) (schema tableSchema, rows int64, timestamps *timestampRange, err error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return tableSchema{}, 0, nil, err
+	}
+	defer f.Close()
+	file, err := openParquetFile(f)
+	if err != nil {
+		return tableSchema{}, 0, nil, err
+	}
+	schema = frictionlessSchema(parquetColumns(file.Schema(), sourceNames), nil)
+	minValue, hasMin := file.Lookup(minTimestampMetadataKey)
+	maxValue, hasMax := file.Lookup(maxTimestampMetadataKey)
+	if hasMin && hasMax {
+		timestamps = &timestampRange{}
+		if timestamps.Min, err = time.Parse(time.RFC3339, minValue); err != nil {
+			return tableSchema{}, 0, nil, &PartitionError{Path: filePath, Err: err}
+		}
+		if timestamps.Max, err = time.Parse(time.RFC3339, maxValue); err != nil {
+			return tableSchema{}, 0, nil, &PartitionError{Path: filePath, Err: err}
+		}
+	}
+	return schema, file.NumRows(), timestamps, nil
+}
+
+// updateCatalog rewrites the archive's catalog from the files listed for the manifest, returning the list
+// with the catalog's own entry updated. Files in other formats than Parquet are described with the schema
+// the archive config writes, without a row count, and files without a recorded timestamp range cover their month.
+func updateCatalog(archiveDir string, config ArchiveConfig, provenance archiveProvenance, files []ManifestFile) ([]ManifestFile, error) {
+	sourceNames := make(map[string]string, len(config.RenameColumns))
+	for source, name := range config.RenameColumns {
+		sourceNames[name] = source
+	}
+	configured, err := describeArchive(Config{FeedId: provenance.FeedId, Archive: config})
+	if err != nil {
+		return nil, err
+	}
+
+	catalog := dataPackage{
+		Profile:     "tabular-data-package",
+		Name:        config.Catalog.Name,
+		Title:       config.Catalog.Title,
+		Description: config.Catalog.Description,
+		FeedId:      provenance.FeedId,
+		Created:     time.Now().UTC().Format(time.RFC3339),
+		Resources:   []dataPackageResource{},
+	}
+	if catalog.Name == "" {
+		catalog.Name = catalogNameInvalid.ReplaceAllString(strings.ToLower("gtfs-realtime-"+provenance.FeedId), "_")
+	}
+	if config.Catalog.License != "" || config.Catalog.LicenseURL != "" {
+		catalog.Licenses = []dataPackageLicense{{Name: config.Catalog.License, Path: config.Catalog.LicenseURL}}
+	}
+	sources := []struct {
+		title string
+		urls  []string
+	}{{"Vehicle positions", provenance.FeedURLs}, {"Trip updates", provenance.TripUpdatesURLs}}
+	for _, source := range sources {
+		for _, feedURL := range source.urls {
+			// Query parameters may be credentials
+			if u, err := url.Parse(feedURL); err == nil {
+				catalog.Sources = append(catalog.Sources, dataPackageSource{Title: source.title, Path: withoutQuery(u)})
+			}
+		}
+	}
+
+	var kept []ManifestFile
+	for _, file := range files {
+		if file.Path == catalogName {
+			continue
+		}
+		kept = append(kept, file)
+		resource := dataPackageResource{
+			Name:  catalogResourceName(file.Path),
+			Path:  file.Path,
+			Bytes: file.Size,
+			Hash:  "sha256:" + file.SHA256,
+		}
+		switch archiveFileExt(file.Path) {
+		case ".parquet":
+			resource.Format, resource.Mediatype = "parquet", "application/vnd.apache.parquet"
+			var rows int64
+			resource.Schema, rows, resource.Temporal, err = describeParquetFile(filepath.Join(archiveDir, filepath.FromSlash(file.Path)), sourceNames)
+			if err != nil {
+				return nil, err
+			}
+			resource.Rows = &rows
+		case ".orc":
+			resource.Format, resource.Mediatype = "orc", "application/vnd.apache.orc"
+			resource.Schema = frictionlessSchema(configured.Columns, nil)
+		case ".csv.gz":
+			resource.Format, resource.Mediatype, resource.Compression = "csv", "text/csv", "gz"
+			resource.Schema = frictionlessSchema(configured.Columns, nil)
+		default:
+			// Only data files are resources
+			continue
+		}
+		if month, found := partitionMonthOf(file.Path); found && resource.Temporal == nil {
+			start, end := partitionMonth(config, month)
+			resource.Temporal = &timestampRange{Min: start.UTC(), Max: end.Add(-time.Second).UTC()}
+		}
+		if resource.Temporal != nil {
+			if catalog.Temporal == nil {
+				catalog.Temporal = &timestampRange{}
+			}
+			catalog.Temporal.add(resource.Temporal.Min)
+			catalog.Temporal.add(resource.Temporal.Max)
+		}
+		catalog.Resources = append(catalog.Resources, resource)
+	}
+	sort.Slice(catalog.Resources, func(i, j int) bool { return catalog.Resources[i].Path < catalog.Resources[j].Path })
+
+	contents, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	catalogPath := filepath.Join(archiveDir, catalogName)
+	if err := writeFileAtomic(catalogPath, contents); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(catalogPath)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(contents)
+	config.log().Info("Updated catalog", "resources", len(catalog.Resources))
+	return append(kept, ManifestFile{Path: catalogName, Size: info.Size(), Modified: info.ModTime().UTC(), SHA256: hex.EncodeToString(sum[:])}), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ChatConfig posts notifications to a chat service.
+type ChatConfig struct {
+	// Type is one of "slack", "discord", "matrix" or "webhook".
+	Type string
+	// URL is the incoming webhook URL for Slack, Discord and generic webhooks, or the homeserver URL for Matrix.
+	URL string
+	// RoomId and AccessToken are for Matrix.
+	RoomId      string
+	AccessToken string
+	// Secret signs generic webhook requests as for position webhooks.
+	Secret string
+}
+
+// Discord rejects longer messages
+const discordMaxLength = 2000
+
+type chatNotifier struct {
+	config ChatConfig
+}
+
+func (c chatNotifier) name() string {
+	return c.config.Type
+}
+
+func (c chatNotifier) send(config Config, batch []notification) error {
+	text := strings.TrimSpace(formatNotifications(config.Notifications, batch))
+	var payload any
+	switch c.config.Type {
+	case "slack":
+		payload = map[string]string{"text": text}
+	case "discord":
+		if len(text) > discordMaxLength {
+			text = text[:discordMaxLength-3] + "..."
+		}
+		payload = map[string]string{"content": text}
+	case "webhook":
+		// The rendered text for display, and the notifications for anything acting on them
+		payload = map[string]any{"text": text, "notifications": batch}
+	case "matrix":
+		return c.sendMatrix(text)
+	default:
+		return fmt.Errorf("unknown chat type %q", c.config.Type)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookDeadline)
+	defer cancel()
+	return postWebhook(ctx, WebhookConfig{URL: c.config.URL, Secret: c.config.Secret}, body)
+}
+
+// sendMatrix sends a text message to a Matrix room with the client-server API.
+func (c chatNotifier) sendMatrix(text string) error {
+	body, err := json.Marshal(map[string]string{"msgtype": "m.text", "body": text})
+	if err != nil {
+		return err
+	}
+	// The transaction ID makes retries of the same message idempotent
+	txnId := fmt.Sprintf("gtfs-scraper-%d", time.Now().UnixNano())
+	sendURL := strings.TrimSuffix(c.config.URL, "/") + "/_matrix/client/v3/rooms/" + url.PathEscape(c.config.RoomId) +
+		"/send/m.room.message/" + txnId
+	req, err := http.NewRequest(http.MethodPut, sendURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.config.AccessToken)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("matrix returned %s", resp.Status)
+	}
+	return nil
+}
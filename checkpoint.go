@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Progress of an interrupted month is kept next to its partitions until they're committed.
+const archiveCheckpointName = "archive-checkpoint.json"
+
+// archiveCheckpoint records how far the rewrite of a month's partitions got, so a rerun can resume it.
+// Rows written before the checkpoint are in complete segment files next to each partition file.
+type archiveCheckpoint struct {
+	// Schema is the archive schema the segments were written with. A changed schema starts over.
+	Schema string   `json:"schema"`
+	Keys   []string `json:"keys"`
+	// Series is the columns the files' last updates are tracked by. A change starts over.
+	Series []string `json:"series"`
+	// Cursor is the timestamp up to which rows from the database have been written, or 0 while existing rows
+	// are still being copied.
+	Cursor int64                      `json:"cursor"`
+	Files  map[string]*fileCheckpoint `json:"files"`
+}
+
+type fileCheckpoint struct {
+	// OldSize and OldModified identify the existing file, which must be unchanged to resume
+	OldSize     int64     `json:"old_size"`
+	OldModified time.Time `json:"old_modified"`
+	// OldRows is how many rows of the existing file have been copied
+	OldRows            int64                `json:"old_rows"`
+	ValidCount         int64                `json:"valid_count"`
+	LastVehicleUpdates map[string]time.Time `json:"last_vehicle_updates"`
+	Segments           int                  `json:"segments"`
+	New                int                  `json:"new"`
+	Skipped            int                  `json:"skipped"`
+	Timestamps         timestampRange       `json:"timestamps"`
+}
+
+// loadArchiveCheckpoint reads the checkpoint of a month, returning nil if there's none
+// or it can't be resumed with the current schema and partitions, which is logged through logger.
+func loadArchiveCheckpoint(partitionRoot string, schema *archiveSchema, keys []string, paths map[string]string, logger *slog.Logger) *archiveCheckpoint {
+	contents, err := os.ReadFile(filepath.Join(partitionRoot, archiveCheckpointName))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Ignoring unreadable archive checkpoint", "err", err)
+		}
+		return nil
+	}
+	var checkpoint archiveCheckpoint
+	if err := json.Unmarshal(contents, &checkpoint); err != nil {
+		logger.Warn("Ignoring unreadable archive checkpoint", "err", err)
+		return nil
+	}
+	if checkpoint.Schema != schema.schema.String() || !slices.Equal(checkpoint.Keys, keys) || !slices.Equal(checkpoint.Series, schema.seriesColumns) {
+		logger.Warn("Ignoring archive checkpoint written with different settings")
+		return nil
+	}
+	for _, key := range keys {
+		f := checkpoint.Files[key]
+		if f == nil {
+			return nil
+		}
+		var size int64
+		var modified time.Time
+		info, err := os.Stat(paths[key])
+		if err == nil {
+			size, modified = info.Size(), info.ModTime().UTC()
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if size != f.OldSize || !modified.Equal(f.OldModified) {
+			logger.Warn("Ignoring archive checkpoint, as a file has changed since", "path", paths[key])
+			return nil
+		}
+	}
+	return &checkpoint
+}
+
+// saveArchiveCheckpoint closes off the current segment of every partition file, then records the progress.
+// Segments are synced first, so the checkpoint never refers to rows which weren't written.
+func saveArchiveCheckpoint(partitionRoot string, schema *archiveSchema, keys []string, files map[string]*partitionFile, cursor int64) error {
+	checkpoint := archiveCheckpoint{
+		Schema: schema.schema.String(),
+		Keys:   keys,
+		Series: schema.seriesColumns,
+		Cursor: cursor,
+		Files:  make(map[string]*fileCheckpoint, len(files)),
+	}
+	for _, key := range keys {
+		p := files[key]
+		// Files without new rows keep writing to the same segment. Rows still buffered count, as closing the
+		// segment flushes them.
+		if p.segmentRows > 0 || len(p.buffer) > 0 {
+			if err := p.nextSegment(); err != nil {
+				return err
+			}
+		}
+		checkpoint.Files[key] = &fileCheckpoint{
+			OldSize:            p.oldSize,
+			OldModified:        p.oldModified,
+			OldRows:            p.oldRows,
+			ValidCount:         p.validCount,
+			LastVehicleUpdates: p.lastVehicleUpdates,
+			Segments:           p.segments,
+			New:                p.nNew,
+			Skipped:            p.nSkipped,
+			Timestamps:         p.timestamps,
+		}
+	}
+	contents, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(partitionRoot, archiveCheckpointName), contents)
+}
+
+// removeArchiveCheckpoint deletes a month's checkpoint and the segments of its partition files.
+func removeArchiveCheckpoint(partitionRoot string, files map[string]*partitionFile) error {
+	if err := os.Remove(filepath.Join(partitionRoot, archiveCheckpointName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, p := range files {
+		p.removeSegments()
+	}
+	return nil
+}
+
+func (p *partitionFile) segmentPath(n int) string {
+	return fmt.Sprintf("%s.%d.tmp", p.path, n)
+}
+
+// createSegment starts writing the next segment file.
+func (p *partitionFile) createSegment() error {
+	f, err := os.Create(p.segmentPath(p.segments))
+	if err != nil {
+		return err
+	}
+	p.file = f
+	p.segmentRows = 0
+	p.writer, err = p.newWriter(f)
+	return err
+}
+
+// nextSegment completes the current segment and starts another.
+func (p *partitionFile) nextSegment() error {
+	if err := p.closeSegment(); err != nil {
+		return err
+	}
+	return p.createSegment()
+}
+
+// closeSegment finishes writing the current segment and syncs it to disk.
+func (p *partitionFile) closeSegment() error {
+	if err := p.flush(); err != nil {
+		return err
+	}
+	if err := p.writer.Close(); err != nil {
+		return err
+	}
+	p.writer = nil
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	p.file = nil
+	p.segments++
+	return nil
+}
+
+// copyOldRows copies up to limit rows from the existing file, reporting whether they've all been copied.
+func (p *partitionFile) copyOldRows(limit int64) (bool, error) {
+	if p.oldReader == nil {
+		return true, nil
+	}
+	n, err := p.schema.copyRows(p.writer, &limitedRowReader{reader: p.oldReader, remaining: limit})
+	p.oldRows += n
+	p.segmentRows += n
+	if err != nil {
+		return false, err
+	}
+	if n < limit {
+		p.logger.Debug("Copied rows from the existing file", "rows", p.oldRows)
+		if p.validCount != p.oldRows {
+			return false, fmt.Errorf("%s: expected to write %d parquet rows, wrote %d", p.label, p.validCount, p.oldRows)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// joinSegments writes the rows of every segment to the staging file, in order.
+func (p *partitionFile) joinSegments() error {
+	f, err := os.Create(p.stagingPath)
+	if err != nil {
+		return err
+	}
+	p.file = f
+	p.writer, err = p.newWriter(f)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < p.segments; i++ {
+		if err := p.copySegment(p.segmentPath(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *partitionFile) copySegment(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	file, err := openParquetFile(f)
+	if err != nil {
+		return err
+	}
+	reader := parquet.NewReader(file)
+	defer reader.Close()
+	_, err = parquet.CopyRows(p.writer, reader)
+	return err
+}
+
+func (p *partitionFile) removeSegments() {
+	segments, _ := filepath.Glob(p.path + ".*.tmp")
+	for _, path := range segments {
+		os.Remove(path)
+	}
+}
+
+// limitedRowReader reads at most a number of rows from a Parquet reader.
+type limitedRowReader struct {
+	reader    *parquet.Reader
+	remaining int64
+}
+
+func (r *limitedRowReader) Schema() *parquet.Schema {
+	return r.reader.Schema()
+}
+
+func (r *limitedRowReader) ReadRows(rows []parquet.Row) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(rows)) > r.remaining {
+		rows = rows[:r.remaining]
+	}
+	n, err := r.reader.ReadRows(rows)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+func (a *archiver) checkpointing() bool {
+	return a.config.CheckpointRows > 0 && filepath.Ext(a.fileName) == ".parquet"
+}
+
+// beginCheckpointed starts the segments of each partition file, and copies the rest of the existing rows
+// with a checkpoint after each batch.
+func (a *archiver) beginCheckpointed(partitionRoot string, keys []string, files map[string]*partitionFile, checkpoint *archiveCheckpoint) error {
+	for _, key := range keys {
+		p := files[key]
+		if checkpoint == nil {
+			// Segments of an abandoned checkpoint
+			p.removeSegments()
+		}
+		if err := p.createSegment(); err != nil {
+			return err
+		}
+	}
+	if checkpoint != nil && checkpoint.Cursor > 0 {
+		return nil
+	}
+	for _, key := range keys {
+		for done := false; !done; {
+			var err error
+			if done, err = files[key].copyOldRows(a.config.CheckpointRows); err != nil {
+				return err
+			}
+			if err := saveArchiveCheckpoint(partitionRoot, a.schema, keys, files, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveCheckpointResume(t *testing.T) {
+	dataDir := t.TempDir()
+	config := Config{DataDir: dataDir, FeedId: "test", Archive: ArchiveConfig{CheckpointRows: 2}}
+	archiveDir := feedArchiveDir(config)
+	period := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	db, err := createDatabase(filepath.Join(dataDir, "realtime.db"), config.FeedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, timestamp := range []uint64{1709280000, 1709280030, 1709280060} {
+		for _, vehicleId := range []string{"bus-0", "bus-1"} {
+			if _, err := addVehiclePositions(positionsFeed(timestamp, "trip-"+vehicleId, vehicleId), db, config.FeedId, nil, time.UTC, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// A row which can't be read interrupts the archive after the checkpoint of the rows before it
+	if _, err := db.Exec("UPDATE vehicle_positions SET latitude = 'x' WHERE timestamp = 1709280060 AND vehicle_id = 'bus-1'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := archivePartitions(db, archiveDir, config.Archive, provenanceOf(config)); err == nil {
+		t.Fatal("archived an unreadable row")
+	}
+	contents, err := os.ReadFile(filepath.Join(monthDir(archiveDir, period), archiveCheckpointName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checkpoint archiveCheckpoint
+	if err := json.Unmarshal(contents, &checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.Cursor != 1709280030 {
+		t.Fatalf("checkpoint at %d, want 1709280030", checkpoint.Cursor)
+	}
+
+	if _, err := db.Exec("UPDATE vehicle_positions SET latitude = 49.28 WHERE latitude = 'x'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := archivePartitions(db, archiveDir, config.Archive, provenanceOf(config)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(monthDir(archiveDir, period), archiveCheckpointName)); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left after the archive completed: %v", err)
+	}
+	schema, err := newArchiveSchema(config.Archive, config.FeedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := readArchivedMonth(monthDir(archiveDir, period), schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[positionKey]bool)
+	for _, row := range rows {
+		key := schema.archivedKey(row)
+		if seen[key] {
+			t.Errorf("archived %+v twice", key)
+		}
+		seen[key] = true
+	}
+	if len(seen) != countPositions(t, db) {
+		t.Errorf("archived %d distinct rows of %d in the database", len(seen), countPositions(t, db))
+	}
+}
+
+func TestLoadArchiveCheckpoint(t *testing.T) {
+	schema, err := newArchiveSchema(ArchiveConfig{}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{""}
+	tests := []struct {
+		name   string
+		modify func(t *testing.T, path string, checkpoint *archiveCheckpoint)
+		resume bool
+	}{
+		{"unchanged", func(t *testing.T, path string, checkpoint *archiveCheckpoint) {}, true},
+		{"file changed", func(t *testing.T, path string, checkpoint *archiveCheckpoint) {
+			if err := os.WriteFile(path, []byte("rewritten since"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"file touched", func(t *testing.T, path string, checkpoint *archiveCheckpoint) {
+			modified := checkpoint.Files[""].OldModified.Add(time.Minute)
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"schema changed", func(t *testing.T, path string, checkpoint *archiveCheckpoint) {
+			checkpoint.Schema = "message vehicle_positions {}"
+		}, false},
+		{"series changed", func(t *testing.T, path string, checkpoint *archiveCheckpoint) {
+			checkpoint.Series = []string{"vehicle_id"}
+		}, false},
+		{"partitions changed", func(t *testing.T, path string, checkpoint *archiveCheckpoint) {
+			checkpoint.Keys = []string{"99"}
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			partitionRoot := t.TempDir()
+			path := filepath.Join(partitionRoot, "vehicle_positions.parquet")
+			if err := os.WriteFile(path, []byte("existing partition"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkpoint := archiveCheckpoint{
+				Schema: schema.schema.String(),
+				Keys:   keys,
+				Series: schema.seriesColumns,
+				Cursor: 1709280000,
+				Files:  map[string]*fileCheckpoint{"": {OldSize: info.Size(), OldModified: info.ModTime().UTC(), OldRows: 2, ValidCount: 2}},
+			}
+			test.modify(t, path, &checkpoint)
+			contents, err := json.Marshal(checkpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(partitionRoot, archiveCheckpointName), contents, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			loaded := loadArchiveCheckpoint(partitionRoot, schema, keys, map[string]string{"": path}, slog.Default())
+			if resumed := loaded != nil; resumed != test.resume {
+				t.Fatalf("resumed %v, want %v", resumed, test.resume)
+			}
+			if loaded != nil && loaded.Cursor != checkpoint.Cursor {
+				t.Errorf("resumed at %d, want %d", loaded.Cursor, checkpoint.Cursor)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/klauspost/compress/zstd"
+)
+
+// writeColdShard copies the vehicle positions matching a condition into a SQLite file of their own, compressed with
+// zstd into shardPath. Rows already in an existing shard are kept, so pruning a month again only adds to it.
+// The shard is built in an uncompressed staging file and renamed into place, so it's never left half written.
+// It returns how many rows were new to the shard.
+func writeColdShard(ctx context.Context, db *sqlx.DB, shardPath string, condition string, args []any) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(shardPath), 0755); err != nil {
+		return 0, err
+	}
+	dbPath := strings.TrimSuffix(shardPath, ".zst") + ".tmp"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+	existing := true
+	if err := zstdFile(shardPath, dbPath, false); errors.Is(err, os.ErrNotExist) {
+		existing = false
+	} else if err != nil {
+		return 0, err
+	}
+
+	n, err := copyToShard(ctx, db, dbPath, condition, args)
+	if err != nil || n == 0 && !existing {
+		return n, err
+	}
+	return n, zstdFile(dbPath, shardPath, true)
+}
+
+// copyToShard copies the vehicle positions matching a condition into the database file at dbPath,
+// returning how many rows were new to it.
+func copyToShard(ctx context.Context, db *sqlx.DB, dbPath string, condition string, args []any) (n int64, err error) {
+	// Attached databases belong to a connection, so everything runs on one
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS shard", dbPath); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if _, detachErr := conn.ExecContext(ctx, "DETACH DATABASE shard"); err == nil {
+			err = detachErr
+		}
+	}()
+	if _, err := conn.ExecContext(ctx, strings.Replace(createTableQuery(), "vehicle_positions", "shard.vehicle_positions", 1)); err != nil {
+		return 0, err
+	}
+	var names []string
+	for _, colInfo := range columns {
+		names = append(names, colInfo.Name)
+	}
+	columnList := strings.Join(names, ", ")
+	result, err := conn.ExecContext(ctx, "INSERT OR IGNORE INTO shard.vehicle_positions ("+columnList+") SELECT "+columnList+
+		" FROM main.vehicle_positions WHERE "+condition, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// zstdFile compresses or decompresses a file with zstd, writing a staging file which is renamed to destPath.
+func zstdFile(path string, destPath string, compress bool) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stagingPath := destPath + ".part"
+	dest, err := os.Create(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dest.Close()
+			os.Remove(stagingPath)
+		}
+	}()
+	if compress {
+		var w *zstd.Encoder
+		if w, err = zstd.NewWriter(dest, zstd.WithEncoderLevel(zstd.SpeedBestCompression)); err != nil {
+			return err
+		}
+		if _, err = io.Copy(w, src); err != nil {
+			w.Close()
+			return err
+		}
+		if err = w.Close(); err != nil {
+			return err
+		}
+	} else {
+		var r *zstd.Decoder
+		if r, err = zstd.NewReader(src, zstd.WithDecoderConcurrency(1)); err != nil {
+			return err
+		}
+		defer r.Close()
+		if _, err = io.Copy(dest, r); err != nil {
+			return err
+		}
+	}
+	if err = dest.Close(); err != nil {
+		return err
+	}
+	return os.Rename(stagingPath, destPath)
+}
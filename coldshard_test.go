@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestWriteColdShard(t *testing.T) {
+	dir := t.TempDir()
+	db, err := createDatabase(filepath.Join(dir, "realtime.db"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, timestamp := range []uint64{1709280000, 1709280030, 1711958400} {
+		if _, err := addVehiclePositions(positionsFeed(timestamp, "trip-1", "bus-1"), db, "test", nil, time.UTC, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shardPath := filepath.Join(dir, "shards", "2024-03.db.zst")
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		condition string
+		args      []any
+		want      int
+	}{
+		{"a month's rows", "timestamp < ?", []any{1709280030}, 1},
+		// Pruning again adds to the shard, keeping what it had
+		{"more rows", "timestamp < ?", []any{1711958400}, 2},
+		{"no new rows", "timestamp < ?", []any{1709280000}, 2},
+	}
+	for _, test := range tests {
+		if _, err := writeColdShard(ctx, db, shardPath, test.condition, test.args); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		dbPath := filepath.Join(t.TempDir(), "shard.db")
+		if err := zstdFile(shardPath, dbPath, false); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		shard, err := sqlx.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		err = shard.Get(&n, "SELECT COUNT(*) FROM vehicle_positions WHERE feed_id = 'test' AND vehicle_id = 'bus-1'")
+		shard.Close()
+		if err != nil || n != test.want {
+			t.Errorf("%s: shard has %d rows (%v), want %d", test.name, n, err, test.want)
+		}
+	}
+
+	// Nothing is written for a month without rows
+	empty := filepath.Join(dir, "shards", "2024-05.db.zst")
+	if _, err := writeColdShard(ctx, db, empty, "timestamp > ?", []any{1711958400}); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := filepath.Glob(filepath.Join(dir, "shards", "*"))
+	if len(entries) != 1 {
+		t.Errorf("left %v in the shard directory, want only the March shard", entries)
+	}
+}
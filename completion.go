@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// cliCommand describes a command or subcommand for shell completion.
+type cliCommand struct {
+	// name is the command, followed by the subcommand if any
+	name  string
+	flags []string
+	// Flags which take an archived month as YYYY-MM
+	monthFlags []string
+}
+
+// Keep in sync with the commands handled in main.
+var cliCommands = []cliCommand{
+	{name: "static"},
+	{name: "alerts"},
+	{name: "tripupdates"},
+	{name: "vehicleupdates"},
+	{name: "archive", flags: []string{"--prune"}},
+	{name: "archive bench", flags: []string{"--month", "--archive"}, monthFlags: []string{"--month"}},
+	{name: "export snapshot", flags: []string{"--db", "--archive", "--output", "--enum-names"}},
+	{name: "export arrow", flags: []string{"--db", "--archive", "--output", "--from", "--to", "--compression", "--enum-names"}},
+	{name: "export alerts", flags: []string{"--db", "--output", "--language", "--active"}},
+	{name: "export delay-heatmap", flags: []string{"--db", "--archive", "--from", "--to", "--exclude-anomalies", "--max-speed", "--static", "--output"}},
+	{name: "export tracks", flags: []string{"--db", "--archive", "--from", "--to", "--exclude-anomalies", "--max-speed", "--static", "--output", "--interpolate", "--step", "--max-offset"}},
+	{name: "export gtfs-ride", flags: []string{"--db", "--archive", "--from", "--to", "--exclude-anomalies", "--max-speed", "--static", "--output"}},
+	{name: "db backup"},
+	{name: "db restore", flags: []string{"--archive", "--since", "--force", "--from-replica", "--generation"}, monthFlags: []string{"--since"}},
+	{name: "db replicate", flags: []string{"--db"}},
+	{name: "db migrate", flags: []string{"--db", "--dry-run"}},
+	{name: "analyze occupancy", flags: []string{"--db", "--archive", "--from", "--to", "--exclude-anomalies", "--max-speed", "--output", "--by", "--interval"}},
+	{name: "analyze speed-profile", flags: []string{"--db", "--archive", "--from", "--to", "--exclude-anomalies", "--max-speed", "--route", "--static", "--output", "--bucket", "--interval", "--slow", "--max-offset"}},
+	{name: "analyze fleet", flags: []string{"--db", "--archive", "--from", "--to", "--exclude-anomalies", "--max-speed", "--output", "--gap"}},
+	{name: "analyze gps-anomalies", flags: []string{"--db", "--archive", "--from", "--to", "--max-speed", "--output"}},
+	{name: "analyze deviations", flags: []string{"--db", "--archive", "--from", "--to", "--exclude-anomalies", "--max-speed", "--static", "--output", "--threshold", "--min-samples", "--gap"}},
+	{name: "analyze gaps", flags: []string{"--db", "--archive", "--from", "--to", "--exclude-anomalies", "--max-speed", "--output", "--gap"}},
+	{name: "analyze predictions", flags: []string{"--db", "--archive", "--from", "--to", "--output", "--horizons", "--arrival-window"}},
+	{name: "bench ingest", flags: []string{"--vehicles", "--polls", "--dir"}},
+	{name: "bench archive", flags: []string{"--rows", "--vehicles"}},
+	{name: "health report", flags: []string{"--db", "--from", "--to", "--gap"}},
+	{name: "schema export", flags: []string{"--format", "--output"}},
+	{name: "decrypt"},
+	{name: "verify"},
+	{name: "replay", flags: []string{"--db", "--dir", "--feeds", "--from", "--to"}},
+	{name: "dump", flags: []string{"--type", "--file", "--entity", "--trip", "--format"}},
+	{name: "top", flags: []string{"--db", "--interval", "--once"}},
+	{name: "serve", flags: []string{"--db", "--addr", "--graphql", "--static", "--grpc-addr", "--replica", "--archive", "--refresh"}},
+	{name: "daemon", flags: []string{"--interval", "--jitter", "--feeds", "--admin"}},
+	{name: "supervise", flags: []string{"--config-dir", "--jobs"}},
+	{name: "init", flags: []string{"--data-dir", "--feed-id", "--static-url", "--vehicle-url", "--trip-updates-url", "--alerts-url", "--timezone", "--systemd", "--force"}},
+	{name: "version"},
+	{name: "completion"},
+}
+
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// Flags which don't take a value
+var booleanFlags = map[string]bool{"--force": true, "--once": true, "--exclude-anomalies": true, "--enum-names": true, "--graphql": true, "--active": true, "--prune": true, "--replica": true, "--from-replica": true, "--dry-run": true}
+
+// topLevelCommands returns each command name once, and the subcommands of commands which have them.
+func topLevelCommands() ([]string, map[string][]string) {
+	var commands []string
+	subcommands := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, c := range cliCommands {
+		command, subcommand, _ := strings.Cut(c.name, " ")
+		if !seen[command] {
+			seen[command] = true
+			commands = append(commands, command)
+		}
+		if subcommand != "" {
+			subcommands[command] = append(subcommands[command], subcommand)
+		}
+	}
+	subcommands["completion"] = completionShells
+	return commands, subcommands
+}
+
+func writeBashCompletion(w io.Writer) {
+	commands, subcommands := topLevelCommands()
+	fmt.Fprintln(w, "# bash completion for gtfs-scraper")
+	fmt.Fprintln(w, "_gtfs_scraper() {")
+	fmt.Fprintln(w, `	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"`)
+	fmt.Fprintln(w, "	if [[ $COMP_CWORD -eq 1 ]]; then")
+	fmt.Fprintf(w, "		COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(commands, " "))
+	fmt.Fprintln(w, "		return")
+	fmt.Fprintln(w, "	fi")
+	fmt.Fprintln(w, "	if [[ $COMP_CWORD -eq 2 ]]; then")
+	fmt.Fprintln(w, `		case "${COMP_WORDS[1]}" in`)
+	for _, command := range commands {
+		if subs, found := subcommands[command]; found {
+			fmt.Fprintf(w, "		%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", command, strings.Join(subs, " "))
+		}
+	}
+	fmt.Fprintln(w, "		esac")
+	fmt.Fprintln(w, "	fi")
+	fmt.Fprintln(w, `	local flags=""`)
+	fmt.Fprintln(w, `	case "${COMP_WORDS[1]} ${COMP_WORDS[2]}" in`)
+	for _, c := range cliCommands {
+		if len(c.flags) == 0 {
+			continue
+		}
+		if strings.Contains(c.name, " ") {
+			fmt.Fprintf(w, "	%q)\n", c.name)
+		} else {
+			fmt.Fprintf(w, "	%q*)\n", c.name+" ")
+		}
+		fmt.Fprintf(w, "		flags=%q\n", strings.Join(c.flags, " "))
+		if len(c.monthFlags) > 0 {
+			fmt.Fprintf(w, "		if [[ \"$prev\" == @(%s) ]]; then\n", strings.Join(c.monthFlags, "|"))
+			fmt.Fprintln(w, `			COMPREPLY=($(compgen -W "$(gtfs-scraper completion months 2>/dev/null)" -- "$cur"))`)
+			fmt.Fprintln(w, "			return")
+			fmt.Fprintln(w, "		fi")
+		}
+		fmt.Fprintln(w, "		;;")
+	}
+	fmt.Fprintln(w, "	esac")
+	fmt.Fprintln(w, `	if [[ "$cur" == -* ]]; then`)
+	fmt.Fprintln(w, `		COMPREPLY=($(compgen -W "$flags" -- "$cur"))`)
+	fmt.Fprintln(w, "	else")
+	fmt.Fprintln(w, `		COMPREPLY=($(compgen -f -- "$cur"))`)
+	fmt.Fprintln(w, "	fi")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "shopt -s extglob")
+	fmt.Fprintln(w, "complete -o filenames -F _gtfs_scraper gtfs-scraper")
+}
+
+func writeZshCompletion(w io.Writer) {
+	// zsh can run bash completion functions, which keeps the two in step
+	fmt.Fprintln(w, "# zsh completion for gtfs-scraper")
+	fmt.Fprintln(w, "autoload -U +X bashcompinit && bashcompinit")
+	writeBashCompletion(w)
+}
+
+func writeFishCompletion(w io.Writer) {
+	commands, subcommands := topLevelCommands()
+	fmt.Fprintln(w, "# fish completion for gtfs-scraper")
+	fmt.Fprintln(w, "complete -c gtfs-scraper -f")
+	fmt.Fprintf(w, "complete -c gtfs-scraper -n __fish_use_subcommand -a %q\n", strings.Join(commands, " "))
+	for _, command := range commands {
+		if subs, found := subcommands[command]; found {
+			fmt.Fprintf(w, "complete -c gtfs-scraper -n \"__fish_seen_subcommand_from %s; and not __fish_seen_subcommand_from %s\" -a %q\n",
+				command, strings.Join(subs, " "), strings.Join(subs, " "))
+		}
+	}
+	for _, c := range cliCommands {
+		words := strings.Fields(c.name)
+		condition := "__fish_seen_subcommand_from " + words[len(words)-1]
+		months := make(map[string]bool)
+		for _, flag := range c.monthFlags {
+			months[flag] = true
+		}
+		for _, flag := range c.flags {
+			name := strings.TrimPrefix(flag, "--")
+			if months[flag] {
+				fmt.Fprintf(w, "complete -c gtfs-scraper -n %q -l %s -x -a \"(gtfs-scraper completion months 2>/dev/null)\"\n", condition, name)
+			} else if booleanFlags[flag] {
+				fmt.Fprintf(w, "complete -c gtfs-scraper -n %q -l %s\n", condition, name)
+			} else {
+				fmt.Fprintf(w, "complete -c gtfs-scraper -n %q -l %s -r -F\n", condition, name)
+			}
+		}
+	}
+	for _, command := range []string{"archive", "db", "decrypt", "verify"} {
+		fmt.Fprintf(w, "complete -c gtfs-scraper -n \"__fish_seen_subcommand_from %s\" -F\n", command)
+	}
+}
+
+// writeCompletion prints the completion script for a shell.
+func writeCompletion(shell string) error {
+	switch shell {
+	case "bash":
+		writeBashCompletion(os.Stdout)
+	case "zsh":
+		writeZshCompletion(os.Stdout)
+	case "fish":
+		writeFishCompletion(os.Stdout)
+	default:
+		return fmt.Errorf("unsupported shell %q, expected one of %s", shell, strings.Join(completionShells, ", "))
+	}
+	return nil
+}
+
+// printArchivedMonths lists the archived months for completing month flags.
+func printArchivedMonths(config Config) error {
+	months, err := archivedMonths(feedArchiveDir(config))
+	if err != nil {
+		return err
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i].After(months[j]) })
+	for _, month := range months {
+		fmt.Println(month.Format(yearMonthLayout))
+	}
+	return nil
+}
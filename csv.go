@@ -0,0 +1,104 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// csvColumn returns a formatter for the values of a flat Parquet column.
+// Timestamps are written as RFC 3339 in UTC so spreadsheets and R can parse them.
+func csvColumn(node parquet.Node) func(parquet.Value) string {
+	lt := node.Type().LogicalType()
+	switch node.Type().Kind() {
+	case parquet.Boolean:
+		return func(v parquet.Value) string { return strconv.FormatBool(v.Boolean()) }
+	case parquet.Int32:
+		if lt != nil && lt.Integer != nil && !lt.Integer.IsSigned {
+			return func(v parquet.Value) string { return strconv.FormatUint(uint64(v.Uint32()), 10) }
+		}
+		return func(v parquet.Value) string { return strconv.FormatInt(int64(v.Int32()), 10) }
+	case parquet.Int64:
+		if lt != nil && lt.Timestamp != nil {
+			return func(v parquet.Value) string { return timestampOf(v, node).Format(time.RFC3339Nano) }
+		}
+		return func(v parquet.Value) string { return strconv.FormatInt(v.Int64(), 10) }
+	case parquet.Int96:
+		return func(v parquet.Value) string { return int96Time(v.Int96()).Format(time.RFC3339Nano) }
+	case parquet.Float:
+		return func(v parquet.Value) string { return strconv.FormatFloat(float64(v.Float()), 'g', -1, 32) }
+	case parquet.Double:
+		return func(v parquet.Value) string { return strconv.FormatFloat(v.Double(), 'g', -1, 64) }
+	}
+	return func(v parquet.Value) string { return string(v.ByteArray()) }
+}
+
+// csvGzipLevel maps the archive compression settings to a gzip level.
+func csvGzipLevel(config ArchiveConfig) (int, error) {
+	switch config.Compression {
+	case "", "gzip":
+		if config.CompressionLevel == 0 {
+			return gzip.DefaultCompression, nil
+		}
+		return config.CompressionLevel, nil
+	}
+	return 0, fmt.Errorf("compression codec %q isn't supported for csv.gz archives", config.Compression)
+}
+
+// csvWriter writes archive rows as gzipped CSV with a header row.
+// Missing values are written as empty fields.
+type csvWriter struct {
+	gzip    *gzip.Writer
+	writer  *csv.Writer
+	formats []func(parquet.Value) string
+	record  []string
+}
+
+func newCSVWriter(w io.Writer, schema *archiveSchema, config ArchiveConfig) (*csvWriter, error) {
+	level, err := csvGzipLevel(config)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	c := &csvWriter{gzip: gz, writer: csv.NewWriter(gz)}
+	var header []string
+	for _, node := range schema.schema.Fields() {
+		header = append(header, node.Name())
+		c.formats = append(c.formats, csvColumn(node))
+	}
+	c.record = make([]string, len(header))
+	return c, c.writer.Write(header)
+}
+
+func (c *csvWriter) WriteRows(rows []parquet.Row) (int, error) {
+	for i, row := range rows {
+		for j := range c.record {
+			c.record[j] = ""
+		}
+		for _, v := range row {
+			if !v.IsNull() {
+				c.record[v.Column()] = c.formats[v.Column()](v)
+			}
+		}
+		if err := c.writer.Write(c.record); err != nil {
+			return i, err
+		}
+	}
+	return len(rows), nil
+}
+
+func (c *csvWriter) Close() error {
+	c.writer.Flush()
+	if err := c.writer.Error(); err != nil {
+		return err
+	}
+	return c.gzip.Close()
+}
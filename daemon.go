@@ -0,0 +1,377 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DaemonConfig sets what the daemon command polls and how often.
+type DaemonConfig struct {
+	// IntervalSeconds between the starts of poll cycles, defaulting to 30. A cycle overrunning it delays the next
+	// rather than overlapping it.
+	IntervalSeconds int
+	// JitterSeconds delays each cycle by a random amount up to this many seconds, so scrapers started together or
+	// on round times don't poll agency servers in step. Defaults to a tenth of the interval, and a negative value disables it.
+	JitterSeconds int
+	// Feeds are polled in order each cycle, from "vehicleupdates" (the default), "tripupdates" and "alerts".
+	Feeds []string
+	// ArchiveAfterRows archives a feed once polls have inserted this many of its rows since its last archive,
+	// as the archive command would. Zero disables it.
+	ArchiveAfterRows int
+	// ArchiveAfterHours archives a feed once this many hours have passed since its last archive, going by the
+	// archive manifest, so a quiet feed is still archived. Zero disables it.
+	ArchiveAfterHours int
+	// ArchiveAt archives each feed daily at this time ("HH:MM") in its TimeZone, e.g. "03:30" while few vehicles run.
+	// A daemon started later in the day archives a feed not archived since the last such time straight away.
+	ArchiveAt string
+	// Admin serves an API for pausing feeds, polling and archiving on demand and changing the log level.
+	Admin AdminConfig
+}
+
+const defaultDaemonInterval = 30 * time.Second
+
+var daemonFeeds = []string{"vehicleupdates", "tripupdates", "alerts"}
+
+// daemonRun polls one feed's feed types through its database's one connection.
+type daemonRun struct {
+	config Config
+	db     *sqlx.DB
+	zones  []geofence
+	static *staticGTFS
+	// Stop times for the delays pushed by RemoteWrite
+	remoteStatic *staticGTFS
+	archive      *daemonArchive
+
+	// Guards what the admin API reads and changes while polls run
+	mu     sync.Mutex
+	paused bool
+	polls  map[string]*pollStatus
+}
+
+func (d *daemonRun) setPaused(paused bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.paused = paused
+}
+
+func (d *daemonRun) isPaused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused
+}
+
+func (d *daemonRun) status() daemonFeedStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := daemonFeedStatus{FeedId: d.config.FeedId, Paused: d.paused, Polls: make(map[string]*pollStatus, len(d.polls))}
+	for feed, poll := range d.polls {
+		copied := *poll
+		status.Polls[feed] = &copied
+	}
+	return status
+}
+
+// poll runs one feed's poll as its one-shot command would, logging a failure so later polls still run, and returns it.
+// Metrics and failure notifications are sent under the feed's command, so they match scheduled one-shot runs.
+func (d *daemonRun) poll(feed string) error {
+	config := d.config.withLogAttrs("command", feed)
+	runStats = runMetrics{}
+	start := time.Now()
+	var failure error
+	switch feed {
+	case "alerts":
+		failure = pollAlerts(d.db, config)
+	case "tripupdates":
+		failure = pollTripUpdates(d.db, config, d.static)
+	case "vehicleupdates":
+		failure = pollVehiclePositions(d.db, config, d.zones, d.remoteStatic)
+	}
+	pushRunMetrics(config.Pushgateway, config.FeedId, feed, start, failure == nil, runStats)
+	if d.archive != nil {
+		d.archive.rows += runStats.rowsInserted
+	}
+	if failure != nil {
+		config.log().Error("Poll failed", "after", time.Since(start).Round(time.Millisecond), "err", failure)
+		if err := reportFailure(config, feed, failure); err != nil {
+			config.log().Error("Failed to report the failure", "err", err)
+		}
+	}
+	runStats = runMetrics{}
+
+	status := &pollStatus{Polled: start.UTC()}
+	if failure != nil {
+		status.Error = failure.Error()
+	}
+	d.mu.Lock()
+	if d.polls == nil {
+		d.polls = make(map[string]*pollStatus)
+	}
+	d.polls[feed] = status
+	d.mu.Unlock()
+	return failure
+}
+
+// daemonArchive archives one feed when enough has been inserted into it, enough time has passed,
+// or at its daily time.
+type daemonArchive struct {
+	config Config
+	db     *sqlx.DB
+	dir    string
+	rows   int
+	last   time.Time
+	// With ArchiveAt, the time of day to archive at in location
+	daily        bool
+	hour, minute int
+	location     *time.Location
+}
+
+func newDaemonArchive(config Config, db *sqlx.DB) *daemonArchive {
+	a := &daemonArchive{config: config, db: db, dir: feedArchiveDir(config), last: time.Now()}
+	if manifest, _, err := readManifest(a.dir); err == nil {
+		a.last = manifest.Updated
+	}
+	if config.Daemon.ArchiveAt != "" {
+		// Both were checked when the daemon started
+		at, _ := time.Parse("15:04", config.Daemon.ArchiveAt)
+		a.location, _ = time.LoadLocation(config.TimeZone)
+		a.daily, a.hour, a.minute = true, at.Hour(), at.Minute()
+	}
+	return a
+}
+
+// lastScheduled is the latest daily archive time up to now, by the clock so it stays put when daylight saving changes.
+func (a *daemonArchive) lastScheduled(now time.Time) time.Time {
+	local := now.In(a.location)
+	scheduled := time.Date(local.Year(), local.Month(), local.Day(), a.hour, a.minute, 0, 0, a.location)
+	if scheduled.After(now) {
+		scheduled = time.Date(local.Year(), local.Month(), local.Day()-1, a.hour, a.minute, 0, 0, a.location)
+	}
+	return scheduled
+}
+
+// due tests whether either threshold has been reached, or the daily time has passed since the last archive.
+func (a *daemonArchive) due(now time.Time) bool {
+	rows, hours := a.config.Daemon.ArchiveAfterRows, a.config.Daemon.ArchiveAfterHours
+	return rows > 0 && a.rows >= rows || hours > 0 && now.Sub(a.last) >= time.Duration(hours)*time.Hour ||
+		a.daily && a.last.Before(a.lastScheduled(now))
+}
+
+// run archives the feed, reporting the outcome under the archive command like a scheduled archive.
+// Failed archives are retried after the next poll, as the thresholds are only reset by a successful one.
+func (a *daemonArchive) run() error {
+	config := a.config.withLogAttrs("command", "archive")
+	runStats = runMetrics{}
+	start := time.Now()
+	config.log().Info("Archiving", "new_rows", a.rows, "since", start.Sub(a.last).Round(time.Minute))
+	failure := archivePartitions(a.db, a.dir, config.Archive, provenanceOf(config))
+	pushRunMetrics(config.Pushgateway, config.FeedId, "archive", start, failure == nil, runStats)
+	if failure != nil {
+		config.log().Error("Archive failed", "after", time.Since(start).Round(time.Millisecond), "err", failure)
+		if err := reportFailure(config, "archive", failure); err != nil {
+			config.log().Error("Failed to report the failure", "err", err)
+		}
+	} else {
+		a.rows, a.last = 0, time.Now()
+	}
+	runStats = runMetrics{}
+	return failure
+}
+
+// jitter picks a random delay up to limit.
+func jitter(limit time.Duration) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// daemon polls the configured feed types of each feed every interval until interrupted, finishing the poll in progress
+// before exiting. A second interrupt exits straight away.
+// Geofences and the static GTFS for nearest stops are loaded once at startup, so restart it after the static command.
+// With Replication set, each database is replicated by the daemon too.
+// With archive thresholds or a daily time set, each feed is archived between cycles once it reaches one, into its own
+// archive even when feeds share a database.
+// With an admin address set, feeds can be paused, polled and archived and the log level changed while it runs.
+func daemon(configs []Config, args []string) error {
+	// Daemon settings aren't per feed, so every feed has the same
+	config := configs[0]
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	interval := flags.Duration("interval", 0, "time between poll cycles, overriding Daemon.IntervalSeconds")
+	maxJitter := flags.Duration("jitter", -1, "maximum random delay of each cycle, overriding Daemon.JitterSeconds")
+	feedList := flags.String("feeds", "", "comma-separated feeds to poll, overriding Daemon.Feeds")
+	adminAddr := flags.String("admin", config.Daemon.Admin.Listen, "address or unix:socket path of the admin API, overriding Daemon.Admin.Listen")
+	flags.Parse(args)
+
+	if *interval == 0 {
+		*interval = time.Duration(config.Daemon.IntervalSeconds) * time.Second
+	}
+	if *interval == 0 {
+		*interval = defaultDaemonInterval
+	}
+	if *interval < time.Second {
+		return fmt.Errorf("the interval must be at least a second, got %s", *interval)
+	}
+	if *maxJitter < 0 {
+		switch {
+		case config.Daemon.JitterSeconds > 0:
+			*maxJitter = time.Duration(config.Daemon.JitterSeconds) * time.Second
+		case config.Daemon.JitterSeconds == 0:
+			*maxJitter = *interval / 10
+		default:
+			*maxJitter = 0
+		}
+	}
+	feeds := config.Daemon.Feeds
+	if *feedList != "" {
+		feeds = strings.Split(*feedList, ",")
+	}
+	if len(feeds) == 0 {
+		feeds = []string{"vehicleupdates"}
+	}
+	for _, feed := range feeds {
+		if !contains(daemonFeeds, feed) {
+			return fmt.Errorf("%w: can't poll %q, expected some of %s", ErrConfig, feed, strings.Join(daemonFeeds, ", "))
+		}
+	}
+	if config.Daemon.ArchiveAfterRows < 0 || config.Daemon.ArchiveAfterHours < 0 {
+		return fmt.Errorf("%w: Daemon.ArchiveAfterRows and ArchiveAfterHours can't be negative", ErrConfig)
+	}
+
+	// Feeds sharing a data directory share its database
+	dbs := make(map[string]*sqlx.DB)
+	if config.Daemon.ArchiveAt != "" {
+		if _, err := time.Parse("15:04", config.Daemon.ArchiveAt); err != nil {
+			return fmt.Errorf("%w: Daemon.ArchiveAt must be a time of day such as 03:30, got %q", ErrConfig, config.Daemon.ArchiveAt)
+		}
+		for _, c := range configs {
+			if _, err := time.LoadLocation(c.TimeZone); err != nil {
+				return fmt.Errorf("%w: feed %s: %w", ErrConfig, c.FeedId, err)
+			}
+		}
+	}
+	archiving := config.Daemon.ArchiveAfterRows > 0 || config.Daemon.ArchiveAfterHours > 0 || config.Daemon.ArchiveAt != ""
+	defer func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+	}()
+	runs := make([]*daemonRun, len(configs))
+	for i, c := range configs {
+		// Each feed's messages carry its feed ID, and those of its polls and archives their command too
+		runs[i] = &daemonRun{config: c.withLogAttrs("feed", c.FeedId), db: dbs[c.DataDir]}
+		if contains(feeds, "vehicleupdates") {
+			zones, err := setupVehiclePolling(c)
+			if err != nil {
+				return fmt.Errorf("feed %s: %w", c.FeedId, err)
+			}
+			runs[i].zones = zones
+			if runs[i].remoteStatic, err = setupRemoteWrite(c); err != nil {
+				return fmt.Errorf("feed %s: %w", c.FeedId, err)
+			}
+		}
+		if contains(feeds, "tripupdates") {
+			static, err := setupTripUpdatePolling(c)
+			if err != nil {
+				return fmt.Errorf("feed %s: %w", c.FeedId, err)
+			}
+			runs[i].static = static
+		}
+		if runs[i].db == nil {
+			db, err := setupDatabase(c.DataDir, c.FeedId)
+			if err != nil {
+				return fmt.Errorf("feed %s: %w", c.FeedId, err)
+			}
+			runs[i].db = db
+			// Polls run one at a time, so one connection is enough and saves reopening the database every cycle
+			runs[i].db.SetMaxOpenConns(1)
+			dbs[c.DataDir] = runs[i].db
+		}
+		if archiving {
+			runs[i].archive = newDaemonArchive(runs[i].config, runs[i].db)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(runContext, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// Restores the default handling, so a second signal exits without waiting for the poll
+		stop()
+	}()
+	// Each database is replicated alongside polling, and shipped one last time on the way out
+	if config.Replication.enabled() {
+		var replicators sync.WaitGroup
+		defer replicators.Wait()
+		for dataDir := range dbs {
+			r, err := newReplicator(config.Replication, filepath.Join(dataDir, "realtime.db"))
+			if err != nil {
+				return err
+			}
+			replicators.Add(1)
+			go func() {
+				defer replicators.Done()
+				r.run(ctx)
+			}()
+		}
+	}
+
+	admin := &daemonAdmin{runs: runs, feeds: feeds, requests: make(chan adminRequest)}
+	if *adminAddr != "" {
+		adminConfig := config.Daemon.Admin
+		adminConfig.Listen = *adminAddr
+		stopAdmin, err := serveAdmin(ctx, adminConfig, admin)
+		if err != nil {
+			return err
+		}
+		defer stopAdmin()
+	}
+
+	feedIds := make([]string, len(runs))
+	for i, d := range runs {
+		feedIds[i] = d.config.FeedId
+	}
+	slog.Info("Polling", "feeds", strings.Join(feedIds, ", "), "feed_types", strings.Join(feeds, ", "), "interval", *interval, "max_jitter", *maxJitter)
+	timer := time.NewTimer(jitter(*maxJitter))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case request := <-admin.requests:
+			// The timer keeps running, so requests don't delay the next cycle
+			request.result <- request.do()
+			continue
+		case <-ctx.Done():
+			slog.Info("Stopping")
+			return nil
+		}
+		cycleStart := time.Now()
+		for _, d := range runs {
+			for _, feed := range feeds {
+				if ctx.Err() == nil && !d.isPaused() && (len(runs) == 1 || hasURLFor(d.config, feed)) {
+					d.poll(feed)
+				}
+			}
+			// Batched notifications go out with whichever cycle comes after the batch interval
+			if err := flushNotifications(d.config); err != nil {
+				d.config.log().Error("Failed to send notifications", "err", err)
+			}
+		}
+		for _, d := range runs {
+			if ctx.Err() == nil && d.archive != nil && d.archive.due(time.Now()) {
+				d.archive.run()
+			}
+		}
+		timer.Reset(max(0, *interval-time.Since(cycleStart)) + jitter(*maxJitter))
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDaemonArchiveDue(t *testing.T) {
+	vancouver, err := time.LoadLocation("America/Vancouver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day, hour, minute int) time.Time { return time.Date(2024, 3, day, hour, minute, 0, 0, vancouver) }
+	tests := []struct {
+		name   string
+		daemon DaemonConfig
+		rows   int
+		last   time.Time
+		now    time.Time
+		want   bool
+	}{
+		{"no thresholds", DaemonConfig{}, 1000, at(1, 0, 0), at(30, 0, 0), false},
+		{"below rows", DaemonConfig{ArchiveAfterRows: 100}, 99, at(1, 0, 0), at(30, 0, 0), false},
+		{"reached rows", DaemonConfig{ArchiveAfterRows: 100}, 100, at(1, 0, 0), at(1, 0, 0), true},
+		{"below hours", DaemonConfig{ArchiveAfterHours: 6}, 0, at(1, 0, 0), at(1, 5, 59), false},
+		{"reached hours", DaemonConfig{ArchiveAfterHours: 6}, 0, at(1, 0, 0), at(1, 6, 0), true},
+		{"before the daily time", DaemonConfig{ArchiveAt: "03:30"}, 0, at(1, 4, 0), at(2, 3, 29), false},
+		{"at the daily time", DaemonConfig{ArchiveAt: "03:30"}, 0, at(1, 4, 0), at(2, 3, 30), true},
+		{"already archived today", DaemonConfig{ArchiveAt: "03:30"}, 0, at(2, 3, 31), at(2, 23, 0), false},
+		// A daemon started after the daily time catches up on the day it missed
+		{"missed yesterday", DaemonConfig{ArchiveAt: "03:30"}, 0, at(1, 3, 0), at(2, 1, 0), true},
+		// Daylight saving time starts on 10 March, so this day is 23 hours long
+		{"across daylight saving", DaemonConfig{ArchiveAt: "03:30"}, 0, at(9, 3, 31), at(10, 3, 29), false},
+		{"after daylight saving", DaemonConfig{ArchiveAt: "03:30"}, 0, at(9, 3, 31), at(10, 3, 30), true},
+	}
+	for _, test := range tests {
+		a := newDaemonArchive(Config{TimeZone: "America/Vancouver", Daemon: test.daemon}, nil)
+		a.rows, a.last = test.rows, test.last
+		if got := a.due(test.now); got != test.want {
+			t.Errorf("%s: due is %t, want %t", test.name, got, test.want)
+		}
+	}
+}
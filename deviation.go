@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DeviationEvent is a run of consecutive positions from one trip which were off the trip's shape.
+type DeviationEvent struct {
+	VehicleId string    `parquet:"vehicle_id"`
+	TripId    string    `parquet:"trip_id"`
+	RouteId   string    `parquet:"route_id"`
+	ShapeId   string    `parquet:"shape_id"`
+	Start     time.Time `parquet:"start,timestamp(millisecond)"`
+	End       time.Time `parquet:"end,timestamp(millisecond)"`
+	// From the first to the last position off the shape
+	DurationSeconds float64 `parquet:"duration_seconds"`
+	Samples         int64   `parquet:"samples"`
+	MaxOffsetMeters float64 `parquet:"max_offset_m"`
+	// Where the vehicle was furthest from the shape
+	MaxOffsetLatitude  float32 `parquet:"max_offset_lat"`
+	MaxOffsetLongitude float32 `parquet:"max_offset_lon"`
+}
+
+// analyzeDeviations flags positions further than a threshold from their trip's shape, grouping consecutive ones
+// into events to find unannounced detours and bad trip assignments.
+func analyzeDeviations(config Config, args []string) error {
+	flags := flag.NewFlagSet("analyze deviations", flag.ExitOnError)
+	input := addAnalysisFlags(flags, config)
+	staticFile := flags.String("static", "", "static GTFS zip (default: the latest download in the static directory)")
+	output := flags.String("output", filepath.Join(config.DataDir, "deviations.csv"), "output file, as Parquet if it ends in .parquet and CSV otherwise")
+	threshold := flags.Float64("threshold", 100, "distance from the shape in meters beyond which a position deviates")
+	minSamples := flags.Int("min-samples", 2, "minimum consecutive positions off the shape for an event, to ignore single GPS errors")
+	gap := flags.Duration("gap", 5*time.Minute, "positions further apart than this end an event")
+	flags.Parse(args)
+
+	if *threshold <= 0 {
+		return fmt.Errorf("invalid --threshold: %v", *threshold)
+	}
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+	if *staticFile == "" {
+		if *staticFile, err = latestStaticFile(feedStaticDir(config)); err != nil {
+			return err
+		}
+	}
+	static, err := loadStaticGTFS(*staticFile, "trips.txt", "shapes.txt")
+	if err != nil {
+		return err
+	}
+
+	lines := make(map[string]*shapeLine)
+	open := make(map[tripInstance]*DeviationEvent)
+	var events []DeviationEvent
+	finish := func(instance tripInstance) {
+		if event := open[instance]; event != nil && event.Samples >= int64(*minSamples) {
+			event.DurationSeconds = event.End.Sub(event.Start).Seconds()
+			events = append(events, *event)
+		}
+		delete(open, instance)
+	}
+	var unmatched int
+	err = input.forEachPosition(config, location, func(vp *VehiclePosition) {
+		if vp.Latitude == nil || vp.Longitude == nil {
+			return
+		}
+		trip, found := static.trips[vp.TripId]
+		if !found || len(static.shapes[trip.ShapeId]) < 2 {
+			unmatched++
+			return
+		}
+		line, found := lines[trip.ShapeId]
+		if !found {
+			line = newShapeLine(static.shapes[trip.ShapeId])
+			lines[trip.ShapeId] = line
+		}
+
+		instance := tripInstance{vp.VehicleId, vp.TripId, vp.StartTimeUnix}
+		_, offset := line.project(float64(*vp.Latitude), float64(*vp.Longitude))
+		event := open[instance]
+		if event != nil && vp.Timestamp.Sub(event.End) > *gap {
+			finish(instance)
+			event = nil
+		}
+		if offset <= *threshold {
+			finish(instance)
+			return
+		}
+		if event == nil {
+			event = &DeviationEvent{
+				VehicleId: vp.VehicleId,
+				TripId:    vp.TripId,
+				RouteId:   trip.RouteId,
+				ShapeId:   trip.ShapeId,
+				Start:     vp.Timestamp,
+			}
+			open[instance] = event
+		}
+		event.End = vp.Timestamp
+		event.Samples++
+		if offset > event.MaxOffsetMeters {
+			event.MaxOffsetMeters = offset
+			event.MaxOffsetLatitude, event.MaxOffsetLongitude = *vp.Latitude, *vp.Longitude
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for instance := range open {
+		finish(instance)
+	}
+	if unmatched > 0 {
+		config.log().Warn("Skipped positions without a trip shape in the static GTFS", "positions", unmatched)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].Start.Equal(events[j].Start) {
+			return events[i].Start.Before(events[j].Start)
+		}
+		return events[i].VehicleId < events[j].VehicleId
+	})
+	return writeAnalysis(*output, events)
+}
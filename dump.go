@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+// entityTripIds lists the trips an entity is about, including those an alert informs.
+func entityTripIds(entity *gtfs.FeedEntity) []string {
+	var ids []string
+	if id := entity.GetVehicle().GetTrip().GetTripId(); id != "" {
+		ids = append(ids, id)
+	}
+	if id := entity.GetTripUpdate().GetTrip().GetTripId(); id != "" {
+		ids = append(ids, id)
+	}
+	for _, informed := range entity.GetAlert().GetInformedEntity() {
+		if id := informed.GetTrip().GetTripId(); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// readFeedFile parses a FeedMessage saved to a file, or from standard input for "-".
+func readFeedFile(path string) (*gtfs.FeedMessage, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Raw snapshots are gzipped
+	if strings.HasSuffix(path, ".gz") {
+		if data, err = gunzipBytes(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	feed := &gtfs.FeedMessage{}
+	if err := proto.Unmarshal(data, feed); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return feed, nil
+}
+
+// dump fetches a feed, or reads one from a file, and prints it as JSON or Protobuf text for debugging,
+// optionally only the entities with an ID or about a trip. Nothing is stored.
+func dump(config Config, args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	feedType := flags.String("type", "vehicleupdates", "feed type to fetch: vehicleupdates, tripupdates or alerts")
+	file := flags.String("file", "", "read the feed from this file, gzipped if it ends in .gz like raw snapshots, or - for standard input, instead of fetching it")
+	entityId := flags.String("entity", "", "only print the entity with this ID")
+	tripId := flags.String("trip", "", "only print entities about this trip")
+	format := flags.String("format", "json", "output format: json or text")
+	flags.Parse(args)
+
+	var feed *gtfs.FeedMessage
+	var err error
+	if *file != "" {
+		feed, err = readFeedFile(*file)
+	} else {
+		if !contains(daemonFeeds, *feedType) {
+			return fmt.Errorf("invalid --type %q, expected one of %s", *feedType, strings.Join(daemonFeeds, ", "))
+		}
+		urls := realtimeURLs(config, *feedType)
+		if len(urls) == 0 {
+			return fmt.Errorf("no %s URL configured", *feedType)
+		}
+		feed, _, err = extractFeeds(urls, config.FeedRequest, config.Auth, config.FeedId, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	total := len(feed.Entity)
+	if *entityId != "" || *tripId != "" {
+		var entities []*gtfs.FeedEntity
+		for _, entity := range feed.Entity {
+			if (*entityId == "" || entity.GetId() == *entityId) && (*tripId == "" || contains(entityTripIds(entity), *tripId)) {
+				entities = append(entities, entity)
+			}
+		}
+		feed.Entity = entities
+	}
+
+	var out []byte
+	switch *format {
+	case "json":
+		out, err = protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(feed)
+	case "text":
+		out, err = prototext.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(feed)
+	default:
+		return errors.New("--format must be json or text")
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stdout.Write(append(out, '\n')); err != nil {
+		return err
+	}
+	config.log().Info("Printed entities", "printed", len(feed.Entity), "entities", total)
+	return nil
+}
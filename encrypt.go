@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+type EncryptionConfig struct {
+	// Recipients are the age public keys (age1...) which archive files are encrypted to.
+	// Encryption is disabled if empty.
+	Recipients []string
+	// Dir receives an encrypted copy of each archive file, in the same layout with an .age suffix,
+	// for upload to remote storage. Defaults to the archive directory with an "-encrypted" suffix.
+	Dir string
+	// IdentityFile holds the age private keys used by the decrypt command.
+	IdentityFile string
+}
+
+const encryptedSuffix = ".age"
+
+// encryptor writes encrypted copies of archive files into a mirror of the archive directory.
+type encryptor struct {
+	archiveDir string
+	dir        string
+	recipients []age.Recipient
+	logger     *slog.Logger
+}
+
+// newEncryptor returns nil if encryption isn't configured. Encrypted files are logged through logger.
+func newEncryptor(archiveDir string, config EncryptionConfig, logger *slog.Logger) (*encryptor, error) {
+	if len(config.Recipients) == 0 {
+		return nil, nil
+	}
+	recipients, err := age.ParseRecipients(strings.NewReader(strings.Join(config.Recipients, "\n")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption recipients: %w", err)
+	}
+	dir := config.Dir
+	if dir == "" {
+		dir = filepath.Clean(archiveDir) + "-encrypted"
+	}
+	return &encryptor{archiveDir: archiveDir, dir: dir, recipients: recipients, logger: logger}, nil
+}
+
+// encryptFile writes an encrypted copy of a file from the archive directory.
+func (e *encryptor) encryptFile(path string) (err error) {
+	rel, err := filepath.Rel(e.archiveDir, path)
+	if err != nil {
+		return err
+	}
+	destPath := filepath.Join(e.dir, rel) + encryptedSuffix
+	if err = os.MkdirAll(filepath.Dir(destPath), 0775); err != nil {
+		return err
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stagingPath := destPath + ".tmp"
+	dest, err := os.Create(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dest.Close()
+			os.Remove(stagingPath)
+		}
+	}()
+	w, err := age.Encrypt(dest, e.recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, src); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	if err = dest.Close(); err != nil {
+		return err
+	}
+	e.logger.Debug("Encrypted archive file", "path", path, "to", destPath)
+	return os.Rename(stagingPath, destPath)
+}
+
+// decryptFile decrypts a file with the identities in the configured identity file.
+// The output defaults to the input path without its .age suffix.
+func decryptFile(config EncryptionConfig, args []string) (err error) {
+	if len(args) < 1 {
+		return errors.New("missing file to decrypt")
+	}
+	path := args[0]
+	output := strings.TrimSuffix(path, encryptedSuffix)
+	if len(args) > 1 {
+		output = args[1]
+	} else if output == path {
+		return fmt.Errorf("%s has no %s suffix, give an output path", path, encryptedSuffix)
+	}
+	if config.IdentityFile == "" {
+		return errors.New("no IdentityFile configured for decryption")
+	}
+
+	identityFile, err := os.Open(config.IdentityFile)
+	if err != nil {
+		return err
+	}
+	defer identityFile.Close()
+	identities, err := age.ParseIdentities(identityFile)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	r, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return err
+	}
+	stagingPath := output + ".tmp"
+	dest, err := os.Create(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dest.Close()
+			os.Remove(stagingPath)
+		}
+	}()
+	if _, err = io.Copy(dest, r); err != nil {
+		return err
+	}
+	if err = dest.Close(); err != nil {
+		return err
+	}
+	return os.Rename(stagingPath, output)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func writeIdentity(t *testing.T, dir string, name string) (*age.X25519Identity, string) {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return identity, path
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	dir := t.TempDir()
+	archiveDir := filepath.Join(dir, "archive")
+	path := filepath.Join(archiveDir, "year=2024", "month=03", "vehicle_positions.parquet")
+	contents := []byte("archived positions")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	recipient, identityFile := writeIdentity(t, dir, "key.txt")
+	_, otherIdentityFile := writeIdentity(t, dir, "other-key.txt")
+
+	e, err := newEncryptor(archiveDir, EncryptionConfig{Recipients: []string{recipient.Recipient().String()}}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.encryptFile(path); err != nil {
+		t.Fatal(err)
+	}
+	encryptedPath := filepath.Join(dir, "archive-encrypted", "year=2024", "month=03", "vehicle_positions.parquet.age")
+	encrypted, err := os.ReadFile(encryptedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, contents) {
+		t.Fatal("the encrypted copy contains the file's contents")
+	}
+
+	t.Run("identity", func(t *testing.T) {
+		output := filepath.Join(t.TempDir(), "vehicle_positions.parquet")
+		if err := decryptFile(EncryptionConfig{IdentityFile: identityFile}, []string{encryptedPath, output}); err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, contents) {
+			t.Errorf("decrypted %q, want %q", decrypted, contents)
+		}
+	})
+	t.Run("wrong identity", func(t *testing.T) {
+		output := filepath.Join(t.TempDir(), "vehicle_positions.parquet")
+		err := decryptFile(EncryptionConfig{IdentityFile: otherIdentityFile}, []string{encryptedPath, output})
+		var noMatch *age.NoIdentityMatchError
+		if !errors.As(err, &noMatch) {
+			t.Fatalf("decrypted with another identity: %v", err)
+		}
+		if _, err := os.Stat(output); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("wrote output despite failing: %v", err)
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/jmoiron/sqlx"
+	"github.com/parquet-go/parquet-go"
+)
+
+// VehicleDescriptor.WheelchairAccessible, which postdates the bindings
+var wheelchairAccessibleName = map[int32]string{
+	0: "NO_VALUE",
+	1: "UNKNOWN",
+	2: "WHEELCHAIR_ACCESSIBLE",
+	3: "WHEELCHAIR_INACCESSIBLE",
+}
+
+// Names of the values of vehicle position columns holding GTFS-RT enums
+var positionEnumNames = map[string]map[int32]string{
+	"schedule_relationship": gtfs.TripDescriptor_ScheduleRelationship_name,
+	"current_status":        gtfs.VehiclePosition_VehicleStopStatus_name,
+	"congestion_level":      gtfs.VehiclePosition_CongestionLevel_name,
+	"occupancy_status":      gtfs.VehiclePosition_OccupancyStatus_name,
+	"wheelchair_accessible": wheelchairAccessibleName,
+}
+
+// Names of the values of the other GTFS-RT enums, by the column they're stored in
+var otherEnumNames = map[string]map[int32]string{
+	"cause":                           gtfs.Alert_Cause_name,
+	"effect":                          gtfs.Alert_Effect_name,
+	"severity_level":                  gtfs.Alert_SeverityLevel_name,
+	"stop_time_schedule_relationship": gtfs.TripUpdate_StopTimeUpdate_ScheduleRelationship_name,
+	"incrementality":                  gtfs.FeedHeader_Incrementality_name,
+}
+
+// EnumValue is a row of the enum lookup table, which decodes the integer enum columns in SQL joins.
+type EnumValue struct {
+	// Enum is the name of the column holding the enum
+	Enum string `db:"enum" parquet:"enum,dict" json:"enum"`
+	Code int32  `db:"code" parquet:"code" json:"code"`
+	Name string `db:"name" parquet:"name" json:"name"`
+}
+
+var enumValueColumns = []ColumnInfo{
+	{Name: "enum", Type: "TEXT NOT NULL"},
+	{Name: "code", Type: "INTEGER NOT NULL"},
+	{Name: "name", Type: "TEXT NOT NULL"},
+}
+
+func createEnumValuesTableQuery() string {
+	return createTableIfNotExistsQuery("enum_values", enumValueColumns, "enum, code")
+}
+
+// Archive directory holding the enum lookup table. Query engines skip paths starting with an underscore
+// when reading the partitions, and the directory can be registered as a table of its own.
+const (
+	enumValuesDirName  = "_enums"
+	enumValuesFileName = "enum_values.parquet"
+)
+
+// enumValues lists the values of every GTFS-RT enum, ordered by enum and code.
+func enumValues() []EnumValue {
+	var values []EnumValue
+	for _, enums := range []map[string]map[int32]string{positionEnumNames, otherEnumNames} {
+		for enum, names := range enums {
+			for code, name := range names {
+				values = append(values, EnumValue{Enum: enum, Code: code, Name: name})
+			}
+		}
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Enum != values[j].Enum {
+			return values[i].Enum < values[j].Enum
+		}
+		return values[i].Code < values[j].Code
+	})
+	return values
+}
+
+// addEnumValues fills in the enum lookup table, keeping any existing rows.
+func addEnumValues(db *sqlx.DB) error {
+	ctx, cancel := dbContext()
+	defer cancel()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := insertIntoQuery("enum_values", enumValueColumns)
+	for _, value := range enumValues() {
+		if _, err := tx.NamedExecContext(ctx, query, value); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// writeEnumValues writes the enum lookup table to the archive, unless it's already up to date.
+func writeEnumValues(archiveDir string) error {
+	var contents bytes.Buffer
+	if err := parquet.Write(&contents, enumValues()); err != nil {
+		return err
+	}
+	dir := filepath.Join(archiveDir, enumValuesDirName)
+	path := filepath.Join(dir, enumValuesFileName)
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, contents.Bytes()) {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, contents.Bytes())
+}
+
+// enumName returns the name of an enum value, or the number itself if the value isn't known.
+func enumName(names map[int32]string, value int32) string {
+	if name, found := names[value]; found {
+		return name
+	}
+	return strconv.Itoa(int(value))
+}
+
+// enumField is a string column replacing an enum column.
+type enumField struct {
+	parquet.Node
+	field parquet.Field
+}
+
+func (f enumField) Name() string { return f.field.Name() }
+
+func (f enumField) Value(base reflect.Value) reflect.Value { return f.field.Value(base) }
+
+// enumNameConverter renders the enum columns of archive rows as the names of their values,
+// for consumers who'd rather not look up the codes.
+type enumNameConverter struct {
+	schema *parquet.Schema
+	// For each output column, the names of its values, or nil if it isn't an enum
+	names []map[int32]string
+}
+
+func newEnumNameConverter(a *archiveSchema) *enumNameConverter {
+	fields := a.schema.Fields()
+	c := &enumNameConverter{names: make([]map[int32]string, len(fields))}
+	for i, name := range a.sourceNames() {
+		c.names[i] = positionEnumNames[name]
+	}
+	outputFields := make([]parquet.Field, len(fields))
+	for i, field := range fields {
+		outputFields[i] = field
+		if c.names[i] != nil {
+			node := parquet.Optional(parquet.Encoded(parquet.String(), &parquet.RLEDictionary))
+			outputFields[i] = enumField{Node: node, field: field}
+		}
+	}
+	c.schema = parquet.NewSchema(a.schema.Name(), orderedGroup{Node: a.schema, fields: outputFields})
+	return c
+}
+
+// convert replaces the enum values of a row in place.
+func (c *enumNameConverter) convert(row parquet.Row) parquet.Row {
+	for i, v := range row {
+		names := c.names[v.Column()]
+		if names == nil || v.IsNull() {
+			continue
+		}
+		name := parquet.ByteArrayValue([]byte(enumName(names, v.Int32())))
+		row[i] = name.Level(v.RepetitionLevel(), v.DefinitionLevel(), v.Column())
+	}
+	return row
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Kinds of errors which programs embedding the scraper can branch on with errors.Is.
+var (
+	// ErrFeedUnavailable means a realtime feed couldn't be retrieved or parsed. Polling again later may succeed.
+	ErrFeedUnavailable = errors.New("feed unavailable")
+	// ErrSchemaMismatch means an existing archive file lacks columns the archive schema needs.
+	ErrSchemaMismatch = errors.New("schema mismatch")
+	// ErrPartitionCorrupt means an archived partition can't be read, or doesn't match the archive manifest.
+	ErrPartitionCorrupt = errors.New("partition corrupt")
+	// ErrConfig means the config is unreadable or has an invalid setting.
+	ErrConfig = errors.New("invalid config")
+	// ErrLocked means another process holds the lock on what a command writes. Running again later may succeed.
+	ErrLocked = errors.New("locked")
+)
+
+// Exit codes of the command line for each kind of failure, so schedulers and scripts can tell them apart.
+// Invalid flags exit with exitUsage too, as the flag package does.
+const (
+	exitFailure         = 1
+	exitUsage           = 2
+	exitConfig          = 3
+	exitFeedUnavailable = 4
+	// The archive is corrupt or doesn't match the archive schema
+	exitArchive = 5
+	exitLocked  = 6
+	// SQLite failed, e.g. with a full disk or a corrupt database
+	exitDatabase = 7
+)
+
+// exitCode picks the exit code for a failed command. An error of several kinds, e.g. from several feeds,
+// exits with the lowest code of its kinds.
+func exitCode(err error) int {
+	var sqliteErr sqlite3.Error
+	switch {
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, ErrConfig):
+		return exitConfig
+	case errors.Is(err, ErrFeedUnavailable):
+		return exitFeedUnavailable
+	case errors.Is(err, ErrPartitionCorrupt), errors.Is(err, ErrSchemaMismatch):
+		return exitArchive
+	case errors.Is(err, ErrLocked):
+		return exitLocked
+	case errors.As(err, &sqliteErr), errors.Is(err, errColumnEncoding):
+		return exitDatabase
+	}
+	return exitFailure
+}
+
+// errUsage means a command was given a missing or invalid argument.
+var errUsage = errors.New("invalid usage")
+
+// errColumnEncoding means a value couldn't be encoded for its database column, so it fails like a SQLite error.
+var errColumnEncoding = errors.New("can't encode column")
+
+// usageError describes a missing or invalid argument. It matches errUsage.
+func usageError(format string, args ...any) error {
+	return fmt.Errorf("%w: "+format, append([]any{errUsage}, args...)...)
+}
+
+// FeedError is returned when a request for a feed fails. It matches ErrFeedUnavailable.
+type FeedError struct {
+	URL string
+	// StatusCode is the HTTP status of the response, or 0 if there was none.
+	StatusCode int
+	Err        error
+}
+
+func (e *FeedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FeedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FeedError) Is(target error) bool {
+	return target == ErrFeedUnavailable
+}
+
+// LockError is returned when another process holds a lock. It matches ErrLocked.
+type LockError struct {
+	Path string
+	Err  error
+}
+
+func (e *LockError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LockError) Unwrap() error {
+	return e.Err
+}
+
+func (e *LockError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// PartitionError is returned when an archived partition file is unreadable or altered. It matches ErrPartitionCorrupt.
+type PartitionError struct {
+	Path string
+	Err  error
+}
+
+func (e *PartitionError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *PartitionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PartitionError) Is(target error) bool {
+	return target == ErrPartitionCorrupt
+}
+
+// openParquetFile opens an archived Parquet file, reporting an invalid file as a PartitionError
+// rather than panicking as parquet.NewReader does.
+func openParquetFile(f *os.File) (*parquet.File, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	file, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		return nil, &PartitionError{Path: f.Name(), Err: err}
+	}
+	return file, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestExitCode(t *testing.T) {
+	var column *string
+	encodingErr := jsonColumn(&column, "image", []float64{math.NaN()})
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{errors.New("anything"), exitFailure},
+		{fmt.Errorf("flag: %w", errUsage), exitUsage},
+		{fmt.Errorf("%w: TimeZone", ErrConfig), exitConfig},
+		{sqlite3.Error{Code: sqlite3.ErrFull}, exitDatabase},
+		{fmt.Errorf("alert 1: %w", encodingErr), exitDatabase},
+		// The lowest code of several failures wins
+		{errors.Join(fmt.Errorf("a: %w", ErrLocked), fmt.Errorf("b: %w", ErrFeedUnavailable)), exitFeedUnavailable},
+	}
+	for _, test := range tests {
+		if got := exitCode(test.err); got != test.want {
+			t.Errorf("%v: exit code %d, want %d", test.err, got, test.want)
+		}
+	}
+}
+
+func TestJSONColumn(t *testing.T) {
+	var column *string
+	if err := jsonColumn(&column, "url", []translation{{Text: "https://example.com", Language: "en"}}); err != nil || column == nil {
+		t.Fatalf("got %v, %v", column, err)
+	}
+	if err := jsonColumn(&column, "url", []translation(nil)); err != nil || column != nil {
+		t.Errorf("empty field: got %v, %v, want NULL", column, err)
+	}
+	if err := jsonColumn(&column, "image", []float64{math.Inf(1)}); !errors.Is(err, errColumnEncoding) {
+		t.Errorf("unencodable field: got %v, want errColumnEncoding", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/parquet-go/parquet-go"
+)
+
+// monthDir returns the directory of a monthly partition within an archive.
+func monthDir(archiveDir string, period time.Time) string {
+	return filepath.Join(archiveDir, fmt.Sprintf("year=%04d", period.Year()), fmt.Sprintf("month=%02d", int(period.Month())))
+}
+
+// archivedMonths lists the months which have a partition in the archive, in order.
+func archivedMonths(archiveDir string) ([]time.Time, error) {
+	dirs, err := filepath.Glob(filepath.Join(archiveDir, "year=*", "month=*"))
+	if err != nil {
+		return nil, err
+	}
+	var months []time.Time
+	for _, dir := range dirs {
+		var year, month int
+		_, err := fmt.Sscanf(filepath.Base(filepath.Dir(dir))+filepath.Base(dir), "year=%04dmonth=%02d", &year, &month)
+		if err != nil {
+			continue
+		}
+		months = append(months, time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC))
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i].Before(months[j]) })
+	return months, nil
+}
+
+// exportRange finds the first and last months with data in either the archive or the database.
+func exportRange(db *sqlx.DB, archiveDir string, config ArchiveConfig) (startMonth time.Time, endMonth time.Time, err error) {
+	startMonth, endMonth, err = findArchiveRange(db, config)
+	if err != nil {
+		return
+	}
+	months, err := archivedMonths(archiveDir)
+	if err != nil || len(months) == 0 {
+		return
+	}
+	if startMonth.IsZero() || months[0].Before(startMonth) {
+		startMonth = months[0]
+	}
+	if last := months[len(months)-1]; last.After(endMonth) {
+		endMonth = last
+	}
+	return startMonth, endMonth, nil
+}
+
+// positionKey identifies an archived position, by its archive series and time, or its content hash with Dedup "hash".
+type positionKey struct {
+	series    string
+	timestamp int64
+	hash      uint64
+}
+
+// readSnapshotMonth combines the archived rows for a month with rows in the database which haven't been archived yet.
+func readSnapshotMonth(db *sqlx.DB, archiveDir string, config ArchiveConfig, period time.Time, schema *archiveSchema) ([]parquet.Row, error) {
+	var rows []parquet.Row
+	if _, err := os.Stat(monthDir(archiveDir, period)); err == nil {
+		rows, err = readArchivedMonth(monthDir(archiveDir, period), schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+	archived := make(map[positionKey]bool, len(rows))
+	for _, row := range rows {
+		archived[schema.archivedKey(row)] = true
+	}
+
+	positions, err := queryPartition(db, config, period, partitionStart(config, period), false)
+	if err != nil {
+		return nil, err
+	}
+	defer positions.Close()
+	var vp VehiclePosition
+	for positions.Next() {
+		if err := scanPartitionRow(positions, &vp, period); err != nil {
+			return nil, err
+		}
+		if vp.VehicleId == "" {
+			continue
+		}
+		row := schema.row(&vp)
+		if archived[schema.archivedKey(row)] {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, positions.Err()
+}
+
+// exportSnapshot writes the whole dataset, i.e. every archived month plus rows not yet archived,
+// to a single Parquet file sorted by timestamp and vehicle.
+// Only one month is held in memory at a time.
+func exportSnapshot(config Config, args []string) (err error) {
+	flags := flag.NewFlagSet("export snapshot", flag.ExitOnError)
+	dbPath := flags.String("db", filepath.Join(config.DataDir, "realtime.db"), "realtime database")
+	archiveDir := flags.String("archive", feedArchiveDir(config), "archive directory")
+	output := flags.String("output", filepath.Join(config.DataDir, "snapshot.parquet"), "output file")
+	enumNames := flags.Bool("enum-names", false, "write enum columns as the names of their values instead of codes")
+	flags.Parse(args)
+
+	db, err := openDatabase(*dbPath, config.FeedId)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	a, err := newArchiver(db, *archiveDir, config.Archive, provenanceOf(config))
+	if err != nil {
+		return err
+	}
+	schema := a.schema
+	startMonth, endMonth, err := exportRange(db, *archiveDir, config.Archive)
+	if err != nil {
+		return err
+	} else if startMonth.IsZero() {
+		return errors.New("no data to export")
+	}
+
+	stagingPath := *output + ".tmp"
+	f, err := os.Create(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(stagingPath)
+		}
+	}()
+	sortingColumns := []parquet.SortingColumn{parquet.Ascending(schema.timestampName), parquet.Ascending(schema.vehicleIdName)}
+	outputSchema := schema.schema
+	var enums *enumNameConverter
+	if *enumNames {
+		enums = newEnumNameConverter(schema)
+		outputSchema = enums.schema
+	}
+	writer := parquet.NewWriter(f, outputSchema, a.writerConfig, parquet.SortingWriterConfig(parquet.SortingColumns(sortingColumns...)))
+	compare := schema.schema.Comparator(sortingColumns...)
+
+	var total int
+	var timestamps timestampRange
+	for period := startMonth; !period.After(endMonth); period = period.AddDate(0, 1, 0) {
+		rows, err := readSnapshotMonth(db, *archiveDir, config.Archive, period, schema)
+		if err != nil {
+			return err
+		}
+		sort.Slice(rows, func(i, j int) bool { return compare(rows[i], rows[j]) < 0 })
+		for _, row := range rows {
+			_, timestamp := schema.rowKey(row)
+			timestamps.add(timestamp)
+			if enums != nil {
+				enums.convert(row)
+			}
+		}
+		if _, err := writer.WriteRows(rows); err != nil {
+			return err
+		}
+		total += len(rows)
+		config.log().Debug("Exported a month", "month", period.Format(yearMonthLayout), "rows", len(rows))
+	}
+	setContentMetadata(writer, int64(total), timestamps)
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	config.log().Info("Exported rows", "rows", total, "output", *output)
+	return os.Rename(stagingPath, *output)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// FeedAuthConfig sends an agency's credentials with every request for its feeds, static and realtime, for feeds
+// needing an API key. Values are text/templates with an env function like FeedRequest.Body, so keys can be kept out
+// of the config, e.g. {"x-api-key": "{{env \"MTA_API_KEY\"}}"}.
+type FeedAuthConfig struct {
+	// Headers are set on each request.
+	Headers map[string]string
+	// BearerToken is sent as "Authorization: Bearer <token>".
+	BearerToken string
+	// Query parameters are added to each URL, e.g. {"api_key": "..."}. They're left out of logs and feed_fetches.
+	Query map[string]string
+}
+
+// merge returns the settings of a feed in Feeds over those shared by the config.
+func (auth FeedAuthConfig) merge(feed FeedAuthConfig) FeedAuthConfig {
+	merged := FeedAuthConfig{BearerToken: auth.BearerToken, Headers: make(map[string]string), Query: make(map[string]string)}
+	for _, m := range []FeedAuthConfig{auth, feed} {
+		for name, value := range m.Headers {
+			merged.Headers[name] = value
+		}
+		for name, value := range m.Query {
+			merged.Query[name] = value
+		}
+	}
+	if feed.BearerToken != "" {
+		merged.BearerToken = feed.BearerToken
+	}
+	return merged
+}
+
+// expandSecret executes a credential template.
+func expandSecret(value string) (string, error) {
+	tmpl, err := template.New("secret").Option("missingkey=error").Funcs(template.FuncMap{"env": os.Getenv}).Parse(value)
+	if err != nil {
+		return "", err
+	}
+	var expanded strings.Builder
+	if err := tmpl.Execute(&expanded, nil); err != nil {
+		return "", err
+	}
+	return expanded.String(), nil
+}
+
+// authorize adds a feed's credentials to a request.
+func authorize(req *http.Request, auth FeedAuthConfig) error {
+	for name, value := range auth.Headers {
+		expanded, err := expandSecret(value)
+		if err != nil {
+			return fmt.Errorf("invalid Auth header %s: %w", name, err)
+		}
+		req.Header.Set(name, expanded)
+	}
+	if auth.BearerToken != "" {
+		token, err := expandSecret(auth.BearerToken)
+		if err != nil {
+			return fmt.Errorf("invalid Auth.BearerToken: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if len(auth.Query) > 0 {
+		query := req.URL.Query()
+		for name, value := range auth.Query {
+			expanded, err := expandSecret(value)
+			if err != nil {
+				return fmt.Errorf("invalid Auth query parameter %s: %w", name, err)
+			}
+			query.Set(name, expanded)
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	return nil
+}
+
+// setupFeedAuth checks the feeds' credentials, which can't be combined with OAuth2 or SigV4 authorization.
+func setupFeedAuth(config Config, configs []Config) error {
+	for _, c := range configs {
+		if c.Auth.BearerToken != "" && (config.OAuth2.TokenURL != "" || config.AWSSigV4.Region != "") {
+			return errors.New("Auth.BearerToken can't be used with OAuth2 or AWSSigV4")
+		}
+		req, err := http.NewRequest(http.MethodGet, "http://localhost/", nil)
+		if err != nil {
+			return err
+		}
+		if err := authorize(req, c.Auth); err != nil {
+			return fmt.Errorf("feed %s: %w", c.FeedId, err)
+		}
+	}
+	return nil
+}
+
+// withoutQuery is a URL for logs, leaving out query parameters which may be credentials.
+func withoutQuery(u *url.URL) string {
+	redacted := *u
+	redacted.RawQuery = ""
+	return redacted.Redacted()
+}
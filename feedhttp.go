@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sync/singleflight"
+)
+
+// HTTPConfig tunes the client shared by every feed request, static and realtime.
+type HTTPConfig struct {
+	// AcceptEncoding is offered to feed servers and the responses decoded, defaulting to "zstd, br, gzip".
+	// "identity" asks for uncompressed responses, for servers which mishandle the others.
+	AcceptEncoding string
+	// MaxRequestsPerHost caps the feed requests in flight to each host, defaulting to 4.
+	MaxRequestsPerHost int
+	// CacheSeconds reuses a successful realtime feed response for identical requests within this many seconds,
+	// so feed types sharing one URL fetch it once per poll cycle. Defaults to 5, and a negative value disables it.
+	CacheSeconds int
+	// TimeoutSeconds bounds each realtime feed request, including its retries and reading the response,
+	// defaulting to 30, so a hung server can't stall polling.
+	TimeoutSeconds int
+	// StaticTimeoutSeconds bounds each static GTFS download, defaulting to 600.
+	StaticTimeoutSeconds int
+	// Retries is how many times a request failing with a network error or a 5xx status is retried, defaulting to 2.
+	// A negative value disables retries.
+	Retries int
+	// RetryBackoffMilliseconds is the wait before the first retry, doubling for each one after, defaulting to 500.
+	// Waits are jittered by up to half their length.
+	RetryBackoffMilliseconds int
+	// RetryBudgetPercent caps the retries to each host at this percentage of the requests to it, defaulting to 20,
+	// so a struggling server isn't sent several times its usual load. Up to Retries retries are saved up.
+	RetryBudgetPercent int
+	// RefetchUnchanged stores every poll in full. By default, realtime feed requests are conditional on the ETag and
+	// Last-Modified of the version stored last, and a feed answered with 304 Not Modified or with the same header
+	// timestamp isn't stored again.
+	RefetchUnchanged bool
+}
+
+const (
+	defaultAcceptEncoding     = "zstd, br, gzip"
+	defaultMaxRequestsPerHost = 4
+	defaultCacheSeconds       = 5
+	defaultFeedTimeout        = 30 * time.Second
+	defaultStaticTimeout      = 10 * time.Minute
+	defaultRetries            = 2
+	defaultRetryBackoff       = 500 * time.Millisecond
+	defaultRetryBudgetPercent = 20
+	// Error bodies up to this size are read before retrying, so the connection can be reused
+	maxRetryDrainBytes = 64 << 10
+)
+
+var (
+	// feedTimeout bounds each realtime feed request, and staticTimeout each static GTFS download.
+	feedTimeout   = defaultFeedTimeout
+	staticTimeout = defaultStaticTimeout
+)
+
+// encodingTransport negotiates compressed responses and decodes them, so callers always read the plain body.
+// Go's transport only does this for gzip.
+type encodingTransport struct {
+	base           http.RoundTripper
+	acceptEncoding string
+}
+
+func (t *encodingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Accept-Encoding") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", t.acceptEncoding)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	var body io.ReadCloser
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return resp, nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("decoding gzip response: %w", err)
+		}
+		body = r
+	case "br":
+		body = io.NopCloser(brotli.NewReader(resp.Body))
+	case "zstd":
+		r, err := zstd.NewReader(resp.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("decoding zstd response: %w", err)
+		}
+		body = r.IOReadCloser()
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+	resp.Body = &decodedBody{Reader: body, decoder: body, raw: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+// decodedBody closes both the decoder and the response body it reads.
+type decodedBody struct {
+	io.Reader
+	decoder io.Closer
+	raw     io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	b.decoder.Close()
+	return b.raw.Close()
+}
+
+// hostLimitTransport caps the requests in flight to each host, holding a slot until the response body is closed.
+type hostLimitTransport struct {
+	base  http.RoundTripper
+	limit int
+
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func (t *hostLimitTransport) slot(host string) chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slot, found := t.slots[host]
+	if !found {
+		slot = make(chan struct{}, t.limit)
+		t.slots[host] = slot
+	}
+	return slot
+}
+
+func (t *hostLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	slot := t.slot(req.URL.Host)
+	select {
+	case slot <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		<-slot
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { <-slot }}
+	return resp, nil
+}
+
+// retryTransport retries requests failing with a network error or a 5xx status, with exponential backoff,
+// while the host's retry budget allows. Each request adds a fraction of a retry to the budget.
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+	backoff time.Duration
+	// Retries earned by each request
+	rate float64
+
+	mu      sync.Mutex
+	budgets map[string]float64
+}
+
+// withdraw takes a retry from a host's budget, or reports that it's spent.
+func (t *retryTransport) withdraw(host string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.budgets[host] < 1 {
+		return false
+	}
+	t.budgets[host]--
+	return true
+}
+
+func (t *retryTransport) deposit(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	budget, found := t.budgets[host]
+	if !found {
+		budget = float64(t.retries)
+	}
+	t.budgets[host] = math.Min(budget+t.rate, float64(t.retries))
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	t.deposit(host)
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		retryable := err != nil && req.Context().Err() == nil || err == nil && resp.StatusCode >= 500
+		if !retryable || attempt == t.retries || req.Body != nil && req.GetBody == nil {
+			return resp, err
+		}
+		if !t.withdraw(host) {
+			slog.Warn("Not retrying, as the host's retry budget is spent", "url", withoutQuery(req.URL), "host", host)
+			return resp, err
+		}
+		if err == nil {
+			err = errors.New(resp.Status)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxRetryDrainBytes))
+			resp.Body.Close()
+		}
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		slog.Warn("Retrying", "url", withoutQuery(req.URL), "wait", wait.Round(time.Millisecond), "err", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// cacheableKey marks requests whose responses the cache may share, which are only realtime feed requests,
+// so that static GTFS downloads are streamed rather than held in memory.
+type cacheableKey struct{}
+
+// cacheable marks a feed request as safe to answer from the response cache.
+func cacheable(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), cacheableKey{}, true))
+}
+
+type cachedResponse struct {
+	status     string
+	statusCode int
+	header     http.Header
+	body       []byte
+	fetched    time.Time
+}
+
+// cacheTransport answers identical GET requests for realtime feeds from one response for a short time,
+// and makes concurrent identical requests share one fetch.
+type cacheTransport struct {
+	base http.RoundTripper
+	ttl  time.Duration
+
+	group   singleflight.Group
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+func (t *cacheTransport) lookup(key string, now time.Time) *cachedResponse {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, found := t.entries[key]
+	if found && now.Sub(entry.fetched) >= t.ttl {
+		delete(t.entries, key)
+		return nil
+	}
+	return entry
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Context().Value(cacheableKey{}) == nil {
+		return t.base.RoundTrip(req)
+	}
+	// GET feed requests differ only in their URL and validators, as credentials are the same for every request to a host.
+	// A 304 response to a conditional request mustn't answer another without the same validators.
+	key := req.URL.String() + "\n" + req.Header.Get("If-None-Match") + "\n" + req.Header.Get("If-Modified-Since")
+	if entry := t.lookup(key, time.Now()); entry != nil {
+		return entry.response(req), nil
+	}
+	result, err, _ := t.group.Do(key, func() (any, error) {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body := io.Reader(resp.Body)
+		if maxFeedBytes > 0 {
+			// The caller rejects feeds past the limit, so there's no need to hold more
+			body = io.LimitReader(resp.Body, maxFeedBytes+1)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		entry := &cachedResponse{status: resp.Status, statusCode: resp.StatusCode, header: resp.Header, body: data, fetched: time.Now()}
+		if resp.StatusCode == http.StatusOK {
+			t.mu.Lock()
+			t.entries[key] = entry
+			t.mu.Unlock()
+		}
+		return entry, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*cachedResponse).response(req), nil
+}
+
+// response makes a copy of a cached response for one request.
+func (c *cachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        c.status,
+		StatusCode:    c.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        c.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(c.body)),
+		ContentLength: int64(len(c.body)),
+		Request:       req,
+	}
+}
+
+// setupHTTP wraps the rate limited feed client with the per-host concurrency caps, encoding negotiation, retries and
+// then the response cache, so a cached response takes neither a rate limit token nor a slot, and each retry takes both.
+// Authentication wraps the result, and is added before the cache is consulted.
+func setupHTTP(config HTTPConfig) error {
+	if config.MaxRequestsPerHost < 0 {
+		return fmt.Errorf("HTTP.MaxRequestsPerHost must be positive, not %d", config.MaxRequestsPerHost)
+	}
+	acceptEncoding := config.AcceptEncoding
+	if acceptEncoding == "" {
+		acceptEncoding = defaultAcceptEncoding
+	}
+	if config.TimeoutSeconds > 0 {
+		feedTimeout = time.Duration(config.TimeoutSeconds) * time.Second
+	}
+	if config.StaticTimeoutSeconds > 0 {
+		staticTimeout = time.Duration(config.StaticTimeoutSeconds) * time.Second
+	}
+	limit := config.MaxRequestsPerHost
+	if limit == 0 {
+		limit = defaultMaxRequestsPerHost
+	}
+	base := feedClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	var t http.RoundTripper = &hostLimitTransport{base: base, limit: limit, slots: make(map[string]chan struct{})}
+	t = &encodingTransport{base: t, acceptEncoding: acceptEncoding}
+	retries := config.Retries
+	if retries == 0 {
+		retries = defaultRetries
+	}
+	if retries > 0 {
+		backoff := time.Duration(config.RetryBackoffMilliseconds) * time.Millisecond
+		if backoff <= 0 {
+			backoff = defaultRetryBackoff
+		}
+		budgetPercent := config.RetryBudgetPercent
+		if budgetPercent <= 0 {
+			budgetPercent = defaultRetryBudgetPercent
+		}
+		t = &retryTransport{base: t, retries: retries, backoff: backoff, rate: float64(budgetPercent) / 100, budgets: make(map[string]float64)}
+	}
+	cacheSeconds := config.CacheSeconds
+	if cacheSeconds == 0 {
+		cacheSeconds = defaultCacheSeconds
+	}
+	if cacheSeconds > 0 {
+		t = &cacheTransport{base: t, ttl: time.Duration(cacheSeconds) * time.Second, entries: make(map[string]*cachedResponse)}
+	}
+	feedClient = &http.Client{Transport: t}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// FeedRequestConfig customizes the requests for realtime feeds, for vendor endpoints which only return GTFS-RT
+// in response to a POST with a token or a SOAP envelope.
+type FeedRequestConfig struct {
+	// Method defaults to GET, or POST if there's a Body.
+	Method string
+	// Body is a text/template executed with .FeedId, .URL and .Now, and an env function for reading secrets
+	// from the environment, e.g. {"token": "{{env "FEED_TOKEN"}}"}.
+	Body string
+	// ContentType of the body, e.g. "text/xml; charset=utf-8" or "application/soap+xml; action=..."
+	ContentType string
+}
+
+type feedRequestData struct {
+	FeedId string
+	URL    string
+	Now    time.Time
+}
+
+// newFeedRequest builds the request for a realtime feed.
+func newFeedRequest(feedURL string, config FeedRequestConfig, feedId string) (*http.Request, error) {
+	method := strings.ToUpper(config.Method)
+	if method == "" {
+		method = http.MethodGet
+		if config.Body != "" {
+			method = http.MethodPost
+		}
+	}
+	if config.Body == "" {
+		return http.NewRequest(method, feedURL, nil)
+	}
+
+	tmpl, err := template.New("body").Option("missingkey=error").Funcs(template.FuncMap{"env": os.Getenv}).Parse(config.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid feed request body: %w", err)
+	}
+	var body strings.Builder
+	if err := tmpl.Execute(&body, feedRequestData{FeedId: feedId, URL: feedURL, Now: time.Now()}); err != nil {
+		return nil, fmt.Errorf("invalid feed request body: %w", err)
+	}
+	req, err := http.NewRequest(method, feedURL, strings.NewReader(body.String()))
+	if err != nil {
+		return nil, err
+	}
+	if config.ContentType != "" {
+		req.Header.Set("Content-Type", config.ContentType)
+	}
+	return req, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// FeedConfig is one of several feeds collected by one scraper, e.g. from neighbouring agencies.
+// Every other setting, such as the archive and notifications, is shared by the feeds.
+type FeedConfig struct {
+	// FeedId is stored in feed_id to tell the feeds' rows apart, and must be unique.
+	FeedId string
+	// AgencyId is stored in agency_id, e.g. the agency_id of the agency in its static GTFS.
+	AgencyId           string
+	StaticURL          string
+	AlertsURL          string
+	TripUpdatesURL     string
+	VehicleUpdatesURL  string
+	AlertsURLs         []string
+	TripUpdatesURLs    []string
+	VehicleUpdatesURLs []string
+	// Auth is added to the config's Auth, replacing any of its headers, query parameters or token set again here.
+	Auth FeedAuthConfig
+	// TimeZone defaults to the config's.
+	TimeZone string
+	// VehicleLabels replaces the config's rules for the feed's labels or license plates, for each it sets rules for.
+	VehicleLabels VehicleLabelsConfig
+	// DataDir defaults to the config's, where the feeds share a database, or DataDir/<FeedId> with IsolateFeedData.
+	DataDir string
+}
+
+// Commands which run for every feed of a config unless --feed picks one. Others need --feed with several feeds.
+var everyFeedCommands = map[string]bool{"static": true, "alerts": true, "tripupdates": true, "vehicleupdates": true, "daemon": true}
+
+// feedConfigs expands a config into one per feed, each as if it were the only feed in the config.
+// A config without Feeds is its own only feed.
+func feedConfigs(config Config) ([]Config, error) {
+	if len(config.Feeds) == 0 {
+		return []Config{config}, nil
+	}
+	configs := make([]Config, 0, len(config.Feeds))
+	seen := make(map[string]bool)
+	for _, feed := range config.Feeds {
+		if feed.FeedId == "" {
+			return nil, errors.New("every feed in Feeds needs a FeedId")
+		}
+		if seen[feed.FeedId] {
+			return nil, fmt.Errorf("FeedId %q is in Feeds more than once", feed.FeedId)
+		}
+		seen[feed.FeedId] = true
+
+		c := config
+		c.Feeds = nil
+		c.listed = true
+		c.Archive.feedId = feed.FeedId
+		c.FeedId = feed.FeedId
+		c.AgencyId = feed.AgencyId
+		c.StaticURL = feed.StaticURL
+		c.AlertsURL, c.AlertsURLs = feed.AlertsURL, feed.AlertsURLs
+		c.TripUpdatesURL, c.TripUpdatesURLs = feed.TripUpdatesURL, feed.TripUpdatesURLs
+		c.VehicleUpdatesURL, c.VehicleUpdatesURLs = feed.VehicleUpdatesURL, feed.VehicleUpdatesURLs
+		c.Auth = config.Auth.merge(feed.Auth)
+		if feed.TimeZone != "" {
+			c.TimeZone = feed.TimeZone
+		}
+		if len(feed.VehicleLabels.Label) > 0 {
+			c.VehicleLabels.Label = feed.VehicleLabels.Label
+		}
+		if len(feed.VehicleLabels.LicensePlate) > 0 {
+			c.VehicleLabels.LicensePlate = feed.VehicleLabels.LicensePlate
+		}
+		if feed.DataDir != "" {
+			c.DataDir = feed.DataDir
+		} else if config.IsolateFeedData {
+			c.DataDir = filepath.Join(config.DataDir, feed.FeedId)
+		}
+		configs = append(configs, c)
+	}
+	return configs, nil
+}
+
+// feedStaticDir is where a feed's static GTFS is downloaded. Feeds listed in Feeds each have static/<FeedId>,
+// as feeds sharing a data directory would otherwise all use whichever agency's schedule was downloaded last.
+func feedStaticDir(config Config) string {
+	if config.listed {
+		return filepath.Join(config.DataDir, "static", config.FeedId)
+	}
+	return filepath.Join(config.DataDir, "static")
+}
+
+// feedArchiveDir is where a feed is archived. Feeds listed in Feeds are partitioned into archive/feed_id=<FeedId>,
+// each with its own manifest and provenance, like the hive-style partitions of months within them.
+func feedArchiveDir(config Config) string {
+	if config.listed {
+		return filepath.Join(config.DataDir, "archive", "feed_id="+url.PathEscape(config.FeedId))
+	}
+	return filepath.Join(config.DataDir, "archive")
+}
+
+// feedShardDir is where a feed keeps the compressed SQLite shards of pruned months, in shards/<FeedId> for feeds
+// listed in Feeds like their static GTFS.
+func feedShardDir(config Config) string {
+	if config.listed {
+		return filepath.Join(config.DataDir, "shards", config.FeedId)
+	}
+	return filepath.Join(config.DataDir, "shards")
+}
+
+// selectFeeds picks the feeds a command runs for: the one named by feedId if set, or else every feed.
+func selectFeeds(config Config, feedId string, command string) ([]Config, error) {
+	configs, err := feedConfigs(config)
+	if err != nil {
+		return nil, err
+	}
+	if feedId != "" {
+		for _, c := range configs {
+			if c.FeedId == feedId {
+				return []Config{c}, nil
+			}
+		}
+		return nil, fmt.Errorf("no feed %q in the config", feedId)
+	}
+	if len(configs) > 1 && !everyFeedCommands[command] {
+		ids := make([]string, len(configs))
+		for i, c := range configs {
+			ids[i] = c.FeedId
+		}
+		return nil, fmt.Errorf("the config has several feeds, pick one of %s with --feed", strings.Join(ids, ", "))
+	}
+	return configs, nil
+}
+
+// realtimeURLs lists the endpoints of a feed type, named after the command polling it.
+func realtimeURLs(config Config, command string) []string {
+	switch command {
+	case "alerts":
+		return feedURLs(config.AlertsURL, config.AlertsURLs)
+	case "tripupdates":
+		return feedURLs(config.TripUpdatesURL, config.TripUpdatesURLs)
+	case "vehicleupdates":
+		return feedURLs(config.VehicleUpdatesURL, config.VehicleUpdatesURLs)
+	}
+	return nil
+}
+
+// hasURLFor tests whether a feed has a URL for what a polling command fetches.
+// Feeds in Feeds without one are skipped by the command, as not every agency publishes every feed type.
+func hasURLFor(config Config, command string) bool {
+	switch command {
+	case "static":
+		return config.StaticURL != ""
+	case "alerts", "tripupdates", "vehicleupdates":
+		return len(realtimeURLs(config, command)) > 0
+	}
+	return true
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// archivedRowCount counts the vehicle positions archived under an archive directory.
+func archivedRowCount(t *testing.T, archiveDir string) int64 {
+	t.Helper()
+	var n int64
+	err := filepath.WalkDir(archiveDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() != "vehicle_positions.parquet" {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		file, err := openParquetFile(f)
+		if err != nil {
+			return err
+		}
+		n += file.NumRows()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestFeedDirs(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		static  []string
+		archive []string
+	}{
+		{
+			name:    "single feed",
+			config:  Config{DataDir: "data", FeedId: "transit"},
+			static:  []string{"data/static"},
+			archive: []string{"data/archive"},
+		},
+		{
+			name:    "shared data directory",
+			config:  Config{DataDir: "data", Feeds: []FeedConfig{{FeedId: "a"}, {FeedId: "b/c"}}},
+			static:  []string{"data/static/a", "data/static/b/c"},
+			archive: []string{"data/archive/feed_id=a", "data/archive/feed_id=b%2Fc"},
+		},
+		{
+			name:    "isolated data directories",
+			config:  Config{DataDir: "data", IsolateFeedData: true, Feeds: []FeedConfig{{FeedId: "a"}, {FeedId: "b", DataDir: "other"}}},
+			static:  []string{"data/a/static/a", "other/static/b"},
+			archive: []string{"data/a/archive/feed_id=a", "other/archive/feed_id=b"},
+		},
+	}
+	for _, test := range tests {
+		configs, err := feedConfigs(test.config)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		for i, c := range configs {
+			if got := filepath.ToSlash(feedStaticDir(c)); got != test.static[i] {
+				t.Errorf("%s: feed %s has static data in %s, want %s", test.name, c.FeedId, got, test.static[i])
+			}
+			if got := filepath.ToSlash(feedArchiveDir(c)); got != test.archive[i] {
+				t.Errorf("%s: feed %s is archived in %s, want %s", test.name, c.FeedId, got, test.archive[i])
+			}
+		}
+	}
+}
+
+func TestArchiveKeepsFeedsApart(t *testing.T) {
+	dataDir := t.TempDir()
+	configs, err := feedConfigs(Config{DataDir: dataDir, Feeds: []FeedConfig{{FeedId: "a"}, {FeedId: "b"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := createDatabase(filepath.Join(dataDir, "realtime.db"), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Feed a has one vehicle and feed b two, at the same times
+	for _, timestamp := range []uint64{1709280000, 1709280030} {
+		if _, err := addVehiclePositions(positionsFeed(timestamp, "trip-1", "bus-1"), db, "a", nil, time.UTC, 0); err != nil {
+			t.Fatal(err)
+		}
+		feed := positionsFeed(timestamp, "trip-1", "bus-1")
+		feed.Entity = append(feed.Entity, positionsFeed(timestamp, "trip-2", "bus-2").Entity...)
+		if _, err := addVehiclePositions(feed, db, "b", nil, time.UTC, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range []int64{2, 4} {
+		c := configs[i]
+		archiveDir := feedArchiveDir(c)
+		if err := archivePartitions(db, archiveDir, c.Archive, provenanceOf(c)); err != nil {
+			t.Fatalf("feed %s: %v", c.FeedId, err)
+		}
+		if n := archivedRowCount(t, archiveDir); n != want {
+			t.Errorf("feed %s: archived %d rows, want %d", c.FeedId, n, want)
+		}
+		start, end, err := findArchiveRange(db, c.Archive)
+		if err != nil || start.IsZero() || !start.Equal(end) {
+			t.Errorf("feed %s: archive range %s to %s (%v), want March 2024", c.FeedId, start, end, err)
+		}
+	}
+	if n := archivedRowCount(t, filepath.Join(dataDir, "archive")); n != 6 {
+		t.Errorf("archived %d rows across feeds, want 6", n)
+	}
+}
+
+func TestFeedConfigs(t *testing.T) {
+	config := Config{DataDir: "data", TimeZone: "America/Vancouver", FeedId: "ignored", Feeds: []FeedConfig{
+		{FeedId: "a", AgencyId: "agency-a", VehicleUpdatesURL: "https://a.example/vehicles"},
+		{FeedId: "b", TimeZone: "America/Edmonton", DataDir: "other"},
+	}}
+	configs, err := feedConfigs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("got %d feeds, want 2", len(configs))
+	}
+	a, b := configs[0], configs[1]
+	if a.FeedId != "a" || a.AgencyId != "agency-a" || a.TimeZone != "America/Vancouver" || a.DataDir != "data" || len(a.Feeds) != 0 {
+		t.Errorf("feed a: got %+v", a)
+	}
+	if b.FeedId != "b" || b.AgencyId != "" || b.TimeZone != "America/Edmonton" || b.DataDir != "other" {
+		t.Errorf("feed b: got %+v", b)
+	}
+	if !hasURLFor(a, "vehicleupdates") || hasURLFor(b, "vehicleupdates") || hasURLFor(a, "alerts") {
+		t.Error("feeds have URLs for other feed types than their own")
+	}
+
+	config.IsolateFeedData = true
+	if configs, err := feedConfigs(config); err != nil || configs[0].DataDir != filepath.Join("data", "a") || configs[1].DataDir != "other" {
+		t.Errorf("isolated data directories: got %v (%v)", configs, err)
+	}
+	for _, feeds := range [][]FeedConfig{{{FeedId: "a"}, {FeedId: ""}}, {{FeedId: "a"}, {FeedId: "a"}}} {
+		if _, err := feedConfigs(Config{Feeds: feeds}); err == nil {
+			t.Errorf("%+v: got no error", feeds)
+		}
+	}
+}
+
+func TestSelectFeeds(t *testing.T) {
+	several := Config{Feeds: []FeedConfig{{FeedId: "a"}, {FeedId: "b"}}}
+	tests := []struct {
+		config  Config
+		feedId  string
+		command string
+		want    []string
+	}{
+		{Config{FeedId: "only"}, "", "archive", []string{"only"}},
+		{several, "", "vehicleupdates", []string{"a", "b"}},
+		{several, "", "daemon", []string{"a", "b"}},
+		{several, "b", "archive", []string{"b"}},
+		// Commands other than polling need a pick of feed
+		{several, "", "archive", nil},
+		{several, "c", "vehicleupdates", nil},
+	}
+	for _, test := range tests {
+		configs, err := selectFeeds(test.config, test.feedId, test.command)
+		var got []string
+		for _, c := range configs {
+			got = append(got, c.FeedId)
+		}
+		if !slices.Equal(got, test.want) || (err == nil) != (test.want != nil) {
+			t.Errorf("%s with --feed %q: got %v (%v), want %v", test.command, test.feedId, got, err, test.want)
+		}
+	}
+}
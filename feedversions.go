@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/jmoiron/sqlx"
+	"google.golang.org/protobuf/proto"
+)
+
+var feedVersionColumns = []ColumnInfo{
+	{Name: "feed_id", Type: "TEXT NOT NULL"},
+	{Name: "feed_type", Type: "TEXT NOT NULL"},
+	{Name: "url", Type: "TEXT NOT NULL"},
+	{Name: "etag", Type: "TEXT"},
+	{Name: "last_modified", Type: "TEXT"},
+	{Name: "header_timestamp", Type: "INTEGER"},
+}
+
+func createFeedVersionsTableQuery() string {
+	return createTableIfNotExistsQuery("feed_versions", feedVersionColumns, "feed_id, feed_type, url")
+}
+
+// FeedVersion identifies the version of a feed URL last stored, so polls can ask for it only if it has changed
+// and skip storing it again if it hasn't. It's kept per feed type, as feed types sharing a URL store it separately.
+type FeedVersion struct {
+	FeedId       string  `db:"feed_id"`
+	FeedType     string  `db:"feed_type"`
+	URL          string  `db:"url"`
+	ETag         *string `db:"etag"`
+	LastModified *string `db:"last_modified"`
+	// The feed header's timestamp, which is unchanged in an unchanged feed even from servers without validators
+	HeaderTimestamp *int64 `db:"header_timestamp"`
+}
+
+// loadFeedVersions returns the versions last stored of a feed type's URLs, by URL.
+func loadFeedVersions(db *sqlx.DB, feedId, feedType string) (map[string]FeedVersion, error) {
+	ctx, cancel := dbContext()
+	defer cancel()
+	var rows []FeedVersion
+	if err := db.SelectContext(ctx, &rows, "SELECT * FROM feed_versions WHERE feed_id = ? AND feed_type = ?", feedId, feedType); err != nil {
+		return nil, err
+	}
+	versions := make(map[string]FeedVersion, len(rows))
+	for _, version := range rows {
+		versions[version.URL] = version
+	}
+	return versions, nil
+}
+
+// saveFeedVersions records the versions of a poll's feeds once they're stored.
+func saveFeedVersions(db *sqlx.DB, feedId, feedType string, fetches []feedFetch) error {
+	ctx, cancel := dbContext()
+	defer cancel()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, fetch := range fetches {
+		version := fetch.version
+		version.FeedId, version.FeedType, version.URL = feedId, feedType, fetch.url
+		if _, err := tx.NamedExecContext(ctx, "INSERT OR REPLACE INTO feed_versions (feed_id, feed_type, url, etag, last_modified, header_timestamp) "+
+			"VALUES (:feed_id, :feed_type, :url, :etag, :last_modified, :header_timestamp)", &version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// unchangedFeed stands in for feeds whose versions are all stored already, with only a header carrying the oldest
+// of their timestamps, so staleness is still reported.
+func unchangedFeed(fetches []feedFetch) *gtfs.FeedMessage {
+	header := &gtfs.FeedHeader{GtfsRealtimeVersion: proto.String("2.0")}
+	for _, fetch := range fetches {
+		if t := fetch.version.HeaderTimestamp; t != nil && (header.Timestamp == nil || uint64(*t) < *header.Timestamp) {
+			header.Timestamp = proto.Uint64(uint64(*t))
+		}
+	}
+	return &gtfs.FeedMessage{Header: header}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// versionedFeedServer serves a feed with an ETag, answering requests for the current version with 304 Not Modified.
+type versionedFeedServer struct {
+	mu          sync.Mutex
+	etag        string
+	data        []byte
+	notModified int
+}
+
+func (s *versionedFeedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Header.Get("If-None-Match") == s.etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	w.Write(s.data)
+}
+
+func (s *versionedFeedServer) publish(t *testing.T, etag string, timestamp uint64, vehicleIds ...string) {
+	t.Helper()
+	data, err := proto.Marshal(positionsFeed(timestamp, "trip-1", vehicleIds...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.etag, s.data = etag, data
+}
+
+func TestPollUnchangedFeed(t *testing.T) {
+	feedServer := &versionedFeedServer{}
+	server := httptest.NewServer(feedServer)
+	defer server.Close()
+	dataDir := t.TempDir()
+	config := Config{DataDir: dataDir, FeedId: "test", TimeZone: "UTC", VehicleUpdatesURL: server.URL + "/vehicles.pb"}
+	db, err := createDatabase(filepath.Join(dataDir, "realtime.db"), config.FeedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	feedServer.publish(t, `"v1"`, 1709280000, "bus-1")
+	if err := pollVehiclePositions(db, config, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPositions(t, db); n != 1 {
+		t.Fatalf("stored %d positions, want 1", n)
+	}
+	// The stored version is asked for only if it changed, and the 304 stores nothing
+	if err := pollVehiclePositions(db, config, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if feedServer.notModified != 1 {
+		t.Errorf("answered %d polls with 304 Not Modified, want 1", feedServer.notModified)
+	}
+	if n := countPositions(t, db); n != 1 {
+		t.Errorf("stored %d positions after an unchanged poll, want 1", n)
+	}
+
+	feedServer.publish(t, `"v2"`, 1709280030, "bus-1")
+	if err := pollVehiclePositions(db, config, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPositions(t, db); n != 2 {
+		t.Errorf("stored %d positions after the feed changed, want 2", n)
+	}
+}
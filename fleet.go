@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// VehicleUtilization summarizes how much a vehicle was in service and reporting.
+type VehicleUtilization struct {
+	VehicleId    string    `parquet:"vehicle_id"`
+	VehicleLabel *string   `parquet:"vehicle_label,optional"`
+	FirstSeen    time.Time `parquet:"first_seen,timestamp(millisecond)"`
+	LastSeen     time.Time `parquet:"last_seen,timestamp(millisecond)"`
+	Positions    int64     `parquet:"positions"`
+	// Local dates with at least one position
+	DaysInService int64 `parquet:"days_in_service"`
+	// Time covered by consecutive positions no further apart than the gap threshold
+	HoursReporting float64 `parquet:"hours_reporting"`
+	// Distance between consecutive positions, and from the odometer if the feed reports one
+	DistanceKm         float64  `parquet:"distance_km"`
+	OdometerDistanceKm *float64 `parquet:"odometer_distance_km,optional"`
+	// Intervals longer than the gap threshold between positions on the same local date
+	Gaps           int64   `parquet:"gaps"`
+	LongestGapMins float64 `parquet:"longest_gap_minutes"`
+}
+
+type vehicleState struct {
+	summary      VehicleUtilization
+	days         map[string]bool
+	last         *VehiclePosition
+	lastOdometer *float64
+	odometer     float64
+	hasOdometer  bool
+}
+
+// analyzeFleet reports how much each vehicle was in service, how far it travelled and how often it stopped reporting.
+func analyzeFleet(config Config, args []string) error {
+	flags := flag.NewFlagSet("analyze fleet", flag.ExitOnError)
+	input := addAnalysisFlags(flags, config)
+	output := flags.String("output", filepath.Join(config.DataDir, "fleet.csv"), "output file, as Parquet if it ends in .parquet and CSV otherwise")
+	gap := flags.Duration("gap", 5*time.Minute, "interval between positions counted as a gap in reporting")
+	flags.Parse(args)
+
+	if *gap <= 0 {
+		return fmt.Errorf("invalid --gap: %v", *gap)
+	}
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	vehicles := make(map[string]*vehicleState)
+	err = input.forEachPosition(config, location, func(vp *VehiclePosition) {
+		if vp.VehicleId == "" {
+			return
+		}
+		state, found := vehicles[vp.VehicleId]
+		if !found {
+			state = &vehicleState{
+				summary: VehicleUtilization{VehicleId: vp.VehicleId, FirstSeen: vp.Timestamp},
+				days:    make(map[string]bool),
+			}
+			vehicles[vp.VehicleId] = state
+		}
+		s := &state.summary
+		s.Positions++
+		s.LastSeen = vp.Timestamp
+		if vp.VehicleLabel != nil {
+			s.VehicleLabel = copyOptional(vp.VehicleLabel)
+		}
+		state.days[vp.Timestamp.In(location).Format(time.DateOnly)] = true
+
+		if previous := state.last; previous != nil {
+			elapsed := vp.Timestamp.Sub(previous.Timestamp)
+			if elapsed <= *gap {
+				s.HoursReporting += elapsed.Hours()
+				if previous.Latitude != nil && previous.Longitude != nil && vp.Latitude != nil && vp.Longitude != nil {
+					s.DistanceKm += haversineMeters(float64(*previous.Latitude), float64(*previous.Longitude), float64(*vp.Latitude), float64(*vp.Longitude)) / 1000
+				}
+			} else if previous.Timestamp.In(location).Format(time.DateOnly) == vp.Timestamp.In(location).Format(time.DateOnly) {
+				s.Gaps++
+				if minutes := elapsed.Minutes(); minutes > s.LongestGapMins {
+					s.LongestGapMins = minutes
+				}
+			}
+		}
+		if vp.Odometer != nil {
+			// Odometers reset or are swapped between vehicles, so only count increases
+			if state.lastOdometer != nil && *vp.Odometer > *state.lastOdometer {
+				state.odometer += *vp.Odometer - *state.lastOdometer
+			}
+			state.lastOdometer = copyOptional(vp.Odometer)
+			state.hasOdometer = true
+		}
+		state.last = copyOptional(vp)
+	})
+	if err != nil {
+		return err
+	}
+
+	results := make([]VehicleUtilization, 0, len(vehicles))
+	for _, state := range vehicles {
+		s := state.summary
+		s.DaysInService = int64(len(state.days))
+		if state.hasOdometer {
+			// Odometers are in meters
+			km := state.odometer / 1000
+			s.OdometerDistanceKm = &km
+		}
+		results = append(results, s)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].VehicleId < results[j].VehicleId })
+	return writeAnalysis(*output, results)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Causes of a gap in collected positions, from the polls recorded in feed_health during it
+const (
+	// No polls were recorded, so the scraper wasn't running
+	gapCauseScraper = "scraper_down"
+	// Every poll failed, e.g. the agency's server was down or rejected requests
+	gapCauseFeedUnavailable = "feed_unavailable"
+	// Polls succeeded but the feed had no new positions, e.g. a frozen feed or no vehicles in service
+	gapCauseFeedStale = "feed_stale"
+	// The gap is older than the recorded poll history, as with archives from before feed_health
+	gapCauseUnknown = "unknown"
+)
+
+// CollectionGap is an interval without any positions from a feed.
+type CollectionGap struct {
+	FeedId string `parquet:"feed_id"`
+	// The last position before the gap, and the first after it or the end of the range if there are none yet
+	Start           time.Time `parquet:"start,timestamp(millisecond)"`
+	End             time.Time `parquet:"end,timestamp(millisecond)"`
+	DurationMinutes float64   `parquet:"duration_minutes"`
+	Ongoing         bool      `parquet:"ongoing"`
+	Cause           string    `parquet:"cause"`
+	// Vehicle position polls recorded during the gap
+	Polls       int64 `parquet:"polls"`
+	FailedPolls int64 `parquet:"failed_polls"`
+	// The longest time during the gap without a recorded poll, which is scraper downtime in a gap with other causes
+	LongestWithoutPollMinutes *float64 `parquet:"longest_without_poll_minutes,optional"`
+	LastError                 *string  `parquet:"last_error,optional"`
+}
+
+// pollHistory is a feed's vehicle position polls in time order.
+type pollHistory struct {
+	polledAt []int64
+	success  []bool
+	errors   []*string
+}
+
+// loadPollHistory reads the vehicle position polls recorded in feed_health by feed.
+// A database without feed_health has no history rather than failing the analysis.
+func loadPollHistory(dbPath string) (map[string]*pollHistory, error) {
+	// Opened read-only, so the analysis never blocks the scraper
+	db, err := sqlx.Open("sqlite3", readOnlyURI(dbPath))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := db.QueryxContext(ctx, `SELECT feed_id, CAST(polled_at AS INT) AS polled_at, success, error
+		FROM feed_health WHERE feed_type = 'vehicle_positions' ORDER BY feed_id, polled_at`)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	histories := make(map[string]*pollHistory)
+	for rows.Next() {
+		var health FeedHealth
+		if err := rows.StructScan(&health); err != nil {
+			return nil, err
+		}
+		history := histories[health.FeedId]
+		if history == nil {
+			history = &pollHistory{}
+			histories[health.FeedId] = history
+		}
+		history.polledAt = append(history.polledAt, health.PolledAtUnix)
+		history.success = append(history.success, health.Success)
+		history.errors = append(history.errors, health.Error)
+	}
+	return histories, rows.Err()
+}
+
+// classify fills in the cause of a gap from the polls strictly inside it.
+func (h *pollHistory) classify(gap *CollectionGap) {
+	start, end := gap.Start.Unix(), gap.End.Unix()
+	if h == nil || len(h.polledAt) == 0 || start < h.polledAt[0] {
+		gap.Cause = gapCauseUnknown
+		return
+	}
+	first := sort.Search(len(h.polledAt), func(i int) bool { return h.polledAt[i] > start })
+	last := start
+	var longest int64
+	for i := first; i < len(h.polledAt) && h.polledAt[i] < end; i++ {
+		gap.Polls++
+		if !h.success[i] {
+			gap.FailedPolls++
+			gap.LastError = h.errors[i]
+		}
+		longest = max(longest, h.polledAt[i]-last)
+		last = h.polledAt[i]
+	}
+	longest = max(longest, end-last)
+	minutes := float64(longest) / 60
+	gap.LongestWithoutPollMinutes = &minutes
+	switch {
+	case gap.Polls == 0:
+		gap.Cause = gapCauseScraper
+	case gap.FailedPolls == gap.Polls:
+		gap.Cause = gapCauseFeedUnavailable
+	default:
+		gap.Cause = gapCauseFeedStale
+	}
+}
+
+// analyzeGaps lists the intervals in which no positions were collected from each feed for longer than the gap
+// threshold, and whether the scraper or the feed was at fault, so outages can be told apart from quiet periods.
+func analyzeGaps(config Config, args []string) error {
+	flags := flag.NewFlagSet("analyze gaps", flag.ExitOnError)
+	input := addAnalysisFlags(flags, config)
+	output := flags.String("output", filepath.Join(config.DataDir, "gaps.csv"), "output file, as Parquet if it ends in .parquet and CSV otherwise")
+	gap := flags.Duration("gap", 5*time.Minute, "time without positions counted as a gap, which should be longer than the poll interval")
+	flags.Parse(args)
+
+	if *gap <= 0 {
+		return fmt.Errorf("invalid --gap: %v", *gap)
+	}
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+	histories, err := loadPollHistory(*input.dbPath)
+	if err != nil {
+		return err
+	}
+
+	var gaps []CollectionGap
+	lastSeen := make(map[string]time.Time)
+	err = input.forEachPosition(config, location, func(vp *VehiclePosition) {
+		feedId := vp.FeedId
+		if feedId == "" {
+			feedId = config.FeedId
+		}
+		if last, found := lastSeen[feedId]; found && vp.Timestamp.Sub(last) > *gap {
+			gaps = append(gaps, CollectionGap{FeedId: feedId, Start: last, End: vp.Timestamp})
+		}
+		if vp.Timestamp.After(lastSeen[feedId]) {
+			lastSeen[feedId] = vp.Timestamp
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// Feeds which haven't had positions since the gap threshold are in an outage which hasn't ended yet
+	end := time.Now()
+	if toTime, err := parseExportDate(*input.to, location); err == nil && !toTime.IsZero() && toTime.Before(end) {
+		end = toTime
+	}
+	for feedId, last := range lastSeen {
+		if end.Sub(last) > *gap {
+			gaps = append(gaps, CollectionGap{FeedId: feedId, Start: last, End: end, Ongoing: true})
+		}
+	}
+
+	causes := make(map[string]int)
+	for i := range gaps {
+		g := &gaps[i]
+		g.DurationMinutes = g.End.Sub(g.Start).Minutes()
+		histories[g.FeedId].classify(g)
+		causes[g.Cause]++
+	}
+	sort.SliceStable(gaps, func(i, j int) bool {
+		if gaps[i].FeedId != gaps[j].FeedId {
+			return gaps[i].FeedId < gaps[j].FeedId
+		}
+		return gaps[i].Start.Before(gaps[j].Start)
+	})
+	config.log().Info("Found gaps", "gaps", len(gaps), "scraper_down", causes[gapCauseScraper], "feed_unavailable", causes[gapCauseFeedUnavailable],
+		"feed_stale", causes[gapCauseFeedStale], "unknown", causes[gapCauseUnknown])
+	return writeAnalysis(*output, gaps)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const earthRadiusMeters = 6371008.8
+
+// haversineMeters returns the great circle distance between two points.
+func haversineMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1, phi2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dPhi := phi2 - phi1
+	dLambda := (lon2 - lon1) * math.Pi / 180
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(a))
+}
+
+// bearingDegrees returns the initial bearing from one point to another, clockwise from north.
+func bearingDegrees(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1, phi2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dLambda := (lon2 - lon1) * math.Pi / 180
+	y := math.Sin(dLambda) * math.Cos(phi2)
+	x := math.Cos(phi1)*math.Sin(phi2) - math.Sin(phi1)*math.Cos(phi2)*math.Cos(dLambda)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// shapeLine is a shape with the distance of each point from its start, in meters.
+type shapeLine struct {
+	points     []ShapePoint
+	cumulative []float64
+}
+
+func newShapeLine(points []ShapePoint) *shapeLine {
+	line := &shapeLine{points: points, cumulative: make([]float64, len(points))}
+	for i := 1; i < len(points); i++ {
+		line.cumulative[i] = line.cumulative[i-1] + haversineMeters(points[i-1].Latitude, points[i-1].Longitude, points[i].Latitude, points[i].Longitude)
+	}
+	return line
+}
+
+// length returns the length of the shape in meters.
+func (line *shapeLine) length() float64 {
+	if len(line.cumulative) == 0 {
+		return 0
+	}
+	return line.cumulative[len(line.cumulative)-1]
+}
+
+// project snaps a point onto the closest segment of the shape, returning the distance along the shape
+// and the distance from the shape to the point, both in meters.
+// Segments are short enough to treat as flat, so each is projected onto a local equirectangular plane.
+func (line *shapeLine) project(lat, lon float64) (along float64, offset float64) {
+	offset = math.Inf(1)
+	if len(line.points) == 1 {
+		return 0, haversineMeters(lat, lon, line.points[0].Latitude, line.points[0].Longitude)
+	}
+	metersPerDegree := earthRadiusMeters * math.Pi / 180
+	metersPerDegreeLon := metersPerDegree * math.Cos(lat*math.Pi/180)
+	for i := 1; i < len(line.points); i++ {
+		a, b := line.points[i-1], line.points[i]
+		// Coordinates relative to the point
+		ax, ay := (a.Longitude-lon)*metersPerDegreeLon, (a.Latitude-lat)*metersPerDegree
+		bx, by := (b.Longitude-lon)*metersPerDegreeLon, (b.Latitude-lat)*metersPerDegree
+		dx, dy := bx-ax, by-ay
+		t := 0.0
+		if lengthSquared := dx*dx + dy*dy; lengthSquared > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lengthSquared))
+		}
+		px, py := ax+t*dx, ay+t*dy
+		if d := math.Hypot(px, py); d < offset {
+			offset = d
+			along = line.cumulative[i-1] + t*(line.cumulative[i]-line.cumulative[i-1])
+		}
+	}
+	return along, offset
+}
+
+// at returns the point a distance in meters along the shape, clamped to its ends.
+func (line *shapeLine) at(along float64) (lat, lon float64) {
+	i := sort.SearchFloat64s(line.cumulative, along)
+	if i == 0 {
+		return line.points[0].Latitude, line.points[0].Longitude
+	} else if i == len(line.points) {
+		last := line.points[len(line.points)-1]
+		return last.Latitude, last.Longitude
+	}
+	a, b := line.points[i-1], line.points[i]
+	t := 0.0
+	if segment := line.cumulative[i] - line.cumulative[i-1]; segment > 0 {
+		t = (along - line.cumulative[i-1]) / segment
+	}
+	return a.Latitude + t*(b.Latitude-a.Latitude), a.Longitude + t*(b.Longitude-a.Longitude)
+}
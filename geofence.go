@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// GeofenceConfig is a named zone, e.g. a depot or a downtown congestion zone.
+type GeofenceConfig struct {
+	Name string
+	// A GeoJSON Polygon or MultiPolygon geometry, with coordinates as [longitude, latitude]
+	Geometry json.RawMessage
+}
+
+// geofence is a parsed zone. Each polygon is a list of rings, where rings after the first are holes.
+type geofence struct {
+	name     string
+	polygons [][][][2]float64
+}
+
+var geofenceEventColumns = []ColumnInfo{
+	{Name: "feed_id", Type: "TEXT NOT NULL"},
+	{Name: "vehicle_id", Type: "TEXT NOT NULL"},
+	{Name: "zone", Type: "TEXT NOT NULL"},
+	{Name: "event", Type: "TEXT NOT NULL"},
+	{Name: "timestamp", Type: "DATETIME"},
+	{Name: "trip_id", Type: "TEXT"},
+	{Name: "latitude", Type: "REAL"},
+	{Name: "longitude", Type: "REAL"},
+}
+
+func createGeofenceEventsTableQuery() string {
+	return createTableIfNotExistsQuery("geofence_events", geofenceEventColumns, "feed_id, vehicle_id, zone, timestamp")
+}
+
+// GeofenceEvent records a vehicle entering or leaving a zone.
+type GeofenceEvent struct {
+	FeedId        string   `db:"feed_id"`
+	VehicleId     string   `db:"vehicle_id"`
+	Zone          string   `db:"zone"`
+	Event         string   `db:"event"`
+	TimestampUnix int64    `db:"timestamp"`
+	TripId        string   `db:"trip_id"`
+	Latitude      *float32 `db:"latitude"`
+	Longitude     *float32 `db:"longitude"`
+}
+
+// parseGeofences parses the zones in the config.
+func parseGeofences(configs []GeofenceConfig) ([]geofence, error) {
+	var zones []geofence
+	names := make(map[string]bool)
+	for _, config := range configs {
+		if config.Name == "" || names[config.Name] {
+			return nil, fmt.Errorf("geofences need unique names, got %q", config.Name)
+		}
+		names[config.Name] = true
+
+		var geometry struct {
+			Type        string
+			Coordinates json.RawMessage
+		}
+		if err := json.Unmarshal(config.Geometry, &geometry); err != nil {
+			return nil, fmt.Errorf("geofence %s: %w", config.Name, err)
+		}
+		zone := geofence{name: config.Name}
+		var err error
+		switch geometry.Type {
+		case "Polygon":
+			var polygon [][][2]float64
+			err = json.Unmarshal(geometry.Coordinates, &polygon)
+			zone.polygons = [][][][2]float64{polygon}
+		case "MultiPolygon":
+			err = json.Unmarshal(geometry.Coordinates, &zone.polygons)
+		default:
+			err = fmt.Errorf("unsupported geometry type %q, expected Polygon or MultiPolygon", geometry.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("geofence %s: %w", config.Name, err)
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// ringContains tests whether a point is inside a ring by casting a ray east and counting crossings.
+// Zones are small enough to treat longitude and latitude as planar.
+func ringContains(ring [][2]float64, lon, lat float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (zone *geofence) contains(lat, lon float64) bool {
+	for _, polygon := range zone.polygons {
+		if len(polygon) == 0 || !ringContains(polygon[0], lon, lat) {
+			continue
+		}
+		inHole := false
+		for _, hole := range polygon[1:] {
+			inHole = inHole || ringContains(hole, lon, lat)
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+type vehicleZone struct {
+	vehicleId string
+	zone      string
+}
+
+// addGeofenceEvents records when vehicles entered or left each zone, given newly inserted positions.
+// Whether a vehicle is inside a zone carries over from its last event, and vehicles without events start outside,
+// so a vehicle first seen inside a zone enters it.
+func addGeofenceEvents(db *sqlx.DB, feedId string, zones []geofence, positions []VehiclePosition) (int, error) {
+	var last []struct {
+		VehicleId string `db:"vehicle_id"`
+		Zone      string `db:"zone"`
+		Event     string `db:"event"`
+		Timestamp int64  `db:"timestamp"`
+	}
+	// SQLite takes the other columns from the row with the MAX
+	ctx, cancel := dbContext()
+	defer cancel()
+	err := db.SelectContext(ctx, &last, `SELECT vehicle_id, zone, event, CAST(MAX(timestamp) AS INT) AS timestamp
+		FROM geofence_events WHERE feed_id = ? GROUP BY vehicle_id, zone`, feedId)
+	if err != nil {
+		return 0, err
+	}
+	inside := make(map[vehicleZone]bool, len(last))
+	for _, l := range last {
+		inside[vehicleZone{l.VehicleId, l.Zone}] = l.Event == "enter"
+	}
+
+	sorted := make([]VehiclePosition, len(positions))
+	copy(sorted, positions)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].TimestampUnix < sorted[j].TimestampUnix })
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareNamedContext(ctx, insertIntoQuery("geofence_events", geofenceEventColumns))
+	if err != nil {
+		return 0, err
+	}
+	events := 0
+	for _, vp := range sorted {
+		if vp.VehicleId == "" || vp.Latitude == nil || vp.Longitude == nil {
+			continue
+		}
+		for i := range zones {
+			key := vehicleZone{vp.VehicleId, zones[i].name}
+			now := zones[i].contains(float64(*vp.Latitude), float64(*vp.Longitude))
+			if now == inside[key] {
+				continue
+			}
+			inside[key] = now
+			event := GeofenceEvent{
+				FeedId:        feedId,
+				VehicleId:     vp.VehicleId,
+				Zone:          zones[i].name,
+				Event:         "exit",
+				TimestampUnix: vp.TimestampUnix,
+				TripId:        vp.TripId,
+				Latitude:      vp.Latitude,
+				Longitude:     vp.Longitude,
+			}
+			if now {
+				event.Event = "enter"
+			}
+			if _, err := stmt.ExecContext(ctx, &event); err != nil {
+				return 0, err
+			}
+			events++
+		}
+	}
+	return events, tx.Commit()
+}
@@ -0,0 +1,840 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The GraphQL endpoint implements the subset of GraphQL that dashboards need: queries with arguments,
+// variables (with defaults), aliases, nested selections and __typename. Fragments, directives,
+// mutations and introspection aren't supported; the schema is published in SDL at /v1/graphql/schema instead.
+
+// gqlSelection is a field selected in a query, with its arguments' values already substituted for variables.
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       map[string]any
+	selections []gqlSelection
+}
+
+// maxGraphQLDepth bounds how deeply selection sets and lists can nest, so a query can't recurse without limit.
+const maxGraphQLDepth = 32
+
+type gqlParser struct {
+	src       string
+	pos       int
+	variables map[string]any
+	// How many selection sets and lists enclose the position
+	depth int
+}
+
+// nest enters a selection set or list, failing if it's nested too deeply. The returned function leaves it.
+func (p *gqlParser) nest() (func(), error) {
+	if p.depth >= maxGraphQLDepth {
+		return nil, p.errorf("nested more than %d levels deep", maxGraphQLDepth)
+	}
+	p.depth++
+	return func() { p.depth-- }, nil
+}
+
+func (p *gqlParser) errorf(format string, args ...any) error {
+	return badRequest("GraphQL syntax error at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// peek skips whitespace, commas and comments, and returns the next character, or 0 at the end.
+func (p *gqlParser) peek() byte {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; c {
+		case ' ', '\t', '\n', '\r', ',':
+			p.pos++
+		case '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return c
+		}
+	}
+	return 0
+}
+
+func (p *gqlParser) consume(c byte) bool {
+	if p.peek() == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(c byte) error {
+	if !p.consume(c) {
+		return p.errorf("expected %q", c)
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	p.peek()
+	start := p.pos
+	for ; p.pos < len(p.src); p.pos++ {
+		c := p.src[p.pos]
+		if !(c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || p.pos > start && '0' <= c && c <= '9') {
+			break
+		}
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a name")
+	}
+	return p.src[start:p.pos], nil
+}
+
+// value parses an argument value. Numbers are float64, as in JSON variables.
+func (p *gqlParser) value() (any, error) {
+	switch c := p.peek(); {
+	case c == '$':
+		p.pos++
+		name, err := p.name()
+		return p.variables[name], err
+	case c == '"':
+		// Escapes are the same as JSON's
+		start := p.pos
+		for p.pos++; p.pos < len(p.src) && p.src[p.pos] != '"'; p.pos++ {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+		}
+		if p.pos >= len(p.src) {
+			return nil, p.errorf("unterminated string")
+		}
+		p.pos++
+		var s string
+		if err := json.Unmarshal([]byte(p.src[start:p.pos]), &s); err != nil {
+			return nil, p.errorf("invalid string: %v", err)
+		}
+		return s, nil
+	case c == '[':
+		leave, err := p.nest()
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		p.pos++
+		list := []any{}
+		for !p.consume(']') {
+			if p.peek() == 0 {
+				return nil, p.errorf("unterminated list")
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case c == '-' || '0' <= c && c <= '9':
+		start := p.pos
+		for p.pos < len(p.src) && strings.IndexByte("+-.eE0123456789", p.src[p.pos]) >= 0 {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", p.src[start:p.pos])
+		}
+		return v, nil
+	case c == '{':
+		return nil, p.errorf("input objects aren't supported")
+	}
+	name, err := p.name()
+	switch name {
+	case "true":
+		return true, err
+	case "false":
+		return false, err
+	case "null":
+		return nil, err
+	}
+	// Enum values
+	return name, err
+}
+
+// skipType skips a variable's type, which isn't checked until the variable is used as an argument.
+func (p *gqlParser) skipType() error {
+	if p.peek() == '[' {
+		leave, err := p.nest()
+		if err != nil {
+			return err
+		}
+		defer leave()
+	}
+	if p.consume('[') {
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expect(']'); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	p.consume('!')
+	return nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	leave, err := p.nest()
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	var selections []gqlSelection
+	for !p.consume('}') {
+		switch p.peek() {
+		case 0:
+			return nil, p.errorf("unterminated selection set")
+		case '.':
+			return nil, p.errorf("fragments aren't supported")
+		case '@':
+			return nil, p.errorf("directives aren't supported")
+		}
+		var s gqlSelection
+		var err error
+		if s.name, err = p.name(); err != nil {
+			return nil, err
+		}
+		s.alias = s.name
+		if p.consume(':') {
+			if s.name, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if p.consume('(') {
+			s.args = make(map[string]any)
+			for !p.consume(')') {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(':'); err != nil {
+					return nil, err
+				}
+				if s.args[name], err = p.value(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if p.peek() == '{' {
+			if s.selections, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		selections = append(selections, s)
+	}
+	return selections, nil
+}
+
+// parseGraphQL parses a query document, returning the selections of the named operation,
+// or of its only operation if operationName is empty.
+func parseGraphQL(query, operationName string, variables map[string]any) ([]gqlSelection, error) {
+	if variables == nil {
+		variables = make(map[string]any)
+	}
+	p := &gqlParser{src: query, variables: variables}
+	var operation []gqlSelection
+	var operations int
+	for p.peek() != 0 {
+		var name string
+		if p.peek() != '{' {
+			keyword, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if keyword != "query" {
+				return nil, badRequest("only queries are supported, not %s", keyword)
+			}
+			if c := p.peek(); c != '(' && c != '{' {
+				if name, err = p.name(); err != nil {
+					return nil, err
+				}
+			}
+			if p.consume('(') {
+				for !p.consume(')') {
+					if err := p.expect('$'); err != nil {
+						return nil, err
+					}
+					variable, err := p.name()
+					if err != nil {
+						return nil, err
+					}
+					if err := p.expect(':'); err != nil {
+						return nil, err
+					}
+					if err := p.skipType(); err != nil {
+						return nil, err
+					}
+					if p.consume('=') {
+						defaultValue, err := p.value()
+						if err != nil {
+							return nil, err
+						}
+						if _, found := variables[variable]; !found {
+							variables[variable] = defaultValue
+						}
+					}
+				}
+			}
+		}
+		selections, err := p.selectionSet()
+		if err != nil {
+			return nil, err
+		}
+		operations++
+		if name == operationName || operationName == "" {
+			operation = selections
+		}
+	}
+	switch {
+	case operations == 0:
+		return nil, badRequest("no query in the document")
+	case operationName == "" && operations > 1:
+		return nil, badRequest("operationName is required for documents with several operations")
+	case operation == nil:
+		return nil, badRequest("no operation named %s", operationName)
+	}
+	return operation, nil
+}
+
+// gqlArgs are the arguments of a field, coerced to their declared types.
+type gqlArgs map[string]any
+
+// listParams reads the list arguments shared with the REST endpoints.
+func (a gqlArgs) listParams() (listParams, error) {
+	params := listParams{limit: defaultPageLimit}
+	params.feed, _ = a["feedId"].(string)
+	params.route, _ = a["route"].(string)
+	params.vehicle, _ = a["vehicle"].(string)
+	if values, ok := a["bbox"].([]float64); ok {
+		bbox, err := newBBox(values)
+		if err != nil {
+			return params, err
+		}
+		params.bbox = bbox
+	}
+	for name, t := range map[string]**time.Time{"from": &params.from, "to": &params.to} {
+		if value, ok := a[name].(string); ok {
+			parsed, err := parseAPITime(value)
+			if err != nil {
+				return params, badRequest("invalid %s: %v", name, err)
+			}
+			*t = &parsed
+		}
+	}
+	if limit, ok := a["limit"].(int); ok {
+		if err := checkLimit(limit); err != nil {
+			return params, err
+		}
+		params.limit = limit
+	}
+	return params, nil
+}
+
+// coerceArg converts an argument value to its declared type: String, Int, Float, [Float], and non-null variants.
+func coerceArg(typ string, value any) (any, error) {
+	nonNull := strings.HasSuffix(typ, "!")
+	typ = strings.TrimSuffix(typ, "!")
+	if value == nil {
+		if nonNull {
+			return nil, errors.New("is required")
+		}
+		return nil, nil
+	}
+	switch typ {
+	case "String":
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case "Int":
+		if f, ok := value.(float64); ok && f == float64(int(f)) {
+			return int(f), nil
+		}
+	case "Float":
+		if f, ok := value.(float64); ok {
+			return f, nil
+		}
+	case "[Float!]":
+		if list, ok := value.([]any); ok {
+			floats := make([]float64, len(list))
+			for i, v := range list {
+				f, ok := v.(float64)
+				if !ok {
+					return nil, errors.New("must be a list of numbers")
+				}
+				floats[i] = f
+			}
+			return floats, nil
+		}
+	}
+	return nil, fmt.Errorf("must be of type %s", typ)
+}
+
+type gqlArg struct {
+	name string
+	typ  string
+}
+
+// gqlField is a field of an object type. Its type is an object type's name or a scalar,
+// wrapped in [] for lists and suffixed with ! if it's never null.
+type gqlField struct {
+	typ     string
+	args    []gqlArg
+	resolve func(ctx context.Context, parent any, args gqlArgs) (any, error)
+}
+
+type gqlType map[string]gqlField
+
+// gqlProperty is a field computed from its parent value alone.
+func gqlProperty[T any](typ string, fn func(T) any) gqlField {
+	return gqlField{typ: typ, resolve: func(_ context.Context, parent any, _ gqlArgs) (any, error) {
+		return fn(parent.(T)), nil
+	}}
+}
+
+// gqlObject is a selection's result, which keeps the fields in the order they were selected.
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value any
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, entry := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(entry.key)
+		value, err := json.Marshal(entry.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return []byte(b.String()), nil
+}
+
+// graphQL executes queries against a schema of object types, starting from its Query type.
+type graphQL struct {
+	types map[string]gqlType
+}
+
+func (g *graphQL) execute(ctx context.Context, selections []gqlSelection) (any, error) {
+	if err := g.validate("Query", selections, "query"); err != nil {
+		return nil, err
+	}
+	return g.resolveValue(ctx, "Query!", struct{}{}, selections, "query")
+}
+
+// validate checks that the selected fields and their arguments exist, and that object fields
+// and only object fields have selections, before any field is resolved.
+func (g *graphQL) validate(typ string, selections []gqlSelection, path string) error {
+	typ = strings.Trim(typ, "[]!")
+	objectType, isObject := g.types[typ]
+	switch {
+	case !isObject && selections != nil:
+		return badRequest("%s: %s has no fields to select", path, typ)
+	case isObject && selections == nil:
+		return badRequest("%s: %s needs a selection of fields", path, typ)
+	}
+	for _, s := range selections {
+		fieldPath := path + "." + s.alias
+		if s.name == "__typename" {
+			continue
+		}
+		field, found := objectType[s.name]
+		if !found {
+			return badRequest("%s: %s has no field %s", fieldPath, typ, s.name)
+		}
+		for name := range s.args {
+			if !containsArg(field.args, name) {
+				return badRequest("%s: unknown argument %s", fieldPath, name)
+			}
+		}
+		if err := g.validate(field.typ, s.selections, fieldPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveValue completes a field's value according to its type, once validate has checked the selections.
+func (g *graphQL) resolveValue(ctx context.Context, typ string, value any, selections []gqlSelection, path string) (any, error) {
+	typ = strings.TrimSuffix(typ, "!")
+	v := reflect.ValueOf(value)
+	if !v.IsValid() || v.Kind() == reflect.Pointer && v.IsNil() || v.Kind() == reflect.Slice && v.IsNil() && !strings.HasPrefix(typ, "[") {
+		return nil, nil
+	}
+	if strings.HasPrefix(typ, "[") {
+		elementType := typ[1 : len(typ)-1]
+		list := make([]any, v.Len())
+		for i := range list {
+			element, err := g.resolveValue(ctx, elementType, v.Index(i).Interface(), selections, fmt.Sprintf("%s.%d", path, i))
+			if err != nil {
+				return nil, err
+			}
+			list[i] = element
+		}
+		return list, nil
+	}
+	objectType, isObject := g.types[typ]
+	if !isObject {
+		return value, nil
+	}
+	if v.Kind() == reflect.Pointer {
+		value = v.Elem().Interface()
+	}
+	result := make(gqlObject, 0, len(selections))
+	for _, s := range selections {
+		fieldPath := path + "." + s.alias
+		if s.name == "__typename" {
+			result = append(result, gqlEntry{s.alias, typ})
+			continue
+		}
+		field := objectType[s.name]
+		args := make(gqlArgs, len(field.args))
+		for _, arg := range field.args {
+			coerced, err := coerceArg(arg.typ, s.args[arg.name])
+			if err != nil {
+				return nil, badRequest("%s: argument %s %v", fieldPath, arg.name, err)
+			}
+			if coerced != nil {
+				args[arg.name] = coerced
+			}
+		}
+		fieldValue, err := field.resolve(ctx, value, args)
+		if err != nil {
+			return nil, err
+		}
+		completed, err := g.resolveValue(ctx, field.typ, fieldValue, s.selections, fieldPath)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, gqlEntry{s.alias, completed})
+	}
+	return result, nil
+}
+
+func containsArg(args []gqlArg, name string) bool {
+	for _, arg := range args {
+		if arg.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// schema describes the types in GraphQL SDL.
+func (g *graphQL) schema() string {
+	var b strings.Builder
+	typeNames := make([]string, 0, len(g.types))
+	for name := range g.types {
+		typeNames = append(typeNames, name)
+	}
+	sort.Strings(typeNames)
+	for _, typeName := range typeNames {
+		fmt.Fprintf(&b, "type %s {\n", typeName)
+		fieldNames := make([]string, 0, len(g.types[typeName]))
+		for name := range g.types[typeName] {
+			fieldNames = append(fieldNames, name)
+		}
+		sort.Strings(fieldNames)
+		for _, fieldName := range fieldNames {
+			field := g.types[typeName][fieldName]
+			fmt.Fprintf(&b, "  %s", fieldName)
+			if len(field.args) > 0 {
+				args := make([]string, len(field.args))
+				for i, arg := range field.args {
+					args[i] = arg.name + ": " + arg.typ
+				}
+				fmt.Fprintf(&b, "(%s)", strings.Join(args, ", "))
+			}
+			fmt.Fprintf(&b, ": %s\n", field.typ)
+		}
+		b.WriteString("}\n\n")
+	}
+	return b.String()
+}
+
+// Values in the GraphQL schema
+
+func optionalString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func optionalEnumName(names map[int32]string, value *int32) any {
+	if value == nil {
+		return nil
+	}
+	return enumName(names, *value)
+}
+
+func formatAPITime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// route looks up a route in the static GTFS. Routes which aren't in it only have their ID.
+func (s *apiServer) route(id string) any {
+	if id == "" {
+		return nil
+	}
+	if route, found := s.static.routes[id]; found {
+		return route
+	}
+	return Route{Id: id}
+}
+
+// trip looks up a trip in the static GTFS. Trips which aren't in it only have their ID and route.
+func (s *apiServer) trip(id string, routeId *string) any {
+	if id == "" {
+		return nil
+	}
+	if trip, found := s.static.trips[id]; found {
+		return trip
+	}
+	trip := Trip{Id: id}
+	if routeId != nil {
+		trip.RouteId = *routeId
+	}
+	return trip
+}
+
+// newGraphQL builds the GraphQL schema over vehicles, trips and routes from the static GTFS, and alerts.
+func (s *apiServer) newGraphQL() *graphQL {
+	timeRange := []gqlArg{{"from", "String"}, {"to", "String"}, {"limit", "Int"}}
+	listArgs := func(names ...string) []gqlArg {
+		args := make([]gqlArg, len(names))
+		for i, name := range names {
+			args[i] = gqlArg{name, "String"}
+		}
+		return append(args, timeRange...)
+	}
+	withBBox := func(args []gqlArg) []gqlArg {
+		return append(args[:len(args):len(args)], gqlArg{"bbox", "[Float!]"})
+	}
+	// list resolves a field listing rows with the REST endpoints' queries, with extra filters from the parent
+	list := func(typ string, args []gqlArg, query func(ctx context.Context, params listParams, limit int) (any, error),
+		filter func(parent any, params *listParams)) gqlField {
+		return gqlField{typ: typ, args: args, resolve: func(ctx context.Context, parent any, args gqlArgs) (any, error) {
+			params, err := args.listParams()
+			if err != nil {
+				return nil, err
+			}
+			if filter != nil {
+				filter(parent, &params)
+			}
+			return query(ctx, params, params.limit)
+		}}
+	}
+	positions := func(ctx context.Context, params listParams, limit int) (any, error) {
+		return s.queryPositions(ctx, params, limit)
+	}
+	latestPositions := func(ctx context.Context, params listParams, limit int) (any, error) {
+		return s.queryLatestPositions(ctx, params, limit)
+	}
+	alerts := func(ctx context.Context, params listParams, limit int) (any, error) {
+		return s.queryAlerts(ctx, params, limit)
+	}
+	routeFilter := func(parent any, params *listParams) { params.route = parent.(Route).Id }
+
+	return &graphQL{types: map[string]gqlType{
+		"Query": {
+			"vehicles":  list("[Vehicle!]!", withBBox(listArgs("feedId", "route")), latestPositions, nil),
+			"positions": list("[Position!]!", withBBox(listArgs("feedId", "route", "vehicle")), positions, nil),
+			"alerts":    list("[Alert!]!", listArgs("feedId", "route"), alerts, nil),
+			"vehicle": {typ: "Vehicle", args: []gqlArg{{"id", "String!"}, {"from", "String"}, {"to", "String"}},
+				resolve: func(ctx context.Context, _ any, args gqlArgs) (any, error) {
+					params, err := args.listParams()
+					if err != nil {
+						return nil, err
+					}
+					params.vehicle = args["id"].(string)
+					latest, err := s.queryLatestPositions(ctx, params, 1)
+					if err != nil || len(latest) == 0 {
+						return nil, err
+					}
+					return latest[0], nil
+				}},
+			"routes": {typ: "[Route!]!", resolve: func(context.Context, any, gqlArgs) (any, error) {
+				routes := make([]Route, 0, len(s.static.routes))
+				for _, route := range s.static.routes {
+					routes = append(routes, route)
+				}
+				sort.Slice(routes, func(i, j int) bool { return routes[i].Id < routes[j].Id })
+				return routes, nil
+			}},
+			"route": {typ: "Route", args: []gqlArg{{"id", "String!"}}, resolve: func(_ context.Context, _ any, args gqlArgs) (any, error) {
+				return s.route(args["id"].(string)), nil
+			}},
+			"trip": {typ: "Trip", args: []gqlArg{{"id", "String!"}}, resolve: func(_ context.Context, _ any, args gqlArgs) (any, error) {
+				return s.trip(args["id"].(string), nil), nil
+			}},
+		},
+		// A vehicle is represented by its latest position
+		"Vehicle": {
+			"id":       gqlProperty("String!", func(p apiPosition) any { return p.VehicleId }),
+			"label":    gqlProperty("String", func(p apiPosition) any { return p.VehicleLabel }),
+			"position": gqlProperty("Position!", func(p apiPosition) any { return p }),
+			"positions": list("[Position!]!", timeRange, positions, func(parent any, params *listParams) {
+				params.vehicle = parent.(apiPosition).VehicleId
+			}),
+		},
+		"Position": {
+			"feedId":              gqlProperty("String!", func(p apiPosition) any { return p.FeedId }),
+			"vehicleId":           gqlProperty("String!", func(p apiPosition) any { return p.VehicleId }),
+			"timestamp":           gqlProperty("String!", func(p apiPosition) any { return formatAPITime(p.Timestamp) }),
+			"latitude":            gqlProperty("Float", func(p apiPosition) any { return p.Latitude }),
+			"longitude":           gqlProperty("Float", func(p apiPosition) any { return p.Longitude }),
+			"bearing":             gqlProperty("Float", func(p apiPosition) any { return p.Bearing }),
+			"speed":               gqlProperty("Float", func(p apiPosition) any { return p.Speed }),
+			"stopId":              gqlProperty("String", func(p apiPosition) any { return p.StopId }),
+			"nearestStopId":       gqlProperty("String", func(p apiPosition) any { return p.NearestStopId }),
+			"agencyId":            gqlProperty("String", func(p apiPosition) any { return p.AgencyId }),
+			"currentStopSequence": gqlProperty("Int", func(p apiPosition) any { return p.CurrentStopSequence }),
+			"startDate":           gqlProperty("String", func(p apiPosition) any { return p.StartDate }),
+			"currentStatus":       gqlProperty("String", func(p apiPosition) any { return optionalEnumName(positionEnumNames["current_status"], p.CurrentStatus) }),
+			"congestionLevel": gqlProperty("String", func(p apiPosition) any {
+				return optionalEnumName(positionEnumNames["congestion_level"], p.CongestionLevel)
+			}),
+			"occupancyStatus": gqlProperty("String", func(p apiPosition) any {
+				return optionalEnumName(positionEnumNames["occupancy_status"], p.OccupancyStatus)
+			}),
+			"occupancyPercentage":  gqlProperty("Int", func(p apiPosition) any { return p.OccupancyPercentage }),
+			"wheelchairAccessible": gqlProperty("String", func(p apiPosition) any { return optionalEnumName(wheelchairAccessibleName, p.WheelchairAccessible) }),
+			"trip":                 gqlProperty("Trip", func(p apiPosition) any { return s.trip(p.TripId, p.RouteId) }),
+			"route": gqlProperty("Route", func(p apiPosition) any {
+				if p.RouteId != nil {
+					return s.route(*p.RouteId)
+				}
+				return s.route(s.static.trips[p.TripId].RouteId)
+			}),
+		},
+		"Trip": {
+			"id":          gqlProperty("String!", func(t Trip) any { return t.Id }),
+			"headsign":    gqlProperty("String", func(t Trip) any { return optionalString(t.Headsign) }),
+			"directionId": gqlProperty("Int", func(t Trip) any { return t.DirectionId }),
+			"route":       gqlProperty("Route", func(t Trip) any { return s.route(t.RouteId) }),
+		},
+		"Route": {
+			"id":        gqlProperty("String!", func(r Route) any { return r.Id }),
+			"shortName": gqlProperty("String", func(r Route) any { return optionalString(r.ShortName) }),
+			"longName":  gqlProperty("String", func(r Route) any { return optionalString(r.LongName) }),
+			"type": gqlProperty("Int", func(r Route) any {
+				if _, found := s.static.routes[r.Id]; !found {
+					return nil
+				}
+				return r.Type
+			}),
+			"color":    gqlProperty("String", func(r Route) any { return optionalString(r.Color) }),
+			"vehicles": list("[Vehicle!]!", timeRange, latestPositions, routeFilter),
+			"alerts":   list("[Alert!]!", timeRange, alerts, routeFilter),
+		},
+		"Alert": {
+			"id":              gqlProperty("String!", func(a apiAlert) any { return a.AlertId }),
+			"firstSeen":       gqlProperty("String!", func(a apiAlert) any { return formatAPITime(time.Unix(a.FirstSeen, 0)) }),
+			"lastSeen":        gqlProperty("String!", func(a apiAlert) any { return formatAPITime(time.Unix(a.LastSeen, 0)) }),
+			"cause":           gqlProperty("String", func(a apiAlert) any { return optionalEnumName(otherEnumNames["cause"], a.Cause) }),
+			"effect":          gqlProperty("String", func(a apiAlert) any { return optionalEnumName(otherEnumNames["effect"], a.Effect) }),
+			"severityLevel":   gqlProperty("String", func(a apiAlert) any { return optionalEnumName(otherEnumNames["severity_level"], a.SeverityLevel) }),
+			"causeDetail":     gqlProperty("String", func(a apiAlert) any { return a.CauseDetail }),
+			"effectDetail":    gqlProperty("String", func(a apiAlert) any { return a.EffectDetail }),
+			"headerText":      gqlProperty("String", func(a apiAlert) any { return a.HeaderText }),
+			"descriptionText": gqlProperty("String", func(a apiAlert) any { return a.DescriptionText }),
+			"url":             gqlProperty("String", func(a apiAlert) any { return a.URL }),
+			"routes": gqlProperty("[Route!]!", func(a apiAlert) any {
+				var entities []struct {
+					RouteId string `json:"route_id"`
+				}
+				json.Unmarshal(a.InformedEntities, &entities)
+				routes := []any{}
+				seen := make(map[string]bool)
+				for _, entity := range entities {
+					if entity.RouteId != "" && !seen[entity.RouteId] {
+						seen[entity.RouteId] = true
+						routes = append(routes, s.route(entity.RouteId))
+					}
+				}
+				return routes
+			}),
+		},
+	}}
+}
+
+// graphQLRequest is a GraphQL-over-HTTP request, sent as a POSTed JSON body or GET query parameters.
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// serveGraphQL answers GraphQL queries with {"data": ...}, or {"errors": [...]} if the query fails.
+func (s *apiServer) serveGraphQL(g *graphQL) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var request graphQLRequest
+		switch r.Method {
+		case http.MethodGet:
+			query := r.URL.Query()
+			request.Query, request.OperationName = query.Get("query"), query.Get("operationName")
+			if variables := query.Get("variables"); variables != "" {
+				if err := json.Unmarshal([]byte(variables), &request.Variables); err != nil {
+					writeGraphQLError(w, badRequest("invalid variables: %v", err))
+					return
+				}
+			}
+		case http.MethodPost:
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+				writeGraphQLError(w, badRequest("invalid request: %v", err))
+				return
+			}
+		default:
+			writeGraphQLError(w, &apiError{status: http.StatusMethodNotAllowed, message: "only GET and POST are supported"})
+			return
+		}
+		selections, err := parseGraphQL(request.Query, request.OperationName, request.Variables)
+		if err != nil {
+			writeGraphQLError(w, err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), dbTimeout)
+		defer cancel()
+		data, err := g.execute(ctx, selections)
+		if err != nil {
+			writeGraphQLError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data})
+	}
+}
+
+func writeGraphQLError(w http.ResponseWriter, err error) {
+	status, message := errorStatus(err)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"errors": []map[string]string{{"message": message}}})
+}
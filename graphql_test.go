@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testRoute struct {
+	id    string
+	name  string
+	trips []string
+}
+
+// testGraphQL has a schema like the API's, over routes held in memory.
+func testGraphQL() *graphQL {
+	routes := []testRoute{{"99", "99 B-Line", []string{"t1", "t2"}}, {"R4", "", nil}}
+	return &graphQL{types: map[string]gqlType{
+		"Query": {
+			"routes": {typ: "[Route!]!", args: []gqlArg{{"limit", "Int"}, {"bbox", "[Float!]"}},
+				resolve: func(_ context.Context, _ any, args gqlArgs) (any, error) {
+					if limit, ok := args["limit"].(int); ok && limit < len(routes) {
+						return routes[:limit], nil
+					}
+					return routes, nil
+				}},
+			"route": {typ: "Route", args: []gqlArg{{"id", "String!"}},
+				resolve: func(_ context.Context, _ any, args gqlArgs) (any, error) {
+					for _, r := range routes {
+						if r.id == args["id"] {
+							return &r, nil
+						}
+					}
+					return (*testRoute)(nil), nil
+				}},
+			"failing": {typ: "String", resolve: func(context.Context, any, gqlArgs) (any, error) {
+				return nil, errors.New("resolver failed")
+			}},
+		},
+		"Route": {
+			"id":    gqlProperty("String!", func(r testRoute) any { return r.id }),
+			"name":  gqlProperty("String", func(r testRoute) any { return optionalString(r.name) }),
+			"trips": gqlProperty("[String!]!", func(r testRoute) any { return r.trips }),
+		},
+	}}
+}
+
+// runGraphQL parses and executes a query, turning a panic into a failure of the test.
+func runGraphQL(t *testing.T, g *graphQL, query string, operationName string, variables map[string]any) (result string, err error) {
+	t.Helper()
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("%q panicked: %v", query, r)
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	selections, err := parseGraphQL(query, operationName, variables)
+	if err != nil {
+		return "", err
+	}
+	data, err := g.execute(context.Background(), selections)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := json.Marshal(data)
+	return string(encoded), err
+}
+
+func TestParseGraphQL(t *testing.T) {
+	tests := []struct {
+		query         string
+		operationName string
+		variables     map[string]any
+		want          []gqlSelection
+	}{
+		{`{ routes { id } }`, "", nil, []gqlSelection{{alias: "routes", name: "routes", selections: []gqlSelection{{alias: "id", name: "id"}}}}},
+		{`query { r: route(id: "99") { id, name } }`, "", nil, []gqlSelection{{alias: "r", name: "route", args: map[string]any{"id": "99"},
+			selections: []gqlSelection{{alias: "id", name: "id"}, {alias: "name", name: "name"}}}}},
+		{"# comment\nquery Named($id: String! = \"R4\") { route(id: $id) { __typename } }", "", nil,
+			[]gqlSelection{{alias: "route", name: "route", args: map[string]any{"id": "R4"}, selections: []gqlSelection{{alias: "__typename", name: "__typename"}}}}},
+		// Variables override defaults
+		{`query ($id: String = "R4") { route(id: $id) { id } }`, "", map[string]any{"id": "99"},
+			[]gqlSelection{{alias: "route", name: "route", args: map[string]any{"id": "99"}, selections: []gqlSelection{{alias: "id", name: "id"}}}}},
+		{`query A { a: routes { id } } query B { b: routes { id } }`, "B", nil,
+			[]gqlSelection{{alias: "b", name: "routes", selections: []gqlSelection{{alias: "id", name: "id"}}}}},
+		{`{ routes(limit: 1, bbox: [-123.5, 49, -122.5e0, 49.5]) { id } }`, "", nil, []gqlSelection{{alias: "routes", name: "routes",
+			args: map[string]any{"limit": 1.0, "bbox": []any{-123.5, 49.0, -122.5, 49.5}}, selections: []gqlSelection{{alias: "id", name: "id"}}}}},
+		{`{ route(id: "say \"hi\"!") { id } }`, "", nil, []gqlSelection{{alias: "route", name: "route",
+			args: map[string]any{"id": `say "hi"!`}, selections: []gqlSelection{{alias: "id", name: "id"}}}}},
+		{`{ routes(limit: null) { id } failing }`, "", nil, []gqlSelection{{alias: "routes", name: "routes", args: map[string]any{"limit": nil},
+			selections: []gqlSelection{{alias: "id", name: "id"}}}, {alias: "failing", name: "failing"}}},
+	}
+	for _, test := range tests {
+		got, err := parseGraphQL(test.query, test.operationName, test.variables)
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestExecuteGraphQL(t *testing.T) {
+	g := testGraphQL()
+	tests := []struct {
+		query     string
+		variables map[string]any
+		want      string
+	}{
+		{`{ routes { id name } }`, nil, `{"routes":[{"id":"99","name":"99 B-Line"},{"id":"R4","name":null}]}`},
+		// Fields are kept in the order selected, under their aliases
+		{`{ routes(limit: 1) { n: name, id, trips, __typename } }`, nil, `{"routes":[{"n":"99 B-Line","id":"99","trips":["t1","t2"],"__typename":"Route"}]}`},
+		{`query ($id: String!) { route(id: $id) { id } }`, map[string]any{"id": "R4"}, `{"route":{"id":"R4"}}`},
+		{`{ route(id: "none") { id } }`, nil, `{"route":null}`},
+		{`{ route(id: "R4") { trips } }`, nil, `{"route":{"trips":[]}}`},
+		{`{ __typename }`, nil, `{"__typename":"Query"}`},
+	}
+	for _, test := range tests {
+		got, err := runGraphQL(t, g, test.query, "", test.variables)
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+		} else if got != test.want {
+			t.Errorf("%q: got %s, want %s", test.query, got, test.want)
+		}
+	}
+}
+
+func TestMalformedGraphQL(t *testing.T) {
+	g := testGraphQL()
+	tests := []struct {
+		query         string
+		operationName string
+		variables     map[string]any
+		// A fragment of the expected error
+		want string
+	}{
+		{``, "", nil, "no query"},
+		{`   # only a comment`, "", nil, "no query"},
+		{`{`, "", nil, "unterminated selection set"},
+		{`{ routes { id }`, "", nil, "unterminated selection set"},
+		{`}`, "", nil, "expected a name"},
+		{`{ 1routes }`, "", nil, "expected a name"},
+		{`{ routes(limit: ) { id } }`, "", nil, "expected a name"},
+		{`{ routes(limit 1) { id } }`, "", nil, `expected ':'`},
+		{`{ routes(limit: 1 { id } }`, "", nil, "expected a name"},
+		{`{ route(id: "99) { id } }`, "", nil, "unterminated string"},
+		{`{ route(id: "\q") { id } }`, "", nil, "invalid string"},
+		{`{ route(id: "\`, "", nil, "unterminated string"},
+		{`{ routes(bbox: [1, 2) { id } }`, "", nil, "expected a name"},
+		{`{ routes(bbox: [1, 2`, "", nil, "unterminated list"},
+		{`{ routes(limit: 1e) { id } }`, "", nil, "invalid number"},
+		{`{ routes(limit: -) { id } }`, "", nil, "invalid number"},
+		{`{ routes(limit: {a: 1}) { id } }`, "", nil, "input objects"},
+		{`{ ...fields }`, "", nil, "fragments"},
+		{`{ routes @skip(if: true) { id } }`, "", nil, "directives"},
+		{`mutation { routes { id } }`, "", nil, "only queries"},
+		{`subscription { routes { id } }`, "", nil, "only queries"},
+		{`query`, "", nil, "expected a name"},
+		{`query (`, "", nil, `expected '$'`},
+		{`query ($id) { routes { id } }`, "", nil, `expected ':'`},
+		{`query ($id: [String) { routes { id } }`, "", nil, `expected ']'`},
+		{`query ($id: String = ) { routes { id } }`, "", nil, "expected a name"},
+		{`query A { routes { id } } query B { routes { id } }`, "", nil, "operationName is required"},
+		{`query A { routes { id } }`, "B", nil, "no operation named B"},
+		{`{ routes { id } } extra`, "", nil, "only queries"},
+		{strings.Repeat("{ a ", 1000), "", nil, "nested more than"},
+		{`{ routes(bbox: ` + strings.Repeat("[", 1000) + `) { id } }`, "", nil, "nested more than"},
+		{`query ($v: ` + strings.Repeat("[", 1000) + `) { routes { id } }`, "", nil, "nested more than"},
+		// Valid syntax, but not for the schema
+		{`{ stops { id } }`, "", nil, "Query has no field stops"},
+		{`{ routes }`, "", nil, "Route needs a selection of fields"},
+		{`{ routes { id { value } } }`, "", nil, "String has no fields to select"},
+		{`{ routes(color: "red") { id } }`, "", nil, "unknown argument color"},
+		{`{ route { id } }`, "", nil, "argument id is required"},
+		{`{ route(id: 99) { id } }`, "", nil, "argument id must be of type String"},
+		{`{ routes(limit: 1.5) { id } }`, "", nil, "argument limit must be of type Int"},
+		{`{ routes(limit: "1") { id } }`, "", nil, "argument limit must be of type Int"},
+		{`{ routes(limit: 1e300) { id } }`, "", nil, "argument limit must be of type Int"},
+		{`{ routes(bbox: [1, "2"]) { id } }`, "", nil, "must be a list of numbers"},
+		{`{ routes(bbox: 1) { id } }`, "", nil, "must be of type [Float!]"},
+		{`query ($id: String!) { route(id: $id) { id } }`, "", nil, "argument id is required"},
+		{`query ($id: String!) { route(id: $id) { id } }`, "", map[string]any{"id": map[string]any{"a": 1}}, "must be of type String"},
+		{`{ route(id: $undeclared) { id } }`, "", nil, "argument id is required"},
+		{`{ failing }`, "", nil, "resolver failed"},
+	}
+	for _, test := range tests {
+		_, err := runGraphQL(t, g, test.query, test.operationName, test.variables)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got error %v, want one containing %q", test.query, err, test.want)
+		}
+	}
+}
+
+// TestTruncatedGraphQL checks that no prefix of a valid query, nor the query with any one byte replaced, panics.
+func TestTruncatedGraphQL(t *testing.T) {
+	g := testGraphQL()
+	query := "query Q($id: String! = \"99\", $b: [Float!]) { r: route(id: $id) { id, name trips __typename } routes(limit: 2, bbox: $b) { id } } # end"
+	for i := range query {
+		runGraphQL(t, g, query[:i], "", nil)
+		for _, c := range []byte("{}()[]\"\\$:!=#,.@ a1-") {
+			mutated := query[:i] + string(c) + query[i+1:]
+			runGraphQL(t, g, mutated, "", map[string]any{"b": []any{1.0, "x"}})
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+//go:generate protoc --proto_path=proto --go_out=proto --go_opt=paths=source_relative --go-grpc_out=proto --go-grpc_opt=paths=source_relative gtfsscraper/v1/query.proto
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	gtfsscraperv1 "github.com/touchesir/gtfs-scraper/proto/gtfsscraper/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// The gRPC service is defined in proto/gtfsscraper/v1/query.proto, and its Go code generated from it with
+// protoc-gen-go and protoc-gen-go-grpc. Clients can also fetch its descriptors with server reflection,
+// e.g. grpcurl -plaintext localhost:9090 describe gtfsscraper.v1.Query
+
+// How often PositionHistory checks for new positions when following
+const followInterval = 5 * time.Second
+
+// positionMessage copies a position's columns into its message. A new column needs a field in query.proto too.
+func positionMessage(p VehiclePosition) *gtfsscraperv1.VehiclePosition {
+	return &gtfsscraperv1.VehiclePosition{
+		FeedId:               p.FeedId,
+		TripId:               p.TripId,
+		RouteId:              p.RouteId,
+		DirectionId:          p.DirectionId,
+		StartTime:            p.StartTimeUnix,
+		ScheduleRelationship: p.ScheduleRelationship,
+		Latitude:             p.Latitude,
+		Longitude:            p.Longitude,
+		Bearing:              p.Bearing,
+		Odometer:             p.Odometer,
+		Speed:                p.Speed,
+		CurrentStopSequence:  p.CurrentStopSequence,
+		StopId:               p.StopId,
+		CurrentStatus:        p.CurrentStatus,
+		Timestamp:            p.TimestampUnix,
+		CongestionLevel:      p.CongestionLevel,
+		OccupancyStatus:      p.OccupancyStatus,
+		OccupancyPercentage:  p.OccupancyPercentage,
+		VehicleId:            p.VehicleId,
+		VehicleLabel:         p.VehicleLabel,
+		LicensePlate:         p.LicensePlate,
+		StartDate:            p.StartDate,
+		WheelchairAccessible: p.WheelchairAccessible,
+		NearestStopId:        p.NearestStopId,
+		AgencyId:             p.AgencyId,
+	}
+}
+
+// alertMessage copies an alert version's columns into its message.
+func alertMessage(a Alert) *gtfsscraperv1.Alert {
+	return &gtfsscraperv1.Alert{
+		FeedId:               a.FeedId,
+		AlertId:              a.AlertId,
+		ContentHash:          a.ContentHash,
+		FirstSeen:            a.FirstSeen,
+		LastSeen:             a.LastSeen,
+		ActivePeriods:        a.ActivePeriods,
+		InformedEntities:     a.InformedEntities,
+		Cause:                a.Cause,
+		CauseDetail:          a.CauseDetail,
+		Effect:               a.Effect,
+		EffectDetail:         a.EffectDetail,
+		SeverityLevel:        a.SeverityLevel,
+		Url:                  a.URL,
+		HeaderText:           a.HeaderText,
+		DescriptionText:      a.DescriptionText,
+		TtsHeaderText:        a.TtsHeaderText,
+		TtsDescriptionText:   a.TtsDescriptionText,
+		Image:                a.Image,
+		ImageAlternativeText: a.ImageAlternativeText,
+	}
+}
+
+// grpcService implements the gtfsscraper.v1.Query service with the REST endpoints' queries.
+type grpcService struct {
+	gtfsscraperv1.UnimplementedQueryServer
+	api *apiServer
+}
+
+// register adds the service to a server, along with server reflection.
+func (s *grpcService) register(server *grpc.Server) {
+	gtfsscraperv1.RegisterQueryServer(server, s)
+	reflection.Register(server)
+}
+
+// grpcError converts an error to a gRPC status, logging unexpected errors.
+func grpcError(err error) error {
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr):
+		return status.Error(codes.InvalidArgument, apiErr.message)
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, "query timed out")
+	}
+	slog.Error("Query failed", "err", err)
+	return status.Error(codes.Internal, "internal error")
+}
+
+// requestParams reads the filters of a request into the parameters of the REST endpoints' queries.
+// Times are Unix seconds, and zero values are unset.
+func requestParams(route, vehicle string, from, to int64, limit int32) (listParams, error) {
+	params := listParams{route: route, vehicle: vehicle, limit: defaultPageLimit}
+	if from != 0 {
+		t := time.Unix(from, 0).UTC()
+		params.from = &t
+	}
+	if to != 0 {
+		t := time.Unix(to, 0).UTC()
+		params.to = &t
+	}
+	if limit != 0 {
+		if err := checkLimit(int(limit)); err != nil {
+			return params, err
+		}
+		params.limit = int(limit)
+	}
+	return params, nil
+}
+
+// LatestPositions returns the latest position of each vehicle, as /v1/vehicles does.
+func (s *grpcService) LatestPositions(ctx context.Context, r *gtfsscraperv1.LatestPositionsRequest) (*gtfsscraperv1.LatestPositionsResponse, error) {
+	params, err := requestParams(r.RouteId, r.VehicleId, r.From, r.To, r.Limit)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	positions, err := s.api.queryLatestPositions(ctx, params, params.limit)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	response := &gtfsscraperv1.LatestPositionsResponse{Positions: make([]*gtfsscraperv1.VehiclePosition, len(positions))}
+	for i, p := range positions {
+		response.Positions[i] = positionMessage(p.VehiclePosition)
+	}
+	return response, nil
+}
+
+// Alerts returns the stored alert versions seen during the time range, as /v1/alerts does.
+func (s *grpcService) Alerts(ctx context.Context, r *gtfsscraperv1.AlertsRequest) (*gtfsscraperv1.AlertsResponse, error) {
+	params, err := requestParams(r.RouteId, "", r.From, r.To, r.Limit)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	alerts, err := s.api.queryAlerts(ctx, params, params.limit)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	response := &gtfsscraperv1.AlertsResponse{Alerts: make([]*gtfsscraperv1.Alert, len(alerts))}
+	for i, a := range alerts {
+		response.Alerts[i] = alertMessage(a.stored)
+	}
+	return response, nil
+}
+
+// PositionHistory streams the positions stored so far in order of time. When following,
+// it then streams positions as they're stored, each batch in order of time, until the client cancels.
+func (s *grpcService) PositionHistory(r *gtfsscraperv1.PositionHistoryRequest, stream gtfsscraperv1.Query_PositionHistoryServer) error {
+	params, err := requestParams(r.RouteId, r.VehicleId, r.From, r.To, 0)
+	if err != nil {
+		return grpcError(err)
+	}
+	ctx := stream.Context()
+	for {
+		// Each batch is the rows stored since the previous one
+		queryCtx, cancel := context.WithTimeout(ctx, dbTimeout)
+		err := s.api.db.Load().GetContext(queryCtx, &params.maxRowId, "SELECT IFNULL(MAX(rowid), 0) FROM vehicle_positions")
+		cancel()
+		if err != nil {
+			return grpcError(err)
+		}
+		for params.maxRowId > params.afterRowId {
+			queryCtx, cancel := context.WithTimeout(ctx, dbTimeout)
+			positions, err := s.api.queryPositions(queryCtx, params, maxPageLimit)
+			cancel()
+			if err != nil {
+				return grpcError(err)
+			}
+			for _, p := range positions {
+				if err := stream.Send(positionMessage(p.VehiclePosition)); err != nil {
+					return err
+				}
+			}
+			if len(positions) < maxPageLimit {
+				break
+			}
+			last := positions[len(positions)-1]
+			params.cursor = &pageCursor{Timestamp: last.TimestampUnix, RowId: last.RowId}
+		}
+		if !r.Follow {
+			return nil
+		}
+		params.afterRowId, params.cursor = params.maxRowId, nil
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-time.After(followInterval):
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	gtfsscraperv1 "github.com/touchesir/gtfs-scraper/proto/gtfsscraper/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// populated returns a row with every field set to a non-zero value.
+func populated[T any]() T {
+	var row T
+	v := reflect.ValueOf(&row).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Pointer {
+			field.Set(reflect.New(field.Type().Elem()))
+			field = field.Elem()
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString("x")
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			field.SetInt(1)
+		case reflect.Uint32:
+			field.SetUint(1)
+		case reflect.Float32, reflect.Float64:
+			field.SetFloat(1)
+		}
+	}
+	return row
+}
+
+// Every column has a field in query.proto, and is copied into it
+func TestRowMessages(t *testing.T) {
+	tests := []struct {
+		row     reflect.Type
+		message proto.Message
+	}{
+		{reflect.TypeOf(VehiclePosition{}), positionMessage(populated[VehiclePosition]())},
+		{reflect.TypeOf(Alert{}), alertMessage(populated[Alert]())},
+	}
+	for _, test := range tests {
+		message := test.message.ProtoReflect()
+		fields := message.Descriptor().Fields()
+		columns := 0
+		for i := 0; i < test.row.NumField(); i++ {
+			column := test.row.Field(i).Tag.Get("db")
+			if column == "" || column == "-" {
+				continue
+			}
+			columns++
+			field := fields.ByName(protoreflect.Name(column))
+			if field == nil {
+				t.Errorf("%s has no field for column %s", message.Descriptor().Name(), column)
+			} else if !message.Has(field) {
+				t.Errorf("%s.%s isn't copied from its column", message.Descriptor().Name(), column)
+			}
+		}
+		if fields.Len() != columns {
+			t.Errorf("%s has %d fields for %d columns", message.Descriptor().Name(), fields.Len(), columns)
+		}
+	}
+	// NULLs stay unset rather than becoming zeros
+	if p := positionMessage(VehiclePosition{VehicleId: "bus-1"}); p.Latitude != nil || p.RouteId != nil {
+		t.Errorf("NULL columns are set: %v", p)
+	}
+}
+
+func TestGRPCQuery(t *testing.T) {
+	db, err := createDatabase(filepath.Join(t.TempDir(), "realtime.db"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, timestamp := range []uint64{1709280000, 1709280030} {
+		feed := positionsFeed(timestamp, "trip-1", "bus-1")
+		feed.Entity = append(feed.Entity, positionsFeed(timestamp, "trip-2", "bus-2").Entity...)
+		if _, err := addVehiclePositions(feed, db, "test", nil, time.UTC, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := &apiServer{}
+	api.db.Store(db)
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	(&grpcService{api: api}).register(server)
+	go server.Serve(listener)
+	defer server.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufconn", grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := gtfsscraperv1.NewQueryClient(conn)
+	ctx := context.Background()
+
+	latest, err := client.LatestPositions(ctx, &gtfsscraperv1.LatestPositionsRequest{From: 1709280000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(latest.Positions); n != 2 {
+		t.Errorf("LatestPositions returned %d positions, want 2", n)
+	}
+	for _, p := range latest.Positions {
+		if p.Timestamp != 1709280030 || p.GetLatitude() == 0 || p.RouteId != nil {
+			t.Errorf("LatestPositions returned %v", p)
+		}
+	}
+
+	tests := []struct {
+		request *gtfsscraperv1.PositionHistoryRequest
+		want    int
+	}{
+		{&gtfsscraperv1.PositionHistoryRequest{}, 4},
+		{&gtfsscraperv1.PositionHistoryRequest{VehicleId: "bus-2"}, 2},
+		{&gtfsscraperv1.PositionHistoryRequest{From: 1709280030}, 2},
+		{&gtfsscraperv1.PositionHistoryRequest{From: 1709280030, To: 1709280030}, 0},
+	}
+	for _, test := range tests {
+		stream, err := client.PositionHistory(ctx, test.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var positions []*gtfsscraperv1.VehiclePosition
+		for {
+			p, err := stream.Recv()
+			if err != nil {
+				break
+			}
+			positions = append(positions, p)
+		}
+		if len(positions) != test.want {
+			t.Errorf("PositionHistory(%v) streamed %d positions, want %d", test.request, len(positions), test.want)
+		}
+		for i := 1; i < len(positions); i++ {
+			if positions[i].Timestamp < positions[i-1].Timestamp {
+				t.Errorf("PositionHistory(%v) streamed positions out of order", test.request)
+			}
+		}
+	}
+
+	if alerts, err := client.Alerts(ctx, &gtfsscraperv1.AlertsRequest{From: 1709280000}); err != nil || len(alerts.Alerts) != 0 {
+		t.Errorf("Alerts: got %v, %v, want none", alerts, err)
+	}
+	if _, err := client.LatestPositions(ctx, &gtfsscraperv1.LatestPositionsRequest{Limit: -1}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("invalid limit: got %v, want InvalidArgument", err)
+	}
+}
@@ -1,105 +1,475 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 )
 
+const defaultFeedId = "default"
+
 type Config struct {
 	DataDir           string
 	StaticURL         string
 	AlertsURL         string
 	TripUpdatesURL    string
 	VehicleUpdatesURL string
-	TimeZone          string
+	// Further endpoints for agencies which split a feed type across several, e.g. one per mode.
+	// Their entities are merged with those from the URL above, dropping duplicates.
+	AlertsURLs         []string
+	TripUpdatesURLs    []string
+	VehicleUpdatesURLs []string
+	TimeZone           string
+	// StartTimeAnchor is how trip start times are converted to instants in TimeZone. "midnight" (default) parses
+	// them as clock times on the start date, which can be ambiguous or nonexistent when clocks change.
+	// "noon" counts them from noon minus 12 hours on the start date, as GTFS defines times, which is unambiguous.
+	StartTimeAnchor string
+	FeedRequest     FeedRequestConfig
+	Auth            FeedAuthConfig
+	OAuth2          OAuth2Config
+	AWSSigV4        AWSSigV4Config
+	Webhooks        []WebhookConfig
+	RateLimits      []RateLimitConfig
+	HTTP            HTTPConfig
+	Simulation      SimulationConfig
+	Pushgateway     PushgatewayConfig
+	Notifications   NotificationsConfig
+	RemoteWrite     RemoteWriteConfig
+	Alerts          AlertsConfig
+	TripUpdates     TripUpdatesConfig
+	Geofences       []GeofenceConfig
+	Archive         ArchiveConfig
+	Replication     ReplicationConfig
+	RawSnapshots    RawSnapshotsConfig
+	// MinPositionIntervalSeconds keeps at most one position per vehicle in each interval of this many seconds,
+	// replacing it with later positions, for polling often while storing a coarser history. 0 keeps every position.
+	MinPositionIntervalSeconds int
+	// CommitRows commits the inserts of a poll every this many rows rather than all at once, so storing a huge feed
+	// doesn't hold the database's write lock throughout, holding up other writers such as pruning and replication.
+	// Rows committed before a poll fails stay stored. 0 stores each poll in one transaction.
+	CommitRows int
+	// CommitIntervalMilliseconds likewise commits the inserts of a poll whenever its transaction has been open this long.
+	CommitIntervalMilliseconds int
+	// DatabaseTimeoutSeconds bounds each database statement or transaction, defaulting to 30.
+	// Bulk operations such as archiving and restoring aren't bounded.
+	DatabaseTimeoutSeconds int
+	// FeedId is stored with every row to tell feeds apart, defaulting to "default".
+	FeedId string
+	// AgencyId is stored in agency_id with each vehicle position and trip update. Unset leaves it NULL.
+	AgencyId      string
+	VehicleLabels VehicleLabelsConfig
+	// Feeds lists several feeds to collect, each with its own FeedId, URLs and optionally time zone and data directory,
+	// in place of the single feed given by the fields above.
+	Feeds []FeedConfig
+	// IsolateFeedData keeps each feed's database, static data and archive in DataDir/<FeedId>.
+	IsolateFeedData bool
+	// listed is set on the config of each feed listed in Feeds, whose static GTFS and archive are kept apart
+	// from the others' within the data directory they may share
+	listed bool
+	// logger logs the feed's messages with the attributes added by withLogAttrs
+	logger *slog.Logger
+	// MaxMemory is a memory budget such as "512MB" sizing the feed, archive and database buffers,
+	// for hosts with little memory. --max-memory overrides it. Unset leaves the buffers unlimited.
+	MaxMemory string
+	// PositionKey is the columns identifying a stored position besides feed_id, from timestamp (required), trip_id
+	// and vehicle_id. It defaults to timestamp and trip_id, which drops positions when several vehicles serve one trip
+	// at once, e.g. coupled trains, where timestamp and vehicle_id suit better. After changing it, run db migrate to
+	// rebuild the vehicle_positions table, which drops rows that are duplicates under the new key. Positions without
+	// a trip are only stored under a key without trip_id.
+	PositionKey []string
+	// NearestStopMeters sets nearest_stop_id on positions without a stop_id to the closest stop on their route within
+	// this many meters, up to 10000, using the latest static GTFS. 0 (default) doesn't.
+	NearestStopMeters float64
+	// TripIdentities records the route, direction and scheduled start time of each trip_id stored on each service
+	// date in trip_identities, using the latest static GTFS, for following trips across static releases which
+	// regenerate trip_ids.
+	TripIdentities bool
+	Daemon         DaemonConfig
+	Logging        LoggingConfig
+	// Schedule lists the commands run periodically when this config is one of those run by supervise.
+	Schedule []ScheduleConfig
+}
+
+// loadConfig reads a config file and fills in defaults.
+func loadConfig(path string) (Config, error) {
+	var config Config
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return config, fmt.Errorf("%s: %w", path, err)
+	}
+	if config.FeedId == "" {
+		config.FeedId = defaultFeedId
+	}
+	// Feeds listed in Feeds are isolated when they're expanded
+	if config.IsolateFeedData && len(config.Feeds) == 0 {
+		config.DataDir = filepath.Join(config.DataDir, config.FeedId)
+	}
+	return config, nil
+}
+
+// globalOptions are the flags given before the command.
+type globalOptions struct {
+	configPath string
+	maxMemory  string
+	feedId     string
+	logLevel   string
+	logFormat  string
 }
 
+// runContext is done when the process is asked to stop other than by a signal, e.g. by the Windows service manager.
+// Long-running commands stop with it as they would when interrupted.
+var runContext = context.Background()
+
 func main() {
+	// Global flags come before the command
+	globalFlags := flag.NewFlagSet("gtfs-scraper", flag.ExitOnError)
+	var options globalOptions
+	globalFlags.StringVar(&options.configPath, "config", configFileName, "config file")
+	globalFlags.StringVar(&options.maxMemory, "max-memory", "", "memory budget such as 512MB, overriding MaxMemory in the config")
+	globalFlags.StringVar(&options.feedId, "feed", "", "FeedId of the one feed in Feeds to run the command for")
+	globalFlags.StringVar(&options.logLevel, "log-level", "", "least severe level logged: debug, info, warn or error, overriding Logging.Level in the config")
+	globalFlags.StringVar(&options.logFormat, "log-format", "", "text or json, overriding Logging.Format in the config")
+	globalFlags.Parse(os.Args[1:])
+	os.Args = append(os.Args[:1], globalFlags.Args()...)
+
 	command := "static"
 	if len(os.Args) > 1 {
 		command = os.Args[1]
 	}
+	// Run by the Windows service manager, the service reports the exit code instead
+	if isService, err := runService(func() error { return run(command, options) }); isService || err != nil {
+		if err != nil {
+			slog.Error("Failed to run as a service", "err", err)
+			os.Exit(exitFailure)
+		}
+		return
+	}
+	// Commands return their failure, having cleaned up after themselves, so all that's left is to say why and exit
+	if err := run(command, options); err != nil {
+		code := exitCode(err)
+		slog.Error("Failed to run "+command, "err", err, "exit_code", code)
+		os.Exit(code)
+	}
+}
 
-	contents, err := os.ReadFile("gtfs-scraper.json")
-	if err != nil {
-		log.Panicln(err)
+// run sets up from the config and runs a command for each feed it's for.
+func run(command string, options globalOptions) error {
+	switch command {
+	case "version":
+		fmt.Println(versionString())
+		return nil
+	case "completion":
+		if len(os.Args) < 3 {
+			return usageError("missing shell, expected one of %v", completionShells)
+		}
+		if os.Args[2] != "months" {
+			return writeCompletion(os.Args[2])
+		}
+	case "init":
+		return initProject(options.configPath, os.Args[2:])
+	case "supervise":
+		return supervise(os.Args[2:], LoggingConfig{Level: options.logLevel, Format: options.logFormat})
 	}
 
-	var config Config
-	err = json.Unmarshal(contents, &config)
+	config, err := loadConfig(options.configPath)
 	if err != nil {
-		log.Panicln(err)
+		return fmt.Errorf("%w: %w", ErrConfig, err)
 	}
-
-	if command == "static" {
-		staticDir := filepath.Join(config.DataDir, "static")
-		err = os.Mkdir(staticDir, 0775)
-		if err != nil && !os.IsExist(err) {
-			log.Panicln(err)
+	if options.logLevel != "" {
+		config.Logging.Level = options.logLevel
+	}
+	if options.logFormat != "" {
+		config.Logging.Format = options.logFormat
+	}
+	if options.maxMemory != "" {
+		config.MaxMemory = options.maxMemory
+	}
+	if err := setupLogging(config.Logging); err != nil {
+		return fmt.Errorf("%w: %w", ErrConfig, err)
+	}
+	configs, err := selectFeeds(config, options.feedId, command)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrConfig, err)
+	}
+	if config.IsolateFeedData || len(config.Feeds) > 0 {
+		for _, c := range configs {
+			if err := os.MkdirAll(c.DataDir, 0775); err != nil {
+				return err
+			}
+		}
+	}
+	if config.DatabaseTimeoutSeconds > 0 {
+		dbTimeout = time.Duration(config.DatabaseTimeoutSeconds) * time.Second
+	}
+	commitRows = config.CommitRows
+	commitInterval = time.Duration(config.CommitIntervalMilliseconds) * time.Millisecond
+	setupRateLimits(config.RateLimits)
+	setups := []func() error{
+		func() error { return setupMemoryBudget(config.MaxMemory) },
+		func() error { return setupHTTP(config.HTTP) },
+		func() error { return setupStartTimes(config) },
+		func() error { return setupPositionKey(config) },
+		func() error { return setupOAuth2(config) },
+		func() error { return setupSigV4(config) },
+		func() error { return setupFeedAuth(config, configs) },
+		func() error { return setupVehicleLabels(configs) },
+		func() error { return checkWebhooks(configs) },
+		func() error { return setupSimulation(configs) },
+	}
+	for _, setup := range setups {
+		if err := setup(); err != nil {
+			return fmt.Errorf("%w: %w", ErrConfig, err)
 		}
-		downloadStatic(staticDir, config.StaticURL)
-		return
 	}
 
-	switch command {
-	case "alerts":
-		feed, err := extractFeed(config.AlertsURL)
-		if err != nil {
-			log.Panicln(err)
-		}
-		log.Println(feed)
-		log.Panicln("archiving alerts not implemented")
-	case "tripupdates":
-		log.Panicln("archiving trip updates not implemented")
-	case "vehicleupdates":
-		feed, err := extractFeed(config.VehicleUpdatesURL)
-		if err != nil {
-			log.Panicln(err)
+	if command == "daemon" {
+		return daemon(configs, os.Args[2:])
+	}
+	if len(configs) == 1 {
+		return runCommand(configs[0], command)
+	}
+	// Each feed runs as if it were the only one, so one failing doesn't stop the rest
+	failed := &feedsError{}
+	for _, c := range configs {
+		if !hasURLFor(c, command) {
+			continue
 		}
+		if err := runCommand(c, command); err != nil {
+			slog.Error("Failed to run "+command, "feed", c.FeedId, "err", err)
+			failed.feeds = append(failed.feeds, c.FeedId)
+			failed.errs = append(failed.errs, err)
+		}
+	}
+	if len(failed.feeds) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// feedsError is the failure of a command run for several feeds, whose errors were logged as they failed.
+type feedsError struct {
+	feeds []string
+	errs  []error
+}
+
+func (e *feedsError) Error() string {
+	return "failed for feeds " + strings.Join(e.feeds, ", ")
+}
 
-		db := setupDatabase(config.DataDir)
-		defer func() {
-			if err := db.Close(); err != nil {
-				log.Panicln(err)
+func (e *feedsError) Unwrap() []error {
+	return e.errs
+}
+
+// runCommand runs a command for one feed.
+func runCommand(config Config, command string) (err error) {
+	config = config.withLogAttrs("feed", config.FeedId, "command", command)
+
+	start := time.Now()
+	defer func() {
+		pushRunMetrics(config.Pushgateway, config.FeedId, command, start, err == nil, runStats)
+		if err != nil {
+			if err := reportFailure(config, command, err); err != nil {
+				config.log().Error("Failed to report the failure", "err", err)
 			}
-		}()
+		}
+		// Batched notifications are sent by whichever run comes after the batch interval
+		if err := flushNotifications(config); err != nil {
+			config.log().Error("Failed to send notifications", "err", err)
+		}
+	}()
+	// Closing a database written to can fail too, which fails the command if nothing else did
+	closeDatabase := func(db *sqlx.DB) {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+	}
 
-		timeZone, err := time.LoadLocation(config.TimeZone)
+	switch command {
+	case "static":
+		staticDir := feedStaticDir(config)
+		if err := os.MkdirAll(staticDir, 0775); err != nil {
+			return err
+		}
+		unlock, err := acquireLock(staticDir+".lock", "static")
 		if err != nil {
-			log.Panicln(err)
+			return err
+		}
+		defer unlock()
+		if err := recoverStatic(staticDir); err != nil {
+			return err
 		}
-		err = addVehiclePositions(feed, db, timeZone)
+		return downloadStatic(staticDir, config.StaticURL, config.Auth)
+	case "alerts", "tripupdates", "vehicleupdates":
+		var zones []geofence
+		var static *staticGTFS
+		switch command {
+		case "vehicleupdates":
+			if zones, err = setupVehiclePolling(config); err != nil {
+				return err
+			}
+			if static, err = setupRemoteWrite(config); err != nil {
+				return err
+			}
+		case "tripupdates":
+			if static, err = setupTripUpdatePolling(config); err != nil {
+				return err
+			}
+		}
+		db, err := setupDatabase(config.DataDir, config.FeedId)
 		if err != nil {
-			log.Panicln(err)
+			return err
+		}
+		defer closeDatabase(db)
+
+		switch command {
+		case "alerts":
+			return pollAlerts(db, config)
+		case "tripupdates":
+			return pollTripUpdates(db, config, static)
+		default:
+			return pollVehiclePositions(db, config, zones, static)
 		}
 	case "archive":
+		if len(os.Args) > 2 && os.Args[2] == "bench" {
+			return archiveBench(config, os.Args[3:])
+		}
+		flags := flag.NewFlagSet("archive", flag.ExitOnError)
+		prune := flags.Bool("prune", false, "delete the positions (but not trip updates) of sealed months from the database once the archive verifies and holds them all, then vacuum it")
+		flags.Parse(os.Args[2:])
 		dbPath := filepath.Join(config.DataDir, "realtime.db")
-		if len(os.Args) > 2 {
-			dbPath = os.Args[2]
+		if flags.NArg() > 0 {
+			dbPath = flags.Arg(0)
 		}
-		db := sqlx.MustOpen("sqlite3", dbPath)
-		defer func() {
-			if err := db.Close(); err != nil {
-				log.Panicln(err)
-			}
-		}()
+		db, err := openDatabase(dbPath, config.FeedId)
+		if err != nil {
+			return err
+		}
+		defer closeDatabase(db)
 
-		var archiveDir string
-		if len(os.Args) > 3 {
-			archiveDir = os.Args[3]
-		} else {
-			archiveDir = filepath.Join(config.DataDir, "archive")
+		archiveDir := feedArchiveDir(config)
+		if flags.NArg() > 1 {
+			archiveDir = flags.Arg(1)
 		}
-		err = archivePartitions(db, archiveDir)
-		if err != nil {
-			log.Panicln(err)
+		if err := archivePartitions(db, archiveDir, config.Archive, provenanceOf(config)); err != nil {
+			return err
+		}
+		if *prune {
+			shardDir := ""
+			if config.Archive.ColdShards {
+				shardDir = feedShardDir(config)
+			}
+			return pruneArchived(db, archiveDir, shardDir, config.Archive, config.FeedId)
+		}
+		return nil
+	case "export":
+		if len(os.Args) < 3 {
+			return usageError("missing export type")
+		}
+		switch os.Args[2] {
+		case "snapshot":
+			return exportSnapshot(config, os.Args[3:])
+		case "arrow":
+			return exportArrow(config, os.Args[3:])
+		case "alerts":
+			return exportAlerts(config, os.Args[3:])
+		case "delay-heatmap":
+			return exportDelayHeatmap(config, os.Args[3:])
+		case "tracks":
+			return exportTracks(config, os.Args[3:])
+		case "gtfs-ride":
+			return exportGTFSRide(config, os.Args[3:])
+		}
+		return usageError("invalid export type: %s", os.Args[2])
+	case "db":
+		if len(os.Args) < 3 {
+			return usageError("missing db command")
+		}
+		switch os.Args[2] {
+		case "backup":
+			if len(os.Args) < 4 {
+				return usageError("missing backup destination")
+			}
+			return backupDatabase(filepath.Join(config.DataDir, "realtime.db"), os.Args[3])
+		case "restore":
+			return restoreDatabase(config, os.Args[3:])
+		case "replicate":
+			return replicate(config, os.Args[3:])
+		case "migrate":
+			return migrateDatabase(config, os.Args[3:])
+		}
+		return usageError("invalid db command: %s", os.Args[2])
+	case "analyze":
+		if len(os.Args) < 3 {
+			return usageError("missing analysis")
+		}
+		switch os.Args[2] {
+		case "occupancy":
+			return analyzeOccupancy(config, os.Args[3:])
+		case "speed-profile":
+			return analyzeSpeedProfile(config, os.Args[3:])
+		case "fleet":
+			return analyzeFleet(config, os.Args[3:])
+		case "deviations":
+			return analyzeDeviations(config, os.Args[3:])
+		case "gps-anomalies":
+			return analyzeGPSAnomalies(config, os.Args[3:])
+		case "gaps":
+			return analyzeGaps(config, os.Args[3:])
+		case "predictions":
+			return analyzePredictions(config, os.Args[3:])
+		}
+		return usageError("invalid analysis: %s", os.Args[2])
+	case "bench":
+		if len(os.Args) < 3 {
+			return usageError("missing benchmark")
+		}
+		switch os.Args[2] {
+		case "ingest":
+			return benchIngest(config, os.Args[3:])
+		case "archive":
+			return benchArchiveWrite(config, os.Args[3:])
+		}
+		return usageError("invalid benchmark: %s", os.Args[2])
+	case "replay":
+		return replay(config, os.Args[2:])
+	case "health":
+		if len(os.Args) < 3 || os.Args[2] != "report" {
+			return usageError("expected health report [flags]")
+		}
+		return healthReport(config, os.Args[3:])
+	case "schema":
+		if len(os.Args) < 3 || os.Args[2] != "export" {
+			return usageError("expected schema export [flags]")
+		}
+		return exportSchema(config, os.Args[3:])
+	case "verify":
+		archiveDir := feedArchiveDir(config)
+		if len(os.Args) > 2 {
+			archiveDir = os.Args[2]
 		}
-	default:
-		log.Panicf("Invalid command: %s\n", command)
+		return verifyArchive(archiveDir, config.Archive)
+	case "dump":
+		return dump(config, os.Args[2:])
+	case "top":
+		return monitor(config, os.Args[2:])
+	case "serve":
+		return serve(config, os.Args[2:])
+	case "completion":
+		// Lists archived months for the completion scripts
+		return printArchivedMonths(config)
+	case "decrypt":
+		return decryptFile(config.Archive.Encryption, os.Args[2:])
 	}
+	return usageError("invalid command: %s", command)
 }
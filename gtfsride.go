@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// BoardAlight is a row of GTFS-ride's board_alight.txt, for a visit of a trip to a stop observed from the positions
+// reported while the vehicle was stopped there. GTFS-realtime has no passenger counts, so rows are load only
+// (record_use 1) and leave boardings, alightings and current_load empty, and the occupancy reported as the vehicle
+// left is given in extension columns, along with the vehicle.
+type BoardAlight struct {
+	TripId               string `parquet:"trip_id"`
+	StopId               string `parquet:"stop_id"`
+	StopSequence         uint32 `parquet:"stop_sequence"`
+	RecordUse            int32  `parquet:"record_use"`
+	ScheduleRelationship *int32 `parquet:"schedule_relationship,optional"`
+	// Dates are YYYYMMDD and times HH:MM:SS in the feed's time zone. The departure is the last position
+	// reported at the stop, so it can be up to a poll interval early.
+	ServiceDate          string  `parquet:"service_date"`
+	ServiceArrivalDate   string  `parquet:"service_arrival_date"`
+	ServiceArrivalTime   string  `parquet:"service_arrival_time"`
+	ServiceDepartureDate string  `parquet:"service_departure_date"`
+	ServiceDepartureTime string  `parquet:"service_departure_time"`
+	VehicleId            string  `parquet:"vehicle_id"`
+	OccupancyStatus      *int32  `parquet:"occupancy_status,optional"`
+	OccupancyPercentage  *uint32 `parquet:"occupancy_percentage,optional"`
+}
+
+// RideFeedInfo is the one row of GTFS-ride's ride_feed_info.txt.
+type RideFeedInfo struct {
+	// 0 is board_alight.txt only
+	RideFiles       int32  `parquet:"ride_files"`
+	RideStartDate   string `parquet:"ride_start_date"`
+	RideEndDate     string `parquet:"ride_end_date"`
+	RideFeedVersion string `parquet:"ride_feed_version"`
+}
+
+// stopVisit is a visit to a stop in progress, ended by the trip's next stop.
+type stopVisit struct {
+	key       arrivalKey
+	row       BoardAlight
+	departure time.Time
+}
+
+// exportGTFSRide writes the stop visits observed in the positions as a GTFS-ride feed, a zip of board_alight.txt
+// and ride_feed_info.txt, for tools which read ridership data in that format. Stop sequences missing from the
+// positions are found in the static GTFS when there is one, and visits without one are left out.
+func exportGTFSRide(config Config, args []string) error {
+	flags := flag.NewFlagSet("export gtfs-ride", flag.ExitOnError)
+	input := addAnalysisFlags(flags, config)
+	staticFile := flags.String("static", "", "static GTFS zip for stop sequences missing from positions (default: the latest download in the static directory, if any)")
+	output := flags.String("output", filepath.Join(config.DataDir, "gtfs-ride.zip"), "output zip")
+	flags.Parse(args)
+
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+	if *staticFile == "" {
+		// The static GTFS is only needed for feeds without stop sequences
+		*staticFile, _ = latestStaticFile(feedStaticDir(config))
+	}
+	var static *staticGTFS
+	if *staticFile != "" {
+		if static, err = loadStaticGTFS(*staticFile, "stop_times.txt"); err != nil {
+			return err
+		}
+		config.log().Info("Loaded stop times", "trips", len(static.stopTimes), "static", *staticFile)
+	}
+
+	var rows []BoardAlight
+	unmatched := 0
+	visits := make(map[tripInstance]*stopVisit)
+	endVisit := func(visit *stopVisit) {
+		local := visit.departure.In(location)
+		visit.row.ServiceDepartureDate, visit.row.ServiceDepartureTime = local.Format(serviceDateLayout), local.Format(time.TimeOnly)
+		rows = append(rows, visit.row)
+	}
+	err = input.forEachPosition(config, location, func(vp *VehiclePosition) {
+		if valueOf(vp.CurrentStatus) != stoppedAtStatus {
+			return
+		}
+		stopId, sequence := valueOf(vp.StopId), vp.CurrentStopSequence
+		if static != nil && (stopId == "" || sequence == nil) {
+			if stopTime, _, found := scheduledArrival(vp, static); found {
+				stopId, sequence = stopTime.StopId, &stopTime.StopSequence
+			}
+		}
+		if stopId == "" || sequence == nil {
+			unmatched++
+			return
+		}
+		instance := tripInstance{vp.VehicleId, vp.TripId, vp.StartTimeUnix}
+		key := arrivalKey{vp.TripId, vp.StartTimeUnix, stopId, *sequence}
+		visit := visits[instance]
+		if visit != nil && visit.key != key {
+			endVisit(visit)
+			visit = nil
+		}
+		if visit == nil {
+			serviceDate := valueOf(vp.StartDate)
+			if serviceDate == "" {
+				serviceDate = vp.StartTime.In(location).Format(serviceDateLayout)
+			}
+			local := vp.Timestamp.In(location)
+			visit = &stopVisit{key: key, row: BoardAlight{
+				TripId:               vp.TripId,
+				StopId:               stopId,
+				StopSequence:         *sequence,
+				RecordUse:            1,
+				ScheduleRelationship: copyOptional(vp.ScheduleRelationship),
+				ServiceDate:          serviceDate,
+				ServiceArrivalDate:   local.Format(serviceDateLayout),
+				ServiceArrivalTime:   local.Format(time.TimeOnly),
+				VehicleId:            vp.VehicleId,
+			}}
+			visits[instance] = visit
+		}
+		visit.departure = vp.Timestamp
+		if vp.OccupancyStatus != nil || vp.OccupancyPercentage != nil {
+			visit.row.OccupancyStatus, visit.row.OccupancyPercentage = copyOptional(vp.OccupancyStatus), copyOptional(vp.OccupancyPercentage)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, visit := range visits {
+		endVisit(visit)
+	}
+	if unmatched > 0 {
+		config.log().Warn("Left out positions stopped at an unknown stop or stop sequence", "positions", unmatched)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.ServiceDate != b.ServiceDate {
+			return a.ServiceDate < b.ServiceDate
+		}
+		if a.TripId != b.TripId {
+			return a.TripId < b.TripId
+		}
+		if a.VehicleId != b.VehicleId {
+			return a.VehicleId < b.VehicleId
+		}
+		return a.StopSequence < b.StopSequence
+	})
+
+	info := RideFeedInfo{RideFeedVersion: time.Now().In(location).Format(serviceDateLayout)}
+	if len(rows) > 0 {
+		info.RideStartDate, info.RideEndDate = rows[0].ServiceDate, rows[len(rows)-1].ServiceDate
+	}
+	if err := writeGTFSRide(*output, rows, info); err != nil {
+		return err
+	}
+	config.log().Info("Wrote stop visits", "visits", len(rows), "output", *output)
+	return nil
+}
+
+// writeGTFSRide writes the files of a GTFS-ride feed to a zip, through a staging file.
+func writeGTFSRide(output string, rows []BoardAlight, info RideFeedInfo) (err error) {
+	stagingPath := output + ".tmp"
+	f, err := os.Create(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(stagingPath)
+		}
+	}()
+	archive := zip.NewWriter(f)
+	files := []struct {
+		name  string
+		write func(w *bufio.Writer) error
+	}{
+		{"board_alight.txt", func(w *bufio.Writer) error { return writeAnalysisCSV(w, rows) }},
+		{"ride_feed_info.txt", func(w *bufio.Writer) error { return writeAnalysisCSV(w, []RideFeedInfo{info}) }},
+	}
+	for _, file := range files {
+		entry, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(entry)
+		if err := file.write(w); err != nil {
+			return fmt.Errorf("%s: %w", file.name, err)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if err = archive.Close(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(stagingPath, output)
+}
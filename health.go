@@ -0,0 +1,387 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/jmoiron/sqlx"
+)
+
+var feedHealthColumns = []ColumnInfo{
+	{Name: "feed_id", Type: "TEXT NOT NULL"},
+	{Name: "feed_type", Type: "TEXT NOT NULL"},
+	{Name: "polled_at", Type: "DATETIME NOT NULL"},
+	{Name: "success", Type: "BOOLEAN NOT NULL"},
+	{Name: "http_status", Type: "INTEGER"},
+	{Name: "latency_ms", Type: "INTEGER"},
+	{Name: "entity_count", Type: "INTEGER"},
+	{Name: "header_age_seconds", Type: "INTEGER"},
+	{Name: "error", Type: "TEXT"},
+}
+
+func createFeedHealthTableQuery() string {
+	return createTableIfNotExistsQuery("feed_health", feedHealthColumns, "feed_id, feed_type, polled_at")
+}
+
+var feedFetchColumns = []ColumnInfo{
+	{Name: "feed_id", Type: "TEXT NOT NULL"},
+	{Name: "feed_type", Type: "TEXT NOT NULL"},
+	{Name: "polled_at", Type: "DATETIME NOT NULL"},
+	{Name: "url", Type: "TEXT NOT NULL"},
+	{Name: "http_status", Type: "INTEGER"},
+	{Name: "latency_ms", Type: "INTEGER"},
+	{Name: "last_modified", Type: "TEXT"},
+	{Name: "etag", Type: "TEXT"},
+	{Name: "age", Type: "TEXT"},
+	{Name: "cache_control", Type: "TEXT"},
+	{Name: "server", Type: "TEXT"},
+	{Name: "cf_cache_status", Type: "TEXT"},
+}
+
+func createFeedFetchesTableQuery() string {
+	return createTableIfNotExistsQuery("feed_fetches", feedFetchColumns, "feed_id, feed_type, polled_at, url")
+}
+
+// FeedFetch is one request made by a poll, with the response headers which help debug stale CDN caches.
+type FeedFetch struct {
+	FeedId        string  `db:"feed_id"`
+	FeedType      string  `db:"feed_type"`
+	PolledAtUnix  int64   `db:"polled_at"`
+	URL           string  `db:"url"`
+	HTTPStatus    *int    `db:"http_status"`
+	LatencyMs     int64   `db:"latency_ms"`
+	LastModified  *string `db:"last_modified"`
+	ETag          *string `db:"etag"`
+	Age           *string `db:"age"`
+	CacheControl  *string `db:"cache_control"`
+	Server        *string `db:"server"`
+	CFCacheStatus *string `db:"cf_cache_status"`
+}
+
+// optionalHeader returns a response header's value, or nil if it wasn't sent.
+func optionalHeader(header http.Header, name string) *string {
+	if values := header.Values(name); len(values) > 0 {
+		value := strings.Join(values, ", ")
+		return &value
+	}
+	return nil
+}
+
+// FeedHealth is the outcome of polling a feed type, across all of its URLs.
+type FeedHealth struct {
+	FeedId       string `db:"feed_id"`
+	FeedType     string `db:"feed_type"`
+	PolledAtUnix int64  `db:"polled_at"`
+	Success      bool   `db:"success"`
+	// The status of the last response, which is the failing one if a request failed
+	HTTPStatus *int   `db:"http_status"`
+	LatencyMs  *int64 `db:"latency_ms"`
+	// Entities after merging, and the age of the feed header's timestamp when polled
+	EntityCount      *int64  `db:"entity_count"`
+	HeaderAgeSeconds *int64  `db:"header_age_seconds"`
+	Error            *string `db:"error"`
+}
+
+// pollFeed retrieves a feed type from its URLs and records the outcome in feed_health.
+// Failing to record the outcome is logged rather than failing the poll.
+func pollFeed(db *sqlx.DB, config Config, feedType string, urls []string) (*feedPoll, error) {
+	polledAt := time.Now()
+	var stored map[string]FeedVersion
+	if !config.HTTP.RefetchUnchanged {
+		var err error
+		if stored, err = loadFeedVersions(db, config.FeedId, feedType); err != nil {
+			return nil, err
+		}
+	}
+	feed, fetches, err := extractFeeds(urls, config.FeedRequest, config.Auth, config.FeedId, stored)
+	poll := &feedPoll{feed: feed, unchanged: stored != nil && err == nil, versioned: stored != nil, feedId: config.FeedId, feedType: feedType, fetches: fetches}
+	for _, fetch := range fetches {
+		poll.unchanged = poll.unchanged && fetch.notModified
+	}
+	if config.RawSnapshots.Enabled && err == nil && !poll.unchanged {
+		// Like the feed health, a failure to keep them shouldn't keep the feed from being stored
+		if err := saveRawSnapshots(config, feedType, polledAt, fetches); err != nil {
+			slog.Warn("Failed to keep raw snapshots", "err", err)
+		}
+	}
+
+	health := FeedHealth{
+		FeedId:       config.FeedId,
+		FeedType:     feedType,
+		PolledAtUnix: polledAt.Unix(),
+		Success:      err == nil,
+	}
+	if len(fetches) > 0 {
+		if status := fetches[len(fetches)-1].statusCode; status != 0 {
+			health.HTTPStatus = &status
+		}
+		var latency time.Duration
+		for _, fetch := range fetches {
+			latency += fetch.latency
+		}
+		ms := latency.Milliseconds()
+		health.LatencyMs = &ms
+	}
+	if err != nil {
+		message := err.Error()
+		health.Error = &message
+	} else {
+		// An unchanged feed's entities aren't parsed, or it's the same feed as last time
+		if !poll.unchanged {
+			count := int64(len(feed.Entity))
+			health.EntityCount = &count
+		}
+		if t := feed.GetHeader().GetTimestamp(); t > 0 {
+			age := polledAt.Unix() - int64(t)
+			health.HeaderAgeSeconds = &age
+		}
+	}
+	if recordErr := recordPoll(db, &health, fetches); recordErr != nil {
+		slog.Warn("Failed to record feed health", "err", recordErr)
+	}
+	return poll, err
+}
+
+// feedPoll is the outcome of polling a feed type.
+type feedPoll struct {
+	feed *gtfs.FeedMessage
+	// Set if every URL's feed is the version stored last, when feed is only a header for reporting staleness
+	unchanged bool
+
+	versioned bool
+	feedId    string
+	feedType  string
+	fetches   []feedFetch
+}
+
+// stored records the versions of the poll's feeds once they're stored, so later polls can skip them while
+// they're unchanged. Failing to record them only costs storing them again, so it's logged.
+func (p *feedPoll) stored(db *sqlx.DB) {
+	if !p.versioned {
+		return
+	}
+	if err := saveFeedVersions(db, p.feedId, p.feedType, p.fetches); err != nil {
+		slog.Warn("Failed to record feed versions", "err", err)
+	}
+}
+
+// recordPoll stores the outcome of a poll and each of its requests.
+func recordPoll(db *sqlx.DB, health *FeedHealth, fetches []feedFetch) error {
+	ctx, cancel := dbContext()
+	defer cancel()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.NamedExecContext(ctx, insertIntoQuery("feed_health", feedHealthColumns), health); err != nil {
+		return err
+	}
+	for _, f := range fetches {
+		fetch := FeedFetch{
+			FeedId:        health.FeedId,
+			FeedType:      health.FeedType,
+			PolledAtUnix:  health.PolledAtUnix,
+			URL:           f.url,
+			LatencyMs:     f.latency.Milliseconds(),
+			LastModified:  optionalHeader(f.header, "Last-Modified"),
+			ETag:          optionalHeader(f.header, "ETag"),
+			Age:           optionalHeader(f.header, "Age"),
+			CacheControl:  optionalHeader(f.header, "Cache-Control"),
+			Server:        optionalHeader(f.header, "Server"),
+			CFCacheStatus: optionalHeader(f.header, "CF-Cache-Status"),
+		}
+		if f.statusCode != 0 {
+			fetch.HTTPStatus = copyOptional(&f.statusCode)
+		}
+		if _, err := tx.NamedExecContext(ctx, insertIntoQuery("feed_fetches", feedFetchColumns), &fetch); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type healthKey struct {
+	feedId   string
+	feedType string
+	day      string
+}
+
+type healthSummary struct {
+	polls, successes, stale int64
+	latencies               []int64
+	entities                int64
+	maxHeaderAge            *int64
+	gaps                    int64
+	longestGap              time.Duration
+}
+
+type dataGap struct {
+	feedId, feedType string
+	start, end       time.Time
+}
+
+// percentile returns the p-th percentile of sorted values, by the nearest rank.
+func percentile(sorted []int64, p float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// healthReport summarizes the feed health history by feed, feed type and local date,
+// then lists the gaps in data between successful polls.
+func healthReport(config Config, args []string) error {
+	flags := flag.NewFlagSet("health report", flag.ExitOnError)
+	dbPath := flags.String("db", filepath.Join(config.DataDir, "realtime.db"), "realtime database")
+	from := flags.String("from", "", "first date to report, as YYYY-MM-DD (default: start of the history)")
+	to := flags.String("to", "", "date to report up to, exclusive, as YYYY-MM-DD (default: end of the history)")
+	gap := flags.Duration("gap", 5*time.Minute, "time without a successful poll, or header age, counted as a gap in data")
+	flags.Parse(args)
+
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+	fromTime, err := parseExportDate(*from, location)
+	if err != nil {
+		return fmt.Errorf("invalid --from: %w", err)
+	}
+	toTime, err := parseExportDate(*to, location)
+	if err != nil {
+		return fmt.Errorf("invalid --to: %w", err)
+	}
+
+	// Opened read-only, so the report never blocks the scraper
+	db, err := sqlx.Open("sqlite3", readOnlyURI(*dbPath))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	query := `SELECT feed_id, feed_type, CAST(polled_at AS INT) AS polled_at, success, http_status, latency_ms,
+		entity_count, header_age_seconds, error FROM feed_health WHERE polled_at >= ?`
+	queryArgs := []any{fromTime.Unix()}
+	if !toTime.IsZero() {
+		query += " AND polled_at < ?"
+		queryArgs = append(queryArgs, toTime.Unix())
+	}
+	ctx, cancel := dbContext()
+	defer cancel()
+	rows, err := db.QueryxContext(ctx, query+" ORDER BY feed_id, feed_type, polled_at", queryArgs...)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return fmt.Errorf("no feed health history in %s yet", *dbPath)
+		}
+		return err
+	}
+	defer rows.Close()
+
+	summaries := make(map[healthKey]*healthSummary)
+	var keys []healthKey
+	var gaps []dataGap
+	var lastSuccess time.Time
+	var lastFeed [2]string
+	for rows.Next() {
+		var health FeedHealth
+		if err := rows.StructScan(&health); err != nil {
+			return err
+		}
+		polledAt := time.Unix(health.PolledAtUnix, 0).In(location)
+		key := healthKey{health.FeedId, health.FeedType, polledAt.Format(time.DateOnly)}
+		summary, found := summaries[key]
+		if !found {
+			summary = &healthSummary{}
+			summaries[key] = summary
+			keys = append(keys, key)
+		}
+		if feed := [2]string{health.FeedId, health.FeedType}; feed != lastFeed {
+			lastFeed = feed
+			lastSuccess = time.Time{}
+		}
+
+		summary.polls++
+		if health.LatencyMs != nil {
+			summary.latencies = append(summary.latencies, *health.LatencyMs)
+		}
+		if !health.Success {
+			continue
+		}
+		summary.successes++
+		if health.EntityCount != nil {
+			summary.entities += *health.EntityCount
+		}
+		if age := health.HeaderAgeSeconds; age != nil {
+			if summary.maxHeaderAge == nil || *age > *summary.maxHeaderAge {
+				summary.maxHeaderAge = copyOptional(age)
+			}
+			if time.Duration(*age)*time.Second > *gap {
+				summary.stale++
+			}
+		}
+		if !lastSuccess.IsZero() {
+			if elapsed := polledAt.Sub(lastSuccess); elapsed > *gap {
+				summary.gaps++
+				if elapsed > summary.longestGap {
+					summary.longestGap = elapsed
+				}
+				gaps = append(gaps, dataGap{health.FeedId, health.FeedType, lastSuccess, polledAt})
+			}
+		}
+		lastSuccess = polledAt
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		fmt.Println("No polls recorded in this range")
+		return nil
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "FEED\tTYPE\tDATE\tPOLLS\tUPTIME\tP50 LATENCY\tP95 LATENCY\tAVG ENTITIES\tSTALE\tMAX HEADER AGE\tGAPS\tLONGEST GAP")
+	for _, key := range keys {
+		s := summaries[key]
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		avgEntities, maxAge := "-", "-"
+		if s.successes > 0 {
+			avgEntities = fmt.Sprintf("%.1f", float64(s.entities)/float64(s.successes))
+		}
+		if s.maxHeaderAge != nil {
+			maxAge = (time.Duration(*s.maxHeaderAge) * time.Second).String()
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%.1f%%\t%dms\t%dms\t%s\t%d\t%s\t%d\t%v\n",
+			key.feedId, key.feedType, key.day, s.polls, 100*float64(s.successes)/float64(s.polls),
+			percentile(s.latencies, 50), percentile(s.latencies, 95), avgEntities, s.stale, maxAge,
+			s.gaps, s.longestGap.Round(time.Second))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	if len(gaps) > 0 {
+		fmt.Printf("\nGaps longer than %v between successful polls:\n", *gap)
+		table = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "FEED\tTYPE\tFROM\tTO\tDURATION")
+		for _, g := range gaps {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%v\n",
+				g.feedId, g.feedType, g.start.Format(time.DateTime), g.end.Format(time.DateTime), g.end.Sub(g.start).Round(time.Second))
+		}
+		return table.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Delays beyond this are assumed to come from a bad trip or stop match rather than the bus being late
+const maxPlausibleDelay = 3 * time.Hour
+
+// stoppedAtStatus is the VehicleStopStatus for a vehicle standing at a stop.
+const stoppedAtStatus = 1
+
+// DelaySummary is the delay observed at a stop during one hour of the day.
+type DelaySummary struct {
+	StopId       string   `parquet:"stop_id" json:"stop_id"`
+	StopName     string   `parquet:"stop_name" json:"stop_name"`
+	Latitude     *float64 `parquet:"stop_lat,optional" json:"-"`
+	Longitude    *float64 `parquet:"stop_lon,optional" json:"-"`
+	Hour         int32    `parquet:"hour" json:"hour"`
+	Observations int64    `parquet:"observations" json:"observations"`
+	// Positive delays are late arrivals, negative are early
+	MeanDelay   float64 `parquet:"mean_delay_seconds" json:"mean_delay_seconds"`
+	MedianDelay float64 `parquet:"median_delay_seconds" json:"median_delay_seconds"`
+}
+
+type delayKey struct {
+	stopId string
+	hour   int32
+}
+
+// arrivalKey identifies a visit to a stop by one trip on one service day.
+type arrivalKey struct {
+	tripId    string
+	startTime int64
+	stopId    string
+	sequence  uint32
+}
+
+// scheduledArrival finds the scheduled arrival of a position's trip at its current stop.
+// Stop times are relative to the trip's first departure, which is anchored on the start time from the feed
+// so frequency-based trips and trips past midnight line up too.
+func scheduledArrival(vp *VehiclePosition, static *staticGTFS) (stopTime StopTime, arrival time.Time, found bool) {
+	stopTimes := static.stopTimes[vp.TripId]
+	if len(stopTimes) == 0 || vp.StartTimeUnix == 0 {
+		return StopTime{}, time.Time{}, false
+	}
+	for _, st := range stopTimes {
+		if vp.CurrentStopSequence != nil && st.StopSequence == *vp.CurrentStopSequence ||
+			vp.CurrentStopSequence == nil && st.StopId == valueOf(vp.StopId) {
+			offset := time.Duration(st.ArrivalTime-stopTimes[0].DepartureTime) * time.Second
+			return st, time.Unix(vp.StartTimeUnix, 0).Add(offset), true
+		}
+	}
+	return StopTime{}, time.Time{}, false
+}
+
+// exportDelayHeatmap writes the average delay at each stop for each hour of the day, comparing when vehicles were
+// first seen stopped at a stop against the static schedule. The output is GeoJSON points if it ends in .geojson,
+// otherwise Parquet or CSV as for the analyze commands.
+func exportDelayHeatmap(config Config, args []string) error {
+	flags := flag.NewFlagSet("export delay-heatmap", flag.ExitOnError)
+	input := addAnalysisFlags(flags, config)
+	staticFile := flags.String("static", "", "static GTFS zip (default: the latest download in the static directory)")
+	output := flags.String("output", filepath.Join(config.DataDir, "delay-heatmap.csv"), "output file, as GeoJSON if it ends in .geojson, Parquet if it ends in .parquet and CSV otherwise")
+	flags.Parse(args)
+
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+	if *staticFile == "" {
+		if *staticFile, err = latestStaticFile(feedStaticDir(config)); err != nil {
+			return err
+		}
+	}
+	static, err := loadStaticGTFS(*staticFile, "stops.txt", "stop_times.txt")
+	if err != nil {
+		return err
+	}
+	config.log().Info("Loaded stop times", "trips", len(static.stopTimes), "static", *staticFile)
+
+	seen := make(map[arrivalKey]bool)
+	delays := make(map[delayKey][]float64)
+	unmatched := 0
+	err = input.forEachPosition(config, location, func(vp *VehiclePosition) {
+		if valueOf(vp.CurrentStatus) != stoppedAtStatus {
+			return
+		}
+		stopTime, scheduled, found := scheduledArrival(vp, static)
+		if !found {
+			unmatched++
+			return
+		}
+		// Positions are in time order, so the first one at a stop is the arrival
+		key := arrivalKey{vp.TripId, vp.StartTimeUnix, stopTime.StopId, stopTime.StopSequence}
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		delay := vp.Timestamp.Sub(scheduled)
+		if delay > maxPlausibleDelay || delay < -maxPlausibleDelay {
+			unmatched++
+			return
+		}
+		bucket := delayKey{stopTime.StopId, int32(vp.Timestamp.In(location).Hour())}
+		delays[bucket] = append(delays[bucket], delay.Seconds())
+	})
+	if err != nil {
+		return err
+	}
+	if unmatched > 0 {
+		config.log().Warn("Skipped positions which didn't match the schedule", "positions", unmatched)
+	}
+
+	results := make([]DelaySummary, 0, len(delays))
+	for key, values := range delays {
+		sort.Float64s(values)
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		median := values[len(values)/2]
+		if len(values)%2 == 0 {
+			median = (values[len(values)/2-1] + values[len(values)/2]) / 2
+		}
+		summary := DelaySummary{
+			StopId:       key.stopId,
+			Hour:         key.hour,
+			Observations: int64(len(values)),
+			MeanDelay:    sum / float64(len(values)),
+			MedianDelay:  median,
+		}
+		if stop, found := static.stops[key.stopId]; found {
+			summary.StopName = stop.Name
+			summary.Latitude = &stop.Latitude
+			summary.Longitude = &stop.Longitude
+		}
+		results = append(results, summary)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].StopId != results[j].StopId {
+			return results[i].StopId < results[j].StopId
+		}
+		return results[i].Hour < results[j].Hour
+	})
+
+	if filepath.Ext(*output) == ".geojson" {
+		return writeDelayGeoJSON(*output, results)
+	}
+	return writeAnalysis(*output, results)
+}
+
+type geoJSONFeature struct {
+	Type       string `json:"type"`
+	Geometry   any    `json:"geometry"`
+	Properties any    `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// writeDelayGeoJSON writes a point feature for each stop and hour. Stops without coordinates are left out.
+func writeDelayGeoJSON(output string, results []DelaySummary) error {
+	collection := struct {
+		Type     string           `json:"type"`
+		Features []geoJSONFeature `json:"features"`
+	}{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	for _, summary := range results {
+		if summary.Latitude == nil || summary.Longitude == nil {
+			continue
+		}
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONPoint{Type: "Point", Coordinates: [2]float64{*summary.Longitude, *summary.Latitude}},
+			Properties: summary,
+		})
+	}
+	contents, err := json.Marshal(collection)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(output, contents); err != nil {
+		return err
+	}
+	slog.Info("Wrote features", "features", len(collection.Features), "output", output)
+	return nil
+}
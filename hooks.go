@@ -0,0 +1,65 @@
+package main
+
+import "log/slog"
+
+// Hooks let code embedding the scraper filter, enrich or forward each poll's rows without changing the pipeline.
+// Register them before polling, as they aren't safe to add concurrently.
+
+// A BatchFilter is called with the rows decoded from a poll before they're stored, and returns the rows to store,
+// which it may change, drop or add to. An error aborts the poll without storing anything.
+type BatchFilter[T any] func(batch []T) ([]T, error)
+
+// A BatchObserver is called with the rows newly stored from a poll, once they're committed.
+// Its errors are logged rather than failing the poll, as the rows are already stored.
+type BatchObserver[T any] func(stored []T) error
+
+type batchHooks[T any] struct {
+	filters   []BatchFilter[T]
+	observers []BatchObserver[T]
+}
+
+func (h *batchHooks[T]) add(filter BatchFilter[T], observer BatchObserver[T]) {
+	if filter != nil {
+		h.filters = append(h.filters, filter)
+	}
+	if observer != nil {
+		h.observers = append(h.observers, observer)
+	}
+}
+
+// filter runs the filters in the order they were registered, each on the previous one's result.
+func (h *batchHooks[T]) filter(batch []T) ([]T, error) {
+	for _, filter := range h.filters {
+		var err error
+		if batch, err = filter(batch); err != nil {
+			return nil, err
+		}
+	}
+	return batch, nil
+}
+
+func (h *batchHooks[T]) notify(stored []T) {
+	for _, observer := range h.observers {
+		if err := observer(stored); err != nil {
+			slog.Error("Failed to deliver stored rows", "err", err)
+		}
+	}
+}
+
+var (
+	positionHooks batchHooks[VehiclePosition]
+	alertHooks    batchHooks[Alert]
+)
+
+// OnPositions registers hooks for the vehicle positions of each poll. Either may be nil.
+// Filters changing times must set StartTimeUnix and TimestampUnix, which are what's stored.
+// The observer is called with the positions inserted, not those already stored by an earlier poll.
+func OnPositions(filter BatchFilter[VehiclePosition], observer BatchObserver[VehiclePosition]) {
+	positionHooks.add(filter, observer)
+}
+
+// OnAlert registers hooks for the alerts of each poll. Either may be nil.
+// The observer is called with the new alert versions, not those only seen again.
+func OnAlert(filter BatchFilter[Alert], observer BatchObserver[Alert]) {
+	alertHooks.add(filter, observer)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const configFileName = "gtfs-scraper.json"
+
+// starterConfig holds the settings written by init. Everything else keeps its defaults.
+type starterConfig struct {
+	DataDir           string
+	StaticURL         string
+	AlertsURL         string
+	TripUpdatesURL    string
+	VehicleUpdatesURL string
+	TimeZone          string
+	FeedId            string
+}
+
+// Commands run on a schedule by the example systemd units, with their OnCalendar values.
+var systemdTimers = []struct {
+	command  string
+	schedule string
+}{
+	{"vehicleupdates", "*:*:0/30"},
+	{"static", "daily"},
+	{"archive", "daily"},
+}
+
+const systemdServiceTemplate = `[Unit]
+Description=gtfs-scraper %[1]s
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+WorkingDirectory=%[2]s
+ExecStart=%[3]s %[1]s
+`
+
+const systemdTimerTemplate = `[Unit]
+Description=Run gtfs-scraper %[1]s on a schedule
+
+[Timer]
+OnCalendar=%[2]s
+AccuracySec=1s
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`
+
+// prompter asks for settings which weren't given as flags, if stdin is a terminal.
+type prompter struct {
+	interactive bool
+	input       *bufio.Scanner
+}
+
+func newPrompter() *prompter {
+	return &prompter{
+		interactive: term.IsTerminal(int(os.Stdin.Fd())),
+		input:       bufio.NewScanner(os.Stdin),
+	}
+}
+
+func (p *prompter) ask(flags *flag.FlagSet, name string, value *string, question string) {
+	set := false
+	flags.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	if set || !p.interactive {
+		return
+	}
+	fmt.Printf("%s [%s]: ", question, *value)
+	if p.input.Scan() {
+		if answer := strings.TrimSpace(p.input.Text()); answer != "" {
+			*value = answer
+		}
+	}
+}
+
+// writeSystemdUnits writes a service and timer for each scheduled command.
+// The units run the scraper from the current directory, where the config file lives.
+func writeSystemdUnits(unitDir string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	workingDir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(unitDir, 0755); err != nil {
+		return err
+	}
+	for _, timer := range systemdTimers {
+		name := "gtfs-scraper-" + timer.command
+		service := fmt.Sprintf(systemdServiceTemplate, timer.command, workingDir, executable)
+		if err := os.WriteFile(filepath.Join(unitDir, name+".service"), []byte(service), 0644); err != nil {
+			return err
+		}
+		timerUnit := fmt.Sprintf(systemdTimerTemplate, timer.command, timer.schedule)
+		if err := os.WriteFile(filepath.Join(unitDir, name+".timer"), []byte(timerUnit), 0644); err != nil {
+			return err
+		}
+		slog.Info("Wrote systemd units", "service", name+".service", "timer", name+".timer", "dir", unitDir)
+	}
+	return nil
+}
+
+// initProject writes a starter config to configPath and creates the data directories.
+// It runs before the config is loaded, since there may not be one yet.
+func initProject(configPath string, args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	config := starterConfig{DataDir: "./data", TimeZone: "UTC", FeedId: defaultFeedId}
+	flags.StringVar(&config.DataDir, "data-dir", config.DataDir, "data directory")
+	flags.StringVar(&config.FeedId, "feed-id", config.FeedId, "feed identifier")
+	flags.StringVar(&config.StaticURL, "static-url", "", "static GTFS URL")
+	flags.StringVar(&config.VehicleUpdatesURL, "vehicle-url", "", "GTFS-RT vehicle positions URL")
+	flags.StringVar(&config.TripUpdatesURL, "trip-updates-url", "", "GTFS-RT trip updates URL")
+	flags.StringVar(&config.AlertsURL, "alerts-url", "", "GTFS-RT alerts URL")
+	flags.StringVar(&config.TimeZone, "timezone", config.TimeZone, "time zone of the feed, e.g. America/Vancouver")
+	systemdDir := flags.String("systemd", "", "also write example systemd units and timers to this directory, e.g. ~/.config/systemd/user")
+	force := flags.Bool("force", false, "overwrite an existing config file")
+	flags.Parse(args)
+
+	if *systemdDir != "" && runtime.GOOS == "windows" {
+		return errors.New("systemd units aren't supported on Windows, use Task Scheduler to run the commands instead")
+	}
+	if _, err := os.Stat(configPath); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", configPath)
+	}
+
+	p := newPrompter()
+	p.ask(flags, "data-dir", &config.DataDir, "Data directory")
+	p.ask(flags, "feed-id", &config.FeedId, "Feed identifier")
+	p.ask(flags, "static-url", &config.StaticURL, "Static GTFS URL")
+	p.ask(flags, "vehicle-url", &config.VehicleUpdatesURL, "Vehicle positions URL")
+	p.ask(flags, "trip-updates-url", &config.TripUpdatesURL, "Trip updates URL")
+	p.ask(flags, "alerts-url", &config.AlertsURL, "Alerts URL")
+	p.ask(flags, "timezone", &config.TimeZone, "Time zone")
+
+	contents, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(configPath, append(contents, '\n'), 0664); err != nil {
+		return err
+	}
+	slog.Info("Wrote the config", "path", configPath)
+
+	for _, dir := range []string{config.DataDir, filepath.Join(config.DataDir, "static"), filepath.Join(config.DataDir, "archive")} {
+		if err := os.MkdirAll(dir, 0775); err != nil {
+			return err
+		}
+	}
+	slog.Info("Created the data directory", "path", config.DataDir)
+
+	if *systemdDir != "" {
+		return writeSystemdUnits(*systemdDir)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// VehicleLabelsConfig normalizes the vehicle labels and license plates of positions and trip updates as they're
+// stored, for agencies whose formatting changes over time, e.g. from "Bus 1234" to "1234", which would otherwise
+// split a vehicle's history. Each list of rules is applied in order, and a value left empty is stored as NULL.
+type VehicleLabelsConfig struct {
+	Label        []LabelRule
+	LicensePlate []LabelRule
+}
+
+// LabelRule is one step of normalizing a value. Its replacement is made first, then trimming, then the change of case.
+type LabelRule struct {
+	// Pattern is a regular expression whose every match is replaced with Replace, which can refer to groups as $1.
+	Pattern string
+	Replace string
+	// Trim removes leading and trailing white space.
+	Trim bool
+	// Case is "upper" or "lower" to change the case of the value.
+	Case string
+}
+
+type labelRule struct {
+	pattern *regexp.Regexp
+	LabelRule
+}
+
+type labelNormalizer struct {
+	label        []labelRule
+	licensePlate []labelRule
+}
+
+// Normalizers of the feeds with VehicleLabels rules, by FeedId
+var labelNormalizers = make(map[string]*labelNormalizer)
+
+// setupVehicleLabels compiles the rules of each feed.
+func setupVehicleLabels(configs []Config) error {
+	for _, c := range configs {
+		if len(c.VehicleLabels.Label) == 0 && len(c.VehicleLabels.LicensePlate) == 0 {
+			continue
+		}
+		label, err := compileLabelRules(c.VehicleLabels.Label)
+		if err != nil {
+			return fmt.Errorf("feed %s: VehicleLabels.Label: %w", c.FeedId, err)
+		}
+		licensePlate, err := compileLabelRules(c.VehicleLabels.LicensePlate)
+		if err != nil {
+			return fmt.Errorf("feed %s: VehicleLabels.LicensePlate: %w", c.FeedId, err)
+		}
+		labelNormalizers[c.FeedId] = &labelNormalizer{label: label, licensePlate: licensePlate}
+	}
+	return nil
+}
+
+func compileLabelRules(rules []LabelRule) ([]labelRule, error) {
+	compiled := make([]labelRule, len(rules))
+	for i, rule := range rules {
+		compiled[i].LabelRule = rule
+		if rule.Pattern != "" {
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, err
+			}
+			compiled[i].pattern = pattern
+		} else if rule.Replace != "" {
+			return nil, fmt.Errorf("rule %d has a Replace without a Pattern", i)
+		}
+		if rule.Case != "" && rule.Case != "upper" && rule.Case != "lower" {
+			return nil, fmt.Errorf("invalid Case %q, expected upper or lower", rule.Case)
+		}
+	}
+	return compiled, nil
+}
+
+// normalizeLabel applies rules to a value, returning nil for a value left empty.
+func normalizeLabel(value *string, rules []labelRule) *string {
+	if value == nil || len(rules) == 0 {
+		return value
+	}
+	normalized := *value
+	for _, rule := range rules {
+		if rule.pattern != nil {
+			normalized = rule.pattern.ReplaceAllString(normalized, rule.Replace)
+		}
+		if rule.Trim {
+			normalized = strings.TrimSpace(normalized)
+		}
+		switch rule.Case {
+		case "upper":
+			normalized = strings.ToUpper(normalized)
+		case "lower":
+			normalized = strings.ToLower(normalized)
+		}
+	}
+	if normalized == "" {
+		return nil
+	}
+	return &normalized
+}
+
+// normalizeVehicle normalizes the label and license plate of a feed's vehicle, if it has rules.
+func normalizeVehicle(feedId string, label **string, licensePlate **string) {
+	n := labelNormalizers[feedId]
+	if n == nil {
+		return
+	}
+	*label = normalizeLabel(*label, n.label)
+	*licensePlate = normalizeLabel(*licensePlate, n.licensePlate)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// LoggingConfig sets how messages are logged to standard error. Every message carries its level and the feed and
+// command it's about, and archive messages the partition month, so logs of long-running deployments can be
+// filtered and aggregated.
+type LoggingConfig struct {
+	// Level is the least severe level logged: "debug", "info" (default), "warn" or "error". --log-level overrides it.
+	Level string
+	// Format is "text" (default) for a line of key=value pairs per message, or "json" for a JSON object per message.
+	// --log-format overrides it.
+	Format string
+}
+
+// serviceLog replaces standard error with the system's log when running as a service, if set.
+var serviceLog func(options *slog.HandlerOptions) slog.Handler
+
+// logLevel is the level of the default logger, which can be changed while running.
+var logLevel = new(slog.LevelVar)
+
+// parseLogLevel reads a level name, which is case-insensitive.
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// setupLogging makes the configured logger the default, which messages logged by dependencies through the log
+// package go through too, at the info level.
+func setupLogging(config LoggingConfig) error {
+	if config.Level != "" {
+		level, err := parseLogLevel(config.Level)
+		if err != nil {
+			return err
+		}
+		logLevel.Set(level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch strings.ToLower(config.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid log format %q, expected text or json", config.Format)
+	}
+	if serviceLog != nil {
+		handler = serviceLog(options)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// withLogAttrs returns a copy of a feed's config whose messages, including those of its archive, carry the given
+// attributes besides any it had. Commands and daemon polls log through their config's logger rather than changing
+// the default one, which work running alongside them, like the admin API and replication, logs through.
+func (c Config) withLogAttrs(args ...any) Config {
+	c.logger = c.log().With(args...)
+	c.Archive.logger = c.logger
+	return c
+}
+
+// log returns the logger of a feed's messages, which is the default logger until attributes are added.
+func (c Config) log() *slog.Logger {
+	if c.logger == nil {
+		return slog.Default()
+	}
+	return c.logger
+}
+
+// log returns the logger of an archive's messages, that of the feed's config it's part of.
+func (c ArchiveConfig) log() *slog.Logger {
+	if c.logger == nil {
+		return slog.Default()
+	}
+	return c.logger
+}
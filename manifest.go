@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	manifestName          = "manifest.json"
+	manifestSignatureName = "manifest.json.sig"
+)
+
+// Manifest lists every file in the archive with its checksum, so published copies can be verified.
+type Manifest struct {
+	Updated time.Time      `json:"updated"`
+	Files   []ManifestFile `json:"files"`
+	// Sealed lists the months (YYYY-MM) whose partitions are final and no longer rewritten.
+	Sealed []string `json:"sealed,omitempty"`
+}
+
+type ManifestFile struct {
+	// Path is relative to the archive directory, with forward slashes.
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	SHA256   string    `json:"sha256"`
+}
+
+func readManifest(archiveDir string) (*Manifest, []byte, error) {
+	contents, err := os.ReadFile(filepath.Join(archiveDir, manifestName))
+	if err != nil {
+		return nil, nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		return nil, nil, err
+	}
+	return &manifest, contents, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isArchiveFile reports whether a file in the archive directory belongs in the manifest.
+func isArchiveFile(rel string) bool {
+	return rel != manifestName && rel != manifestSignatureName && path.Base(rel) != archiveCheckpointName &&
+		!strings.HasSuffix(rel, ".tmp")
+}
+
+// scanArchive lists the files in the archive directory. Checksums from a previous manifest
+// are reused for files whose size and modification time haven't changed.
+func scanArchive(archiveDir string, previous *Manifest) ([]ManifestFile, error) {
+	known := make(map[string]ManifestFile)
+	if previous != nil {
+		for _, file := range previous.Files {
+			known[file.Path] = file
+		}
+	}
+
+	var files []ManifestFile
+	err := filepath.WalkDir(archiveDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(archiveDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !isArchiveFile(rel) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		file := ManifestFile{Path: rel, Size: info.Size(), Modified: info.ModTime().UTC()}
+		if old, found := known[rel]; found && old.Size == file.Size && old.Modified.Equal(file.Modified) {
+			file.SHA256 = old.SHA256
+		} else if file.SHA256, err = hashFile(path); err != nil {
+			return err
+		}
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+func readPEM(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", path)
+	}
+	return block.Bytes, nil
+}
+
+// readSigningKey reads an Ed25519 private key in PKCS #8 PEM form,
+// e.g. from `openssl genpkey -algorithm ed25519`.
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", path)
+	}
+	return privateKey, nil
+}
+
+// readVerifyKey reads an Ed25519 public key in PKIX PEM form,
+// e.g. from `openssl pkey -pubout`.
+func readVerifyKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 public key", path)
+	}
+	return publicKey, nil
+}
+
+// writeFileAtomic writes a file through a staging file, so readers never see a partial file.
+func writeFileAtomic(path string, contents []byte) error {
+	stagingPath := path + ".tmp"
+	if err := os.WriteFile(stagingPath, contents, 0664); err != nil {
+		os.Remove(stagingPath)
+		return err
+	}
+	return os.Rename(stagingPath, path)
+}
+
+// sealedMonths returns the months recorded as sealed in the manifest. An unreadable manifest has none,
+// so at worst a sealed month is rewritten again.
+func sealedMonths(archiveDir string) map[string]bool {
+	sealed := make(map[string]bool)
+	manifest, _, err := readManifest(archiveDir)
+	if err != nil {
+		return sealed
+	}
+	for _, ym := range manifest.Sealed {
+		sealed[ym] = true
+	}
+	return sealed
+}
+
+// updateManifest rewrites the archive manifest with the sealed months, and the catalog if enabled, and signs the
+// manifest if a signing key is configured.
+// The signature is the base64-encoded Ed25519 signature of the manifest file's contents.
+func updateManifest(archiveDir string, config ArchiveConfig, provenance archiveProvenance, sealed map[string]bool) error {
+	previous, _, err := readManifest(archiveDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		config.log().Warn("Ignoring unreadable manifest", "err", err)
+	}
+	files, err := scanArchive(archiveDir, previous)
+	if err != nil {
+		return err
+	}
+	if config.Catalog.Enabled {
+		if files, err = updateCatalog(archiveDir, config, provenance, files); err != nil {
+			return err
+		}
+	}
+	manifest := Manifest{Updated: time.Now().UTC(), Files: files}
+	for ym := range sealed {
+		manifest.Sealed = append(manifest.Sealed, ym)
+	}
+	sort.Strings(manifest.Sealed)
+	contents, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(archiveDir, manifestName), contents); err != nil {
+		return err
+	}
+	config.log().Info("Updated manifest", "files", len(files))
+
+	if config.ManifestSigningKey == "" {
+		return nil
+	}
+	key, err := readSigningKey(config.ManifestSigningKey)
+	if err != nil {
+		return err
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, contents))
+	return writeFileAtomic(filepath.Join(archiveDir, manifestSignatureName), []byte(signature+"\n"))
+}
+
+// verifyArchive checks the manifest signature, if a public key is configured,
+// and that every file in the archive matches the manifest.
+func verifyArchive(archiveDir string, config ArchiveConfig) error {
+	manifest, contents, err := readManifest(archiveDir)
+	if err != nil {
+		return err
+	}
+	if config.ManifestPublicKey != "" {
+		key, err := readVerifyKey(config.ManifestPublicKey)
+		if err != nil {
+			return err
+		}
+		encoded, err := os.ReadFile(filepath.Join(archiveDir, manifestSignatureName))
+		if err != nil {
+			return err
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil {
+			return err
+		}
+		if !ed25519.Verify(key, contents, signature) {
+			return fmt.Errorf("%w: manifest signature is invalid", ErrPartitionCorrupt)
+		}
+		config.log().Info("Manifest signature is valid")
+	}
+
+	files, err := scanArchive(archiveDir, nil)
+	if err != nil {
+		return err
+	}
+	actual := make(map[string]ManifestFile, len(files))
+	for _, file := range files {
+		actual[file.Path] = file
+	}
+	var errs []error
+	for _, expected := range manifest.Files {
+		file, found := actual[expected.Path]
+		delete(actual, expected.Path)
+		if !found {
+			errs = append(errs, &PartitionError{Path: expected.Path, Err: errors.New("missing")})
+		} else if file.SHA256 != expected.SHA256 {
+			errs = append(errs, &PartitionError{Path: expected.Path, Err: errors.New("does not match its checksum")})
+		}
+	}
+	for path := range actual {
+		errs = append(errs, &PartitionError{Path: path, Err: errors.New("not in the manifest")})
+	}
+	if len(errs) == 0 {
+		config.log().Info("Verified archive files", "files", len(manifest.Files))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a new Ed25519 key pair as PEM files, returning their paths.
+func writeKeyPair(t *testing.T, dir string, name string) (privatePath string, publicPath string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privatePath, publicPath = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".pub.pem")
+	for path, block := range map[string]*pem.Block{privatePath: {Type: "PRIVATE KEY", Bytes: privateDER}, publicPath: {Type: "PUBLIC KEY", Bytes: publicDER}} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return privatePath, publicPath
+}
+
+func TestManifestSignature(t *testing.T) {
+	keyDir := t.TempDir()
+	signingKey, publicKey := writeKeyPair(t, keyDir, "archive")
+	_, otherPublicKey := writeKeyPair(t, keyDir, "other")
+	partition := "year=2024/month=03/vehicle_positions.parquet"
+
+	tests := []struct {
+		name      string
+		publicKey string
+		tamper    func(archiveDir string) error
+		// A fragment of the expected error, or "" if the archive verifies
+		want string
+	}{
+		{"intact", publicKey, nil, ""},
+		{"without checking the signature", "", nil, ""},
+		{"other key", otherPublicKey, nil, "signature is invalid"},
+		{"edited manifest", publicKey, func(archiveDir string) error {
+			path := filepath.Join(archiveDir, manifestName)
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(path, []byte(strings.Replace(string(contents), `"size": `, `"size": 1`, 1)), 0664)
+		}, "signature is invalid"},
+		{"missing signature", publicKey, func(archiveDir string) error {
+			return os.Remove(filepath.Join(archiveDir, manifestSignatureName))
+		}, manifestSignatureName},
+		{"corrupt signature", publicKey, func(archiveDir string) error {
+			return os.WriteFile(filepath.Join(archiveDir, manifestSignatureName), []byte("not base64!\n"), 0664)
+		}, "illegal base64"},
+		// The signature covers the manifest, which catches changes to the files it lists
+		{"edited partition", publicKey, func(archiveDir string) error {
+			f, err := os.OpenFile(filepath.Join(archiveDir, partition), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.WriteString("extra")
+			return err
+		}, partition + ": does not match its checksum"},
+		{"removed partition", publicKey, func(archiveDir string) error {
+			return os.Remove(filepath.Join(archiveDir, partition))
+		}, partition + ": missing"},
+		{"added partition", publicKey, func(archiveDir string) error {
+			if err := os.MkdirAll(filepath.Join(archiveDir, "year=2024/month=04"), 0755); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(archiveDir, "year=2024/month=04/vehicle_positions.parquet"), nil, 0664)
+		}, "not in the manifest"},
+	}
+	for _, test := range tests {
+		dataDir := t.TempDir()
+		config := Config{DataDir: dataDir, FeedId: "test", Archive: ArchiveConfig{ManifestSigningKey: signingKey, ManifestPublicKey: test.publicKey}}
+		db, err := createDatabase(filepath.Join(dataDir, "realtime.db"), config.FeedId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := addVehiclePositions(positionsFeed(1709280000, "trip-1", "bus-1"), db, config.FeedId, nil, time.UTC, 0); err != nil {
+			t.Fatal(err)
+		}
+		archiveDir := feedArchiveDir(config)
+		err = archivePartitions(db, archiveDir, config.Archive, provenanceOf(config))
+		db.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if test.tamper != nil {
+			if err := test.tamper(archiveDir); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+
+		err = verifyArchive(archiveDir, config.Archive)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.want)
+		case strings.Contains(test.want, "signature is invalid") && !errors.Is(err, ErrPartitionCorrupt):
+			t.Errorf("%s: %v isn't ErrPartitionCorrupt", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// A memory budget set with --max-memory or Config.MaxMemory sizes the buffers that grow with the data
+// from shares of it, so runs on small hosts stay within it rather than being killed partway through.
+// Without a budget, the defaults are used and nothing is limited.
+var (
+	// maxFeedBytes is the largest feed response read, or 0 for no limit
+	maxFeedBytes int64
+	// maxRowGroupRows caps the rows the Parquet writer buffers before flushing a row group, or 0 for no cap
+	maxRowGroupRows int64
+	// maxPageBufferSize caps the Parquet page buffer size of each column, or 0 for no cap
+	maxPageBufferSize int
+	// sqliteCacheKiB is the SQLite page cache size of each connection, or 0 for SQLite's default
+	sqliteCacheKiB int64
+)
+
+// Approximate memory of a row buffered by the Parquet writer or handed to it in a batch,
+// from about 25 columns of 24 byte values plus the encoded copy.
+const (
+	bytesPerRowGroupRow = 256
+	bytesPerBatchRow    = 1024
+	minWriteBatchSize   = 1_000
+)
+
+// setupMemoryBudget applies a budget such as "512MB" or "1GiB". An empty budget leaves the defaults.
+func setupMemoryBudget(value string) error {
+	if value == "" {
+		return nil
+	}
+	budget, err := parseByteSize(value)
+	if err != nil {
+		return fmt.Errorf("invalid memory budget: %w", err)
+	}
+	if budget < 16<<20 {
+		return fmt.Errorf("memory budget %s is below the minimum of 16MiB", value)
+	}
+	// Makes the garbage collector work harder near the budget rather than letting the heap grow past it
+	debug.SetMemoryLimit(budget)
+	maxFeedBytes = budget / 16
+	maxRowGroupRows = budget / 4 / bytesPerRowGroupRow
+	maxPageBufferSize = int(budget / 2048)
+	sqliteCacheKiB = budget / 64 / 1024
+	writeBatchSize = int(min(defaultWriteBatchSize, max(minWriteBatchSize, budget/64/bytesPerBatchRow)))
+	return nil
+}
+
+// budgetRowGroupSize caps a row group size from the config to the memory budget.
+func budgetRowGroupSize(rows int64) int64 {
+	if maxRowGroupRows > 0 {
+		return min(rows, maxRowGroupRows)
+	}
+	return rows
+}
+
+// budgetPageSize caps a page buffer size from the config to the memory budget.
+func budgetPageSize(size int) int {
+	if maxPageBufferSize > 0 {
+		return min(size, maxPageBufferSize)
+	}
+	return size
+}
+
+// sqliteParams returns the connection parameters sizing SQLite's cache to the memory budget, if any.
+func sqliteParams() string {
+	if sqliteCacheKiB == 0 {
+		return ""
+	}
+	// Negative sizes are in KiB rather than pages
+	return "_cache_size=" + strconv.FormatInt(-sqliteCacheKiB, 10)
+}
+
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	// Longer suffixes first, so "MiB" isn't taken for "B"
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+// parseByteSize parses a size such as "512MB", "512MiB", "1.5G" or a plain number of bytes.
+// Units are case insensitive, and single letter units are binary, as with Docker.
+func parseByteSize(s string) (int64, error) {
+	number, multiplier := strings.TrimSpace(s), int64(1)
+	for _, unit := range byteSizeUnits {
+		if cut := len(number) - len(unit.suffix); cut >= 0 && strings.EqualFold(number[cut:], unit.suffix) {
+			number, multiplier = strings.TrimSpace(number[:cut]), unit.multiplier
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("%q isn't a positive size such as 512MB", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
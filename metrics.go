@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+type PushgatewayConfig struct {
+	// URL of a Prometheus Pushgateway, e.g. http://localhost:9091. Metrics aren't pushed if empty.
+	URL string
+	// Job is the job label of pushed metrics, defaulting to gtfs_scraper.
+	Job string
+	// Labels are further grouping labels of pushed metrics, e.g. {"tenant": "acme"} to tell apart configs
+	// sharing a Pushgateway and FeedId. They mustn't be job, feed_id or command.
+	Labels map[string]string
+}
+
+// runMetrics is filled in by commands as they run, and pushed when the process exits.
+type runMetrics struct {
+	rowsInserted int
+	// The feed type whose poll failed, if any
+	failedFeedType string
+}
+
+var runStats runMetrics
+
+const pushgatewayTimeout = 10 * time.Second
+
+// formatRunMetrics renders metrics for one run in the Prometheus text exposition format.
+func formatRunMetrics(start time.Time, success bool, stats runMetrics) []byte {
+	var b bytes.Buffer
+	gauge := func(name string, help string, value float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+	}
+	successValue := 0.0
+	if success {
+		successValue = 1
+	}
+	gauge("gtfs_scraper_last_run_success", "Whether the last run completed without errors.", successValue)
+	gauge("gtfs_scraper_last_run_duration_seconds", "Duration of the last run.", time.Since(start).Seconds())
+	gauge("gtfs_scraper_last_run_timestamp_seconds", "Unix time the last run finished.", float64(time.Now().Unix()))
+	gauge("gtfs_scraper_last_run_rows_inserted", "Rows inserted into the database by the last run.", float64(stats.rowsInserted))
+	return b.Bytes()
+}
+
+// pushgatewayGroupPath returns the grouping key path of a feed's metrics, without the command label.
+func pushgatewayGroupPath(config PushgatewayConfig, feedId string) string {
+	job := config.Job
+	if job == "" {
+		job = "gtfs_scraper"
+	}
+	path := "/metrics/job/" + url.PathEscape(job) + "/feed_id/" + url.PathEscape(feedId)
+	names := make([]string, 0, len(config.Labels))
+	for name := range config.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path += "/" + url.PathEscape(name) + "/" + url.PathEscape(config.Labels[name])
+	}
+	return path
+}
+
+// pushRunMetrics replaces the metrics for a feed and command in the Pushgateway group for this job.
+// Failures are only logged, since the run itself has already finished.
+func pushRunMetrics(config PushgatewayConfig, feedId string, command string, start time.Time, success bool, stats runMetrics) {
+	if config.URL == "" {
+		return
+	}
+	logger := slog.With("feed", feedId, "command", command)
+	pushURL := strings.TrimSuffix(config.URL, "/") + pushgatewayGroupPath(config, feedId) + "/command/" + url.PathEscape(command)
+
+	req, err := http.NewRequest(http.MethodPut, pushURL, bytes.NewReader(formatRunMetrics(start, success, stats)))
+	if err != nil {
+		logger.Warn("Failed to push run metrics", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	client := &http.Client{Timeout: pushgatewayTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Warn("Failed to push run metrics", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Warn("Failed to push run metrics", "status", resp.Status)
+	}
+}
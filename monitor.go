@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	monitorWindow = 10 * time.Minute
+	// Feeds without a position for this long are shown as stale
+	staleAfter = 5 * time.Minute
+)
+
+type feedStatus struct {
+	FeedId         string `db:"feed_id"`
+	Newest         int64  `db:"newest"`
+	LastMinute     int64  `db:"last_minute"`
+	LastWindow     int64  `db:"last_window"`
+	ActiveVehicles int64  `db:"active_vehicles"`
+}
+
+const feedStatusQuery = `
+	SELECT
+		newest.feed_id,
+		newest.newest,
+		COALESCE(recent.last_minute, 0) AS last_minute,
+		COALESCE(recent.last_window, 0) AS last_window,
+		COALESCE(recent.active_vehicles, 0) AS active_vehicles
+	FROM (
+		SELECT feed_id, CAST(MAX(timestamp) AS INT) AS newest FROM vehicle_positions GROUP BY feed_id
+	) AS newest LEFT JOIN (
+		SELECT
+			feed_id,
+			SUM(timestamp >= ?) AS last_minute,
+			COUNT(*) AS last_window,
+			COUNT(DISTINCT vehicle_id) AS active_vehicles
+		FROM vehicle_positions WHERE timestamp >= ? GROUP BY feed_id
+	) AS recent ON recent.feed_id = newest.feed_id
+	ORDER BY newest.feed_id
+`
+
+// renderStatus redraws the screen with the status of each feed in the database.
+func renderStatus(db *sqlx.DB, dbPath string) error {
+	now := time.Now()
+	var statuses []feedStatus
+	ctx, cancel := dbContext()
+	defer cancel()
+	err := db.SelectContext(ctx, &statuses, feedStatusQuery, now.Add(-time.Minute).Unix(), now.Add(-monitorWindow).Unix())
+	if err != nil {
+		return err
+	}
+
+	// Clear the screen and move the cursor home
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("gtfs-scraper top - %s - %s\n\n", dbPath, now.Format(time.TimeOnly))
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "FEED\tSTATUS\tNEWEST POSITION\tAGE\tROWS/MIN (1m)\tROWS/MIN (10m)\tVEHICLES (10m)")
+	for _, s := range statuses {
+		newest := time.Unix(s.Newest, 0)
+		age := now.Sub(newest).Round(time.Second)
+		status := "ok"
+		if age > staleAfter {
+			status = "STALE"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%v\t%d\t%.1f\t%d\n",
+			s.FeedId, status, newest.Format(time.DateTime), age, s.LastMinute,
+			float64(s.LastWindow)/monitorWindow.Minutes(), s.ActiveVehicles)
+	}
+	if len(statuses) == 0 {
+		fmt.Fprintln(table, "(no positions yet)")
+	}
+	return table.Flush()
+}
+
+// monitor shows a top-style view of each feed, refreshed by polling the database until interrupted.
+func monitor(config Config, args []string) error {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	dbPath := flags.String("db", filepath.Join(config.DataDir, "realtime.db"), "realtime database")
+	interval := flags.Duration("interval", 5*time.Second, "refresh interval")
+	once := flags.Bool("once", false, "print the status once and exit")
+	flags.Parse(args)
+
+	// Opened read-only, so the monitor never blocks the scraper
+	db, err := sqlx.Open("sqlite3", readOnlyURI(*dbPath))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		if err := renderStatus(db, *dbPath); err != nil {
+			return err
+		}
+		if *once {
+			return nil
+		}
+		<-ticker.C
+	}
+}
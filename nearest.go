@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+)
+
+// routeStopIndex finds the nearest stop served by a route, from the static GTFS of a feed.
+type routeStopIndex struct {
+	feedId string
+	stops  *spatialIndex
+	// Stop IDs served by each route
+	routeStops map[string]map[string]bool
+	// Route of each trip, for positions which only give the trip
+	tripRoutes map[string]string
+	maxMeters  float64
+}
+
+// newRouteStopIndex indexes the stops of each route in a static GTFS zip.
+func newRouteStopIndex(staticFile string, feedId string, maxMeters float64) (*routeStopIndex, error) {
+	static, err := loadStaticGTFS(staticFile, "stops.txt", "trips.txt", "stop_times.txt")
+	if err != nil {
+		return nil, err
+	}
+	ix := &routeStopIndex{
+		feedId:     feedId,
+		stops:      newStopIndex(static),
+		routeStops: make(map[string]map[string]bool),
+		tripRoutes: make(map[string]string, len(static.trips)),
+		maxMeters:  maxMeters,
+	}
+	for tripId, trip := range static.trips {
+		ix.tripRoutes[tripId] = trip.RouteId
+		stops := ix.routeStops[trip.RouteId]
+		if stops == nil {
+			stops = make(map[string]bool)
+			ix.routeStops[trip.RouteId] = stops
+		}
+		for _, stopTime := range static.stopTimes[tripId] {
+			stops[stopTime.StopId] = true
+		}
+	}
+	return ix, nil
+}
+
+// nearest returns the closest stop on a route within the maximum distance, if any.
+func (ix *routeStopIndex) nearest(routeId string, lat, lon float64) (string, bool) {
+	stops := ix.routeStops[routeId]
+	if len(stops) == 0 {
+		return "", false
+	}
+	for _, m := range ix.stops.near(lat, lon, ix.maxMeters, math.MaxInt) {
+		if stops[m.id] {
+			return m.id, true
+		}
+	}
+	return "", false
+}
+
+// annotate is a position filter setting nearest_stop_id on positions without a stop_id,
+// from their route or else their trip's route in the static GTFS. Positions of other feeds are left alone.
+func (ix *routeStopIndex) annotate(batch []VehiclePosition) ([]VehiclePosition, error) {
+	for i := range batch {
+		vp := &batch[i]
+		if vp.FeedId != ix.feedId || vp.StopId != nil || vp.Latitude == nil || vp.Longitude == nil {
+			continue
+		}
+		routeId := valueOf(vp.RouteId)
+		if routeId == "" {
+			routeId = ix.tripRoutes[vp.TripId]
+		}
+		if stopId, found := ix.nearest(routeId, float64(*vp.Latitude), float64(*vp.Longitude)); found {
+			vp.NearestStopId = &stopId
+		}
+	}
+	return batch, nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type NotificationsConfig struct {
+	Email EmailConfig
+	Chat  []ChatConfig
+	// FailureThreshold is the number of polls in a row which must fail before the feed is reported down, defaulting to 3.
+	FailureThreshold int
+	// Notifications are sent at most once per this many minutes, batching any raised in between, defaulting to 60.
+	BatchMinutes int
+	// StaleAfterMinutes is the age of a feed's header timestamp when polled beyond which its data is reported stale,
+	// defaulting to 15.
+	StaleAfterMinutes int
+	// Templates override the message for an event (feed_down, stale_data, archive_failed or database_error).
+	// They're text/templates executed with the notification's .Event, .FeedId, .Command, .Message, .First, .Last and .Count.
+	Templates map[string]string
+}
+
+// EmailConfig sends notifications through an SMTP server. STARTTLS is used if the server supports it.
+type EmailConfig struct {
+	Host string
+	// Port defaults to 587.
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+const (
+	defaultFailureThreshold = 3
+	defaultBatchMinutes     = 60
+	defaultStaleAfter       = 15 * time.Minute
+	notificationStateFile   = "notifications.json"
+)
+
+// Notification events
+const (
+	eventFeedDown      = "feed_down"
+	eventStaleData     = "stale_data"
+	eventDatabaseError = "database_error"
+	eventArchiveFailed = "archive_failed"
+)
+
+// notification is an event waiting to be sent. Repeats of the same event are merged, counting them.
+type notification struct {
+	Event   string    `json:"event"`
+	FeedId  string    `json:"feed_id"`
+	Command string    `json:"command"`
+	Message string    `json:"message"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+	Count   int       `json:"count"`
+}
+
+// notificationState persists batching between runs, since each poll is a separate process.
+type notificationState struct {
+	LastSent time.Time      `json:"last_sent"`
+	Pending  []notification `json:"pending"`
+}
+
+type notifier interface {
+	name() string
+	send(config Config, batch []notification) error
+}
+
+// configuredNotifiers returns a notifier for each configured channel.
+func configuredNotifiers(config NotificationsConfig) []notifier {
+	var notifiers []notifier
+	if config.Email.Host != "" {
+		notifiers = append(notifiers, emailNotifier{config.Email})
+	}
+	for _, chat := range config.Chat {
+		notifiers = append(notifiers, chatNotifier{chat})
+	}
+	return notifiers
+}
+
+func loadNotificationState(dataDir string) (notificationState, error) {
+	var state notificationState
+	contents, err := os.ReadFile(filepath.Join(dataDir, notificationStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal(contents, &state)
+}
+
+func saveNotificationState(dataDir string, state notificationState) error {
+	contents, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dataDir, notificationStateFile), contents)
+}
+
+// queueNotification adds an event to the pending batch, merging it with an earlier one for the same feed and command.
+func queueNotification(config Config, n notification) error {
+	state, err := loadNotificationState(config.DataDir)
+	if err != nil {
+		return err
+	}
+	merged := false
+	for i := range state.Pending {
+		p := &state.Pending[i]
+		if p.Event == n.Event && p.FeedId == n.FeedId && p.Command == n.Command {
+			p.Message, p.Last = n.Message, n.Last
+			p.Count++
+			merged = true
+			break
+		}
+	}
+	if !merged {
+		n.Count = 1
+		state.Pending = append(state.Pending, n)
+	}
+	return saveNotificationState(config.DataDir, state)
+}
+
+// flushNotifications sends the pending batch if the batch interval has passed since the last one was sent.
+// Pending notifications are kept if every channel fails, to retry on the next run.
+func flushNotifications(config Config) error {
+	notifiers := configuredNotifiers(config.Notifications)
+	if len(notifiers) == 0 {
+		return nil
+	}
+	state, err := loadNotificationState(config.DataDir)
+	if err != nil || len(state.Pending) == 0 {
+		return err
+	}
+	batchMinutes := config.Notifications.BatchMinutes
+	if batchMinutes <= 0 {
+		batchMinutes = defaultBatchMinutes
+	}
+	if time.Since(state.LastSent) < time.Duration(batchMinutes)*time.Minute {
+		return nil
+	}
+
+	var errs []error
+	for _, n := range notifiers {
+		if err := n.send(config, state.Pending); err != nil {
+			errs = append(errs, fmt.Errorf("%s notification: %w", n.name(), err))
+		}
+	}
+	if len(errs) == len(notifiers) {
+		return errors.Join(errs...)
+	}
+	config.log().Info("Sent notifications", "notifications", len(state.Pending))
+	state.LastSent = time.Now()
+	state.Pending = nil
+	if err := saveNotificationState(config.DataDir, state); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// consecutiveFailures counts how many of the latest polls of a feed type failed in a row, up to limit.
+func consecutiveFailures(config Config, feedType string, limit int) (int, error) {
+	db, err := sqlx.Open("sqlite3", readOnlyURI(filepath.Join(config.DataDir, "realtime.db")))
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	ctx, cancel := dbContext()
+	defer cancel()
+	var successes []bool
+	err = db.SelectContext(ctx, &successes, "SELECT success FROM feed_health WHERE feed_id = ? AND feed_type = ? ORDER BY polled_at DESC LIMIT ?",
+		config.FeedId, feedType, limit)
+	if err != nil {
+		return 0, err
+	}
+	failures := 0
+	for _, success := range successes {
+		if success {
+			break
+		}
+		failures++
+	}
+	return failures, nil
+}
+
+// reportFailure queues a notification for a failed run.
+// Failed polls are only reported once enough have failed in a row, and other failures of a poll are
+// reported as database errors, since the feed was retrieved.
+func reportFailure(config Config, command string, failure error) error {
+	if len(configuredNotifiers(config.Notifications)) == 0 {
+		return nil
+	}
+	now := time.Now()
+	n := notification{FeedId: config.FeedId, Command: command, Message: strings.TrimSpace(fmt.Sprint(failure)), First: now, Last: now}
+	switch {
+	case command == "archive":
+		n.Event = eventArchiveFailed
+	case runStats.failedFeedType != "":
+		threshold := config.Notifications.FailureThreshold
+		if threshold <= 0 {
+			threshold = defaultFailureThreshold
+		}
+		failures, err := consecutiveFailures(config, runStats.failedFeedType, threshold)
+		if err != nil {
+			// Without the history, report every failure rather than none
+			config.log().Warn("Failed to read the failure history", "err", err)
+			failures = threshold
+		}
+		if failures < threshold {
+			return nil
+		}
+		n.Event = eventFeedDown
+		n.Message = fmt.Sprintf("%d polls of %s failed in a row, most recently: %s", failures, runStats.failedFeedType, n.Message)
+	case command == "alerts" || command == "vehicleupdates":
+		n.Event = eventDatabaseError
+	default:
+		return nil
+	}
+	return queueNotification(config, n)
+}
+
+var defaultNotificationTemplates = map[string]string{
+	eventFeedDown:      "Feed {{.FeedId}} is down: {{.Message}}",
+	eventStaleData:     "Feed {{.FeedId}} is serving stale data: {{.Message}}",
+	eventArchiveFailed: "Archiving failed for feed {{.FeedId}}: {{.Message}}",
+	eventDatabaseError: "Database error for feed {{.FeedId}} during {{.Command}}: {{.Message}}",
+}
+
+// formatNotification renders a notification with its event's template, noting how often it repeated.
+func formatNotification(config NotificationsConfig, n notification) string {
+	text, found := config.Templates[n.Event]
+	if !found {
+		text = defaultNotificationTemplates[n.Event]
+	}
+	var b strings.Builder
+	tmpl, err := template.New(n.Event).Parse(text)
+	if err == nil {
+		err = tmpl.Execute(&b, n)
+	}
+	if err != nil {
+		// Still notify with a bad template, rather than losing the event
+		b.Reset()
+		fmt.Fprintf(&b, "%s for feed %s: %s (template error: %v)", n.Event, n.FeedId, n.Message, err)
+	}
+	if n.Count > 1 {
+		fmt.Fprintf(&b, " (%d times since %s)", n.Count, n.First.Format(time.DateTime))
+	}
+	return b.String()
+}
+
+// formatNotifications renders a batch as plain text, one line per notification.
+func formatNotifications(config NotificationsConfig, batch []notification) string {
+	var b strings.Builder
+	for _, n := range batch {
+		b.WriteString(formatNotification(config, n))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// reportStaleFeed queues a notification if a polled feed's header is older than the stale threshold.
+func reportStaleFeed(config Config, command string, feedType string, feedTimestamp uint64) error {
+	if len(configuredNotifiers(config.Notifications)) == 0 || feedTimestamp == 0 {
+		return nil
+	}
+	staleAfter := time.Duration(config.Notifications.StaleAfterMinutes) * time.Minute
+	if staleAfter <= 0 {
+		staleAfter = defaultStaleAfter
+	}
+	now := time.Now()
+	age := now.Sub(time.Unix(int64(feedTimestamp), 0))
+	if age <= staleAfter {
+		return nil
+	}
+	return queueNotification(config, notification{
+		Event:   eventStaleData,
+		FeedId:  config.FeedId,
+		Command: command,
+		Message: fmt.Sprintf("the %s feed was last updated %v ago", feedType, age.Round(time.Second)),
+		First:   now,
+		Last:    now,
+	})
+}
+
+type emailNotifier struct {
+	config EmailConfig
+}
+
+func (e emailNotifier) name() string {
+	return "email"
+}
+
+func (e emailNotifier) send(config Config, batch []notification) error {
+	if e.config.From == "" || len(e.config.To) == 0 {
+		return errors.New("email notifications need From and To")
+	}
+	port := e.config.Port
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if e.config.Username != "" {
+		auth = smtp.PlainAuth("", e.config.Username, e.config.Password, e.config.Host)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", e.config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.config.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [gtfs-scraper] %d notifications for feed %s\r\n", len(batch), config.FeedId)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(formatNotifications(config.Notifications, batch), "\n", "\r\n"))
+	addr := net.JoinHostPort(e.config.Host, strconv.Itoa(port))
+	return smtp.SendMail(addr, auth, e.config.From, e.config.To, []byte(msg.String()))
+}
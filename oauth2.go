@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth2Config authenticates feed requests with the OAuth2 client credentials grant.
+// It's used if TokenURL is set.
+type OAuth2Config struct {
+	TokenURL     string
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+}
+
+// Tokens are refreshed this long before they expire, so they don't expire in flight
+const tokenExpiryMargin = time.Minute
+
+// oauth2Transport adds a bearer token to requests for the feed hosts, fetching a new token when it expires.
+type oauth2Transport struct {
+	base   http.RoundTripper
+	config OAuth2Config
+	// Tokens are only sent to the hosts of the configured feed URLs
+	hosts map[string]bool
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	// Seconds until the token expires, or 0 if unknown
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// accessToken returns the current token, requesting a new one if there's none or it's about to expire.
+func (t *oauth2Transport) accessToken() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && (t.expiry.IsZero() || time.Now().Before(t.expiry)) {
+		return t.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(t.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(t.config.Scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, t.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(t.config.ClientId), url.QueryEscape(t.config.ClientSecret))
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return "", fmt.Errorf("requesting OAuth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("requesting OAuth2 token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("requesting OAuth2 token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("parsing OAuth2 token: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("OAuth2 token response has no access_token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", fmt.Errorf("unsupported OAuth2 token type %q", token.TokenType)
+	}
+
+	t.token = token.AccessToken
+	t.expiry = time.Time{}
+	if token.ExpiresIn > 0 {
+		lifetime := time.Duration(token.ExpiresIn) * time.Second
+		if lifetime > 2*tokenExpiryMargin {
+			lifetime -= tokenExpiryMargin
+		}
+		t.expiry = time.Now().Add(lifetime)
+	}
+	return t.token, nil
+}
+
+func (t *oauth2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.hosts[req.URL.Host] {
+		return t.base.RoundTrip(req)
+	}
+	token, err := t.accessToken()
+	if err != nil {
+		return nil, err
+	}
+	// RoundTrippers mustn't modify the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// setupOAuth2 authenticates feed requests to the hosts of the feed URLs, if OAuth2 is configured.
+func setupOAuth2(config Config) error {
+	if config.OAuth2.TokenURL == "" {
+		return nil
+	}
+	if config.OAuth2.ClientId == "" {
+		return errors.New("OAuth2 needs a ClientId")
+	}
+	hosts, err := feedHosts(config)
+	if err != nil {
+		return err
+	}
+	t := &oauth2Transport{base: feedClient.Transport, config: config.OAuth2, hosts: hosts}
+	if t.base == nil {
+		t.base = http.DefaultTransport
+	}
+	feedClient = &http.Client{Transport: t}
+	return nil
+}
+
+// feedHosts returns the hosts of the feed URLs of every feed, which are the only ones sent feed credentials.
+func feedHosts(config Config) (map[string]bool, error) {
+	configs, err := feedConfigs(config)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string]bool)
+	var urls []string
+	for _, c := range configs {
+		urls = append(urls, c.StaticURL)
+		urls = append(urls, feedURLs(c.AlertsURL, c.AlertsURLs)...)
+		urls = append(urls, feedURLs(c.TripUpdatesURL, c.TripUpdatesURLs)...)
+		urls = append(urls, feedURLs(c.VehicleUpdatesURL, c.VehicleUpdatesURLs)...)
+	}
+	for _, feedURL := range urls {
+		if feedURL == "" {
+			continue
+		}
+		u, err := url.Parse(feedURL)
+		if err != nil {
+			return nil, err
+		}
+		hosts[u.Host] = true
+	}
+	return hosts, nil
+}
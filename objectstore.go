@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config locates a bucket in S3 or an S3-compatible object store, such as MinIO, R2 or B2.
+type S3Config struct {
+	// Endpoint of an S3-compatible service, e.g. "https://minio.example.com:9000", whose buckets are addressed
+	// in the path. Defaults to AWS S3 in the Region, whose buckets are addressed in the host name.
+	Endpoint string
+	// Region signed for, defaulting to "us-east-1", which most S3-compatible services accept.
+	Region string
+	Bucket string
+	// Prefix is prepended to every key, e.g. "gtfs/".
+	Prefix string
+	// Profile in the shared credentials file, as for AWSSigV4, or the AWS_* environment variables by default.
+	Profile string
+	// PartSizeMB is the size in MiB of the parts files larger than it are uploaded in, each held in memory
+	// while it's sent. Defaults to 64, and S3 requires at least 5.
+	PartSizeMB int
+}
+
+const (
+	defaultS3Region       = "us-east-1"
+	defaultPartSizeMB     = 64
+	minPartSizeMB         = 5
+	objectRequestTimeout  = 5 * time.Minute
+	maxObjectErrorMessage = 1 << 10
+)
+
+// errObjectNotFound is returned for missing keys.
+var errObjectNotFound = errors.New("object not found")
+
+// objectStore reads and writes objects in one bucket, under its prefix.
+type objectStore struct {
+	config      S3Config
+	endpoint    *url.URL
+	credentials awsCredentials
+	client      *http.Client
+}
+
+func newObjectStore(config S3Config) (*objectStore, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("no bucket given for the object store")
+	}
+	if config.Region == "" {
+		config.Region = defaultS3Region
+	}
+	if config.PartSizeMB == 0 {
+		config.PartSizeMB = defaultPartSizeMB
+	} else if config.PartSizeMB < minPartSizeMB {
+		return nil, fmt.Errorf("PartSizeMB must be at least %d", minPartSizeMB)
+	}
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + config.Bucket + ".s3." + config.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object store endpoint: %w", err)
+	}
+	credentials, err := loadAWSCredentials(config.Profile)
+	if err != nil {
+		return nil, err
+	}
+	return &objectStore{config: config, endpoint: u, credentials: credentials, client: &http.Client{Timeout: objectRequestTimeout}}, nil
+}
+
+// objectURL is the URL of a key, or of the bucket for an empty key.
+func (s *objectStore) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	if s.config.Endpoint != "" {
+		u.Path += s.config.Bucket + "/"
+	}
+	u.Path += key
+	// Keys are signed encoded as SigV4 requires, which escapes more than Go does, e.g. the = in year=2024
+	u.RawPath = awsURIEncode(u.Path, false)
+	return &u
+}
+
+func (s *objectStore) do(ctx context.Context, method string, u *url.URL, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	if err := signSigV4(req, s.credentials, s.config.Region, "s3", time.Now()); err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%s %s: %w", method, u.Path, errObjectNotFound)
+		}
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, maxObjectErrorMessage))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, u.Path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// put writes an object.
+func (s *objectStore) put(ctx context.Context, key string, body []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, s.objectURL(s.config.Prefix+key), body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// putFile uploads a file, in parts if it's larger than PartSizeMB, so a file of any size can be uploaded
+// without reading it all into memory.
+func (s *objectStore) putFile(ctx context.Context, key, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	partSize := int64(s.config.PartSizeMB) << 20
+	if info.Size() <= partSize {
+		contents, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		return s.put(ctx, key, contents)
+	}
+
+	u := s.objectURL(s.config.Prefix + key)
+	u.RawQuery = "uploads="
+	resp, err := s.do(ctx, http.MethodPost, u, []byte{})
+	if err != nil {
+		return err
+	}
+	var upload struct {
+		UploadId string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&upload)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("starting the upload of %s: %w", key, err)
+	}
+	if err := s.uploadParts(ctx, key, upload.UploadId, f, partSize); err != nil {
+		// Parts of an upload which isn't completed are kept, and billed, until it's aborted
+		u.RawQuery = url.Values{"uploadId": {upload.UploadId}}.Encode()
+		if resp, abortErr := s.do(context.WithoutCancel(ctx), http.MethodDelete, u, nil); abortErr == nil {
+			resp.Body.Close()
+		} else {
+			slog.Warn("Couldn't abort an upload", "key", key, "err", abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// uploadParts uploads a file in parts of partSize bytes, then completes the multipart upload.
+func (s *objectStore) uploadParts(ctx context.Context, key, uploadId string, r io.Reader, partSize int64) error {
+	u := s.objectURL(s.config.Prefix + key)
+	buf := make([]byte, partSize)
+	var parts []completedPart
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		u.RawQuery = url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadId}}.Encode()
+		resp, err := s.do(ctx, http.MethodPut, u, buf[:n])
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		if n < len(buf) {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	u.RawQuery = url.Values{"uploadId": {uploadId}}.Encode()
+	resp, err := s.do(ctx, http.MethodPost, u, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Completing can fail after the response has started, so S3 reports that in the body of a 200 response
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("completing the upload of %s: %w", key, err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("completing the upload of %s: %s: %s", key, result.Code, result.Message)
+	}
+	slog.Debug("Uploaded an object in parts", "key", key, "parts", len(parts))
+	return nil
+}
+
+// get reads an object, returning errObjectNotFound if it doesn't exist.
+func (s *objectStore) get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectURL(s.config.Prefix+key), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// remove deletes an object, which succeeds whether or not it exists.
+func (s *objectStore) remove(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.objectURL(s.config.Prefix+key), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// list returns the keys starting with a prefix in lexical order, relative to the store's prefix.
+func (s *objectStore) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := s.objectURL("")
+		u.RawQuery = query.Encode()
+		resp, err := s.do(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", path.Join(s.config.Bucket, s.config.Prefix+prefix), err)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(object.Key, s.config.Prefix))
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OccupancySummary aggregates occupancy over the positions in one group.
+// Columns which weren't grouped by are left empty.
+type OccupancySummary struct {
+	RouteId      *string `parquet:"route_id,optional"`
+	DirectionId  *int32  `parquet:"direction_id,optional"`
+	StopId       *string `parquet:"stop_id,optional"`
+	TimeOfDay    *string `parquet:"time_of_day,optional"`
+	Observations int64   `parquet:"observations"`
+	// Number of positions with each OccupancyStatus
+	Empty                   int64 `parquet:"empty"`
+	ManySeatsAvailable      int64 `parquet:"many_seats_available"`
+	FewSeatsAvailable       int64 `parquet:"few_seats_available"`
+	StandingRoomOnly        int64 `parquet:"standing_room_only"`
+	CrushedStandingRoomOnly int64 `parquet:"crushed_standing_room_only"`
+	Full                    int64 `parquet:"full"`
+	NotAcceptingPassengers  int64 `parquet:"not_accepting_passengers"`
+	NoDataAvailable         int64 `parquet:"no_data_available"`
+	NotBoardable            int64 `parquet:"not_boardable"`
+	// Mean of the statuses from EMPTY (0) to NOT_ACCEPTING_PASSENGERS (6), which are ordered by crowding
+	MeanOccupancyStatus *float64 `parquet:"mean_occupancy_status,optional"`
+	// Mean and max of occupancy_percentage, from the positions which reported it
+	PercentageObservations  int64    `parquet:"percentage_observations"`
+	MeanOccupancyPercentage *float64 `parquet:"mean_occupancy_percentage,optional"`
+	MaxOccupancyPercentage  *uint32  `parquet:"max_occupancy_percentage,optional"`
+}
+
+var occupancyDimensions = []string{"route", "direction", "stop", "time"}
+
+type occupancyKey struct {
+	routeId     string
+	directionId int32
+	stopId      string
+	timeOfDay   string
+}
+
+type occupancyGroup struct {
+	summary      OccupancySummary
+	statusSum    int64
+	statusCount  int64
+	percentSum   int64
+	statusCounts [9]int64
+}
+
+// analyzeOccupancy aggregates occupancy_status and occupancy_percentage by route, direction, stop
+// and time of day across the archive and database.
+func analyzeOccupancy(config Config, args []string) error {
+	flags := flag.NewFlagSet("analyze occupancy", flag.ExitOnError)
+	input := addAnalysisFlags(flags, config)
+	output := flags.String("output", filepath.Join(config.DataDir, "occupancy.csv"), "output file, as Parquet if it ends in .parquet and CSV otherwise")
+	by := flags.String("by", strings.Join(occupancyDimensions, ","), "comma separated dimensions to group by, from "+strings.Join(occupancyDimensions, ", "))
+	interval := flags.Duration("interval", time.Hour, "time of day bucket size")
+	flags.Parse(args)
+
+	grouped := make(map[string]bool)
+	for _, dimension := range strings.Split(*by, ",") {
+		if dimension = strings.TrimSpace(dimension); dimension == "" {
+			continue
+		}
+		found := false
+		for _, d := range occupancyDimensions {
+			found = found || d == dimension
+		}
+		if !found {
+			return fmt.Errorf("unknown dimension %q, expected one of %s", dimension, strings.Join(occupancyDimensions, ", "))
+		}
+		grouped[dimension] = true
+	}
+	if *interval <= 0 || *interval > 24*time.Hour {
+		return fmt.Errorf("invalid --interval: %v", *interval)
+	}
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[occupancyKey]*occupancyGroup)
+	err = input.forEachPosition(config, location, func(vp *VehiclePosition) {
+		if vp.OccupancyStatus == nil && vp.OccupancyPercentage == nil {
+			return
+		}
+		var key occupancyKey
+		if grouped["route"] {
+			key.routeId = valueOf(vp.RouteId)
+		}
+		if grouped["direction"] {
+			// Kept apart from direction 0
+			key.directionId = -1
+			if vp.DirectionId != nil {
+				key.directionId = *vp.DirectionId
+			}
+		}
+		if grouped["stop"] {
+			key.stopId = valueOf(vp.StopId)
+		}
+		if grouped["time"] {
+			key.timeOfDay = timeOfDayBucket(vp.Timestamp, location, *interval)
+		}
+
+		group, found := groups[key]
+		if !found {
+			group = &occupancyGroup{}
+			if grouped["route"] {
+				group.summary.RouteId = copyOptional(vp.RouteId)
+			}
+			if grouped["direction"] {
+				group.summary.DirectionId = copyOptional(vp.DirectionId)
+			}
+			if grouped["stop"] {
+				group.summary.StopId = copyOptional(vp.StopId)
+			}
+			if grouped["time"] {
+				group.summary.TimeOfDay = copyOptional(&key.timeOfDay)
+			}
+			groups[key] = group
+		}
+		group.summary.Observations++
+		if status := vp.OccupancyStatus; status != nil && *status >= 0 && int(*status) < len(group.statusCounts) {
+			group.statusCounts[*status]++
+			// NO_DATA_AVAILABLE and NOT_BOARDABLE don't describe crowding
+			if *status <= 6 {
+				group.statusSum += int64(*status)
+				group.statusCount++
+			}
+		}
+		if percentage := vp.OccupancyPercentage; percentage != nil {
+			group.summary.PercentageObservations++
+			group.percentSum += int64(*percentage)
+			if group.summary.MaxOccupancyPercentage == nil || *percentage > *group.summary.MaxOccupancyPercentage {
+				group.summary.MaxOccupancyPercentage = copyOptional(percentage)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	results := make([]OccupancySummary, 0, len(groups))
+	for _, group := range groups {
+		s := group.summary
+		counts := group.statusCounts
+		s.Empty, s.ManySeatsAvailable, s.FewSeatsAvailable = counts[0], counts[1], counts[2]
+		s.StandingRoomOnly, s.CrushedStandingRoomOnly, s.Full = counts[3], counts[4], counts[5]
+		s.NotAcceptingPassengers, s.NoDataAvailable, s.NotBoardable = counts[6], counts[7], counts[8]
+		if group.statusCount > 0 {
+			mean := float64(group.statusSum) / float64(group.statusCount)
+			s.MeanOccupancyStatus = &mean
+		}
+		if s.PercentageObservations > 0 {
+			mean := float64(group.percentSum) / float64(s.PercentageObservations)
+			s.MeanOccupancyPercentage = &mean
+		}
+		results = append(results, s)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if valueOf(a.RouteId) != valueOf(b.RouteId) {
+			return valueOf(a.RouteId) < valueOf(b.RouteId)
+		}
+		if valueOf(a.DirectionId) != valueOf(b.DirectionId) {
+			return valueOf(a.DirectionId) < valueOf(b.DirectionId)
+		}
+		if valueOf(a.StopId) != valueOf(b.StopId) {
+			return valueOf(a.StopId) < valueOf(b.StopId)
+		}
+		return valueOf(a.TimeOfDay) < valueOf(b.TimeOfDay)
+	})
+	return writeAnalysis(*output, results)
+}
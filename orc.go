@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/scritchley/orc"
+)
+
+// orcColumn maps a flat Parquet column to an ORC type, along with a conversion
+// from Parquet values to the Go values expected by the ORC writer.
+func orcColumn(node parquet.Node) (string, func(parquet.Value) interface{}, error) {
+	lt := node.Type().LogicalType()
+	switch node.Type().Kind() {
+	case parquet.Boolean:
+		return "boolean", func(v parquet.Value) interface{} { return v.Boolean() }, nil
+	case parquet.Int32:
+		if lt != nil && lt.Integer != nil && !lt.Integer.IsSigned {
+			// ORC has no unsigned types
+			return "bigint", func(v parquet.Value) interface{} { return int64(v.Uint32()) }, nil
+		}
+		return "int", func(v parquet.Value) interface{} { return v.Int32() }, nil
+	case parquet.Int64:
+		if lt != nil && lt.Timestamp != nil {
+			return "timestamp", func(v parquet.Value) interface{} { return timestampOf(v, node) }, nil
+		}
+		return "bigint", func(v parquet.Value) interface{} { return v.Int64() }, nil
+	case parquet.Int96:
+		return "timestamp", func(v parquet.Value) interface{} { return int96Time(v.Int96()) }, nil
+	case parquet.Float:
+		return "float", func(v parquet.Value) interface{} { return v.Float() }, nil
+	case parquet.Double:
+		return "double", func(v parquet.Value) interface{} { return v.Double() }, nil
+	case parquet.ByteArray:
+		return "string", func(v parquet.Value) interface{} { return string(v.ByteArray()) }, nil
+	}
+	return "", nil, fmt.Errorf("unsupported column type for ORC: %s", node.Type())
+}
+
+// orcCompression maps the archive compression settings to an ORC codec.
+// ORC files are zlib compressed unless the archive is uncompressed.
+func orcCompression(config ArchiveConfig) (orc.CompressionCodec, error) {
+	switch config.Compression {
+	case "", "gzip", "zlib":
+		level := config.CompressionLevel
+		if level == 0 {
+			level = -1
+		}
+		return orc.CompressionZlib{Level: level}, nil
+	case "uncompressed":
+		return orc.CompressionNone{}, nil
+	}
+	return nil, fmt.Errorf("compression codec %q isn't supported for ORC archives", config.Compression)
+}
+
+// orcWriter writes archive rows to an ORC file with the same columns as the Parquet archive schema.
+type orcWriter struct {
+	writer   *orc.Writer
+	converts []func(parquet.Value) interface{}
+	values   []interface{}
+}
+
+func newORCWriter(w io.Writer, schema *archiveSchema, config ArchiveConfig) (*orcWriter, error) {
+	o := &orcWriter{}
+	var fields []string
+	for _, node := range schema.schema.Fields() {
+		typeName, convert, err := orcColumn(node)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, node.Name()+":"+typeName)
+		o.converts = append(o.converts, convert)
+	}
+	orcSchema, err := orc.ParseSchema("struct<" + strings.Join(fields, ",") + ">")
+	if err != nil {
+		return nil, fmt.Errorf("invalid ORC schema (column names may only contain letters, digits and underscores): %w", err)
+	}
+	codec, err := orcCompression(config)
+	if err != nil {
+		return nil, err
+	}
+	o.writer, err = orc.NewWriter(w, orc.SetSchema(orcSchema), orc.SetCompression(codec))
+	if err != nil {
+		return nil, err
+	}
+	o.values = make([]interface{}, len(o.converts))
+	return o, nil
+}
+
+func (o *orcWriter) WriteRows(rows []parquet.Row) (int, error) {
+	for i, row := range rows {
+		for j := range o.values {
+			o.values[j] = nil
+		}
+		for _, v := range row {
+			if !v.IsNull() {
+				o.values[v.Column()] = o.converts[v.Column()](v)
+			}
+		}
+		if err := o.writer.Write(o.values...); err != nil {
+			return i, err
+		}
+	}
+	return len(rows), nil
+}
+
+func (o *orcWriter) Close() error {
+	return o.writer.Close()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	routePartitionPrefix = "route="
+	// Hive's placeholder for values which don't have a partition of their own
+	otherRoutesKey = "__HIVE_DEFAULT_PARTITION__"
+)
+
+// routePartitioner assigns rows to route partitions within a month.
+// When route partitioning is disabled, there is a single partition with an empty key.
+type routePartitioner struct {
+	keys  []string
+	keyOf func(routeId string) string
+}
+
+func routeDirName(key string) string {
+	return routePartitionPrefix + url.PathEscape(key)
+}
+
+func newRoutePartitioner(db *sqlx.DB, config ArchiveConfig, monthDir string, period time.Time) (*routePartitioner, error) {
+	switch config.RoutePartitioning {
+	case "":
+		return &routePartitioner{
+			keys:  []string{""},
+			keyOf: func(string) string { return "" },
+		}, nil
+	case "bucket":
+		if config.RouteBuckets <= 0 {
+			return nil, fmt.Errorf("RouteBuckets must be positive, got %d", config.RouteBuckets)
+		}
+		keys := make([]string, config.RouteBuckets)
+		for i := range keys {
+			keys[i] = strconv.Itoa(i)
+		}
+		return &routePartitioner{
+			keys: keys,
+			keyOf: func(routeId string) string {
+				h := fnv.New32a()
+				h.Write([]byte(routeId))
+				return keys[h.Sum32()%uint32(len(keys))]
+			},
+		}, nil
+	case "top":
+		if config.TopRoutes <= 0 {
+			return nil, fmt.Errorf("TopRoutes must be positive, got %d", config.TopRoutes)
+		}
+		// Once a month has been partitioned, keep using the same routes so rows never move between files
+		routes, err := existingRoutePartitions(monthDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(routes) == 0 {
+			start, end := partitionMonth(config, period)
+			routes, err = findTopRoutes(db, config, start, end, config.TopRoutes)
+			if err != nil {
+				return nil, err
+			}
+		}
+		topRoutes := make(map[string]bool, len(routes))
+		for _, routeId := range routes {
+			topRoutes[routeId] = true
+		}
+		return &routePartitioner{
+			keys: append(routes, otherRoutesKey),
+			keyOf: func(routeId string) string {
+				if topRoutes[routeId] {
+					return routeId
+				}
+				return otherRoutesKey
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid RoutePartitioning: %q", config.RoutePartitioning)
+	}
+}
+
+// existingRoutePartitions lists the named route partitions already written for a month.
+func existingRoutePartitions(monthDir string) ([]string, error) {
+	entries, err := os.ReadDir(monthDir)
+	if err != nil {
+		return nil, err
+	}
+	var routes []string
+	for _, entry := range entries {
+		name, found := strings.CutPrefix(entry.Name(), routePartitionPrefix)
+		if !entry.IsDir() || !found {
+			continue
+		}
+		routeId, err := url.PathUnescape(name)
+		if err != nil {
+			return nil, err
+		}
+		if routeId != otherRoutesKey {
+			routes = append(routes, routeId)
+		}
+	}
+	return routes, nil
+}
+
+const topRoutesQuery = `
+	SELECT route_id FROM vehicle_positions
+	WHERE timestamp >= ? AND timestamp < ? AND route_id != ''%s
+	GROUP BY route_id ORDER BY COUNT(*) DESC LIMIT ?
+`
+
+// findTopRoutes returns the routes with the most rows in a month, busiest first.
+func findTopRoutes(db *sqlx.DB, config ArchiveConfig, start time.Time, end time.Time, n int) ([]string, error) {
+	condition, feedArgs := feedCondition(config, "")
+	args := append(append([]any{start.Unix(), end.Unix()}, feedArgs...), n)
+	ctx, cancel := dbContext()
+	defer cancel()
+	var routes []string
+	err := db.SelectContext(ctx, &routes, fmt.Sprintf(topRoutesQuery, condition), args...)
+	return routes, err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/jmoiron/sqlx"
+)
+
+// Each poll fetches one feed type and stores it, recording its outcome in runStats.
+
+func pollAlerts(db *sqlx.DB, config Config) error {
+	poll, err := pollFeed(db, config, "alerts", feedURLs(config.AlertsURL, config.AlertsURLs))
+	if err != nil {
+		runStats.failedFeedType = "alerts"
+		return err
+	}
+	feed := poll.feed
+	if err := reportStaleFeed(config, "alerts", "alerts", feed.GetHeader().GetTimestamp()); err != nil {
+		config.log().Warn("Failed to report a stale feed", "err", err)
+	}
+	if poll.unchanged {
+		config.log().Info("Alerts are unchanged since the last poll")
+		return nil
+	}
+
+	inserted, err := addAlerts(feed, db, config.FeedId)
+	if err != nil {
+		return err
+	}
+	runStats.rowsInserted = inserted
+	poll.stored(db)
+	return nil
+}
+
+func pollTripUpdates(db *sqlx.DB, config Config, static *staticGTFS) error {
+	poll, err := pollFeed(db, config, "trip_updates", feedURLs(config.TripUpdatesURL, config.TripUpdatesURLs))
+	if err != nil {
+		runStats.failedFeedType = "trip_updates"
+		return err
+	}
+	feed := poll.feed
+	if err := reportStaleFeed(config, "tripupdates", "trip_updates", feed.GetHeader().GetTimestamp()); err != nil {
+		config.log().Warn("Failed to report a stale feed", "err", err)
+	}
+	if poll.unchanged {
+		config.log().Info("Trip updates are unchanged since the last poll")
+		return nil
+	}
+
+	timeZone, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+	trips, stops, err := storeTripUpdates(db, config, static, feed, timeZone)
+	if err != nil {
+		return err
+	}
+	runStats.rowsInserted = trips
+	poll.stored(db)
+	config.log().Info("Stored trip updates", "trip_updates", trips, "stop_time_updates", stops)
+	return nil
+}
+
+// storeTripUpdates stores a trip updates feed, whether just polled or replayed.
+// Delays are propagated through static, as loaded by setupTripUpdatePolling.
+func storeTripUpdates(db *sqlx.DB, config Config, static *staticGTFS, feed *gtfs.FeedMessage, timeZone *time.Location) (trips int, stops int, err error) {
+	var derived map[*gtfs.TripUpdate_StopTimeUpdate]bool
+	if static != nil {
+		derived = propagateDelays(feed, static, timeZone)
+		config.log().Debug("Propagated delays", "stops", len(derived))
+	}
+	if trips, stops, err = addTripUpdates(feed, db, config.FeedId, nullIfEmpty(config.AgencyId), timeZone, derived); err != nil {
+		return trips, stops, err
+	}
+	return trips, stops, recordTripIdentities(db, config, feed, timeZone)
+}
+
+// setupTripUpdatePolling loads the stop times of the latest static GTFS if delays are propagated, or else returns nil.
+// It's done once per process, however many polls follow, so restart a daemon after the static command.
+func setupTripUpdatePolling(config Config) (*staticGTFS, error) {
+	if !config.TripUpdates.PropagateDelays {
+		return nil, nil
+	}
+	staticFile, err := latestStaticFile(feedStaticDir(config))
+	if err != nil {
+		return nil, err
+	}
+	return loadStaticGTFS(staticFile, "stop_times.txt")
+}
+
+// setupVehiclePolling parses the geofences and registers the position hooks configured for vehicle positions.
+// It's done once per process, however many polls follow.
+func setupVehiclePolling(config Config) ([]geofence, error) {
+	zones, err := parseGeofences(config.Geofences)
+	if err != nil {
+		return nil, err
+	}
+	if config.NearestStopMeters > 0 {
+		if config.NearestStopMeters > maxNearRadius {
+			return nil, fmt.Errorf("%w: NearestStopMeters can be at most %.0f", ErrConfig, maxNearRadius)
+		}
+		staticFile, err := latestStaticFile(feedStaticDir(config))
+		if err != nil {
+			return nil, err
+		}
+		stops, err := newRouteStopIndex(staticFile, config.FeedId, config.NearestStopMeters)
+		if err != nil {
+			return nil, err
+		}
+		positionHooks.add(stops.annotate, nil)
+	}
+	return zones, nil
+}
+
+// pollVehiclePositions polls and stores vehicle positions. The stop times of delays pushed by RemoteWrite are
+// those returned by setupRemoteWrite.
+func pollVehiclePositions(db *sqlx.DB, config Config, zones []geofence, stopTimes *staticGTFS) error {
+	poll, err := pollFeed(db, config, "vehicle_positions", feedURLs(config.VehicleUpdatesURL, config.VehicleUpdatesURLs))
+	if err != nil {
+		runStats.failedFeedType = "vehicle_positions"
+		return err
+	}
+	feed := poll.feed
+	if err := reportStaleFeed(config, "vehicleupdates", "vehicle_positions", feed.GetHeader().GetTimestamp()); err != nil {
+		config.log().Warn("Failed to report a stale feed", "err", err)
+	}
+	if poll.unchanged {
+		config.log().Info("Vehicle positions are unchanged since the last poll")
+		return nil
+	}
+
+	timeZone, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+	inserted, err := storeVehiclePositions(db, config, zones, feed, timeZone)
+	if err != nil {
+		return err
+	}
+	runStats.rowsInserted = len(inserted)
+	poll.stored(db)
+	// Positions are already committed, so a failed delivery shouldn't fail the whole poll
+	if err := deliverWebhooks(config.Webhooks, inserted, config.log()); err != nil {
+		config.log().Error("Failed to deliver webhooks", "err", err)
+	}
+	if err := pushDerivedSeries(config, feed, timeZone, stopTimes); err != nil {
+		config.log().Warn("Failed to push derived series", "err", err)
+	}
+	return nil
+}
+
+// storeVehiclePositions stores a vehicle positions feed, whether just polled or replayed, along with the geofence
+// events and assignment changes of the positions inserted, returning them.
+func storeVehiclePositions(db *sqlx.DB, config Config, zones []geofence, feed *gtfs.FeedMessage, timeZone *time.Location) ([]VehiclePosition, error) {
+	inserted, err := addVehiclePositions(feed, db, config.FeedId, nullIfEmpty(config.AgencyId), timeZone, time.Duration(config.MinPositionIntervalSeconds)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if len(zones) > 0 {
+		events, err := addGeofenceEvents(db, config.FeedId, zones, inserted)
+		if err != nil {
+			return nil, err
+		}
+		if events > 0 {
+			config.log().Info("Recorded geofence events", "events", events)
+		}
+	}
+	if changes, err := addVehicleAssignments(db, config.FeedId, inserted); err != nil {
+		return nil, err
+	} else if changes > 0 {
+		config.log().Info("Recorded vehicle assignment changes", "changes", changes)
+	}
+	if err := recordTripIdentities(db, config, feed, timeZone); err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var defaultPositionKey = []string{"timestamp", "trip_id"}
+
+// Columns which can identify a position, which are never NULL. SQLite lets primary key columns other than an INTEGER
+// PRIMARY KEY be NULL and treats every NULL as distinct, so a key with route_id or start_date would store
+// a position without a route each time it's polled.
+var positionKeyChoices = []string{"timestamp", "trip_id", "vehicle_id"}
+
+// positionKeyColumns identify a stored position besides feed_id. They're set from PositionKey.
+var positionKeyColumns = defaultPositionKey
+
+// setupPositionKey applies the PositionKey setting.
+func setupPositionKey(config Config) error {
+	if len(config.PositionKey) == 0 {
+		positionKeyColumns = defaultPositionKey
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, name := range config.PositionKey {
+		if !slices.Contains(positionKeyChoices, name) {
+			return fmt.Errorf("invalid PositionKey column %q, expected some of %v", name, positionKeyChoices)
+		} else if seen[name] {
+			return fmt.Errorf("PositionKey has %s more than once", name)
+		}
+		seen[name] = true
+	}
+	if !seen["timestamp"] {
+		return fmt.Errorf("PositionKey needs timestamp, got %v", config.PositionKey)
+	}
+	positionKeyColumns = config.PositionKey
+	return nil
+}
+
+func positionPrimaryKey() string {
+	return "feed_id, " + strings.Join(positionKeyColumns, ", ")
+}
+
+// archiveSeriesColumns returns the columns telling apart the series of updates whose latest time is tracked
+// when appending to archive files with the given Dedup setting. With "trip" (and "hash", which only uses series to
+// find rows without a vehicle), that's each combination of vehicle, trip and other PositionKey columns. With "vehicle",
+// it's each vehicle's, or with vehicle_id in the key, each combination of vehicle and the other key columns.
+func archiveSeriesColumns(dedup string) []string {
+	series := []string{"vehicle_id"}
+	if dedup == "vehicle" && !slices.Contains(positionKeyColumns, "vehicle_id") {
+		return series
+	}
+	if dedup != "vehicle" {
+		series = append(series, "trip_id")
+	}
+	for _, name := range positionKeyColumns {
+		if !slices.Contains(series, name) && name != "timestamp" {
+			series = append(series, name)
+		}
+	}
+	return series
+}
+
+// positionSeries returns the archive series of a position, as the values of the series columns joined by NUL bytes.
+// A series of only vehicle_id is the vehicle ID, as in checkpoints from before the key was configurable.
+func (a *archiveSchema) positionSeries(vp *VehiclePosition) string {
+	var series strings.Builder
+	for i, name := range a.seriesColumns {
+		if i > 0 {
+			series.WriteByte(0)
+		}
+		switch name {
+		case "vehicle_id":
+			series.WriteString(vp.VehicleId)
+		case "trip_id":
+			series.WriteString(vp.TripId)
+		}
+	}
+	return series.String()
+}
+
+// storedPositionKey reads the primary key of the vehicle_positions table, or nil if there's no table yet.
+func storedPositionKey(ctx context.Context, db sqlx.QueryerContext) ([]string, error) {
+	var existing []struct {
+		Name string `db:"name"`
+		PK   int    `db:"pk"`
+	}
+	if err := sqlx.SelectContext(ctx, db, &existing, "SELECT name, pk FROM pragma_table_info('vehicle_positions') ORDER BY cid"); err != nil {
+		return nil, err
+	}
+	keyColumns := make([]string, len(existing)+1)
+	for _, column := range existing {
+		if column.PK > 0 {
+			keyColumns[column.PK] = column.Name
+		}
+	}
+	var key []string
+	for _, name := range keyColumns {
+		if name != "" {
+			key = append(key, name)
+		}
+	}
+	return key, nil
+}
+
+// checkPrimaryKey fails if an existing vehicle_positions table has another primary key than PositionKey,
+// since changing it can drop rows and is left to db migrate.
+func checkPrimaryKey(db *sqlx.DB) error {
+	ctx, cancel := dbContext()
+	defer cancel()
+	key, err := storedPositionKey(ctx, db)
+	if err != nil {
+		return err
+	}
+	if key != nil && strings.Join(key, ", ") != positionPrimaryKey() {
+		return fmt.Errorf("%w: vehicle_positions has primary key (%s) rather than PositionKey's (%s), run db migrate to rebuild it",
+			ErrConfig, strings.Join(key, ", "), positionPrimaryKey())
+	}
+	return nil
+}
+
+// migratePrimaryKey rebuilds an existing vehicle_positions table whose primary key isn't the configured one,
+// returning the number of rows kept and dropped as duplicates under the new key, keeping the first stored.
+// With dryRun, it only counts them.
+func migratePrimaryKey(db *sqlx.DB, dryRun bool) (kept int64, dropped int64, err error) {
+	ctx := context.Background()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	key, err := storedPositionKey(ctx, tx)
+	if err != nil || key == nil || strings.Join(key, ", ") == positionPrimaryKey() {
+		return 0, 0, err
+	}
+	var total int64
+	if err := tx.GetContext(ctx, &total, "SELECT COUNT(*) FROM vehicle_positions"); err != nil {
+		return 0, 0, err
+	}
+	if dryRun {
+		// Key columns are never NULL, so groups are what the new key keeps
+		if err := tx.GetContext(ctx, &kept, "SELECT COUNT(*) FROM (SELECT 1 FROM vehicle_positions GROUP BY "+positionPrimaryKey()+")"); err != nil {
+			return 0, 0, err
+		}
+		return kept, total - kept, nil
+	}
+
+	slog.Info("Migrating the primary key of vehicle_positions", "from", strings.Join(key, ", "), "to", positionPrimaryKey())
+	var names []string
+	if err := tx.SelectContext(ctx, &names, "SELECT name FROM pragma_table_info('vehicle_positions') ORDER BY cid"); err != nil {
+		return 0, 0, err
+	}
+	oldColumns := strings.Join(names, ", ")
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE vehicle_positions RENAME TO vehicle_positions_old"); err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.ExecContext(ctx, createTableQuery()); err != nil {
+		return 0, 0, err
+	}
+	result, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO vehicle_positions ("+oldColumns+") SELECT "+oldColumns+" FROM vehicle_positions_old ORDER BY rowid")
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "DROP TABLE vehicle_positions_old"); err != nil {
+		return 0, 0, err
+	}
+	if kept, err = result.RowsAffected(); err != nil {
+		return 0, 0, err
+	}
+	return kept, total - kept, tx.Commit()
+}
+
+// migrateDatabase changes the primary key of the vehicle_positions table to PositionKey, reporting how many
+// rows it drops as duplicates under the new key. --dry-run reports it without changing the table.
+func migrateDatabase(config Config, args []string) error {
+	flags := flag.NewFlagSet("db migrate", flag.ExitOnError)
+	dbPath := flags.String("db", filepath.Join(config.DataDir, "realtime.db"), "realtime database")
+	dryRun := flags.Bool("dry-run", false, "count the rows which would be dropped without migrating")
+	flags.Parse(args)
+
+	db, err := openDatabaseUnchecked(*dbPath, config.FeedId)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := checkPrimaryKey(db); err == nil {
+		config.log().Info("vehicle_positions already has the primary key", "key", positionPrimaryKey())
+		return nil
+	}
+	kept, dropped, err := migratePrimaryKey(db, *dryRun)
+	switch {
+	case err != nil:
+		return err
+	case *dryRun:
+		config.log().Info("Migrating the primary key would drop duplicates", "key", positionPrimaryKey(), "kept", kept, "dropped", dropped)
+	default:
+		config.log().Info("Migrated the primary key", "kept", kept, "dropped", dropped)
+	}
+	return nil
+}
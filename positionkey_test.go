@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/jmoiron/sqlx"
+	"google.golang.org/protobuf/proto"
+)
+
+// usePositionKey sets PositionKey for a test, restoring the default after it.
+func usePositionKey(t *testing.T, key ...string) {
+	t.Helper()
+	if err := setupPositionKey(Config{PositionKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { positionKeyColumns = defaultPositionKey })
+}
+
+// positionsFeed has a position for each vehicle, on the given trip, without a route.
+func positionsFeed(timestamp uint64, tripId string, vehicleIds ...string) *gtfs.FeedMessage {
+	feed := &gtfs.FeedMessage{Header: &gtfs.FeedHeader{GtfsRealtimeVersion: proto.String("2.0"), Timestamp: proto.Uint64(timestamp)}}
+	for _, vehicleId := range vehicleIds {
+		feed.Entity = append(feed.Entity, &gtfs.FeedEntity{
+			Id: proto.String(vehicleId),
+			Vehicle: &gtfs.VehiclePosition{
+				Trip:      &gtfs.TripDescriptor{TripId: proto.String(tripId), StartDate: proto.String("20240301"), StartTime: proto.String("08:00:00")},
+				Vehicle:   &gtfs.VehicleDescriptor{Id: proto.String(vehicleId)},
+				Position:  &gtfs.Position{Latitude: proto.Float32(49.28), Longitude: proto.Float32(-123.12)},
+				Timestamp: proto.Uint64(timestamp),
+			},
+		})
+	}
+	return feed
+}
+
+func countPositions(t *testing.T, db *sqlx.DB) int {
+	t.Helper()
+	var n int
+	if err := db.Get(&n, "SELECT COUNT(*) FROM vehicle_positions"); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSetupPositionKey(t *testing.T) {
+	t.Cleanup(func() { positionKeyColumns = defaultPositionKey })
+	tests := []struct {
+		key   []string
+		valid bool
+	}{
+		{nil, true},
+		{[]string{"timestamp", "vehicle_id"}, true},
+		{[]string{"timestamp", "trip_id", "vehicle_id"}, true},
+		// Nullable columns would let repeated positions in
+		{[]string{"timestamp", "route_id"}, false},
+		{[]string{"timestamp", "vehicle_id", "start_date"}, false},
+		{[]string{"vehicle_id"}, false},
+		{[]string{"timestamp", "trip_id", "trip_id"}, false},
+	}
+	for _, test := range tests {
+		if err := setupPositionKey(Config{PositionKey: test.key}); (err == nil) != test.valid {
+			t.Errorf("%v: got error %v", test.key, err)
+		}
+	}
+}
+
+func TestRepolledPositionsAreStoredOnce(t *testing.T) {
+	location := time.UTC
+	for _, key := range [][]string{{"timestamp", "trip_id"}, {"timestamp", "vehicle_id"}, {"timestamp", "trip_id", "vehicle_id"}} {
+		usePositionKey(t, key...)
+		db, err := createDatabase(filepath.Join(t.TempDir(), "realtime.db"), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for poll := 0; poll < 3; poll++ {
+			feed := positionsFeed(1709280000, "trip-1", "bus-1")
+			feed.Entity = append(feed.Entity, positionsFeed(1709280000, "trip-2", "bus-2").Entity...)
+			inserted, err := addVehiclePositions(feed, db, "test", nil, location, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[bool]int{true: 2, false: 0}[poll == 0]; len(inserted) != want {
+				t.Errorf("%v: poll %d inserted %d positions, want %d", key, poll, len(inserted), want)
+			}
+		}
+		if n := countPositions(t, db); n != 2 {
+			t.Errorf("%v: stored %d positions, want 2", key, n)
+		}
+		db.Close()
+	}
+}
+
+func TestPositionsWithoutTrip(t *testing.T) {
+	tests := []struct {
+		key  []string
+		want int
+	}{
+		// Positions without a trip would all share its empty trip_id
+		{[]string{"timestamp", "trip_id"}, 1},
+		{[]string{"timestamp", "trip_id", "vehicle_id"}, 1},
+		{[]string{"timestamp", "vehicle_id"}, 3},
+	}
+	for _, test := range tests {
+		usePositionKey(t, test.key...)
+		db, err := createDatabase(filepath.Join(t.TempDir(), "realtime.db"), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		feed := positionsFeed(1709280000, "trip-1", "bus-1", "bus-2", "bus-3")
+		for _, entity := range feed.Entity[1:] {
+			entity.Vehicle.Trip = nil
+		}
+		if _, err := addVehiclePositions(feed, db, "test", nil, time.UTC, 0); err != nil {
+			t.Fatal(err)
+		}
+		if n := countPositions(t, db); n != test.want {
+			t.Errorf("%v: stored %d positions, want %d", test.key, n, test.want)
+		}
+		db.Close()
+	}
+}
+
+func TestMigratePrimaryKey(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "realtime.db")
+	usePositionKey(t, "timestamp", "vehicle_id")
+	db, err := createDatabase(dbPath, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two vehicles coupled on one trip, which the default key can only keep one of
+	for _, timestamp := range []uint64{1709280000, 1709280030} {
+		if _, err := addVehiclePositions(positionsFeed(timestamp, "trip-1", "car-1", "car-2"), db, "test", nil, time.UTC, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	usePositionKey(t)
+	if _, err := openDatabase(dbPath, "test"); !errors.Is(err, ErrConfig) {
+		t.Fatalf("opening with another key: got %v, want ErrConfig", err)
+	}
+	db, err = openDatabaseUnchecked(dbPath, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	kept, dropped, err := migratePrimaryKey(db, true)
+	if err != nil || kept != 2 || dropped != 2 {
+		t.Errorf("dry run: got %d kept and %d dropped (%v), want 2 and 2", kept, dropped, err)
+	}
+	if n := countPositions(t, db); n != 4 {
+		t.Errorf("dry run left %d positions, want 4", n)
+	}
+	kept, dropped, err = migratePrimaryKey(db, false)
+	if err != nil || kept != 2 || dropped != 2 {
+		t.Errorf("got %d kept and %d dropped (%v), want 2 and 2", kept, dropped, err)
+	}
+	if n := countPositions(t, db); n != 2 {
+		t.Errorf("migration left %d positions, want 2", n)
+	}
+	if err := checkPrimaryKey(db); err != nil {
+		t.Error(err)
+	}
+	if kept, dropped, err := migratePrimaryKey(db, false); err != nil || kept != 0 || dropped != 0 {
+		t.Errorf("migrating again: got %d kept and %d dropped (%v), want nothing", kept, dropped, err)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PredictionAccuracy summarizes the arrival predictions made for a route's stops within one horizon before
+// the arrival. Errors are the predicted minus the observed arrival, so positive errors predicted a late arrival.
+type PredictionAccuracy struct {
+	FeedId  string  `parquet:"feed_id"`
+	RouteId *string `parquet:"route_id,optional"`
+	// Predictions made more than HorizonFromMinutes and up to HorizonToMinutes before the observed arrival
+	HorizonFromMinutes       int     `parquet:"horizon_from_minutes"`
+	HorizonToMinutes         int     `parquet:"horizon_to_minutes"`
+	Predictions              int64   `parquet:"predictions"`
+	MeanErrorSeconds         float64 `parquet:"mean_error_seconds"`
+	MeanAbsoluteErrorSeconds float64 `parquet:"mean_absolute_error_seconds"`
+	// Percentiles of the absolute error
+	P50AbsoluteErrorSeconds int64 `parquet:"p50_absolute_error_seconds"`
+	P90AbsoluteErrorSeconds int64 `parquet:"p90_absolute_error_seconds"`
+	P95AbsoluteErrorSeconds int64 `parquet:"p95_absolute_error_seconds"`
+}
+
+// prediction is an arrival at a stop predicted by a trip update.
+type prediction struct {
+	stop      string
+	updatedAt int64
+	arrival   int64
+}
+
+// tripPredictions holds the predictions of one trip's updates, keyed by tripUpdateSeries.
+type tripPredictions struct {
+	feedId      string
+	routeId     *string
+	lastUpdate  time.Time
+	predictions []prediction
+}
+
+type predictionKey struct {
+	feedId  string
+	routeId string
+	horizon int
+}
+
+type predictionGroup struct {
+	summary  PredictionAccuracy
+	errorSum int64
+	absolute []int64
+}
+
+// addPredictions records the arrivals predicted by a trip update. Stop time updates without an absolute arrival
+// (or departure) time are skipped, as are skipped stops and those added by TripUpdates.PropagateDelays.
+func (t *tripPredictions) addPredictions(row *archivedTripUpdate) {
+	if row.Timestamp.After(t.lastUpdate) {
+		t.lastUpdate = row.Timestamp
+	}
+	if t.routeId == nil {
+		t.routeId = row.RouteId
+	}
+	for _, s := range row.StopTimeUpdates {
+		if s.Derived || s.ScheduleRelationship != nil && *s.ScheduleRelationship != 0 {
+			continue
+		}
+		arrival := s.ArrivalTime
+		if arrival == nil {
+			arrival = s.DepartureTime
+		}
+		if arrival == nil {
+			continue
+		}
+		// Stops are told apart by sequence if given, as a stop can be visited twice by a loop
+		stop := ""
+		if s.StopSequence != nil {
+			stop = strconv.FormatUint(uint64(*s.StopSequence), 10)
+		}
+		if s.StopId != nil {
+			stop += "/" + *s.StopId
+		}
+		t.predictions = append(t.predictions, prediction{stop: stop, updatedAt: row.Timestamp.Unix(), arrival: *arrival})
+	}
+}
+
+// predictionErrors calls fn with the error of every prediction of a trip against its observed arrival, and how long
+// before that arrival it was made. A stop's arrival counts as observed by the last update predicting it, if that
+// update was made no more than window before the arrival, as feeds drop stops soon after they're served.
+// The observing update's own prediction isn't counted.
+func (t *tripPredictions) predictionErrors(window time.Duration, fn func(arrival int64, horizon int64, err int64)) {
+	sort.SliceStable(t.predictions, func(i, j int) bool {
+		if t.predictions[i].stop != t.predictions[j].stop {
+			return t.predictions[i].stop < t.predictions[j].stop
+		}
+		return t.predictions[i].updatedAt < t.predictions[j].updatedAt
+	})
+	for start := 0; start < len(t.predictions); {
+		end := start + 1
+		for end < len(t.predictions) && t.predictions[end].stop == t.predictions[start].stop {
+			end++
+		}
+		observed := t.predictions[end-1]
+		if observed.updatedAt >= observed.arrival-int64(window.Seconds()) {
+			for _, p := range t.predictions[start : end-1] {
+				if p.updatedAt < observed.arrival && p.updatedAt < observed.updatedAt {
+					fn(observed.arrival, observed.arrival-p.updatedAt, p.arrival-observed.arrival)
+				}
+			}
+		}
+		start = end
+	}
+}
+
+// parseHorizons parses a list of increasing horizons in minutes, e.g. "0,2,5,10".
+func parseHorizons(value string) ([]int, error) {
+	var horizons []int
+	for _, field := range strings.Split(value, ",") {
+		minutes, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		if minutes < 0 || len(horizons) > 0 && minutes <= horizons[len(horizons)-1] {
+			return nil, errors.New("horizons must be increasing minutes from zero")
+		}
+		horizons = append(horizons, minutes)
+	}
+	if len(horizons) < 2 {
+		return nil, errors.New("at least two horizons are needed to bound a range")
+	}
+	return horizons, nil
+}
+
+// analyzePredictions compares the arrivals predicted by archived trip updates with the observed arrivals,
+// summarizing the errors by route and horizon before arrival. Trip updates not yet archived are read from the
+// database. Each month is analyzed on its own, so a trip running across the end of a month is split in two.
+func analyzePredictions(config Config, args []string) error {
+	flags := flag.NewFlagSet("analyze predictions", flag.ExitOnError)
+	dbPath := flags.String("db", filepath.Join(config.DataDir, "realtime.db"), "realtime database")
+	archiveDir := flags.String("archive", feedArchiveDir(config), "archive directory")
+	from := flags.String("from", "", "first date of arrivals to analyze, as YYYY-MM-DD (default: start of the data)")
+	to := flags.String("to", "", "date of arrivals to analyze up to, exclusive, as YYYY-MM-DD (default: end of the data)")
+	output := flags.String("output", filepath.Join(config.DataDir, "predictions.csv"), "output file, as Parquet if it ends in .parquet and CSV otherwise")
+	horizonsFlag := flags.String("horizons", "0,2,5,10,15,20,30", "bounds of the horizons before arrival to summarize, in minutes")
+	window := flags.Duration("arrival-window", time.Minute, "how long before a predicted arrival the last update predicting it can be made, to count as observing it")
+	flags.Parse(args)
+
+	horizons, err := parseHorizons(*horizonsFlag)
+	if err != nil {
+		return fmt.Errorf("invalid --horizons: %w", err)
+	}
+	if *window < 0 {
+		return fmt.Errorf("invalid --arrival-window: %v", *window)
+	}
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+	fromTime, err := parseExportDate(*from, location)
+	if err != nil {
+		return fmt.Errorf("invalid --from: %w", err)
+	}
+	toTime, err := parseExportDate(*to, location)
+	if err != nil {
+		return fmt.Errorf("invalid --to: %w", err)
+	}
+
+	db, err := openDatabase(*dbPath, config.FeedId)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tripUpdatesDir := filepath.Join(*archiveDir, tripUpdatesArchiveDir)
+	startMonth, endMonth, err := findTripUpdateRange(db, config.Archive)
+	if err != nil {
+		return err
+	}
+	months, err := archivedMonths(tripUpdatesDir)
+	if err != nil {
+		return err
+	}
+	if len(months) > 0 {
+		if startMonth.IsZero() || months[0].Before(startMonth) {
+			startMonth = months[0]
+		}
+		if last := months[len(months)-1]; last.After(endMonth) {
+			endMonth = last
+		}
+	}
+	if startMonth.IsZero() {
+		return errors.New("no trip updates to analyze")
+	}
+	if !fromTime.IsZero() {
+		if month := time.Date(fromTime.Year(), fromTime.Month(), 1, 0, 0, 0, 0, time.UTC); month.After(startMonth) {
+			startMonth = month
+		}
+	}
+	if !toTime.IsZero() {
+		if month := time.Date(toTime.Year(), toTime.Month(), 1, 0, 0, 0, 0, time.UTC); month.Before(endMonth) {
+			endMonth = month
+		}
+	}
+
+	groups := make(map[predictionKey]*predictionGroup)
+	var observed int
+	for period := startMonth; !period.After(endMonth); period = period.AddDate(0, 1, 0) {
+		trips := make(map[string]*tripPredictions)
+		add := func(row *archivedTripUpdate) {
+			series := tripUpdateSeries(row.FeedId, row.TripId, row.StartTime)
+			trip := trips[series]
+			if trip == nil {
+				trip = &tripPredictions{feedId: row.FeedId}
+				trips[series] = trip
+			}
+			trip.addPredictions(row)
+		}
+		var archived int
+		err := readArchivedTripUpdates(filepath.Join(monthDir(tripUpdatesDir, period), tripUpdatesArchiveFile), func(rows []archivedTripUpdate) error {
+			for i := range rows {
+				add(&rows[i])
+			}
+			archived += len(rows)
+			return nil
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		// Rows in the database are skipped up to the last update of their trip in the archive, as archiving does
+		lastArchived := make(map[string]time.Time, len(trips))
+		for series, trip := range trips {
+			lastArchived[series] = trip.lastUpdate
+		}
+		var stored int
+		err = readStoredTripUpdates(db, config.Archive, period, partitionStart(config.Archive, period), func(rows []archivedTripUpdate) error {
+			for i := range rows {
+				if last, found := lastArchived[tripUpdateSeries(rows[i].FeedId, rows[i].TripId, rows[i].StartTime)]; found && !rows[i].Timestamp.After(last) {
+					continue
+				}
+				add(&rows[i])
+				stored++
+			}
+			return nil
+		})
+		if err != nil && !isMissingTable(err, "trip_updates") {
+			return err
+		}
+
+		for _, trip := range trips {
+			trip.predictionErrors(*window, func(arrival int64, horizon int64, err int64) {
+				if !fromTime.IsZero() && arrival < fromTime.Unix() || !toTime.IsZero() && arrival >= toTime.Unix() {
+					return
+				}
+				i := sort.Search(len(horizons), func(i int) bool { return int64(horizons[i])*60 >= horizon })
+				if i == 0 || i == len(horizons) {
+					return
+				}
+				key := predictionKey{feedId: trip.feedId, horizon: horizons[i]}
+				if trip.routeId != nil {
+					key.routeId = *trip.routeId
+				}
+				group := groups[key]
+				if group == nil {
+					group = &predictionGroup{summary: PredictionAccuracy{FeedId: trip.feedId, RouteId: trip.routeId,
+						HorizonFromMinutes: horizons[i-1], HorizonToMinutes: horizons[i]}}
+					groups[key] = group
+				}
+				group.summary.Predictions++
+				group.errorSum += err
+				group.absolute = append(group.absolute, max(err, -err))
+				observed++
+			})
+		}
+		config.log().Debug("Analyzed a month", "month", period.Format(yearMonthLayout), "archived", archived, "stored", stored, "trips", len(trips))
+	}
+
+	results := make([]PredictionAccuracy, 0, len(groups))
+	for _, group := range groups {
+		s := &group.summary
+		sort.Slice(group.absolute, func(i, j int) bool { return group.absolute[i] < group.absolute[j] })
+		var absoluteSum int64
+		for _, e := range group.absolute {
+			absoluteSum += e
+		}
+		s.MeanErrorSeconds = math.Round(float64(group.errorSum)/float64(s.Predictions)*10) / 10
+		s.MeanAbsoluteErrorSeconds = math.Round(float64(absoluteSum)/float64(s.Predictions)*10) / 10
+		s.P50AbsoluteErrorSeconds = percentile(group.absolute, 50)
+		s.P90AbsoluteErrorSeconds = percentile(group.absolute, 90)
+		s.P95AbsoluteErrorSeconds = percentile(group.absolute, 95)
+		results = append(results, *s)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.FeedId != b.FeedId {
+			return a.FeedId < b.FeedId
+		}
+		if (a.RouteId == nil) != (b.RouteId == nil) {
+			return a.RouteId == nil
+		} else if a.RouteId != nil && *a.RouteId != *b.RouteId {
+			return *a.RouteId < *b.RouteId
+		}
+		return a.HorizonToMinutes < b.HorizonToMinutes
+	})
+	config.log().Info("Compared predictions with observed arrivals", "predictions", observed)
+	return writeAnalysis(*output, results)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/proto"
+)
+
+// tripUpdatesFeed has one update of trip-1 on route 99, predicting arrivals at the stops from firstStop on.
+func tripUpdatesFeed(timestamp uint64, firstStop uint32, arrivals ...int64) *gtfs.FeedMessage {
+	update := &gtfs.TripUpdate{
+		Trip: &gtfs.TripDescriptor{TripId: proto.String("trip-1"), RouteId: proto.String("99"),
+			StartDate: proto.String("20240301"), StartTime: proto.String("08:00:00")},
+		Timestamp: proto.Uint64(timestamp),
+	}
+	for i, arrival := range arrivals {
+		update.StopTimeUpdate = append(update.StopTimeUpdate, &gtfs.TripUpdate_StopTimeUpdate{
+			StopSequence: proto.Uint32(firstStop + uint32(i)),
+			Arrival:      &gtfs.TripUpdate_StopTimeEvent{Time: proto.Int64(arrival)},
+		})
+	}
+	return &gtfs.FeedMessage{
+		Header: &gtfs.FeedHeader{GtfsRealtimeVersion: proto.String("2.0"), Timestamp: proto.Uint64(timestamp)},
+		Entity: []*gtfs.FeedEntity{{Id: proto.String("trip-1"), TripUpdate: update}},
+	}
+}
+
+func TestParseHorizons(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []int
+	}{
+		{"0,2,5", []int{0, 2, 5}},
+		{" 1, 10 ", []int{1, 10}},
+		{"0", nil},
+		{"5,2", nil},
+		{"0,0,1", nil},
+		{"-1,2", nil},
+		{"0,two", nil},
+	}
+	for _, test := range tests {
+		got, err := parseHorizons(test.value)
+		if test.want == nil && err == nil {
+			t.Errorf("%q: parsed as %v, want an error", test.value, got)
+		} else if test.want != nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v (%v), want %v", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestPredictionErrors(t *testing.T) {
+	type result struct{ arrival, horizon, err int64 }
+	tests := []struct {
+		name        string
+		predictions []prediction
+		want        []result
+	}{
+		{"observed", []prediction{{"1", 1000, 1700}, {"1", 1300, 1650}, {"1", 1590, 1620}},
+			[]result{{1620, 620, 80}, {1620, 320, 30}}},
+		// The stop was dropped long before its predicted arrival, so it wasn't observed
+		{"dropped early", []prediction{{"1", 1000, 1700}, {"1", 1300, 1650}}, nil},
+		{"only the observing update", []prediction{{"1", 1590, 1620}}, nil},
+		{"stops apart", []prediction{{"2", 1000, 2000}, {"1", 1000, 1500}, {"2", 1990, 1990}, {"1", 1480, 1490}},
+			[]result{{1490, 490, 10}, {1990, 990, 10}}},
+		// Predictions made after the observed arrival aren't counted
+		{"late update", []prediction{{"1", 1000, 1200}, {"1", 1100, 1150}, {"1", 1180, 1160}},
+			[]result{{1160, 160, 40}, {1160, 60, -10}}},
+	}
+	for _, test := range tests {
+		trip := &tripPredictions{predictions: test.predictions}
+		var got []result
+		trip.predictionErrors(time.Minute, func(arrival, horizon, err int64) { got = append(got, result{arrival, horizon, err}) })
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAnalyzePredictions(t *testing.T) {
+	dataDir := t.TempDir()
+	config := Config{DataDir: dataDir, FeedId: "test", TimeZone: "UTC"}
+	db, err := createDatabase(filepath.Join(dataDir, "realtime.db"), config.FeedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	const start = 1709280000
+	add := func(timestamp int64, firstStop uint32, arrivals ...int64) {
+		t.Helper()
+		if _, _, err := addTripUpdates(tripUpdatesFeed(uint64(timestamp), firstStop, arrivals...), db, config.FeedId, nil, time.UTC, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Stop 1 is reached at start+600 and stop 2 at start+1200, with updates dropping passed stops
+	add(start, 1, start+660, start+1320)
+	add(start+300, 1, start+630, start+1260)
+	// Half the updates are archived and half only in the database, which analysis reads both of
+	if err := archivePartitions(db, feedArchiveDir(config), config.Archive, provenanceOf(config)); err != nil {
+		t.Fatal(err)
+	}
+	add(start+580, 1, start+600, start+1230)
+	add(start+900, 2, start+1200)
+	add(start+1170, 2, start+1200)
+
+	output := filepath.Join(dataDir, "predictions.csv")
+	if err := analyzePredictions(config, []string{"--output", output, "--horizons", "0,5,15,30"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"feed_id,route_id,horizon_from_minutes,horizon_to_minutes,predictions,mean_error_seconds,mean_absolute_error_seconds," +
+			"p50_absolute_error_seconds,p90_absolute_error_seconds,p95_absolute_error_seconds",
+		// Stop 1 from start+300 and stop 2 from start+900
+		"test,99,0,5,2,15,15,0,30,30",
+		// Stop 1 from start, and stop 2 from start+300 and start+580
+		"test,99,5,15,3,50,50,60,60,60",
+		"test,99,15,30,1,120,120,120,120,120",
+	}
+	if lines := strings.Split(strings.TrimSpace(string(got)), "\n"); !reflect.DeepEqual(lines, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// archiveProfile is a combination of Parquet settings known to work with a query engine.
+type archiveProfile struct {
+	timestampUnit   string
+	int96Timestamps bool
+	// Engines predating the delta and byte stream split encodings get plain (or dictionary) encoded columns
+	plainEncodings bool
+	// Engines which can't read unsigned integer logical types get signed ones
+	signedIntegers bool
+	// Further columns to dictionary encode
+	dictionaryColumns []string
+	pageStatistics    bool
+	// Compression used unless one is configured
+	compression string
+}
+
+var archiveProfiles = map[string]archiveProfile{
+	// Athena (Trino) reads millisecond INT64 timestamps, and skips pages using their statistics
+	"athena": {timestampUnit: "millisecond", plainEncodings: true, pageStatistics: true},
+	// Spark 2 (parquet-mr 1.10) only reads INT96 timestamps as timestamps, and lacks zstd without native Hadoop libraries
+	"spark2": {
+		int96Timestamps: true, plainEncodings: true, signedIntegers: true, pageStatistics: true, compression: "snappy",
+	},
+	// DuckDB reads every encoding, its TIMESTAMP type has microsecond precision, and it keeps dictionary encoded
+	// strings as dictionary vectors, which speeds up grouping by trip
+	"duckdb": {timestampUnit: "microsecond", dictionaryColumns: []string{"trip_id"}},
+}
+
+// applyArchiveProfile returns the config with the profile's timestamp and compression settings applied.
+// The profile's timestamp settings take precedence over TimestampUnit and LegacyInt96Timestamps.
+func applyArchiveProfile(config ArchiveConfig) (ArchiveConfig, archiveProfile, error) {
+	if config.Profile == "" {
+		return config, archiveProfile{}, nil
+	}
+	profile, found := archiveProfiles[config.Profile]
+	if !found {
+		return config, profile, fmt.Errorf("invalid archive Profile: %q", config.Profile)
+	}
+	if profile.timestampUnit != "" {
+		config.TimestampUnit = profile.timestampUnit
+	}
+	config.LegacyInt96Timestamps = profile.int96Timestamps
+	if config.Compression == "" {
+		config.Compression = profile.compression
+	}
+	return config, profile, nil
+}
+
+// writerOptions returns the profile's Parquet writer settings.
+// Every profile keeps version 2 data pages, as parquet-go writes an invalid level section in version 1 pages
+// of optional columns.
+func (p archiveProfile) writerOptions() []parquet.WriterOption {
+	var options []parquet.WriterOption
+	if p.pageStatistics {
+		options = append(options, parquet.DataPageStatistics(true))
+	}
+	return options
+}
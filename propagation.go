@@ -0,0 +1,129 @@
+package main
+
+import (
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/proto"
+)
+
+// TripUpdatesConfig sets how trip updates are processed before they're stored.
+type TripUpdatesConfig struct {
+	// PropagateDelays extends each trip's last known delay to its later stops in the latest static GTFS, for agencies
+	// which only publish the next stop. The added stop time updates are stored flagged as derived.
+	// The static schedule is loaded once per run, so restart the daemon after the static command.
+	PropagateDelays bool
+}
+
+// eventDelay returns the delay of an arrival or departure, from its delay or, failing that,
+// its time against the scheduled time. Returns nil if neither is known.
+func eventDelay(event *gtfs.TripUpdate_StopTimeEvent, serviceDay time.Time, scheduled int) *int32 {
+	if event == nil {
+		return nil
+	}
+	if event.Delay != nil {
+		return event.Delay
+	}
+	if event.Time != nil && !serviceDay.IsZero() {
+		delay := int32(event.GetTime() - serviceDay.Unix() - int64(scheduled))
+		return &delay
+	}
+	return nil
+}
+
+// derivedEvent predicts an arrival or departure from the scheduled time and a propagated delay.
+func derivedEvent(delay int32, serviceDay time.Time, scheduled int) *gtfs.TripUpdate_StopTimeEvent {
+	event := &gtfs.TripUpdate_StopTimeEvent{Delay: proto.Int32(delay)}
+	if !serviceDay.IsZero() {
+		event.Time = proto.Int64(serviceDay.Unix() + int64(scheduled) + int64(delay))
+	}
+	return event
+}
+
+// matchStopTimes finds the index in the trip's stop times of each stop time update,
+// by stop sequence or else by stop ID after the previous update. Returns false if any update can't be matched,
+// or updates are out of order, which means the feed and schedule disagree on the trip's stops.
+func matchStopTimes(updates []*gtfs.TripUpdate_StopTimeUpdate, stopTimes []StopTime) ([]int, bool) {
+	indexes := make([]int, len(updates))
+	next := 0
+	for i, update := range updates {
+		found := -1
+		for j := next; j < len(stopTimes); j++ {
+			if update.StopSequence != nil && stopTimes[j].StopSequence == update.GetStopSequence() ||
+				update.StopSequence == nil && stopTimes[j].StopId == update.GetStopId() {
+				found = j
+				break
+			}
+		}
+		if found < 0 {
+			return nil, false
+		}
+		indexes[i] = found
+		next = found + 1
+	}
+	return indexes, true
+}
+
+// propagateDelays adds stop time updates for the scheduled stops after each trip's updates, carrying the delay
+// of the update before them as GTFS-RT consumers would. Propagation stops at an update with NO_DATA, and
+// passes over SKIPPED stops. Trips which aren't scheduled, or whose updates don't match their stop times,
+// are left alone. Returns the added updates, which are derived rather than published.
+func propagateDelays(feed *gtfs.FeedMessage, static *staticGTFS, location *time.Location) map[*gtfs.TripUpdate_StopTimeUpdate]bool {
+	derived := make(map[*gtfs.TripUpdate_StopTimeUpdate]bool)
+	for _, entity := range feed.Entity {
+		tripUpdate := entity.GetTripUpdate()
+		trip := tripUpdate.GetTrip()
+		if tripUpdate == nil || len(tripUpdate.StopTimeUpdate) == 0 ||
+			trip.GetScheduleRelationship() != gtfs.TripDescriptor_SCHEDULED {
+			continue
+		}
+		stopTimes := static.stopTimes[trip.GetTripId()]
+		indexes, ok := matchStopTimes(tripUpdate.StopTimeUpdate, stopTimes)
+		if !ok {
+			continue
+		}
+		// Times are only predicted for trips with a start date, which anchors the schedule
+		var serviceDay time.Time
+		if trip.StartDate != nil {
+			serviceDay, _ = parseNoonStartTime(trip.GetStartDate(), "00:00:00", location)
+		}
+
+		updates := make([]*gtfs.TripUpdate_StopTimeUpdate, 0, len(stopTimes)-indexes[0])
+		var delay *int32
+		next := 0
+		for i := indexes[0]; i < len(stopTimes); i++ {
+			stopTime := stopTimes[i]
+			if next < len(indexes) && indexes[next] == i {
+				update := tripUpdate.StopTimeUpdate[next]
+				updates = append(updates, update)
+				next++
+				switch update.GetScheduleRelationship() {
+				case gtfs.TripUpdate_StopTimeUpdate_NO_DATA:
+					delay = nil
+				case gtfs.TripUpdate_StopTimeUpdate_SKIPPED:
+				default:
+					// The departure delay carries on to later stops, or the arrival's if there's no departure
+					if d := eventDelay(update.Departure, serviceDay, stopTime.DepartureTime); d != nil {
+						delay = d
+					} else if d := eventDelay(update.Arrival, serviceDay, stopTime.ArrivalTime); d != nil {
+						delay = d
+					}
+				}
+				continue
+			}
+			if delay == nil {
+				continue
+			}
+			update := &gtfs.TripUpdate_StopTimeUpdate{
+				StopSequence: proto.Uint32(stopTime.StopSequence),
+				StopId:       proto.String(stopTime.StopId),
+				Arrival:      derivedEvent(*delay, serviceDay, stopTime.ArrivalTime),
+				Departure:    derivedEvent(*delay, serviceDay, stopTime.DepartureTime),
+			}
+			updates = append(updates, update)
+			derived[update] = true
+		}
+		tripUpdate.StopTimeUpdate = updates
+	}
+	return derived
+}
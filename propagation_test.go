@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestPropagateDelays(t *testing.T) {
+	// Four stops ten minutes apart from 08:00:00
+	var stopTimes []StopTime
+	for i := 0; i < 4; i++ {
+		scheduled := 8*3600 + 600*i
+		stopTimes = append(stopTimes, StopTime{StopId: string(rune('a' + i)), StopSequence: uint32(i + 1), ArrivalTime: scheduled, DepartureTime: scheduled})
+	}
+	static := &staticGTFS{stopTimes: map[string][]StopTime{"trip-1": stopTimes, "trip-2": stopTimes}}
+	serviceDay := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).Unix()
+	trip := func(tripId string) *gtfs.TripUpdate {
+		return &gtfs.TripUpdate{
+			Trip: &gtfs.TripDescriptor{TripId: proto.String(tripId), StartDate: proto.String("20240301")},
+			StopTimeUpdate: []*gtfs.TripUpdate_StopTimeUpdate{{
+				StopSequence: proto.Uint32(2),
+				Arrival:      &gtfs.TripUpdate_StopTimeEvent{Delay: proto.Int32(120)},
+			}},
+		}
+	}
+	noData := trip("trip-2")
+	noData.StopTimeUpdate[0].ScheduleRelationship = gtfs.TripUpdate_StopTimeUpdate_NO_DATA.Enum()
+	feed := &gtfs.FeedMessage{Entity: []*gtfs.FeedEntity{
+		{Id: proto.String("trip-1"), TripUpdate: trip("trip-1")},
+		{Id: proto.String("trip-2"), TripUpdate: noData},
+		// Not in the schedule
+		{Id: proto.String("trip-3"), TripUpdate: trip("trip-3")},
+	}}
+
+	derived := propagateDelays(feed, static, time.UTC)
+	if len(derived) != 2 {
+		t.Errorf("derived %d stop time updates, want 2", len(derived))
+	}
+	type update struct {
+		sequence uint32
+		arrival  int64
+		derived  bool
+	}
+	for i, want := range [][]update{
+		{{2, 0, false}, {3, serviceDay + 8*3600 + 1200 + 120, true}, {4, serviceDay + 8*3600 + 1800 + 120, true}},
+		{{2, 0, false}},
+		{{2, 0, false}},
+	} {
+		var got []update
+		for _, u := range feed.Entity[i].TripUpdate.StopTimeUpdate {
+			got = append(got, update{u.GetStopSequence(), u.GetArrival().GetTime(), derived[u]})
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", feed.Entity[i].GetId(), got, want)
+		}
+	}
+}
@@ -0,0 +1,1141 @@
+// The gRPC query service of `serve --grpc-addr`. Messages mirror the vehicle_positions and alerts tables,
+// with DATETIME columns as Unix seconds and alert text as the stored JSON. Nullable columns are optional
+// fields, so NULLs can be told apart from zeros.
+//
+// New columns need new field numbers, and numbers are never reused, so existing clients keep decoding
+// the fields they know. Regenerate the Go code with go generate after changing this file.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.2
+// 	protoc        (unknown)
+// source: gtfsscraper/v1/query.proto
+
+package gtfsscraperv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type VehiclePosition struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	FeedId               string   `protobuf:"bytes,1,opt,name=feed_id,json=feedId,proto3" json:"feed_id,omitempty"`
+	TripId               string   `protobuf:"bytes,2,opt,name=trip_id,json=tripId,proto3" json:"trip_id,omitempty"`
+	RouteId              *string  `protobuf:"bytes,3,opt,name=route_id,json=routeId,proto3,oneof" json:"route_id,omitempty"`
+	DirectionId          *int32   `protobuf:"varint,4,opt,name=direction_id,json=directionId,proto3,oneof" json:"direction_id,omitempty"`
+	StartTime            int64    `protobuf:"varint,5,opt,name=start_time,json=startTime,proto3" json:"start_time,omitempty"`
+	ScheduleRelationship *int32   `protobuf:"varint,6,opt,name=schedule_relationship,json=scheduleRelationship,proto3,oneof" json:"schedule_relationship,omitempty"`
+	Latitude             *float32 `protobuf:"fixed32,7,opt,name=latitude,proto3,oneof" json:"latitude,omitempty"`
+	Longitude            *float32 `protobuf:"fixed32,8,opt,name=longitude,proto3,oneof" json:"longitude,omitempty"`
+	Bearing              *float32 `protobuf:"fixed32,9,opt,name=bearing,proto3,oneof" json:"bearing,omitempty"`
+	Odometer             *float64 `protobuf:"fixed64,10,opt,name=odometer,proto3,oneof" json:"odometer,omitempty"`
+	Speed                *float32 `protobuf:"fixed32,11,opt,name=speed,proto3,oneof" json:"speed,omitempty"`
+	CurrentStopSequence  *uint32  `protobuf:"varint,12,opt,name=current_stop_sequence,json=currentStopSequence,proto3,oneof" json:"current_stop_sequence,omitempty"`
+	StopId               *string  `protobuf:"bytes,13,opt,name=stop_id,json=stopId,proto3,oneof" json:"stop_id,omitempty"`
+	CurrentStatus        *int32   `protobuf:"varint,14,opt,name=current_status,json=currentStatus,proto3,oneof" json:"current_status,omitempty"`
+	Timestamp            int64    `protobuf:"varint,15,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	CongestionLevel      *int32   `protobuf:"varint,16,opt,name=congestion_level,json=congestionLevel,proto3,oneof" json:"congestion_level,omitempty"`
+	OccupancyStatus      *int32   `protobuf:"varint,17,opt,name=occupancy_status,json=occupancyStatus,proto3,oneof" json:"occupancy_status,omitempty"`
+	OccupancyPercentage  *uint32  `protobuf:"varint,18,opt,name=occupancy_percentage,json=occupancyPercentage,proto3,oneof" json:"occupancy_percentage,omitempty"`
+	VehicleId            string   `protobuf:"bytes,19,opt,name=vehicle_id,json=vehicleId,proto3" json:"vehicle_id,omitempty"`
+	VehicleLabel         *string  `protobuf:"bytes,20,opt,name=vehicle_label,json=vehicleLabel,proto3,oneof" json:"vehicle_label,omitempty"`
+	LicensePlate         *string  `protobuf:"bytes,21,opt,name=license_plate,json=licensePlate,proto3,oneof" json:"license_plate,omitempty"`
+	StartDate            *string  `protobuf:"bytes,22,opt,name=start_date,json=startDate,proto3,oneof" json:"start_date,omitempty"`
+	WheelchairAccessible *int32   `protobuf:"varint,23,opt,name=wheelchair_accessible,json=wheelchairAccessible,proto3,oneof" json:"wheelchair_accessible,omitempty"`
+	NearestStopId        *string  `protobuf:"bytes,24,opt,name=nearest_stop_id,json=nearestStopId,proto3,oneof" json:"nearest_stop_id,omitempty"`
+	AgencyId             *string  `protobuf:"bytes,25,opt,name=agency_id,json=agencyId,proto3,oneof" json:"agency_id,omitempty"`
+}
+
+func (x *VehiclePosition) Reset() {
+	*x = VehiclePosition{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gtfsscraper_v1_query_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *VehiclePosition) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VehiclePosition) ProtoMessage() {}
+
+func (x *VehiclePosition) ProtoReflect() protoreflect.Message {
+	mi := &file_gtfsscraper_v1_query_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VehiclePosition.ProtoReflect.Descriptor instead.
+func (*VehiclePosition) Descriptor() ([]byte, []int) {
+	return file_gtfsscraper_v1_query_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *VehiclePosition) GetFeedId() string {
+	if x != nil {
+		return x.FeedId
+	}
+	return ""
+}
+
+func (x *VehiclePosition) GetTripId() string {
+	if x != nil {
+		return x.TripId
+	}
+	return ""
+}
+
+func (x *VehiclePosition) GetRouteId() string {
+	if x != nil && x.RouteId != nil {
+		return *x.RouteId
+	}
+	return ""
+}
+
+func (x *VehiclePosition) GetDirectionId() int32 {
+	if x != nil && x.DirectionId != nil {
+		return *x.DirectionId
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetStartTime() int64 {
+	if x != nil {
+		return x.StartTime
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetScheduleRelationship() int32 {
+	if x != nil && x.ScheduleRelationship != nil {
+		return *x.ScheduleRelationship
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetLatitude() float32 {
+	if x != nil && x.Latitude != nil {
+		return *x.Latitude
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetLongitude() float32 {
+	if x != nil && x.Longitude != nil {
+		return *x.Longitude
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetBearing() float32 {
+	if x != nil && x.Bearing != nil {
+		return *x.Bearing
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetOdometer() float64 {
+	if x != nil && x.Odometer != nil {
+		return *x.Odometer
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetSpeed() float32 {
+	if x != nil && x.Speed != nil {
+		return *x.Speed
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetCurrentStopSequence() uint32 {
+	if x != nil && x.CurrentStopSequence != nil {
+		return *x.CurrentStopSequence
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetStopId() string {
+	if x != nil && x.StopId != nil {
+		return *x.StopId
+	}
+	return ""
+}
+
+func (x *VehiclePosition) GetCurrentStatus() int32 {
+	if x != nil && x.CurrentStatus != nil {
+		return *x.CurrentStatus
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetCongestionLevel() int32 {
+	if x != nil && x.CongestionLevel != nil {
+		return *x.CongestionLevel
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetOccupancyStatus() int32 {
+	if x != nil && x.OccupancyStatus != nil {
+		return *x.OccupancyStatus
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetOccupancyPercentage() uint32 {
+	if x != nil && x.OccupancyPercentage != nil {
+		return *x.OccupancyPercentage
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetVehicleId() string {
+	if x != nil {
+		return x.VehicleId
+	}
+	return ""
+}
+
+func (x *VehiclePosition) GetVehicleLabel() string {
+	if x != nil && x.VehicleLabel != nil {
+		return *x.VehicleLabel
+	}
+	return ""
+}
+
+func (x *VehiclePosition) GetLicensePlate() string {
+	if x != nil && x.LicensePlate != nil {
+		return *x.LicensePlate
+	}
+	return ""
+}
+
+func (x *VehiclePosition) GetStartDate() string {
+	if x != nil && x.StartDate != nil {
+		return *x.StartDate
+	}
+	return ""
+}
+
+func (x *VehiclePosition) GetWheelchairAccessible() int32 {
+	if x != nil && x.WheelchairAccessible != nil {
+		return *x.WheelchairAccessible
+	}
+	return 0
+}
+
+func (x *VehiclePosition) GetNearestStopId() string {
+	if x != nil && x.NearestStopId != nil {
+		return *x.NearestStopId
+	}
+	return ""
+}
+
+func (x *VehiclePosition) GetAgencyId() string {
+	if x != nil && x.AgencyId != nil {
+		return *x.AgencyId
+	}
+	return ""
+}
+
+type Alert struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	FeedId               string  `protobuf:"bytes,1,opt,name=feed_id,json=feedId,proto3" json:"feed_id,omitempty"`
+	AlertId              string  `protobuf:"bytes,2,opt,name=alert_id,json=alertId,proto3" json:"alert_id,omitempty"`
+	ContentHash          string  `protobuf:"bytes,3,opt,name=content_hash,json=contentHash,proto3" json:"content_hash,omitempty"`
+	FirstSeen            int64   `protobuf:"varint,4,opt,name=first_seen,json=firstSeen,proto3" json:"first_seen,omitempty"`
+	LastSeen             int64   `protobuf:"varint,5,opt,name=last_seen,json=lastSeen,proto3" json:"last_seen,omitempty"`
+	ActivePeriods        *string `protobuf:"bytes,6,opt,name=active_periods,json=activePeriods,proto3,oneof" json:"active_periods,omitempty"`
+	InformedEntities     *string `protobuf:"bytes,7,opt,name=informed_entities,json=informedEntities,proto3,oneof" json:"informed_entities,omitempty"`
+	Cause                *int32  `protobuf:"varint,8,opt,name=cause,proto3,oneof" json:"cause,omitempty"`
+	CauseDetail          *string `protobuf:"bytes,9,opt,name=cause_detail,json=causeDetail,proto3,oneof" json:"cause_detail,omitempty"`
+	Effect               *int32  `protobuf:"varint,10,opt,name=effect,proto3,oneof" json:"effect,omitempty"`
+	EffectDetail         *string `protobuf:"bytes,11,opt,name=effect_detail,json=effectDetail,proto3,oneof" json:"effect_detail,omitempty"`
+	SeverityLevel        *int32  `protobuf:"varint,12,opt,name=severity_level,json=severityLevel,proto3,oneof" json:"severity_level,omitempty"`
+	Url                  *string `protobuf:"bytes,13,opt,name=url,proto3,oneof" json:"url,omitempty"`
+	HeaderText           *string `protobuf:"bytes,14,opt,name=header_text,json=headerText,proto3,oneof" json:"header_text,omitempty"`
+	DescriptionText      *string `protobuf:"bytes,15,opt,name=description_text,json=descriptionText,proto3,oneof" json:"description_text,omitempty"`
+	TtsHeaderText        *string `protobuf:"bytes,16,opt,name=tts_header_text,json=ttsHeaderText,proto3,oneof" json:"tts_header_text,omitempty"`
+	TtsDescriptionText   *string `protobuf:"bytes,17,opt,name=tts_description_text,json=ttsDescriptionText,proto3,oneof" json:"tts_description_text,omitempty"`
+	Image                *string `protobuf:"bytes,18,opt,name=image,proto3,oneof" json:"image,omitempty"`
+	ImageAlternativeText *string `protobuf:"bytes,19,opt,name=image_alternative_text,json=imageAlternativeText,proto3,oneof" json:"image_alternative_text,omitempty"`
+}
+
+func (x *Alert) Reset() {
+	*x = Alert{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gtfsscraper_v1_query_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Alert) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Alert) ProtoMessage() {}
+
+func (x *Alert) ProtoReflect() protoreflect.Message {
+	mi := &file_gtfsscraper_v1_query_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Alert.ProtoReflect.Descriptor instead.
+func (*Alert) Descriptor() ([]byte, []int) {
+	return file_gtfsscraper_v1_query_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Alert) GetFeedId() string {
+	if x != nil {
+		return x.FeedId
+	}
+	return ""
+}
+
+func (x *Alert) GetAlertId() string {
+	if x != nil {
+		return x.AlertId
+	}
+	return ""
+}
+
+func (x *Alert) GetContentHash() string {
+	if x != nil {
+		return x.ContentHash
+	}
+	return ""
+}
+
+func (x *Alert) GetFirstSeen() int64 {
+	if x != nil {
+		return x.FirstSeen
+	}
+	return 0
+}
+
+func (x *Alert) GetLastSeen() int64 {
+	if x != nil {
+		return x.LastSeen
+	}
+	return 0
+}
+
+func (x *Alert) GetActivePeriods() string {
+	if x != nil && x.ActivePeriods != nil {
+		return *x.ActivePeriods
+	}
+	return ""
+}
+
+func (x *Alert) GetInformedEntities() string {
+	if x != nil && x.InformedEntities != nil {
+		return *x.InformedEntities
+	}
+	return ""
+}
+
+func (x *Alert) GetCause() int32 {
+	if x != nil && x.Cause != nil {
+		return *x.Cause
+	}
+	return 0
+}
+
+func (x *Alert) GetCauseDetail() string {
+	if x != nil && x.CauseDetail != nil {
+		return *x.CauseDetail
+	}
+	return ""
+}
+
+func (x *Alert) GetEffect() int32 {
+	if x != nil && x.Effect != nil {
+		return *x.Effect
+	}
+	return 0
+}
+
+func (x *Alert) GetEffectDetail() string {
+	if x != nil && x.EffectDetail != nil {
+		return *x.EffectDetail
+	}
+	return ""
+}
+
+func (x *Alert) GetSeverityLevel() int32 {
+	if x != nil && x.SeverityLevel != nil {
+		return *x.SeverityLevel
+	}
+	return 0
+}
+
+func (x *Alert) GetUrl() string {
+	if x != nil && x.Url != nil {
+		return *x.Url
+	}
+	return ""
+}
+
+func (x *Alert) GetHeaderText() string {
+	if x != nil && x.HeaderText != nil {
+		return *x.HeaderText
+	}
+	return ""
+}
+
+func (x *Alert) GetDescriptionText() string {
+	if x != nil && x.DescriptionText != nil {
+		return *x.DescriptionText
+	}
+	return ""
+}
+
+func (x *Alert) GetTtsHeaderText() string {
+	if x != nil && x.TtsHeaderText != nil {
+		return *x.TtsHeaderText
+	}
+	return ""
+}
+
+func (x *Alert) GetTtsDescriptionText() string {
+	if x != nil && x.TtsDescriptionText != nil {
+		return *x.TtsDescriptionText
+	}
+	return ""
+}
+
+func (x *Alert) GetImage() string {
+	if x != nil && x.Image != nil {
+		return *x.Image
+	}
+	return ""
+}
+
+func (x *Alert) GetImageAlternativeText() string {
+	if x != nil && x.ImageAlternativeText != nil {
+		return *x.ImageAlternativeText
+	}
+	return ""
+}
+
+type LatestPositionsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	RouteId   string `protobuf:"bytes,1,opt,name=route_id,json=routeId,proto3" json:"route_id,omitempty"`
+	VehicleId string `protobuf:"bytes,2,opt,name=vehicle_id,json=vehicleId,proto3" json:"vehicle_id,omitempty"`
+	From      int64  `protobuf:"varint,3,opt,name=from,proto3" json:"from,omitempty"`
+	To        int64  `protobuf:"varint,4,opt,name=to,proto3" json:"to,omitempty"`
+	Limit     int32  `protobuf:"varint,5,opt,name=limit,proto3" json:"limit,omitempty"`
+}
+
+func (x *LatestPositionsRequest) Reset() {
+	*x = LatestPositionsRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gtfsscraper_v1_query_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *LatestPositionsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LatestPositionsRequest) ProtoMessage() {}
+
+func (x *LatestPositionsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_gtfsscraper_v1_query_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LatestPositionsRequest.ProtoReflect.Descriptor instead.
+func (*LatestPositionsRequest) Descriptor() ([]byte, []int) {
+	return file_gtfsscraper_v1_query_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *LatestPositionsRequest) GetRouteId() string {
+	if x != nil {
+		return x.RouteId
+	}
+	return ""
+}
+
+func (x *LatestPositionsRequest) GetVehicleId() string {
+	if x != nil {
+		return x.VehicleId
+	}
+	return ""
+}
+
+func (x *LatestPositionsRequest) GetFrom() int64 {
+	if x != nil {
+		return x.From
+	}
+	return 0
+}
+
+func (x *LatestPositionsRequest) GetTo() int64 {
+	if x != nil {
+		return x.To
+	}
+	return 0
+}
+
+func (x *LatestPositionsRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type LatestPositionsResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Positions []*VehiclePosition `protobuf:"bytes,1,rep,name=positions,proto3" json:"positions,omitempty"`
+}
+
+func (x *LatestPositionsResponse) Reset() {
+	*x = LatestPositionsResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gtfsscraper_v1_query_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *LatestPositionsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LatestPositionsResponse) ProtoMessage() {}
+
+func (x *LatestPositionsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_gtfsscraper_v1_query_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LatestPositionsResponse.ProtoReflect.Descriptor instead.
+func (*LatestPositionsResponse) Descriptor() ([]byte, []int) {
+	return file_gtfsscraper_v1_query_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *LatestPositionsResponse) GetPositions() []*VehiclePosition {
+	if x != nil {
+		return x.Positions
+	}
+	return nil
+}
+
+type PositionHistoryRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	RouteId   string `protobuf:"bytes,1,opt,name=route_id,json=routeId,proto3" json:"route_id,omitempty"`
+	VehicleId string `protobuf:"bytes,2,opt,name=vehicle_id,json=vehicleId,proto3" json:"vehicle_id,omitempty"`
+	From      int64  `protobuf:"varint,3,opt,name=from,proto3" json:"from,omitempty"`
+	To        int64  `protobuf:"varint,4,opt,name=to,proto3" json:"to,omitempty"`
+	Follow    bool   `protobuf:"varint,5,opt,name=follow,proto3" json:"follow,omitempty"`
+}
+
+func (x *PositionHistoryRequest) Reset() {
+	*x = PositionHistoryRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gtfsscraper_v1_query_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PositionHistoryRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PositionHistoryRequest) ProtoMessage() {}
+
+func (x *PositionHistoryRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_gtfsscraper_v1_query_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PositionHistoryRequest.ProtoReflect.Descriptor instead.
+func (*PositionHistoryRequest) Descriptor() ([]byte, []int) {
+	return file_gtfsscraper_v1_query_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *PositionHistoryRequest) GetRouteId() string {
+	if x != nil {
+		return x.RouteId
+	}
+	return ""
+}
+
+func (x *PositionHistoryRequest) GetVehicleId() string {
+	if x != nil {
+		return x.VehicleId
+	}
+	return ""
+}
+
+func (x *PositionHistoryRequest) GetFrom() int64 {
+	if x != nil {
+		return x.From
+	}
+	return 0
+}
+
+func (x *PositionHistoryRequest) GetTo() int64 {
+	if x != nil {
+		return x.To
+	}
+	return 0
+}
+
+func (x *PositionHistoryRequest) GetFollow() bool {
+	if x != nil {
+		return x.Follow
+	}
+	return false
+}
+
+type AlertsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	RouteId string `protobuf:"bytes,1,opt,name=route_id,json=routeId,proto3" json:"route_id,omitempty"`
+	From    int64  `protobuf:"varint,2,opt,name=from,proto3" json:"from,omitempty"`
+	To      int64  `protobuf:"varint,3,opt,name=to,proto3" json:"to,omitempty"`
+	Limit   int32  `protobuf:"varint,4,opt,name=limit,proto3" json:"limit,omitempty"`
+}
+
+func (x *AlertsRequest) Reset() {
+	*x = AlertsRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gtfsscraper_v1_query_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AlertsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AlertsRequest) ProtoMessage() {}
+
+func (x *AlertsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_gtfsscraper_v1_query_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AlertsRequest.ProtoReflect.Descriptor instead.
+func (*AlertsRequest) Descriptor() ([]byte, []int) {
+	return file_gtfsscraper_v1_query_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *AlertsRequest) GetRouteId() string {
+	if x != nil {
+		return x.RouteId
+	}
+	return ""
+}
+
+func (x *AlertsRequest) GetFrom() int64 {
+	if x != nil {
+		return x.From
+	}
+	return 0
+}
+
+func (x *AlertsRequest) GetTo() int64 {
+	if x != nil {
+		return x.To
+	}
+	return 0
+}
+
+func (x *AlertsRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type AlertsResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Alerts []*Alert `protobuf:"bytes,1,rep,name=alerts,proto3" json:"alerts,omitempty"`
+}
+
+func (x *AlertsResponse) Reset() {
+	*x = AlertsResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_gtfsscraper_v1_query_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AlertsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AlertsResponse) ProtoMessage() {}
+
+func (x *AlertsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_gtfsscraper_v1_query_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AlertsResponse.ProtoReflect.Descriptor instead.
+func (*AlertsResponse) Descriptor() ([]byte, []int) {
+	return file_gtfsscraper_v1_query_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *AlertsResponse) GetAlerts() []*Alert {
+	if x != nil {
+		return x.Alerts
+	}
+	return nil
+}
+
+var File_gtfsscraper_v1_query_proto protoreflect.FileDescriptor
+
+var file_gtfsscraper_v1_query_proto_rawDesc = []byte{
+	0x0a, 0x1a, 0x67, 0x74, 0x66, 0x73, 0x73, 0x63, 0x72, 0x61, 0x70, 0x65, 0x72, 0x2f, 0x76, 0x31,
+	0x2f, 0x71, 0x75, 0x65, 0x72, 0x79, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0e, 0x67, 0x74,
+	0x66, 0x73, 0x73, 0x63, 0x72, 0x61, 0x70, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x22, 0xbd, 0x0a, 0x0a,
+	0x0f, 0x56, 0x65, 0x68, 0x69, 0x63, 0x6c, 0x65, 0x50, 0x6f, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e,
+	0x12, 0x17, 0x0a, 0x07, 0x66, 0x65, 0x65, 0x64, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x06, 0x66, 0x65, 0x65, 0x64, 0x49, 0x64, 0x12, 0x17, 0x0a, 0x07, 0x74, 0x72, 0x69,
+	0x70, 0x5f, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x74, 0x72, 0x69, 0x70,
+	0x49, 0x64, 0x12, 0x1e, 0x0a, 0x08, 0x72, 0x6f, 0x75, 0x74, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x03,
+	0x20, 0x01, 0x28, 0x09, 0x48, 0x00, 0x52, 0x07, 0x72, 0x6f, 0x75, 0x74, 0x65, 0x49, 0x64, 0x88,
+	0x01, 0x01, 0x12, 0x26, 0x0a, 0x0c, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x5f,
+	0x69, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x05, 0x48, 0x01, 0x52, 0x0b, 0x64, 0x69, 0x72, 0x65,
+	0x63, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x64, 0x88, 0x01, 0x01, 0x12, 0x1d, 0x0a, 0x0a, 0x73, 0x74,
+	0x61, 0x72, 0x74, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09,
+	0x73, 0x74, 0x61, 0x72, 0x74, 0x54, 0x69, 0x6d, 0x65, 0x12, 0x38, 0x0a, 0x15, 0x73, 0x63, 0x68,
+	0x65, 0x64, 0x75, 0x6c, 0x65, 0x5f, 0x72, 0x65, 0x6c, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x68,
+	0x69, 0x70, 0x18, 0x06, 0x20, 0x01, 0x28, 0x05, 0x48, 0x02, 0x52, 0x14, 0x73, 0x63, 0x68, 0x65,
+	0x64, 0x75, 0x6c, 0x65, 0x52, 0x65, 0x6c, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x68, 0x69, 0x70,
+	0x88, 0x01, 0x01, 0x12, 0x1f, 0x0a, 0x08, 0x6c, 0x61, 0x74, 0x69, 0x74, 0x75, 0x64, 0x65, 0x18,
+	0x07, 0x20, 0x01, 0x28, 0x02, 0x48, 0x03, 0x52, 0x08, 0x6c, 0x61, 0x74, 0x69, 0x74, 0x75, 0x64,
+	0x65, 0x88, 0x01, 0x01, 0x12, 0x21, 0x0a, 0x09, 0x6c, 0x6f, 0x6e, 0x67, 0x69, 0x74, 0x75, 0x64,
+	0x65, 0x18, 0x08, 0x20, 0x01, 0x28, 0x02, 0x48, 0x04, 0x52, 0x09, 0x6c, 0x6f, 0x6e, 0x67, 0x69,
+	0x74, 0x75, 0x64, 0x65, 0x88, 0x01, 0x01, 0x12, 0x1d, 0x0a, 0x07, 0x62, 0x65, 0x61, 0x72, 0x69,
+	0x6e, 0x67, 0x18, 0x09, 0x20, 0x01, 0x28, 0x02, 0x48, 0x05, 0x52, 0x07, 0x62, 0x65, 0x61, 0x72,
+	0x69, 0x6e, 0x67, 0x88, 0x01, 0x01, 0x12, 0x1f, 0x0a, 0x08, 0x6f, 0x64, 0x6f, 0x6d, 0x65, 0x74,
+	0x65, 0x72, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x01, 0x48, 0x06, 0x52, 0x08, 0x6f, 0x64, 0x6f, 0x6d,
+	0x65, 0x74, 0x65, 0x72, 0x88, 0x01, 0x01, 0x12, 0x19, 0x0a, 0x05, 0x73, 0x70, 0x65, 0x65, 0x64,
+	0x18, 0x0b, 0x20, 0x01, 0x28, 0x02, 0x48, 0x07, 0x52, 0x05, 0x73, 0x70, 0x65, 0x65, 0x64, 0x88,
+	0x01, 0x01, 0x12, 0x37, 0x0a, 0x15, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x5f, 0x73, 0x74,
+	0x6f, 0x70, 0x5f, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x18, 0x0c, 0x20, 0x01, 0x28,
+	0x0d, 0x48, 0x08, 0x52, 0x13, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x53, 0x74, 0x6f, 0x70,
+	0x53, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x88, 0x01, 0x01, 0x12, 0x1c, 0x0a, 0x07, 0x73,
+	0x74, 0x6f, 0x70, 0x5f, 0x69, 0x64, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x09, 0x48, 0x09, 0x52, 0x06,
+	0x73, 0x74, 0x6f, 0x70, 0x49, 0x64, 0x88, 0x01, 0x01, 0x12, 0x2a, 0x0a, 0x0e, 0x63, 0x75, 0x72,
+	0x72, 0x65, 0x6e, 0x74, 0x5f, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x0e, 0x20, 0x01, 0x28,
+	0x05, 0x48, 0x0a, 0x52, 0x0d, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x53, 0x74, 0x61, 0x74,
+	0x75, 0x73, 0x88, 0x01, 0x01, 0x12, 0x1c, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61,
+	0x6d, 0x70, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74,
+	0x61, 0x6d, 0x70, 0x12, 0x2e, 0x0a, 0x10, 0x63, 0x6f, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x69, 0x6f,
+	0x6e, 0x5f, 0x6c, 0x65, 0x76, 0x65, 0x6c, 0x18, 0x10, 0x20, 0x01, 0x28, 0x05, 0x48, 0x0b, 0x52,
+	0x0f, 0x63, 0x6f, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x69, 0x6f, 0x6e, 0x4c, 0x65, 0x76, 0x65, 0x6c,
+	0x88, 0x01, 0x01, 0x12, 0x2e, 0x0a, 0x10, 0x6f, 0x63, 0x63, 0x75, 0x70, 0x61, 0x6e, 0x63, 0x79,
+	0x5f, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x11, 0x20, 0x01, 0x28, 0x05, 0x48, 0x0c, 0x52,
+	0x0f, 0x6f, 0x63, 0x63, 0x75, 0x70, 0x61, 0x6e, 0x63, 0x79, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73,
+	0x88, 0x01, 0x01, 0x12, 0x36, 0x0a, 0x14, 0x6f, 0x63, 0x63, 0x75, 0x70, 0x61, 0x6e, 0x63, 0x79,
+	0x5f, 0x70, 0x65, 0x72, 0x63, 0x65, 0x6e, 0x74, 0x61, 0x67, 0x65, 0x18, 0x12, 0x20, 0x01, 0x28,
+	0x0d, 0x48, 0x0d, 0x52, 0x13, 0x6f, 0x63, 0x63, 0x75, 0x70, 0x61, 0x6e, 0x63, 0x79, 0x50, 0x65,
+	0x72, 0x63, 0x65, 0x6e, 0x74, 0x61, 0x67, 0x65, 0x88, 0x01, 0x01, 0x12, 0x1d, 0x0a, 0x0a, 0x76,
+	0x65, 0x68, 0x69, 0x63, 0x6c, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x13, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x09, 0x76, 0x65, 0x68, 0x69, 0x63, 0x6c, 0x65, 0x49, 0x64, 0x12, 0x28, 0x0a, 0x0d, 0x76, 0x65,
+	0x68, 0x69, 0x63, 0x6c, 0x65, 0x5f, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x18, 0x14, 0x20, 0x01, 0x28,
+	0x09, 0x48, 0x0e, 0x52, 0x0c, 0x76, 0x65, 0x68, 0x69, 0x63, 0x6c, 0x65, 0x4c, 0x61, 0x62, 0x65,
+	0x6c, 0x88, 0x01, 0x01, 0x12, 0x28, 0x0a, 0x0d, 0x6c, 0x69, 0x63, 0x65, 0x6e, 0x73, 0x65, 0x5f,
+	0x70, 0x6c, 0x61, 0x74, 0x65, 0x18, 0x15, 0x20, 0x01, 0x28, 0x09, 0x48, 0x0f, 0x52, 0x0c, 0x6c,
+	0x69, 0x63, 0x65, 0x6e, 0x73, 0x65, 0x50, 0x6c, 0x61, 0x74, 0x65, 0x88, 0x01, 0x01, 0x12, 0x22,
+	0x0a, 0x0a, 0x73, 0x74, 0x61, 0x72, 0x74, 0x5f, 0x64, 0x61, 0x74, 0x65, 0x18, 0x16, 0x20, 0x01,
+	0x28, 0x09, 0x48, 0x10, 0x52, 0x09, 0x73, 0x74, 0x61, 0x72, 0x74, 0x44, 0x61, 0x74, 0x65, 0x88,
+	0x01, 0x01, 0x12, 0x38, 0x0a, 0x15, 0x77, 0x68, 0x65, 0x65, 0x6c, 0x63, 0x68, 0x61, 0x69, 0x72,
+	0x5f, 0x61, 0x63, 0x63, 0x65, 0x73, 0x73, 0x69, 0x62, 0x6c, 0x65, 0x18, 0x17, 0x20, 0x01, 0x28,
+	0x05, 0x48, 0x11, 0x52, 0x14, 0x77, 0x68, 0x65, 0x65, 0x6c, 0x63, 0x68, 0x61, 0x69, 0x72, 0x41,
+	0x63, 0x63, 0x65, 0x73, 0x73, 0x69, 0x62, 0x6c, 0x65, 0x88, 0x01, 0x01, 0x12, 0x2b, 0x0a, 0x0f,
+	0x6e, 0x65, 0x61, 0x72, 0x65, 0x73, 0x74, 0x5f, 0x73, 0x74, 0x6f, 0x70, 0x5f, 0x69, 0x64, 0x18,
+	0x18, 0x20, 0x01, 0x28, 0x09, 0x48, 0x12, 0x52, 0x0d, 0x6e, 0x65, 0x61, 0x72, 0x65, 0x73, 0x74,
+	0x53, 0x74, 0x6f, 0x70, 0x49, 0x64, 0x88, 0x01, 0x01, 0x12, 0x20, 0x0a, 0x09, 0x61, 0x67, 0x65,
+	0x6e, 0x63, 0x79, 0x5f, 0x69, 0x64, 0x18, 0x19, 0x20, 0x01, 0x28, 0x09, 0x48, 0x13, 0x52, 0x08,
+	0x61, 0x67, 0x65, 0x6e, 0x63, 0x79, 0x49, 0x64, 0x88, 0x01, 0x01, 0x42, 0x0b, 0x0a, 0x09, 0x5f,
+	0x72, 0x6f, 0x75, 0x74, 0x65, 0x5f, 0x69, 0x64, 0x42, 0x0f, 0x0a, 0x0d, 0x5f, 0x64, 0x69, 0x72,
+	0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x69, 0x64, 0x42, 0x18, 0x0a, 0x16, 0x5f, 0x73, 0x63,
+	0x68, 0x65, 0x64, 0x75, 0x6c, 0x65, 0x5f, 0x72, 0x65, 0x6c, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x73,
+	0x68, 0x69, 0x70, 0x42, 0x0b, 0x0a, 0x09, 0x5f, 0x6c, 0x61, 0x74, 0x69, 0x74, 0x75, 0x64, 0x65,
+	0x42, 0x0c, 0x0a, 0x0a, 0x5f, 0x6c, 0x6f, 0x6e, 0x67, 0x69, 0x74, 0x75, 0x64, 0x65, 0x42, 0x0a,
+	0x0a, 0x08, 0x5f, 0x62, 0x65, 0x61, 0x72, 0x69, 0x6e, 0x67, 0x42, 0x0b, 0x0a, 0x09, 0x5f, 0x6f,
+	0x64, 0x6f, 0x6d, 0x65, 0x74, 0x65, 0x72, 0x42, 0x08, 0x0a, 0x06, 0x5f, 0x73, 0x70, 0x65, 0x65,
+	0x64, 0x42, 0x18, 0x0a, 0x16, 0x5f, 0x63, 0x75, 0x72, 0x72, 0x65, 0x6e, 0x74, 0x5f, 0x73, 0x74,
+	0x6f, 0x70, 0x5f, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e, 0x63, 0x65, 0x42, 0x0a, 0x0a, 0x08, 0x5f,
+	0x73, 0x74, 0x6f, 0x70, 0x5f, 0x69, 0x64, 0x42, 0x11, 0x0a, 0x0f, 0x5f, 0x63, 0x75, 0x72, 0x72,
+	0x65, 0x6e, 0x74, 0x5f, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x42, 0x13, 0x0a, 0x11, 0x5f, 0x63,
+	0x6f, 0x6e, 0x67, 0x65, 0x73, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x6c, 0x65, 0x76, 0x65, 0x6c, 0x42,
+	0x13, 0x0a, 0x11, 0x5f, 0x6f, 0x63, 0x63, 0x75, 0x70, 0x61, 0x6e, 0x63, 0x79, 0x5f, 0x73, 0x74,
+	0x61, 0x74, 0x75, 0x73, 0x42, 0x17, 0x0a, 0x15, 0x5f, 0x6f, 0x63, 0x63, 0x75, 0x70, 0x61, 0x6e,
+	0x63, 0x79, 0x5f, 0x70, 0x65, 0x72, 0x63, 0x65, 0x6e, 0x74, 0x61, 0x67, 0x65, 0x42, 0x10, 0x0a,
+	0x0e, 0x5f, 0x76, 0x65, 0x68, 0x69, 0x63, 0x6c, 0x65, 0x5f, 0x6c, 0x61, 0x62, 0x65, 0x6c, 0x42,
+	0x10, 0x0a, 0x0e, 0x5f, 0x6c, 0x69, 0x63, 0x65, 0x6e, 0x73, 0x65, 0x5f, 0x70, 0x6c, 0x61, 0x74,
+	0x65, 0x42, 0x0d, 0x0a, 0x0b, 0x5f, 0x73, 0x74, 0x61, 0x72, 0x74, 0x5f, 0x64, 0x61, 0x74, 0x65,
+	0x42, 0x18, 0x0a, 0x16, 0x5f, 0x77, 0x68, 0x65, 0x65, 0x6c, 0x63, 0x68, 0x61, 0x69, 0x72, 0x5f,
+	0x61, 0x63, 0x63, 0x65, 0x73, 0x73, 0x69, 0x62, 0x6c, 0x65, 0x42, 0x12, 0x0a, 0x10, 0x5f, 0x6e,
+	0x65, 0x61, 0x72, 0x65, 0x73, 0x74, 0x5f, 0x73, 0x74, 0x6f, 0x70, 0x5f, 0x69, 0x64, 0x42, 0x0c,
+	0x0a, 0x0a, 0x5f, 0x61, 0x67, 0x65, 0x6e, 0x63, 0x79, 0x5f, 0x69, 0x64, 0x22, 0xc8, 0x07, 0x0a,
+	0x05, 0x41, 0x6c, 0x65, 0x72, 0x74, 0x12, 0x17, 0x0a, 0x07, 0x66, 0x65, 0x65, 0x64, 0x5f, 0x69,
+	0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x66, 0x65, 0x65, 0x64, 0x49, 0x64, 0x12,
+	0x19, 0x0a, 0x08, 0x61, 0x6c, 0x65, 0x72, 0x74, 0x5f, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x07, 0x61, 0x6c, 0x65, 0x72, 0x74, 0x49, 0x64, 0x12, 0x21, 0x0a, 0x0c, 0x63, 0x6f,
+	0x6e, 0x74, 0x65, 0x6e, 0x74, 0x5f, 0x68, 0x61, 0x73, 0x68, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x0b, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x48, 0x61, 0x73, 0x68, 0x12, 0x1d, 0x0a,
+	0x0a, 0x66, 0x69, 0x72, 0x73, 0x74, 0x5f, 0x73, 0x65, 0x65, 0x6e, 0x18, 0x04, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x09, 0x66, 0x69, 0x72, 0x73, 0x74, 0x53, 0x65, 0x65, 0x6e, 0x12, 0x1b, 0x0a, 0x09,
+	0x6c, 0x61, 0x73, 0x74, 0x5f, 0x73, 0x65, 0x65, 0x6e, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x08, 0x6c, 0x61, 0x73, 0x74, 0x53, 0x65, 0x65, 0x6e, 0x12, 0x2a, 0x0a, 0x0e, 0x61, 0x63, 0x74,
+	0x69, 0x76, 0x65, 0x5f, 0x70, 0x65, 0x72, 0x69, 0x6f, 0x64, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28,
+	0x09, 0x48, 0x00, 0x52, 0x0d, 0x61, 0x63, 0x74, 0x69, 0x76, 0x65, 0x50, 0x65, 0x72, 0x69, 0x6f,
+	0x64, 0x73, 0x88, 0x01, 0x01, 0x12, 0x30, 0x0a, 0x11, 0x69, 0x6e, 0x66, 0x6f, 0x72, 0x6d, 0x65,
+	0x64, 0x5f, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x69, 0x65, 0x73, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09,
+	0x48, 0x01, 0x52, 0x10, 0x69, 0x6e, 0x66, 0x6f, 0x72, 0x6d, 0x65, 0x64, 0x45, 0x6e, 0x74, 0x69,
+	0x74, 0x69, 0x65, 0x73, 0x88, 0x01, 0x01, 0x12, 0x19, 0x0a, 0x05, 0x63, 0x61, 0x75, 0x73, 0x65,
+	0x18, 0x08, 0x20, 0x01, 0x28, 0x05, 0x48, 0x02, 0x52, 0x05, 0x63, 0x61, 0x75, 0x73, 0x65, 0x88,
+	0x01, 0x01, 0x12, 0x26, 0x0a, 0x0c, 0x63, 0x61, 0x75, 0x73, 0x65, 0x5f, 0x64, 0x65, 0x74, 0x61,
+	0x69, 0x6c, 0x18, 0x09, 0x20, 0x01, 0x28, 0x09, 0x48, 0x03, 0x52, 0x0b, 0x63, 0x61, 0x75, 0x73,
+	0x65, 0x44, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x88, 0x01, 0x01, 0x12, 0x1b, 0x0a, 0x06, 0x65, 0x66,
+	0x66, 0x65, 0x63, 0x74, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x05, 0x48, 0x04, 0x52, 0x06, 0x65, 0x66,
+	0x66, 0x65, 0x63, 0x74, 0x88, 0x01, 0x01, 0x12, 0x28, 0x0a, 0x0d, 0x65, 0x66, 0x66, 0x65, 0x63,
+	0x74, 0x5f, 0x64, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x09, 0x48, 0x05,
+	0x52, 0x0c, 0x65, 0x66, 0x66, 0x65, 0x63, 0x74, 0x44, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x88, 0x01,
+	0x01, 0x12, 0x2a, 0x0a, 0x0e, 0x73, 0x65, 0x76, 0x65, 0x72, 0x69, 0x74, 0x79, 0x5f, 0x6c, 0x65,
+	0x76, 0x65, 0x6c, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x05, 0x48, 0x06, 0x52, 0x0d, 0x73, 0x65, 0x76,
+	0x65, 0x72, 0x69, 0x74, 0x79, 0x4c, 0x65, 0x76, 0x65, 0x6c, 0x88, 0x01, 0x01, 0x12, 0x15, 0x0a,
+	0x03, 0x75, 0x72, 0x6c, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x09, 0x48, 0x07, 0x52, 0x03, 0x75, 0x72,
+	0x6c, 0x88, 0x01, 0x01, 0x12, 0x24, 0x0a, 0x0b, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x5f, 0x74,
+	0x65, 0x78, 0x74, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x09, 0x48, 0x08, 0x52, 0x0a, 0x68, 0x65, 0x61,
+	0x64, 0x65, 0x72, 0x54, 0x65, 0x78, 0x74, 0x88, 0x01, 0x01, 0x12, 0x2e, 0x0a, 0x10, 0x64, 0x65,
+	0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x74, 0x65, 0x78, 0x74, 0x18, 0x0f,
+	0x20, 0x01, 0x28, 0x09, 0x48, 0x09, 0x52, 0x0f, 0x64, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74,
+	0x69, 0x6f, 0x6e, 0x54, 0x65, 0x78, 0x74, 0x88, 0x01, 0x01, 0x12, 0x2b, 0x0a, 0x0f, 0x74, 0x74,
+	0x73, 0x5f, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x5f, 0x74, 0x65, 0x78, 0x74, 0x18, 0x10, 0x20,
+	0x01, 0x28, 0x09, 0x48, 0x0a, 0x52, 0x0d, 0x74, 0x74, 0x73, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72,
+	0x54, 0x65, 0x78, 0x74, 0x88, 0x01, 0x01, 0x12, 0x35, 0x0a, 0x14, 0x74, 0x74, 0x73, 0x5f, 0x64,
+	0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x74, 0x65, 0x78, 0x74, 0x18,
+	0x11, 0x20, 0x01, 0x28, 0x09, 0x48, 0x0b, 0x52, 0x12, 0x74, 0x74, 0x73, 0x44, 0x65, 0x73, 0x63,
+	0x72, 0x69, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x54, 0x65, 0x78, 0x74, 0x88, 0x01, 0x01, 0x12, 0x19,
+	0x0a, 0x05, 0x69, 0x6d, 0x61, 0x67, 0x65, 0x18, 0x12, 0x20, 0x01, 0x28, 0x09, 0x48, 0x0c, 0x52,
+	0x05, 0x69, 0x6d, 0x61, 0x67, 0x65, 0x88, 0x01, 0x01, 0x12, 0x39, 0x0a, 0x16, 0x69, 0x6d, 0x61,
+	0x67, 0x65, 0x5f, 0x61, 0x6c, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x74, 0x69, 0x76, 0x65, 0x5f, 0x74,
+	0x65, 0x78, 0x74, 0x18, 0x13, 0x20, 0x01, 0x28, 0x09, 0x48, 0x0d, 0x52, 0x14, 0x69, 0x6d, 0x61,
+	0x67, 0x65, 0x41, 0x6c, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x74, 0x69, 0x76, 0x65, 0x54, 0x65, 0x78,
+	0x74, 0x88, 0x01, 0x01, 0x42, 0x11, 0x0a, 0x0f, 0x5f, 0x61, 0x63, 0x74, 0x69, 0x76, 0x65, 0x5f,
+	0x70, 0x65, 0x72, 0x69, 0x6f, 0x64, 0x73, 0x42, 0x14, 0x0a, 0x12, 0x5f, 0x69, 0x6e, 0x66, 0x6f,
+	0x72, 0x6d, 0x65, 0x64, 0x5f, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x69, 0x65, 0x73, 0x42, 0x08, 0x0a,
+	0x06, 0x5f, 0x63, 0x61, 0x75, 0x73, 0x65, 0x42, 0x0f, 0x0a, 0x0d, 0x5f, 0x63, 0x61, 0x75, 0x73,
+	0x65, 0x5f, 0x64, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x42, 0x09, 0x0a, 0x07, 0x5f, 0x65, 0x66, 0x66,
+	0x65, 0x63, 0x74, 0x42, 0x10, 0x0a, 0x0e, 0x5f, 0x65, 0x66, 0x66, 0x65, 0x63, 0x74, 0x5f, 0x64,
+	0x65, 0x74, 0x61, 0x69, 0x6c, 0x42, 0x11, 0x0a, 0x0f, 0x5f, 0x73, 0x65, 0x76, 0x65, 0x72, 0x69,
+	0x74, 0x79, 0x5f, 0x6c, 0x65, 0x76, 0x65, 0x6c, 0x42, 0x06, 0x0a, 0x04, 0x5f, 0x75, 0x72, 0x6c,
+	0x42, 0x0e, 0x0a, 0x0c, 0x5f, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x5f, 0x74, 0x65, 0x78, 0x74,
+	0x42, 0x13, 0x0a, 0x11, 0x5f, 0x64, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x69, 0x6f, 0x6e,
+	0x5f, 0x74, 0x65, 0x78, 0x74, 0x42, 0x12, 0x0a, 0x10, 0x5f, 0x74, 0x74, 0x73, 0x5f, 0x68, 0x65,
+	0x61, 0x64, 0x65, 0x72, 0x5f, 0x74, 0x65, 0x78, 0x74, 0x42, 0x17, 0x0a, 0x15, 0x5f, 0x74, 0x74,
+	0x73, 0x5f, 0x64, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x74, 0x65,
+	0x78, 0x74, 0x42, 0x08, 0x0a, 0x06, 0x5f, 0x69, 0x6d, 0x61, 0x67, 0x65, 0x42, 0x19, 0x0a, 0x17,
+	0x5f, 0x69, 0x6d, 0x61, 0x67, 0x65, 0x5f, 0x61, 0x6c, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x74, 0x69,
+	0x76, 0x65, 0x5f, 0x74, 0x65, 0x78, 0x74, 0x22, 0x8c, 0x01, 0x0a, 0x16, 0x4c, 0x61, 0x74, 0x65,
+	0x73, 0x74, 0x50, 0x6f, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x12, 0x19, 0x0a, 0x08, 0x72, 0x6f, 0x75, 0x74, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x72, 0x6f, 0x75, 0x74, 0x65, 0x49, 0x64, 0x12, 0x1d, 0x0a,
+	0x0a, 0x76, 0x65, 0x68, 0x69, 0x63, 0x6c, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x09, 0x76, 0x65, 0x68, 0x69, 0x63, 0x6c, 0x65, 0x49, 0x64, 0x12, 0x12, 0x0a, 0x04,
+	0x66, 0x72, 0x6f, 0x6d, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x66, 0x72, 0x6f, 0x6d,
+	0x12, 0x0e, 0x0a, 0x02, 0x74, 0x6f, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x02, 0x74, 0x6f,
+	0x12, 0x14, 0x0a, 0x05, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x05, 0x52,
+	0x05, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x22, 0x58, 0x0a, 0x17, 0x4c, 0x61, 0x74, 0x65, 0x73, 0x74,
+	0x50, 0x6f, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x12, 0x3d, 0x0a, 0x09, 0x70, 0x6f, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x01,
+	0x20, 0x03, 0x28, 0x0b, 0x32, 0x1f, 0x2e, 0x67, 0x74, 0x66, 0x73, 0x73, 0x63, 0x72, 0x61, 0x70,
+	0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x56, 0x65, 0x68, 0x69, 0x63, 0x6c, 0x65, 0x50, 0x6f, 0x73,
+	0x69, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x09, 0x70, 0x6f, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x73,
+	0x22, 0x8e, 0x01, 0x0a, 0x16, 0x50, 0x6f, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x48, 0x69, 0x73,
+	0x74, 0x6f, 0x72, 0x79, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x19, 0x0a, 0x08, 0x72,
+	0x6f, 0x75, 0x74, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x72,
+	0x6f, 0x75, 0x74, 0x65, 0x49, 0x64, 0x12, 0x1d, 0x0a, 0x0a, 0x76, 0x65, 0x68, 0x69, 0x63, 0x6c,
+	0x65, 0x5f, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x76, 0x65, 0x68, 0x69,
+	0x63, 0x6c, 0x65, 0x49, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x18, 0x03, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x12, 0x0e, 0x0a, 0x02, 0x74, 0x6f, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x02, 0x74, 0x6f, 0x12, 0x16, 0x0a, 0x06, 0x66, 0x6f, 0x6c,
+	0x6c, 0x6f, 0x77, 0x18, 0x05, 0x20, 0x01, 0x28, 0x08, 0x52, 0x06, 0x66, 0x6f, 0x6c, 0x6c, 0x6f,
+	0x77, 0x22, 0x64, 0x0a, 0x0d, 0x41, 0x6c, 0x65, 0x72, 0x74, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x12, 0x19, 0x0a, 0x08, 0x72, 0x6f, 0x75, 0x74, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x72, 0x6f, 0x75, 0x74, 0x65, 0x49, 0x64, 0x12, 0x12, 0x0a,
+	0x04, 0x66, 0x72, 0x6f, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x66, 0x72, 0x6f,
+	0x6d, 0x12, 0x0e, 0x0a, 0x02, 0x74, 0x6f, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x02, 0x74,
+	0x6f, 0x12, 0x14, 0x0a, 0x05, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x05,
+	0x52, 0x05, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x22, 0x3f, 0x0a, 0x0e, 0x41, 0x6c, 0x65, 0x72, 0x74,
+	0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x2d, 0x0a, 0x06, 0x61, 0x6c, 0x65,
+	0x72, 0x74, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x67, 0x74, 0x66, 0x73,
+	0x73, 0x63, 0x72, 0x61, 0x70, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x41, 0x6c, 0x65, 0x72, 0x74,
+	0x52, 0x06, 0x61, 0x6c, 0x65, 0x72, 0x74, 0x73, 0x32, 0x92, 0x02, 0x0a, 0x05, 0x51, 0x75, 0x65,
+	0x72, 0x79, 0x12, 0x62, 0x0a, 0x0f, 0x4c, 0x61, 0x74, 0x65, 0x73, 0x74, 0x50, 0x6f, 0x73, 0x69,
+	0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x26, 0x2e, 0x67, 0x74, 0x66, 0x73, 0x73, 0x63, 0x72, 0x61,
+	0x70, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4c, 0x61, 0x74, 0x65, 0x73, 0x74, 0x50, 0x6f, 0x73,
+	0x69, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x27, 0x2e,
+	0x67, 0x74, 0x66, 0x73, 0x73, 0x63, 0x72, 0x61, 0x70, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x4c,
+	0x61, 0x74, 0x65, 0x73, 0x74, 0x50, 0x6f, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x52, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x5c, 0x0a, 0x0f, 0x50, 0x6f, 0x73, 0x69, 0x74, 0x69,
+	0x6f, 0x6e, 0x48, 0x69, 0x73, 0x74, 0x6f, 0x72, 0x79, 0x12, 0x26, 0x2e, 0x67, 0x74, 0x66, 0x73,
+	0x73, 0x63, 0x72, 0x61, 0x70, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x50, 0x6f, 0x73, 0x69, 0x74,
+	0x69, 0x6f, 0x6e, 0x48, 0x69, 0x73, 0x74, 0x6f, 0x72, 0x79, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x1a, 0x1f, 0x2e, 0x67, 0x74, 0x66, 0x73, 0x73, 0x63, 0x72, 0x61, 0x70, 0x65, 0x72, 0x2e,
+	0x76, 0x31, 0x2e, 0x56, 0x65, 0x68, 0x69, 0x63, 0x6c, 0x65, 0x50, 0x6f, 0x73, 0x69, 0x74, 0x69,
+	0x6f, 0x6e, 0x30, 0x01, 0x12, 0x47, 0x0a, 0x06, 0x41, 0x6c, 0x65, 0x72, 0x74, 0x73, 0x12, 0x1d,
+	0x2e, 0x67, 0x74, 0x66, 0x73, 0x73, 0x63, 0x72, 0x61, 0x70, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e,
+	0x41, 0x6c, 0x65, 0x72, 0x74, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1e, 0x2e,
+	0x67, 0x74, 0x66, 0x73, 0x73, 0x63, 0x72, 0x61, 0x70, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x41,
+	0x6c, 0x65, 0x72, 0x74, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42, 0x46, 0x5a,
+	0x44, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x74, 0x6f, 0x75, 0x63,
+	0x68, 0x65, 0x73, 0x69, 0x72, 0x2f, 0x67, 0x74, 0x66, 0x73, 0x2d, 0x73, 0x63, 0x72, 0x61, 0x70,
+	0x65, 0x72, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x2f, 0x67, 0x74, 0x66, 0x73, 0x73, 0x63, 0x72,
+	0x61, 0x70, 0x65, 0x72, 0x2f, 0x76, 0x31, 0x3b, 0x67, 0x74, 0x66, 0x73, 0x73, 0x63, 0x72, 0x61,
+	0x70, 0x65, 0x72, 0x76, 0x31, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_gtfsscraper_v1_query_proto_rawDescOnce sync.Once
+	file_gtfsscraper_v1_query_proto_rawDescData = file_gtfsscraper_v1_query_proto_rawDesc
+)
+
+func file_gtfsscraper_v1_query_proto_rawDescGZIP() []byte {
+	file_gtfsscraper_v1_query_proto_rawDescOnce.Do(func() {
+		file_gtfsscraper_v1_query_proto_rawDescData = protoimpl.X.CompressGZIP(file_gtfsscraper_v1_query_proto_rawDescData)
+	})
+	return file_gtfsscraper_v1_query_proto_rawDescData
+}
+
+var file_gtfsscraper_v1_query_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_gtfsscraper_v1_query_proto_goTypes = []any{
+	(*VehiclePosition)(nil),         // 0: gtfsscraper.v1.VehiclePosition
+	(*Alert)(nil),                   // 1: gtfsscraper.v1.Alert
+	(*LatestPositionsRequest)(nil),  // 2: gtfsscraper.v1.LatestPositionsRequest
+	(*LatestPositionsResponse)(nil), // 3: gtfsscraper.v1.LatestPositionsResponse
+	(*PositionHistoryRequest)(nil),  // 4: gtfsscraper.v1.PositionHistoryRequest
+	(*AlertsRequest)(nil),           // 5: gtfsscraper.v1.AlertsRequest
+	(*AlertsResponse)(nil),          // 6: gtfsscraper.v1.AlertsResponse
+}
+var file_gtfsscraper_v1_query_proto_depIdxs = []int32{
+	0, // 0: gtfsscraper.v1.LatestPositionsResponse.positions:type_name -> gtfsscraper.v1.VehiclePosition
+	1, // 1: gtfsscraper.v1.AlertsResponse.alerts:type_name -> gtfsscraper.v1.Alert
+	2, // 2: gtfsscraper.v1.Query.LatestPositions:input_type -> gtfsscraper.v1.LatestPositionsRequest
+	4, // 3: gtfsscraper.v1.Query.PositionHistory:input_type -> gtfsscraper.v1.PositionHistoryRequest
+	5, // 4: gtfsscraper.v1.Query.Alerts:input_type -> gtfsscraper.v1.AlertsRequest
+	3, // 5: gtfsscraper.v1.Query.LatestPositions:output_type -> gtfsscraper.v1.LatestPositionsResponse
+	0, // 6: gtfsscraper.v1.Query.PositionHistory:output_type -> gtfsscraper.v1.VehiclePosition
+	6, // 7: gtfsscraper.v1.Query.Alerts:output_type -> gtfsscraper.v1.AlertsResponse
+	5, // [5:8] is the sub-list for method output_type
+	2, // [2:5] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_gtfsscraper_v1_query_proto_init() }
+func file_gtfsscraper_v1_query_proto_init() {
+	if File_gtfsscraper_v1_query_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_gtfsscraper_v1_query_proto_msgTypes[0].Exporter = func(v any, i int) any {
+			switch v := v.(*VehiclePosition); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_gtfsscraper_v1_query_proto_msgTypes[1].Exporter = func(v any, i int) any {
+			switch v := v.(*Alert); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_gtfsscraper_v1_query_proto_msgTypes[2].Exporter = func(v any, i int) any {
+			switch v := v.(*LatestPositionsRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_gtfsscraper_v1_query_proto_msgTypes[3].Exporter = func(v any, i int) any {
+			switch v := v.(*LatestPositionsResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_gtfsscraper_v1_query_proto_msgTypes[4].Exporter = func(v any, i int) any {
+			switch v := v.(*PositionHistoryRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_gtfsscraper_v1_query_proto_msgTypes[5].Exporter = func(v any, i int) any {
+			switch v := v.(*AlertsRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_gtfsscraper_v1_query_proto_msgTypes[6].Exporter = func(v any, i int) any {
+			switch v := v.(*AlertsResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_gtfsscraper_v1_query_proto_msgTypes[0].OneofWrappers = []any{}
+	file_gtfsscraper_v1_query_proto_msgTypes[1].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_gtfsscraper_v1_query_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   7,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_gtfsscraper_v1_query_proto_goTypes,
+		DependencyIndexes: file_gtfsscraper_v1_query_proto_depIdxs,
+		MessageInfos:      file_gtfsscraper_v1_query_proto_msgTypes,
+	}.Build()
+	File_gtfsscraper_v1_query_proto = out.File
+	file_gtfsscraper_v1_query_proto_rawDesc = nil
+	file_gtfsscraper_v1_query_proto_goTypes = nil
+	file_gtfsscraper_v1_query_proto_depIdxs = nil
+}
@@ -0,0 +1,229 @@
+// The gRPC query service of `serve --grpc-addr`. Messages mirror the vehicle_positions and alerts tables,
+// with DATETIME columns as Unix seconds and alert text as the stored JSON. Nullable columns are optional
+// fields, so NULLs can be told apart from zeros.
+//
+// New columns need new field numbers, and numbers are never reused, so existing clients keep decoding
+// the fields they know. Regenerate the Go code with go generate after changing this file.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: gtfsscraper/v1/query.proto
+
+package gtfsscraperv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Query_LatestPositions_FullMethodName = "/gtfsscraper.v1.Query/LatestPositions"
+	Query_PositionHistory_FullMethodName = "/gtfsscraper.v1.Query/PositionHistory"
+	Query_Alerts_FullMethodName          = "/gtfsscraper.v1.Query/Alerts"
+)
+
+// QueryClient is the client API for Query service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type QueryClient interface {
+	// The latest position of each vehicle, as /v1/vehicles returns.
+	LatestPositions(ctx context.Context, in *LatestPositionsRequest, opts ...grpc.CallOption) (*LatestPositionsResponse, error)
+	// The positions stored so far in order of time. When following, positions are then streamed as they're
+	// stored, each batch in order of time, until the client cancels.
+	PositionHistory(ctx context.Context, in *PositionHistoryRequest, opts ...grpc.CallOption) (Query_PositionHistoryClient, error)
+	// The stored alert versions seen during the time range, as /v1/alerts returns.
+	Alerts(ctx context.Context, in *AlertsRequest, opts ...grpc.CallOption) (*AlertsResponse, error)
+}
+
+type queryClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewQueryClient(cc grpc.ClientConnInterface) QueryClient {
+	return &queryClient{cc}
+}
+
+func (c *queryClient) LatestPositions(ctx context.Context, in *LatestPositionsRequest, opts ...grpc.CallOption) (*LatestPositionsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LatestPositionsResponse)
+	err := c.cc.Invoke(ctx, Query_LatestPositions_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *queryClient) PositionHistory(ctx context.Context, in *PositionHistoryRequest, opts ...grpc.CallOption) (Query_PositionHistoryClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Query_ServiceDesc.Streams[0], Query_PositionHistory_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &queryPositionHistoryClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Query_PositionHistoryClient interface {
+	Recv() (*VehiclePosition, error)
+	grpc.ClientStream
+}
+
+type queryPositionHistoryClient struct {
+	grpc.ClientStream
+}
+
+func (x *queryPositionHistoryClient) Recv() (*VehiclePosition, error) {
+	m := new(VehiclePosition)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *queryClient) Alerts(ctx context.Context, in *AlertsRequest, opts ...grpc.CallOption) (*AlertsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AlertsResponse)
+	err := c.cc.Invoke(ctx, Query_Alerts_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// QueryServer is the server API for Query service.
+// All implementations must embed UnimplementedQueryServer
+// for forward compatibility
+type QueryServer interface {
+	// The latest position of each vehicle, as /v1/vehicles returns.
+	LatestPositions(context.Context, *LatestPositionsRequest) (*LatestPositionsResponse, error)
+	// The positions stored so far in order of time. When following, positions are then streamed as they're
+	// stored, each batch in order of time, until the client cancels.
+	PositionHistory(*PositionHistoryRequest, Query_PositionHistoryServer) error
+	// The stored alert versions seen during the time range, as /v1/alerts returns.
+	Alerts(context.Context, *AlertsRequest) (*AlertsResponse, error)
+	mustEmbedUnimplementedQueryServer()
+}
+
+// UnimplementedQueryServer must be embedded to have forward compatible implementations.
+type UnimplementedQueryServer struct {
+}
+
+func (UnimplementedQueryServer) LatestPositions(context.Context, *LatestPositionsRequest) (*LatestPositionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LatestPositions not implemented")
+}
+func (UnimplementedQueryServer) PositionHistory(*PositionHistoryRequest, Query_PositionHistoryServer) error {
+	return status.Errorf(codes.Unimplemented, "method PositionHistory not implemented")
+}
+func (UnimplementedQueryServer) Alerts(context.Context, *AlertsRequest) (*AlertsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Alerts not implemented")
+}
+func (UnimplementedQueryServer) mustEmbedUnimplementedQueryServer() {}
+
+// UnsafeQueryServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to QueryServer will
+// result in compilation errors.
+type UnsafeQueryServer interface {
+	mustEmbedUnimplementedQueryServer()
+}
+
+func RegisterQueryServer(s grpc.ServiceRegistrar, srv QueryServer) {
+	s.RegisterService(&Query_ServiceDesc, srv)
+}
+
+func _Query_LatestPositions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LatestPositionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueryServer).LatestPositions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Query_LatestPositions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueryServer).LatestPositions(ctx, req.(*LatestPositionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Query_PositionHistory_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PositionHistoryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(QueryServer).PositionHistory(m, &queryPositionHistoryServer{ServerStream: stream})
+}
+
+type Query_PositionHistoryServer interface {
+	Send(*VehiclePosition) error
+	grpc.ServerStream
+}
+
+type queryPositionHistoryServer struct {
+	grpc.ServerStream
+}
+
+func (x *queryPositionHistoryServer) Send(m *VehiclePosition) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Query_Alerts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AlertsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueryServer).Alerts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Query_Alerts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueryServer).Alerts(ctx, req.(*AlertsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Query_ServiceDesc is the grpc.ServiceDesc for Query service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Query_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gtfsscraper.v1.Query",
+	HandlerType: (*QueryServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "LatestPositions",
+			Handler:    _Query_LatestPositions_Handler,
+		},
+		{
+			MethodName: "Alerts",
+			Handler:    _Query_Alerts_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PositionHistory",
+			Handler:       _Query_PositionHistory_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "gtfsscraper/v1/query.proto",
+}
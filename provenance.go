@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Keys of the Parquet file metadata tracing a file back to its source
+const (
+	feedIdMetadataKey            = "gtfs-scraper.feed_id"
+	feedURLsMetadataKey          = "gtfs-scraper.feed_urls"
+	timeZoneMetadataKey          = "gtfs-scraper.timezone"
+	partitionTimeZoneMetadataKey = "gtfs-scraper.partition_timezone"
+	createdMetadataKey           = "gtfs-scraper.created"
+	rowCountMetadataKey          = "gtfs-scraper.row_count"
+	minTimestampMetadataKey      = "gtfs-scraper.min_timestamp"
+	maxTimestampMetadataKey      = "gtfs-scraper.max_timestamp"
+)
+
+// archiveProvenance is the configuration which archived rows were scraped with.
+type archiveProvenance struct {
+	FeedId string
+	// FeedURLs are the vehicle positions endpoints
+	FeedURLs []string
+	// TripUpdatesURLs are recorded in archived trip updates instead
+	TripUpdatesURLs []string
+	TimeZone        string
+	// PartitionTimeZone is where month boundaries fall
+	PartitionTimeZone string
+}
+
+func provenanceOf(config Config) archiveProvenance {
+	timeZone, partitionTimeZone := config.TimeZone, config.Archive.PartitionTimeZone
+	if timeZone == "" {
+		timeZone = "UTC"
+	}
+	if partitionTimeZone == "" {
+		partitionTimeZone = "UTC"
+	}
+	return archiveProvenance{
+		FeedId:            config.FeedId,
+		FeedURLs:          feedURLs(config.VehicleUpdatesURL, config.VehicleUpdatesURLs),
+		TripUpdatesURLs:   feedURLs(config.TripUpdatesURL, config.TripUpdatesURLs),
+		TimeZone:          timeZone,
+		PartitionTimeZone: partitionTimeZone,
+	}
+}
+
+// writerOptions returns the metadata which is the same for every file written in a run.
+func (p archiveProvenance) writerOptions() []parquet.WriterOption {
+	urls, _ := json.Marshal(p.FeedURLs)
+	return []parquet.WriterOption{
+		parquet.KeyValueMetadata(versionMetadataKey, versionString()),
+		parquet.KeyValueMetadata(feedIdMetadataKey, p.FeedId),
+		parquet.KeyValueMetadata(feedURLsMetadataKey, string(urls)),
+		parquet.KeyValueMetadata(timeZoneMetadataKey, p.TimeZone),
+		parquet.KeyValueMetadata(partitionTimeZoneMetadataKey, p.PartitionTimeZone),
+		parquet.KeyValueMetadata(createdMetadataKey, time.Now().UTC().Format(time.RFC3339)),
+	}
+}
+
+// timestampRange tracks the earliest and latest timestamps of the rows in a file.
+type timestampRange struct {
+	Min time.Time `json:"min"`
+	Max time.Time `json:"max"`
+}
+
+func (r *timestampRange) add(t time.Time) {
+	if r.Min.IsZero() || t.Before(r.Min) {
+		r.Min = t
+	}
+	if t.After(r.Max) {
+		r.Max = t
+	}
+}
+
+// setContentMetadata records the row count and timestamp range of a Parquet file before it's closed.
+// Other formats have no file metadata, so they're left as is.
+func setContentMetadata(w rowWriter, rows int64, timestamps timestampRange) {
+	writer, ok := w.(interface{ SetKeyValueMetadata(key, value string) })
+	if !ok {
+		return
+	}
+	writer.SetKeyValueMetadata(rowCountMetadataKey, strconv.FormatInt(rows, 10))
+	if !timestamps.Min.IsZero() {
+		writer.SetKeyValueMetadata(minTimestampMetadataKey, timestamps.Min.UTC().Format(time.RFC3339))
+		writer.SetKeyValueMetadata(maxTimestampMetadataKey, timestamps.Max.UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// pruneArchived deletes the vehicle positions of sealed months from the database, once the whole archive
+// verifies against its manifest and every position of those months is found in their partitions, then
+// checkpoints the WAL and vacuums the database to give the space back. Only sealed months are final, as later
+// runs still append to the others. With a shard directory, each month's positions are first kept in a compressed
+// SQLite shard there. Trip updates and their stop time updates are left in the database.
+// Deleting and vacuuming can take a while for a large database, so they aren't bounded by dbTimeout.
+func pruneArchived(db *sqlx.DB, archiveDir string, shardDir string, config ArchiveConfig, feedId string) error {
+	if err := verifyArchive(archiveDir, config); err != nil {
+		return fmt.Errorf("not pruning, as the archive doesn't verify: %w", err)
+	}
+	manifest, _, err := readManifest(archiveDir)
+	if err != nil {
+		return err
+	}
+	logger := config.log()
+	if len(manifest.Sealed) == 0 {
+		logger.Info("No sealed months to prune, which needs Archive.SealAfterDays")
+		return nil
+	}
+
+	config, _, err = applyArchiveProfile(config)
+	if err != nil {
+		return err
+	}
+	schema, err := newArchiveSchema(config, feedId)
+	if err != nil {
+		return err
+	}
+
+	// Every month is checked before any is pruned, so a mismatch leaves the database as it was
+	var periods []time.Time
+	for _, ym := range manifest.Sealed {
+		period, err := time.Parse(yearMonthLayout, ym)
+		if err != nil {
+			return fmt.Errorf("manifest has an invalid sealed month: %w", err)
+		}
+		// A month with positions has a partition file, so one missing from the manifest means it wasn't archived
+		prefix := filepath.ToSlash(monthDir("", period)) + "/"
+		archived := false
+		for _, file := range manifest.Files {
+			if strings.HasPrefix(file.Path, prefix) {
+				archived = true
+				break
+			}
+		}
+		if !archived {
+			logger.Warn("Not pruning a sealed month without any archived files", "month", ym)
+			continue
+		}
+		missing, err := unarchivedPositions(db, archiveDir, config, schema, period)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ym, err)
+		}
+		if missing > 0 {
+			return fmt.Errorf("not pruning, as %d positions of %s in the database aren't in its partitions", missing, ym)
+		}
+		periods = append(periods, period)
+	}
+
+	ctx := context.Background()
+	var total int64
+	for _, period := range periods {
+		ym := period.Format(yearMonthLayout)
+		where := "("
+		var args []any
+		start, end := partitionMonth(config, period)
+		if config.PartitionBy == "service_date" {
+			where += "start_date >= ? AND start_date < ? OR start_date IS NULL AND timestamp >= ? AND timestamp < ?"
+			args = []any{period.Format(serviceDateLayout), period.AddDate(0, 1, 0).Format(serviceDateLayout), start.Unix(), end.Unix()}
+		} else {
+			where += "timestamp >= ? AND timestamp < ?"
+			args = []any{start.Unix(), end.Unix()}
+		}
+		condition, feedArgs := feedCondition(config, "")
+		where += ")" + condition
+		args = append(args, feedArgs...)
+		if shardDir != "" {
+			shardPath := filepath.Join(shardDir, ym+".db.zst")
+			kept, err := writeColdShard(ctx, db, shardPath, where, args)
+			if err != nil {
+				return fmt.Errorf("%s: %w", ym, err)
+			}
+			if kept > 0 {
+				logger.Info("Kept positions in a cold shard", "month", ym, "rows", kept, "path", shardPath)
+			}
+		}
+		result, err := db.ExecContext(ctx, "DELETE FROM vehicle_positions WHERE "+where, args...)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			logger.Info("Pruned month", "month", ym, "rows", n)
+		}
+		total += n
+	}
+	if total == 0 {
+		logger.Info("Nothing to prune")
+		return nil
+	}
+
+	logger.Info("Pruned positions, vacuuming", "rows", total)
+	if _, err := db.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "VACUUM")
+	return err
+}
+
+// unarchivedPositions counts the positions of a month in the database which are missing from its Parquet
+// partitions, compared as appends are deduplicated. Rows without a vehicle ID are never archived, so they
+// aren't counted. Other formats are rewritten in full from the database by each run until the month is sealed,
+// so they aren't read back.
+func unarchivedPositions(db *sqlx.DB, archiveDir string, config ArchiveConfig, schema *archiveSchema, period time.Time) (int, error) {
+	if config.Format != "" && config.Format != "parquet" {
+		return 0, nil
+	}
+	rows, err := readArchivedMonth(monthDir(archiveDir, period), schema)
+	if err != nil {
+		return 0, err
+	}
+	archived := make(map[positionKey]bool, len(rows))
+	for _, row := range rows {
+		archived[schema.archivedKey(row)] = true
+	}
+
+	positions, err := queryPartition(db, config, period, partitionStart(config, period), false)
+	if err != nil {
+		return 0, err
+	}
+	defer positions.Close()
+	var missing int
+	var vp VehiclePosition
+	for positions.Next() {
+		if err := scanPartitionRow(positions, &vp, period); err != nil {
+			return 0, err
+		}
+		if vp.VehicleId != "" && !archived[schema.archivedKey(schema.row(&vp))] {
+			missing++
+		}
+	}
+	return missing, positions.Err()
+}
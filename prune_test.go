@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneArchived(t *testing.T) {
+	tests := []struct {
+		name string
+		// Positions stored after archiving, which sealed months never take in
+		late []uint64
+		// A fragment of the expected error, or "" if the sealed months are pruned
+		want string
+		// The positions left in the database
+		remaining int
+	}{
+		{"archived", nil, "", 0},
+		{"late position", []uint64{1709280015}, "1 positions of 2024-03", 4},
+		{"position of another vehicle", []uint64{1711958460}, "1 positions of 2024-04", 4},
+	}
+	for _, test := range tests {
+		dataDir := t.TempDir()
+		config := Config{DataDir: dataDir, FeedId: "test", Archive: ArchiveConfig{SealAfterDays: 1}}
+		db, err := createDatabase(filepath.Join(dataDir, "realtime.db"), config.FeedId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		// Positions in March and April 2024, which are sealed by the first run
+		for _, timestamp := range []uint64{1709280000, 1709280030, 1711958400} {
+			if _, err := addVehiclePositions(positionsFeed(timestamp, "trip-1", "bus-1"), db, config.FeedId, nil, time.UTC, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		archiveDir := feedArchiveDir(config)
+		if err := archivePartitions(db, archiveDir, config.Archive, provenanceOf(config)); err != nil {
+			t.Fatal(err)
+		}
+		for _, timestamp := range test.late {
+			vehicleId := "bus-1"
+			if timestamp >= 1711958400 {
+				vehicleId = "bus-2"
+			}
+			if _, err := addVehiclePositions(positionsFeed(timestamp, "trip-1", vehicleId), db, config.FeedId, nil, time.UTC, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = pruneArchived(db, archiveDir, "", config.Archive, config.FeedId)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.want)
+		}
+		if n := countPositions(t, db); n != test.remaining {
+			t.Errorf("%s: %d positions remain, want %d", test.name, n, test.remaining)
+		}
+	}
+}
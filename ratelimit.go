@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+type RateLimitConfig struct {
+	// Host is matched against the host name of each request, without the port.
+	// "*" applies to every host without its own limit.
+	Host              string
+	RequestsPerSecond float64
+	// Burst is the number of requests which can be made at once, defaulting to 1.
+	Burst int
+}
+
+// rateLimitedTransport delays requests with a token bucket per host,
+// so feeds served from the same API gateway share its limit.
+type rateLimitedTransport struct {
+	base    http.RoundTripper
+	configs map[string]RateLimitConfig
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newRateLimitedTransport(base http.RoundTripper, limits []RateLimitConfig) *rateLimitedTransport {
+	t := &rateLimitedTransport{
+		base:     base,
+		configs:  make(map[string]RateLimitConfig, len(limits)),
+		limiters: make(map[string]*rate.Limiter),
+	}
+	for _, limit := range limits {
+		t.configs[limit.Host] = limit
+	}
+	return t
+}
+
+// limiter returns the limiter for a host, or nil if the host isn't rate limited.
+// Hosts covered by the "*" limit each get their own bucket.
+func (t *rateLimitedTransport) limiter(host string) *rate.Limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if limiter, found := t.limiters[host]; found {
+		return limiter
+	}
+	config, found := t.configs[host]
+	if !found {
+		config, found = t.configs["*"]
+	}
+	var limiter *rate.Limiter
+	if found && config.RequestsPerSecond > 0 {
+		burst := config.Burst
+		if burst <= 0 {
+			burst = 1
+		}
+		limiter = rate.NewLimiter(rate.Limit(config.RequestsPerSecond), burst)
+	}
+	t.limiters[host] = limiter
+	return limiter
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if limiter := t.limiter(req.URL.Hostname()); limiter != nil {
+		if err := limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// feedClient is used for every feed request, static and realtime.
+var feedClient = http.DefaultClient
+
+// setupRateLimits routes feed requests through per-host rate limiters.
+func setupRateLimits(limits []RateLimitConfig) {
+	if len(limits) == 0 {
+		return
+	}
+	feedClient = &http.Client{Transport: newRateLimitedTransport(http.DefaultTransport, limits)}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/jmoiron/sqlx"
+	"google.golang.org/protobuf/proto"
+)
+
+// RawSnapshotsConfig keeps every realtime feed polled as it was received, gzipped, so `replay` can store them again
+// after a schema change or a bug fix. Unchanged feeds skipped by conditional requests aren't kept again.
+type RawSnapshotsConfig struct {
+	Enabled bool
+	// Dir defaults to "raw" in the data directory. Snapshots are kept in <Dir>/<FeedId>/<feed type>/<YYYY-MM-DD>,
+	// a directory per UTC day, each named after the time of its poll and the index of its URL among the feed type's,
+	// e.g. raw/default/vehicle_positions/2024-06-01/20240601T101500.123Z-0.pb.gz.
+	Dir string
+	// RetainDays deletes the snapshots of days older than this many days as each day starts. 0 keeps them all.
+	RetainDays int
+}
+
+// Poll times in snapshot names, which sort in time order
+const rawSnapshotLayout = "20060102T150405.000Z"
+
+const rawSnapshotSuffix = ".pb.gz"
+
+// Feed types by the commands polling them
+var pollFeedTypes = map[string]string{"vehicleupdates": "vehicle_positions", "tripupdates": "trip_updates", "alerts": "alerts"}
+
+// rawSnapshotDir is where a feed's raw snapshots are kept.
+func rawSnapshotDir(config Config) string {
+	dir := config.RawSnapshots.Dir
+	if dir == "" {
+		dir = filepath.Join(config.DataDir, "raw")
+	}
+	return filepath.Join(dir, config.FeedId)
+}
+
+// saveRawSnapshots keeps the feeds of a poll as received. Starting a new day deletes days past RetainDays.
+func saveRawSnapshots(config Config, feedType string, polledAt time.Time, fetches []feedFetch) error {
+	polledAt = polledAt.UTC()
+	typeDir := filepath.Join(rawSnapshotDir(config), feedType)
+	dayDir := filepath.Join(typeDir, polledAt.Format(time.DateOnly))
+	if err := os.MkdirAll(typeDir, 0775); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dayDir, 0775); err == nil {
+		if err := pruneRawSnapshots(typeDir, config.RawSnapshots.RetainDays, polledAt, config.log()); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	for i, fetch := range fetches {
+		if fetch.data == nil {
+			continue
+		}
+		compressed, err := gzipBytes(fetch.data)
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%s-%d%s", polledAt.Format(rawSnapshotLayout), i, rawSnapshotSuffix)
+		if err := writeFileAtomic(filepath.Join(dayDir, name), compressed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneRawSnapshots deletes the days of a feed type older than retainDays, logging them through logger.
+func pruneRawSnapshots(typeDir string, retainDays int, now time.Time, logger *slog.Logger) error {
+	if retainDays <= 0 {
+		return nil
+	}
+	oldest := now.AddDate(0, 0, -retainDays).Format(time.DateOnly)
+	entries, err := os.ReadDir(typeDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := time.Parse(time.DateOnly, entry.Name()); err != nil || !entry.IsDir() || entry.Name() >= oldest {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(typeDir, entry.Name())); err != nil {
+			return err
+		}
+		logger.Info("Deleted raw snapshots", "path", filepath.Join(typeDir, entry.Name()))
+	}
+	return nil
+}
+
+// readRawSnapshot parses a raw snapshot file.
+func readRawSnapshot(path string) (*gtfs.FeedMessage, error) {
+	compressed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := gunzipBytes(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	feed := &gtfs.FeedMessage{}
+	if err := proto.Unmarshal(data, feed); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return feed, nil
+}
+
+// rawSnapshotPolls groups the snapshots of a day by poll, in the order they were polled.
+func rawSnapshotPolls(dayDir string) ([][]string, error) {
+	entries, err := os.ReadDir(dayDir)
+	if err != nil {
+		return nil, err
+	}
+	var polls [][]string
+	var last string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, rawSnapshotSuffix) {
+			continue
+		}
+		polledAt, _, found := strings.Cut(name, "-")
+		if !found {
+			continue
+		}
+		if polledAt != last || len(polls) == 0 {
+			polls = append(polls, nil)
+			last = polledAt
+		}
+		polls[len(polls)-1] = append(polls[len(polls)-1], filepath.Join(dayDir, name))
+	}
+	return polls, nil
+}
+
+// replay stores raw snapshots again, merging the feeds of each poll as the poll did. Rows already stored are kept
+// as they are, so after a schema change or a bug fix, delete the affected rows first to have them stored afresh.
+// Webhooks, metrics and feed health aren't replayed.
+func replay(config Config, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	dbPath := flags.String("db", filepath.Join(config.DataDir, "realtime.db"), "database to store the snapshots in")
+	dir := flags.String("dir", rawSnapshotDir(config), "directory of raw snapshots, holding a directory per feed type")
+	feedList := flags.String("feeds", strings.Join(daemonFeeds, ","), "feed types to replay")
+	from := flags.String("from", "", "first day to replay, as YYYY-MM-DD")
+	to := flags.String("to", "", "last day to replay, as YYYY-MM-DD")
+	flags.Parse(args)
+
+	var feeds []string
+	for _, feed := range strings.Split(*feedList, ",") {
+		if !contains(daemonFeeds, feed) {
+			return fmt.Errorf("can't replay %q, expected some of %s", feed, strings.Join(daemonFeeds, ", "))
+		}
+		feeds = append(feeds, feed)
+	}
+	for _, day := range []string{*from, *to} {
+		if _, err := time.Parse(time.DateOnly, day); day != "" && err != nil {
+			return fmt.Errorf("invalid day %q, expected YYYY-MM-DD", day)
+		}
+	}
+	timeZone, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+	var zones []geofence
+	if contains(feeds, "vehicleupdates") {
+		if zones, err = setupVehiclePolling(config); err != nil {
+			return err
+		}
+	}
+	var static *staticGTFS
+	if contains(feeds, "tripupdates") {
+		if static, err = setupTripUpdatePolling(config); err != nil {
+			return err
+		}
+	}
+	db, err := createDatabase(*dbPath, config.FeedId)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, feed := range feeds {
+		typeDir := filepath.Join(*dir, pollFeedTypes[feed])
+		entries, err := os.ReadDir(typeDir)
+		if errors.Is(err, os.ErrNotExist) {
+			config.log().Info("No raw snapshots to replay", "feed_type", pollFeedTypes[feed], "dir", *dir)
+			continue
+		} else if err != nil {
+			return err
+		}
+		var days []string
+		for _, entry := range entries {
+			day := entry.Name()
+			if _, err := time.Parse(time.DateOnly, day); err != nil || !entry.IsDir() {
+				continue
+			}
+			if (*from == "" || day >= *from) && (*to == "" || day <= *to) {
+				days = append(days, day)
+			}
+		}
+		slices.Sort(days)
+		for _, day := range days {
+			polls, rows, err := replayDay(db, config, feed, filepath.Join(typeDir, day), zones, static, timeZone)
+			if err != nil {
+				return err
+			}
+			config.log().Info("Replayed raw snapshots", "polls", polls, "feed_type", pollFeedTypes[feed], "day", day, "rows", rows)
+		}
+	}
+	return nil
+}
+
+// replayDay stores the raw snapshots of a day, returning how many polls and rows were stored. Unreadable
+// snapshots are skipped along with the rest of their poll.
+func replayDay(db *sqlx.DB, config Config, feed string, dayDir string, zones []geofence, static *staticGTFS, timeZone *time.Location) (polls int, rows int, err error) {
+	paths, err := rawSnapshotPolls(dayDir)
+	if err != nil {
+		return 0, 0, err
+	}
+pollLoop:
+	for _, poll := range paths {
+		feeds := make([]*gtfs.FeedMessage, len(poll))
+		for i, path := range poll {
+			if feeds[i], err = readRawSnapshot(path); err != nil {
+				config.log().Warn("Skipping unreadable raw snapshot", "err", err)
+				continue pollLoop
+			}
+		}
+		merged := mergeFeeds(feeds)
+		var n int
+		switch feed {
+		case "vehicleupdates":
+			var inserted []VehiclePosition
+			inserted, err = storeVehiclePositions(db, config, zones, merged, timeZone)
+			n = len(inserted)
+		case "tripupdates":
+			n, _, err = storeTripUpdates(db, config, static, merged, timeZone)
+		case "alerts":
+			n, err = addAlerts(merged, db, config.FeedId)
+		}
+		if err != nil {
+			return polls, rows, fmt.Errorf("replaying %s: %w", poll[0], err)
+		}
+		polls++
+		rows += n
+	}
+	return polls, rows, nil
+}
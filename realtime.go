@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -19,10 +26,12 @@ type ColumnInfo struct {
 }
 
 var columns = []ColumnInfo{
+	{Name: "feed_id", Type: "TEXT NOT NULL"},
 	{Name: "trip_id", Type: "TEXT"},
 	{Name: "route_id", Type: "TEXT"},
 	{Name: "direction_id", Type: "INT8"},
 	{Name: "start_time", Type: "DATETIME"},
+	{Name: "start_date", Type: "TEXT"},
 	{Name: "schedule_relationship", Type: "INT8"},
 	{Name: "latitude", Type: "REAL"},
 	{Name: "longitude", Type: "REAL"}, {Name: "bearing", Type: "REAL"},
@@ -34,14 +43,23 @@ var columns = []ColumnInfo{
 	{Name: "timestamp", Type: "DATETIME"},
 	{Name: "congestion_level", Type: "INT8"},
 	{Name: "occupancy_status", Type: "INT8"},
+	{Name: "occupancy_percentage", Type: "INTEGER"},
 	{Name: "vehicle_id", Type: "TEXT"},
 	{Name: "vehicle_label", Type: "TEXT"},
 	{Name: "license_plate", Type: "TEXT"},
+	{Name: "wheelchair_accessible", Type: "INT8"},
+	{Name: "nearest_stop_id", Type: "TEXT"},
+	{Name: "agency_id", Type: "TEXT"},
 }
 
 func insertQuery() string {
+	return insertIntoQuery("vehicle_positions", columns)
+}
+
+// insertIntoQuery builds an insert with named parameters for each column, ignoring rows which already exist.
+func insertIntoQuery(table string, columns []ColumnInfo) string {
 	var query strings.Builder
-	query.WriteString("INSERT INTO vehicle_positions (")
+	query.WriteString("INSERT INTO " + table + " (")
 	for i, colInfo := range columns {
 		if i > 0 {
 			query.WriteByte(',')
@@ -61,167 +79,770 @@ func insertQuery() string {
 	return query.String()
 }
 
+// VehiclePosition is a flattened GTFS-RT VehiclePosition.
+// Optional fields are pointers so that missing values are stored as NULLs rather than zeros.
 type VehiclePosition struct {
-	TripId      string `db:"trip_id" parquet:"trip_id"`
-	RouteId     string `db:"route_id" parquet:"route_id,dict"`
-	DirectionId int32  `db:"direction_id" parquet:"direction_id"`
+	// FeedId identifies the feed (usually an agency) which published the position.
+	FeedId      string  `db:"feed_id" parquet:"feed_id,dict" json:"feed_id"`
+	TripId      string  `db:"trip_id" parquet:"trip_id" json:"trip_id"`
+	RouteId     *string `db:"route_id" parquet:"route_id,dict" json:"route_id"`
+	DirectionId *int32  `db:"direction_id" parquet:"direction_id" json:"direction_id"`
 	// Need to have two different fields for (de)serizialization from ProtoBuf -> SQLite -> Parquet.
 	// The Go SQLite driver force converts time.Time to TEXT, so we must use an int column instead.
 	// Parquet, however, does treat it as a 8-byte timestamp.
-	StartTime            time.Time `db:"-" parquet:"start_time,delta"`
-	StartTimeUnix        int64     `db:"start_time" parquet:"-"`
-	ScheduleRelationship int32     `db:"schedule_relationship" parquet:"schedule_relationship"`
-	Latitude             float32   `db:"latitude" parquet:"latitude,split"`
-	Longitude            float32   `db:"longitude" parquet:"longitude,split"`
-	Bearing              float32   `db:"bearing" parquet:"bearing,split"`
-	Odometer             float64   `db:"odometer" parquet:"odometer,split"`
-	Speed                float32   `db:"speed" parquet:"speed"`
-	CurrentStopSequence  uint32    `db:"current_stop_sequence" parquet:"current_stop_sequence"`
-	StopId               string    `db:"stop_id" parquet:"stop_id,dict"`
-	CurrentStatus        int32     `db:"current_status" parquet:"current_status"`
+	StartTime     time.Time `db:"-" parquet:"start_time,delta" json:"start_time"`
+	StartTimeUnix int64     `db:"start_time" parquet:"-" json:"-"`
+	// StartDate is the GTFS service day of the trip (YYYYMMDD), which can differ from the calendar date
+	// of trips running past midnight.
+	StartDate            *string  `db:"start_date" parquet:"start_date,dict" json:"start_date"`
+	ScheduleRelationship *int32   `db:"schedule_relationship" parquet:"schedule_relationship" json:"schedule_relationship"`
+	Latitude             *float32 `db:"latitude" parquet:"latitude" json:"latitude"`
+	Longitude            *float32 `db:"longitude" parquet:"longitude" json:"longitude"`
+	Bearing              *float32 `db:"bearing" parquet:"bearing" json:"bearing"`
+	Odometer             *float64 `db:"odometer" parquet:"odometer" json:"odometer"`
+	Speed                *float32 `db:"speed" parquet:"speed" json:"speed"`
+	CurrentStopSequence  *uint32  `db:"current_stop_sequence" parquet:"current_stop_sequence" json:"current_stop_sequence"`
+	StopId               *string  `db:"stop_id" parquet:"stop_id,dict" json:"stop_id"`
+	CurrentStatus        *int32   `db:"current_status" parquet:"current_status" json:"current_status"`
 	// Same treatment applies here
-	Timestamp       time.Time `db:"-" parquet:"timestamp,delta"`
-	TimestampUnix   int64     `db:"timestamp" parquet:"-"`
-	CongestionLevel int32     `db:"congestion_level" parquet:"congestion_level"`
-	OccupancyStatus int32     `db:"occupancy_status" parquet:"occupancy_status"`
-	VehicleId       string    `db:"vehicle_id" parquet:"vehicle_id,dict"`
-	VehicleLabel    string    `db:"vehicle_label" parquet:"vehicle_label,dict"`
-	LicensePlate    string    `db:"license_plate" parquet:"license_plate,dict"`
+	Timestamp       time.Time `db:"-" parquet:"timestamp,delta" json:"timestamp"`
+	TimestampUnix   int64     `db:"timestamp" parquet:"-" json:"-"`
+	CongestionLevel *int32    `db:"congestion_level" parquet:"congestion_level" json:"congestion_level"`
+	OccupancyStatus *int32    `db:"occupancy_status" parquet:"occupancy_status" json:"occupancy_status"`
+	// Percentage of the vehicle's nominal capacity, which may exceed 100
+	OccupancyPercentage *uint32 `db:"occupancy_percentage" parquet:"occupancy_percentage" json:"occupancy_percentage"`
+	VehicleId           string  `db:"vehicle_id" parquet:"vehicle_id,dict" json:"vehicle_id"`
+	VehicleLabel        *string `db:"vehicle_label" parquet:"vehicle_label,dict" json:"vehicle_label"`
+	LicensePlate        *string `db:"license_plate" parquet:"license_plate,dict" json:"license_plate"`
+	// WheelchairAccessible is the VehicleDescriptor's WheelchairAccessible enum value
+	// (0 no value, 1 unknown, 2 accessible, 3 inaccessible).
+	WheelchairAccessible *int32 `db:"wheelchair_accessible" parquet:"wheelchair_accessible" json:"wheelchair_accessible"`
+	// NearestStopId is the closest stop on the route to a position without a stop_id, with NearestStopMeters
+	NearestStopId *string `db:"nearest_stop_id" parquet:"nearest_stop_id,dict" json:"nearest_stop_id"`
+	// AgencyId is the configured agency of the feed, for feeds collected from several agencies
+	AgencyId *string `db:"agency_id" parquet:"agency_id,dict" json:"agency_id"`
 	// Only used for partitioning in Parquet
-	Year  int `parquet:"year"`
-	Month int `parquet:"month"`
+	Year  int `parquet:"year" json:"-"`
+	Month int `parquet:"month" json:"-"`
+}
+
+// copyOptional copies an optional protobuf field so the result doesn't alias the feed message.
+func copyOptional[T any](v *T) *T {
+	if v == nil {
+		return nil
+	}
+	c := *v
+	return &c
+}
+
+// optionalInt32 converts an optional protobuf integer or enum field, preserving absence.
+func optionalInt32[T ~int32 | ~uint32](v *T) *int32 {
+	if v == nil {
+		return nil
+	}
+	c := int32(*v)
+	return &c
+}
+
+// Fields added to the spec after the bindings were generated, which the protobuf runtime keeps as unknown fields
+const (
+	vehicleDescriptorWheelchairAccessible protowire.Number = 4
+)
+
+// unknownEnum reads an enum field which the bindings don't know from a message's unknown fields,
+// returning nil if it's absent. As for known fields, the last occurrence wins.
+func unknownEnum(m proto.Message, number protowire.Number) *int32 {
+	var value *int32
+	b := m.ProtoReflect().GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			break
+		}
+		b = b[n:]
+		if num == number && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				break
+			}
+			c := int32(v)
+			value = &c
+			b = b[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			break
+		}
+		b = b[n:]
+	}
+	return value
+}
+
+// valueOf returns the value of an optional field, or its zero value if absent.
+func valueOf[T any](v *T) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return *v
+}
+
+// nullIfEmpty makes an empty string NULL when stored.
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
 }
 
 const dateFormat = "20060102 15:04:05"
 
+// noonAnchoredStartTimes measures trip start times from noon minus 12 hours on the start date, as GTFS defines them,
+// rather than parsing them as clock times. It's set from StartTimeAnchor.
+var noonAnchoredStartTimes bool
+
+// setupStartTimes applies the StartTimeAnchor setting.
+func setupStartTimes(config Config) error {
+	switch config.StartTimeAnchor {
+	case "", "midnight":
+		noonAnchoredStartTimes = false
+	case "noon":
+		noonAnchoredStartTimes = true
+	default:
+		return fmt.Errorf("invalid StartTimeAnchor: %q", config.StartTimeAnchor)
+	}
+	return nil
+}
+
+// parseNoonStartTime converts a GTFS start date and time (HH:MM:SS, possibly past 24:00) to an instant,
+// counting from noon minus 12 hours on the start date. That's midnight except on days when clocks change,
+// when it's an hour off midnight, so that no start time is skipped or repeated.
+func parseNoonStartTime(startDate string, startTime string, location *time.Location) (time.Time, error) {
+	date, err := time.Parse(serviceDateLayout, startDate)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var hours, minutes, seconds int
+	if _, err := fmt.Sscanf(startTime, "%d:%d:%d", &hours, &minutes, &seconds); err != nil {
+		return time.Time{}, fmt.Errorf("invalid start time %q: %w", startTime, err)
+	} else if hours < 0 || minutes < 0 || minutes > 59 || seconds < 0 || seconds > 59 {
+		return time.Time{}, fmt.Errorf("invalid start time %q", startTime)
+	}
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, location)
+	offset := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second
+	return noon.Add(-12 * time.Hour).Add(offset), nil
+}
+
+// tripStartTime converts the start date and time of a trip to an instant, as set by StartTimeAnchor.
+// Returns the zero time if there's no trip.
+func tripStartTime(trip *gtfs.TripDescriptor, location *time.Location) (time.Time, error) {
+	if trip == nil {
+		return time.Time{}, nil
+	}
+	if noonAnchoredStartTimes {
+		return parseNoonStartTime(trip.GetStartDate(), trip.GetStartTime(), location)
+	}
+	startTimeStr := trip.GetStartTime()
+	startTime, err := time.ParseInLocation(dateFormat, trip.GetStartDate()+" "+startTimeStr, location)
+
+	// If we encouter a >24h offset, we need to parse it separately and then add
+	if err != nil && len(startTimeStr) > 3 {
+		hourOffset, err := time.ParseDuration(startTimeStr[:2] + "h")
+		if err != nil {
+			return time.Time{}, err
+		}
+		startTimeStr = "00" + startTimeStr[2:]
+		startTime, err = time.ParseInLocation(dateFormat, trip.GetStartDate()+" "+startTimeStr, location)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return startTime.Add(hourOffset), nil
+	}
+	return startTime, err
+}
+
 // fromFeedEntity reads a ProtoBuf VehiclePosition into a package-local VehiclePosition.
 func (vp *VehiclePosition) fromFeedEntity(vehicle *gtfs.VehiclePosition, location *time.Location) error {
 	trip := vehicle.GetTrip()
 	position := vehicle.GetPosition()
 	vehicleInfo := vehicle.GetVehicle()
 
-	var startTime time.Time
-	var err error
-	if trip != nil {
-		startTimeStr := trip.GetStartTime()
-		startTime, err = time.ParseInLocation(dateFormat, trip.GetStartDate()+" "+startTimeStr, location)
-
-		// If we encouter a >24h offset, we need to parse it separately and then add
-		if err != nil && len(startTimeStr) > 3 {
-			hourOffset, err := time.ParseDuration(startTimeStr[:2] + "h")
-			if err != nil {
-				return err
-			}
-			startTimeStr = "00" + startTimeStr[3:]
-			startTime, err = time.ParseInLocation(dateFormat, trip.GetStartDate()+" "+startTimeStr, location)
-			if err != nil {
-				return err
-			}
-			startTime = startTime.Add(hourOffset)
-		} else if err != nil {
-			return err
-		}
+	startTime, err := tripStartTime(trip, location)
+	if err != nil {
+		return err
 	}
 
 	vp.TripId = trip.GetTripId()
-	vp.RouteId = trip.GetRouteId()
-	vp.DirectionId = int32(trip.GetDirectionId())
 	vp.StartTimeUnix = startTime.Unix()
 	vp.StartTime = startTime.UTC()
-	vp.ScheduleRelationship = int32(trip.GetScheduleRelationship())
-	vp.Latitude = position.GetLatitude()
-	vp.Longitude = position.GetLongitude()
-	vp.Bearing = position.GetBearing()
-	vp.Odometer = position.GetOdometer()
-	vp.Speed = position.GetSpeed()
-	vp.CurrentStopSequence = vehicle.GetCurrentStopSequence()
-	vp.StopId = vehicle.GetStopId()
-	vp.CurrentStatus = int32(vehicle.GetCurrentStatus())
+	if trip != nil {
+		if trip.GetStartDate() != "" {
+			vp.StartDate = copyOptional(trip.StartDate)
+		}
+		vp.RouteId = copyOptional(trip.RouteId)
+		vp.DirectionId = optionalInt32(trip.DirectionId)
+		vp.ScheduleRelationship = optionalInt32(trip.ScheduleRelationship)
+	}
+	if position != nil {
+		vp.Latitude = copyOptional(position.Latitude)
+		vp.Longitude = copyOptional(position.Longitude)
+		vp.Bearing = copyOptional(position.Bearing)
+		vp.Odometer = copyOptional(position.Odometer)
+		vp.Speed = copyOptional(position.Speed)
+	}
+	vp.CurrentStopSequence = copyOptional(vehicle.CurrentStopSequence)
+	vp.StopId = copyOptional(vehicle.StopId)
+	vp.CurrentStatus = optionalInt32(vehicle.CurrentStatus)
 	// The GTFS protobuf is wrong on this, because Unix timestamps are allowed to be negative.
 	// Thus it should be safe to truncate to the range of a signed int64.
 	vp.TimestampUnix = int64(vehicle.GetTimestamp())
 	vp.Timestamp = time.Unix(vp.TimestampUnix, 0).UTC()
-	vp.CongestionLevel = int32(vehicle.GetCongestionLevel())
-	vp.OccupancyStatus = int32(vehicle.GetOccupancyStatus())
+	vp.CongestionLevel = optionalInt32(vehicle.CongestionLevel)
+	vp.OccupancyStatus = optionalInt32(vehicle.OccupancyStatus)
+	vp.OccupancyPercentage = copyOptional(vehicle.OccupancyPercentage)
 	vp.VehicleId = vehicleInfo.GetId()
-	vp.VehicleLabel = vehicleInfo.GetLabel()
-	vp.LicensePlate = vehicleInfo.GetLicensePlate()
+	if vehicleInfo != nil {
+		vp.VehicleLabel = copyOptional(vehicleInfo.Label)
+		vp.LicensePlate = copyOptional(vehicleInfo.LicensePlate)
+		vp.WheelchairAccessible = unknownEnum(vehicleInfo, vehicleDescriptorWheelchairAccessible)
+	}
 
 	return nil
 }
 
 // setupDatabase initializes and creates the realtime vehicle positions SQLite database.
-func setupDatabase(dataDir string) *sqlx.DB {
-	dbPath := filepath.Join(dataDir, "realtime.db")
-	db := sqlx.MustOpen("sqlite3", dbPath)
+func setupDatabase(dataDir string, feedId string) (*sqlx.DB, error) {
+	return createDatabase(filepath.Join(dataDir, "realtime.db"), feedId)
+}
 
-	// Enabled for data integrity reasons
-	db.MustExec("PRAGMA journal_mode=WAL")
+// selectColumns lists columns to select, with DATETIMEs cast back to Unix times
+// since the driver would otherwise scan them as time.Time.
+func selectColumns(columns []ColumnInfo) string {
+	var names []string
+	for _, colInfo := range columns {
+		if colInfo.Type == "DATETIME" {
+			names = append(names, "CAST("+colInfo.Name+" AS INT) AS "+colInfo.Name)
+		} else {
+			names = append(names, colInfo.Name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
 
+func createTableQuery() string {
+	return createTableIfNotExistsQuery("vehicle_positions", columns, positionPrimaryKey())
+}
+
+func createTableIfNotExistsQuery(table string, columns []ColumnInfo, primaryKey string) string {
 	var query strings.Builder
-	query.WriteString("CREATE TABLE IF NOT EXISTS vehicle_positions (")
+	query.WriteString("CREATE TABLE IF NOT EXISTS " + table + " (")
 	for _, colInfo := range columns {
 		query.WriteString(colInfo.Name)
 		query.WriteString(" ")
 		query.WriteString(colInfo.Type)
 		query.WriteString(",\n")
 	}
-	query.WriteString("PRIMARY KEY(timestamp, trip_id))")
-	db.MustExec(query.String())
-	return db
+	query.WriteString("PRIMARY KEY(" + primaryKey + "))")
+	return query.String()
 }
 
-// addVehiclePositions inserts vehicle positions into a SQLite database.
-// Timestamps from the feed are localized to the specified location.
-func addVehiclePositions(feed *gtfs.FeedMessage, db *sqlx.DB, location *time.Location) error {
-	tx := db.MustBegin()
-	defer tx.Rollback()
+// Queries creating each table of the realtime database
+var createTableQueries = []func() string{
+	createTableQuery,
+	createAlertsTableQuery,
+	createActiveAlertsTableQuery,
+	createTripUpdatesTableQuery,
+	createStopTimeUpdatesTableQuery,
+	createGeofenceEventsTableQuery,
+	createVehicleAssignmentsTableQuery,
+	createFeedHealthTableQuery,
+	createFeedFetchesTableQuery,
+	createFeedVersionsTableQuery,
+	createTripIdentitiesTableQuery,
+	createEnumValuesTableQuery,
+}
+
+// createDatabase opens a database file, creating the tables if needed.
+func createDatabase(dbPath string, feedId string) (db *sqlx.DB, err error) {
+	if db, err = openDatabase(dbPath, feedId); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			db.Close()
+		}
+	}()
+	ctx, cancel := dbContext()
+	defer cancel()
+
+	// Enabled for data integrity reasons
+	if _, err := db.ExecContext(ctx, "PRAGMA journal_mode=WAL"); err != nil {
+		return nil, err
+	}
+
+	for _, query := range createTableQueries {
+		if _, err := db.ExecContext(ctx, query()); err != nil {
+			return nil, err
+		}
+	}
+	if err := addEnumValues(db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// openDatabase opens an existing database file, migrating tables from before feed_id was added
+// with existing rows assigned to feedId and adding any newer columns. It fails if the primary key of
+// vehicle_positions isn't PositionKey, which db migrate changes.
+func openDatabase(dbPath string, feedId string) (*sqlx.DB, error) {
+	db, err := openDatabaseUnchecked(dbPath, feedId)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPrimaryKey(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openDatabaseUnchecked opens a database file like openDatabase, whatever the primary key of vehicle_positions.
+func openDatabaseUnchecked(dbPath string, feedId string) (*sqlx.DB, error) {
+	if params := sqliteParams(); params != "" {
+		dbPath += "?" + params
+	}
+	db, err := sqlx.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, migrate := range []func(*sqlx.DB) error{
+		func(db *sqlx.DB) error { return migrateFeedId(db, feedId) },
+		migrateAddedColumns,
+	} {
+		if err := migrate(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// readOnlyURI builds a SQLite URI filename to open dbPath read-only.
+// URIs need forward slashes, and a leading slash before Windows drive letters.
+func readOnlyURI(dbPath string) string {
+	path := filepath.ToSlash(dbPath)
+	if filepath.VolumeName(dbPath) != "" {
+		path = "/" + path
+	}
+	uri := "file:" + (&url.URL{Path: path}).EscapedPath() + "?mode=ro"
+	if params := sqliteParams(); params != "" {
+		uri += "&" + params
+	}
+	return uri
+}
+
+const defaultDatabaseTimeout = 30 * time.Second
+
+// dbTimeout bounds each database statement or transaction, so a wedged disk or locked database
+// fails with context.DeadlineExceeded rather than hanging. It's set from DatabaseTimeoutSeconds.
+var dbTimeout = defaultDatabaseTimeout
+
+// dbContext returns a context for one database statement or transaction, which the caller must cancel.
+func dbContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), dbTimeout)
+}
+
+// commitRows and commitInterval split the inserts of a poll into several transactions, if set.
+// They're set from CommitRows and CommitIntervalMilliseconds.
+var (
+	commitRows     int
+	commitInterval time.Duration
+)
+
+// chunkedTx is a write transaction for a poll's inserts with prepared statements, which commits and starts over
+// every commitRows rows or commitInterval, so storing one huge poll doesn't hold the write lock throughout.
+// Each transaction gets its own dbContext.
+type chunkedTx struct {
+	db      *sqlx.DB
+	queries []string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	tx      *sqlx.Tx
+	stmts   []*sqlx.NamedStmt
+	rows    int
+	started time.Time
+}
+
+func beginChunkedTx(db *sqlx.DB, queries ...string) (*chunkedTx, error) {
+	c := &chunkedTx{db: db, queries: queries}
+	return c, c.begin()
+}
 
-	stmt, err := tx.PrepareNamed(insertQuery())
+func (c *chunkedTx) begin() error {
+	c.ctx, c.cancel = dbContext()
+	tx, err := c.db.BeginTxx(c.ctx, nil)
 	if err != nil {
+		c.cancel()
 		return err
 	}
+	c.tx, c.stmts, c.rows, c.started = tx, nil, 0, time.Now()
+	for _, query := range c.queries {
+		stmt, err := tx.PrepareNamedContext(c.ctx, query)
+		if err != nil {
+			c.rollback()
+			return err
+		}
+		c.stmts = append(c.stmts, stmt)
+	}
+	return nil
+}
+
+// added counts rows written, committing and starting a new transaction once the current one is due.
+// Rows which must be stored together are added together.
+func (c *chunkedTx) added(rows int) error {
+	c.rows += rows
+	if (commitRows <= 0 || c.rows < commitRows) && (commitInterval <= 0 || time.Since(c.started) < commitInterval) {
+		return nil
+	}
+	if err := c.commit(); err != nil {
+		return err
+	}
+	return c.begin()
+}
+
+func (c *chunkedTx) commit() error {
+	defer c.cancel()
+	return c.tx.Commit()
+}
+
+// rollback abandons the current transaction, leaving those already committed.
+func (c *chunkedTx) rollback() {
+	c.tx.Rollback()
+	c.cancel()
+}
 
+// migrateFeedId adds the feed_id column to an existing vehicle_positions table.
+// The primary key changes as well, so the table is rebuilt rather than altered.
+// Rebuilding takes as long as copying every row, so it isn't bounded by dbTimeout.
+func migrateFeedId(db *sqlx.DB, feedId string) error {
+	ctx := context.Background()
+	var existing []string
+	if err := db.SelectContext(ctx, &existing, "SELECT name FROM pragma_table_info('vehicle_positions')"); err != nil {
+		return err
+	}
+	if len(existing) == 0 || slices.Contains(existing, "feed_id") {
+		return nil
+	}
+
+	slog.Info("Migrating vehicle_positions to add feed_id", "feed", feedId)
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	oldColumns := strings.Join(existing, ", ")
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE vehicle_positions RENAME TO vehicle_positions_old"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, createTableQuery()); err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, "INSERT INTO vehicle_positions (feed_id, "+oldColumns+") SELECT ?, "+oldColumns+" FROM vehicle_positions_old", feedId)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DROP TABLE vehicle_positions_old"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil {
+		slog.Info("Migrated vehicle_positions", "feed", feedId, "rows", n)
+	}
+	return nil
+}
+
+// migrateAddedColumns adds nullable columns which are missing from existing vehicle_positions and trip_updates tables.
+// Existing rows get NULLs, the same as positions or updates which didn't report the field.
+func migrateAddedColumns(db *sqlx.DB) error {
+	ctx, cancel := dbContext()
+	defer cancel()
+	tables := []struct {
+		name    string
+		columns []ColumnInfo
+	}{
+		{"vehicle_positions", columns},
+		{"trip_updates", tripUpdateColumns},
+	}
+	for _, table := range tables {
+		var existing []string
+		if err := db.SelectContext(ctx, &existing, "SELECT name FROM pragma_table_info(?)", table.name); err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			continue
+		}
+		for _, colInfo := range table.columns {
+			if !slices.Contains(existing, colInfo.Name) {
+				slog.Info("Migrating a table to add a column", "table", table.name, "column", colInfo.Name)
+				if _, err := db.ExecContext(ctx, "ALTER TABLE "+table.name+" ADD COLUMN "+colInfo.Name+" "+colInfo.Type); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addVehiclePositions inserts vehicle positions into a SQLite database.
+// Timestamps from the feed are localized to the specified location.
+// Returns the positions which were not already present in the database.
+// With a minInterval, only the latest position of each vehicle is kept within each interval, counted from the epoch.
+func addVehiclePositions(feed *gtfs.FeedMessage, db *sqlx.DB, feedId string, agencyId *string, location *time.Location, minInterval time.Duration) ([]VehiclePosition, error) {
+	var batch []VehiclePosition
 	for _, entity := range feed.Entity {
 		if entity.Vehicle == nil {
 			continue
 		}
-		var vp VehiclePosition
-		vp.fromFeedEntity(entity.Vehicle, location)
+		vp := VehiclePosition{FeedId: feedId, AgencyId: agencyId}
+		if err := vp.fromFeedEntity(entity.Vehicle, location); err != nil {
+			// One malformed position shouldn't lose the rest of the feed
+			slog.Warn("Skipping vehicle position", "entity", entity.GetId(), "err", err)
+			continue
+		}
+		normalizeVehicle(feedId, &vp.VehicleLabel, &vp.LicensePlate)
 		// The BC Transit feed will occasionally publish entries with identical vehicle_ids and timestamps,
-		// but a zero start_time and other trip-related fields missing.
-		// Ignore these to avoid violating the primary key constraint.
-		if vp.StartTime.IsZero() {
+		// but a zero start_time and other trip-related fields missing. Under a key with trip_id, these would all
+		// share the empty trip, so they're ignored. Keys without it keep positions of vehicles without a trip.
+		if vp.StartTime.IsZero() && slices.Contains(positionKeyColumns, "trip_id") {
 			continue
 		}
-		stmt.MustExec(&vp)
+		batch = append(batch, vp)
+	}
+	// Filtered before the transaction, so slow hooks don't hold up other writers
+	batch, err := positionHooks.filter(batch)
+	if err != nil {
+		return nil, err
 	}
 
-	err = tx.Commit()
+	c, err := beginChunkedTx(db, insertQuery())
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer c.rollback()
+	interval := int64(minInterval / time.Second)
 
-	return nil
+	var inserted []VehiclePosition
+	for _, vp := range batch {
+		if interval > 0 && vp.VehicleId != "" {
+			windowStart := vp.TimestampUnix - vp.TimestampUnix%interval
+			var newer bool
+			err := c.tx.GetContext(c.ctx, &newer, `SELECT EXISTS(SELECT 1 FROM vehicle_positions
+				WHERE feed_id = ? AND vehicle_id = ? AND timestamp >= ? AND timestamp < ? AND timestamp >= ?)`,
+				feedId, vp.VehicleId, windowStart, windowStart+interval, vp.TimestampUnix)
+			if err != nil {
+				return nil, err
+			}
+			if newer {
+				continue
+			}
+			_, err = c.tx.ExecContext(c.ctx, `DELETE FROM vehicle_positions WHERE feed_id = ? AND vehicle_id = ? AND timestamp >= ? AND timestamp < ?`,
+				feedId, vp.VehicleId, windowStart, vp.TimestampUnix)
+			if err != nil {
+				return nil, err
+			}
+		}
+		result, err := c.stmts[0].ExecContext(c.ctx, &vp)
+		if err != nil {
+			return nil, err
+		}
+		// Rows ignored by ON CONFLICT DO NOTHING report zero affected rows
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			inserted = append(inserted, vp)
+		}
+		if err := c.added(1); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.commit(); err != nil {
+		return nil, err
+	}
+	positionHooks.notify(inserted)
+
+	return inserted, nil
+}
+
+// feedFetch describes one request for a feed, for the feed health history.
+type feedFetch struct {
+	url string
+	// 0 if there was no response
+	statusCode int
+	latency    time.Duration
+	// nil if there was no response
+	header http.Header
+	// Set for a feed whose stored version was given and which is unchanged from it,
+	// either answered with 304 Not Modified or with the same header timestamp
+	notModified bool
+	version     FeedVersion
+	// The feed as received, for raw snapshots. nil for a feed without a response body or a simulated one.
+	data []byte
 }
 
 // extractFeed retrieves a GTFS feed from the specified URL and returns a FeedMessage.
-// Returns an empty FeedMessage and error if extraction fails.
-func extractFeed(feedURL string) (*gtfs.FeedMessage, error) {
-	resp, err := http.Get(feedURL)
+// Returns an empty FeedMessage and error if extraction fails, including for responses other than 2xx.
+// Given the version stored last, the request is conditional, and a 304 response returns no feed and no error.
+func extractFeed(feedURL string, request FeedRequestConfig, auth FeedAuthConfig, feedId string, stored *FeedVersion) (feed *gtfs.FeedMessage, fetch feedFetch, err error) {
+	fetch.url = feedURL
+	start := time.Now()
+	defer func() { fetch.latency = time.Since(start) }()
+
+	if u, err := url.Parse(feedURL); err == nil && u.Scheme == simulateScheme {
+		feed, err = simulateFeed(u.Opaque, feedId)
+		return feed, fetch, err
+	}
+	req, err := newFeedRequest(feedURL, request, feedId)
 	if err != nil {
-		return nil, err
+		return nil, fetch, err
+	}
+	if err := authorize(req, auth); err != nil {
+		return nil, fetch, err
+	}
+	if stored != nil {
+		if stored.ETag != nil {
+			req.Header.Set("If-None-Match", *stored.ETag)
+		}
+		if stored.LastModified != nil {
+			req.Header.Set("If-Modified-Since", *stored.LastModified)
+		}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), feedTimeout)
+	defer cancel()
+	resp, err := feedClient.Do(cacheable(req.WithContext(ctx)))
+	if err != nil {
+		// Errors name the URL requested, which may have credentials in its query
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = feedURL
+		}
+		return nil, fetch, &FeedError{URL: feedURL, Err: err}
 	}
 	defer resp.Body.Close()
+	fetch.statusCode = resp.StatusCode
+	fetch.header = resp.Header
+	if resp.StatusCode == http.StatusNotModified && stored != nil {
+		fetch.notModified, fetch.version = true, *stored
+		return nil, fetch, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fetch, &FeedError{URL: feedURL, StatusCode: resp.StatusCode, Err: fmt.Errorf("unexpected response: %s", resp.Status)}
+	}
 
-	data, err := io.ReadAll(resp.Body)
+	body := io.Reader(resp.Body)
+	if maxFeedBytes > 0 {
+		// Read one byte past the limit to tell a feed of exactly the limit from a larger one
+		body = io.LimitReader(resp.Body, maxFeedBytes+1)
+	}
+	data, err := io.ReadAll(body)
 	if err != nil {
-		return nil, err
+		return nil, fetch, &FeedError{URL: feedURL, StatusCode: resp.StatusCode, Err: err}
+	}
+	if maxFeedBytes > 0 && int64(len(data)) > maxFeedBytes {
+		return nil, fetch, &FeedError{URL: feedURL, StatusCode: resp.StatusCode, Err: fmt.Errorf("feed is larger than the memory budget allows (%d bytes)", maxFeedBytes)}
 	}
 
-	feed := &gtfs.FeedMessage{}
+	feed = &gtfs.FeedMessage{}
 	if err := proto.Unmarshal(data, feed); err != nil {
-		return nil, err
+		return nil, fetch, &FeedError{URL: feedURL, StatusCode: resp.StatusCode, Err: fmt.Errorf("parsing feed: %w", err)}
+	}
+	fetch.data = data
+	fetch.version = FeedVersion{ETag: optionalHeader(resp.Header, "ETag"), LastModified: optionalHeader(resp.Header, "Last-Modified")}
+	if t := int64(feed.GetHeader().GetTimestamp()); t > 0 {
+		fetch.version.HeaderTimestamp = &t
+		fetch.notModified = stored != nil && stored.HeaderTimestamp != nil && *stored.HeaderTimestamp == t
+	}
+	return feed, fetch, nil
+}
+
+// feedURLs lists the endpoints for a feed type, leaving out unset ones.
+func feedURLs(url string, more []string) []string {
+	var urls []string
+	for _, u := range append([]string{url}, more...) {
+		if u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// extractFeeds retrieves each feed and merges their entities, dropping entities identical to an earlier one,
+// as agencies splitting a feed often publish some entities in more than one.
+// The merged header is the first feed's, with the oldest timestamp, since the result is only as fresh as its stalest part.
+// Each request is described in the returned fetches, up to and including one which failed.
+// Given the versions stored last, by URL, the requests are conditional. If every feed is unchanged, the result is
+// unchangedFeed, and otherwise feeds answered with 304 Not Modified are fetched again to merge with the changed ones.
+func extractFeeds(urls []string, request FeedRequestConfig, auth FeedAuthConfig, feedId string, stored map[string]FeedVersion) (*gtfs.FeedMessage, []feedFetch, error) {
+	if len(urls) == 0 {
+		return nil, nil, errors.New("no feed URL configured")
+	}
+	feeds := make([]*gtfs.FeedMessage, len(urls))
+	var fetches []feedFetch
+	unchanged := stored != nil
+	for i, feedURL := range urls {
+		var version *FeedVersion
+		if v, found := stored[feedURL]; found {
+			version = &v
+		}
+		feed, fetch, err := extractFeed(feedURL, request, auth, feedId, version)
+		fetches = append(fetches, fetch)
+		if err != nil {
+			return nil, fetches, fmt.Errorf("%s: %w", feedURL, err)
+		}
+		feeds[i] = feed
+		unchanged = unchanged && fetch.notModified
+	}
+	if unchanged {
+		return unchangedFeed(fetches), fetches, nil
+	}
+
+	for i, feed := range feeds {
+		if feed == nil {
+			var err error
+			feeds[i], fetches[i], err = extractFeed(urls[i], request, auth, feedId, nil)
+			if err != nil {
+				return nil, fetches, fmt.Errorf("%s: %w", urls[i], err)
+			}
+		}
+	}
+	return mergeFeeds(feeds), fetches, nil
+}
+
+// mergeFeeds merges the entities of several feeds for one feed type, dropping entities identical to an earlier one.
+func mergeFeeds(feeds []*gtfs.FeedMessage) *gtfs.FeedMessage {
+	var merged *gtfs.FeedMessage
+	var entities []*gtfs.FeedEntity
+	seen := make(map[string][]*gtfs.FeedEntity)
+	for _, feed := range feeds {
+	entityLoop:
+		for _, entity := range feed.Entity {
+			for _, other := range seen[entity.GetId()] {
+				if proto.Equal(entity, other) {
+					continue entityLoop
+				}
+			}
+			seen[entity.GetId()] = append(seen[entity.GetId()], entity)
+			entities = append(entities, entity)
+		}
+		if merged == nil {
+			merged = feed
+		} else if merged.Header == nil {
+			merged.Header = feed.Header
+		} else if t := feed.GetHeader().GetTimestamp(); t > 0 && (merged.Header.Timestamp == nil || t < *merged.Header.Timestamp) {
+			merged.Header.Timestamp = proto.Uint64(t)
+		}
 	}
-	return feed, nil
+	merged.Entity = entities
+	return merged
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/jmoiron/sqlx"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTripStartTime(t *testing.T) {
+	location, err := time.LoadLocation("America/Vancouver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		startTime string
+		want      time.Time
+	}{
+		{"08:15:00", time.Date(2024, 3, 1, 8, 15, 0, 0, location)},
+		// Trips running past midnight keep the service day they started on
+		{"24:10:00", time.Date(2024, 3, 2, 0, 10, 0, 0, location)},
+		{"25:00:00", time.Date(2024, 3, 2, 1, 0, 0, 0, location)},
+		{"26:45:30", time.Date(2024, 3, 2, 2, 45, 30, 0, location)},
+	}
+	for _, test := range tests {
+		trip := &gtfs.TripDescriptor{StartDate: proto.String("20240301"), StartTime: proto.String(test.startTime)}
+		got, err := tripStartTime(trip, location)
+		if err != nil {
+			t.Errorf("%s: %v", test.startTime, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("%s: got %s, want %s", test.startTime, got, test.want)
+		}
+	}
+
+	for _, startTime := range []string{"2x:00:00", "24:1"} {
+		trip := &gtfs.TripDescriptor{StartDate: proto.String("20240301"), StartTime: proto.String(startTime)}
+		if got, err := tripStartTime(trip, location); err == nil {
+			t.Errorf("%s: got %s, want an error", startTime, got)
+		}
+	}
+}
+
+// A position whose trip start time can't be read is skipped, keeping the rest of the feed,
+// even under a key without trip_id.
+func TestSkipMalformedPosition(t *testing.T) {
+	usePositionKey(t, "timestamp", "vehicle_id")
+	db, err := createDatabase(filepath.Join(t.TempDir(), "realtime.db"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	feed := positionsFeed(1709280000, "trip-1", "bus-1", "bus-2")
+	feed.Entity[1].Vehicle.Trip.StartTime = proto.String("2x:00:00")
+	inserted, err := addVehiclePositions(feed, db, "test", nil, time.UTC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inserted) != 1 || inserted[0].VehicleId != "bus-1" {
+		t.Errorf("inserted %+v, want bus-1 only", inserted)
+	}
+}
+
+// Start times count from noon minus 12 hours, which is an hour off midnight on days the clocks change.
+func TestParseNoonStartTime(t *testing.T) {
+	location, err := time.LoadLocation("America/Vancouver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		startDate string
+		startTime string
+		want      time.Time
+	}{
+		{"20240301", "08:00:00", time.Date(2024, 3, 1, 16, 0, 0, 0, time.UTC)},
+		{"20240301", "25:00:00", time.Date(2024, 3, 2, 9, 0, 0, 0, time.UTC)},
+		// Clocks go forward at 02:00, so the day's times count from 23:00 the day before
+		{"20240310", "01:30:00", time.Date(2024, 3, 10, 8, 30, 0, 0, time.UTC)},
+		{"20240310", "08:00:00", time.Date(2024, 3, 10, 15, 0, 0, 0, time.UTC)},
+		// Clocks go back at 02:00, so the day's times count from 01:00
+		{"20241103", "01:30:00", time.Date(2024, 11, 3, 9, 30, 0, 0, time.UTC)},
+		{"20241103", "08:00:00", time.Date(2024, 11, 3, 16, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		got, err := parseNoonStartTime(test.startDate, test.startTime, location)
+		if err != nil {
+			t.Errorf("%s %s: %v", test.startDate, test.startTime, err)
+		} else if !got.Equal(test.want) {
+			t.Errorf("%s %s: got %s, want %s", test.startDate, test.startTime, got.UTC(), test.want)
+		}
+	}
+
+	for _, startTime := range []string{"2x:00:00", "08:60:00", "8am"} {
+		if got, err := parseNoonStartTime("20240301", startTime, location); err == nil {
+			t.Errorf("%s: got %s, want an error", startTime, got)
+		}
+	}
+}
+
+// Databases from before feed_id and the later columns get them when opened, keeping their rows.
+func TestOpenOldDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "realtime.db")
+	old, err := sqlx.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		`CREATE TABLE vehicle_positions (trip_id TEXT, route_id TEXT, start_time DATETIME, latitude FLOAT, timestamp DATETIME,
+			vehicle_id TEXT, PRIMARY KEY(timestamp, trip_id))`,
+		`INSERT INTO vehicle_positions VALUES ('trip-1', '99', 1709280000, 49.25, 1709280030, 'bus-1')`,
+		`CREATE TABLE trip_updates (feed_id TEXT NOT NULL, trip_id TEXT, start_time DATETIME, timestamp DATETIME, delay INTEGER,
+			PRIMARY KEY(feed_id, trip_id, start_time, timestamp))`,
+		`INSERT INTO trip_updates VALUES ('legacy', 'trip-1', 1709280000, 1709280030, 60)`,
+	} {
+		if _, err := old.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	// Opening again finds nothing left to migrate
+	for i := 0; i < 2; i++ {
+		db, err := openDatabase(dbPath, "legacy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables := []struct {
+			name    string
+			columns []ColumnInfo
+		}{{"vehicle_positions", columns}, {"trip_updates", tripUpdateColumns}}
+		for _, table := range tables {
+			var existing []string
+			if err := db.Select(&existing, "SELECT name FROM pragma_table_info(?)", table.name); err != nil {
+				t.Fatal(err)
+			}
+			for _, colInfo := range table.columns {
+				if !slices.Contains(existing, colInfo.Name) {
+					t.Errorf("%s has no column %s", table.name, colInfo.Name)
+				}
+			}
+		}
+
+		var positions []VehiclePosition
+		if err := db.Select(&positions, "SELECT "+selectColumns(columns)+" FROM vehicle_positions"); err != nil {
+			t.Fatal(err)
+		}
+		if len(positions) != 1 {
+			t.Fatalf("read %d positions, want 1", len(positions))
+		}
+		vp := positions[0]
+		if vp.FeedId != "legacy" || vp.TripId != "trip-1" || vp.VehicleId != "bus-1" || vp.TimestampUnix != 1709280030 ||
+			vp.StartTimeUnix != 1709280000 || vp.RouteId == nil || *vp.RouteId != "99" || vp.Latitude == nil || *vp.Latitude != 49.25 {
+			t.Errorf("migrated position is %+v", vp)
+		}
+		if vp.Bearing != nil || vp.AgencyId != nil || vp.NearestStopId != nil {
+			t.Errorf("added columns of the migrated position aren't NULL: %+v", vp)
+		}
+		var trips []TripUpdate
+		if err := db.Select(&trips, "SELECT "+selectColumns(tripUpdateColumns)+" FROM trip_updates"); err != nil {
+			t.Fatal(err)
+		}
+		if len(trips) != 1 || trips[0].Delay == nil || *trips[0].Delay != 60 || trips[0].AgencyId != nil {
+			t.Errorf("migrated trip updates are %+v", trips)
+		}
+		db.Close()
+	}
+}
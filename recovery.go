@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// An unreadable lock file younger than this may still be being written by the process taking it.
+const lockWriteGrace = time.Minute
+
+// lockInfo is the contents of a lock file, identifying the process holding it.
+type lockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+}
+
+// acquireLock takes a lock file, so two runs never write the same staging files and a run can tell the files it
+// finds are left over from a crash. A lock left by a process on this host which is no longer running is stale and
+// taken over. It returns the function releasing the lock.
+func acquireLock(path, command string) (func(), error) {
+	host, _ := os.Hostname()
+	contents, err := json.Marshal(lockInfo{PID: os.Getpid(), Host: host, Command: command, Started: time.Now().UTC()})
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			_, err = f.Write(contents)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return func() {
+				if err := os.Remove(path); err != nil {
+					slog.Warn("Failed to release a lock", "err", err)
+				}
+			}, nil
+		}
+		if !errors.Is(err, os.ErrExist) || attempt > 0 {
+			return nil, err
+		}
+		stale, err := staleLock(path, host)
+		if err != nil {
+			return nil, err
+		}
+		slog.Warn("Removing stale lock", "path", path, "reason", stale)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+}
+
+// staleLock describes why an existing lock can be taken over, or returns an error if it's held.
+func staleLock(path, host string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "released", nil
+		}
+		return "", err
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var lock lockInfo
+	if err := json.Unmarshal(contents, &lock); err != nil {
+		if time.Since(info.ModTime()) < lockWriteGrace {
+			return "", &LockError{Path: path, Err: fmt.Errorf("%s is being locked by another process", path)}
+		}
+		return "unreadable", nil
+	}
+	if lock.Host == host && !processAlive(lock.PID) {
+		return fmt.Sprintf("%s (pid %d) is no longer running", lock.Command, lock.PID), nil
+	}
+	return "", &LockError{Path: path, Err: fmt.Errorf("%s is locked by %s (pid %d on %s) since %s; remove it if that process is no longer running",
+		path, lock.Command, lock.PID, lock.Host, lock.Started.Format(time.RFC3339))}
+}
+
+// processAlive reports whether a process is running. On Windows, finding a process fails once it has exited.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return !errors.Is(p.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
+
+// A checkpointed partition file's segment, e.g. vehicle_positions.parquet.3.tmp
+var segmentPattern = regexp.MustCompile(`\.\d+\.tmp$`)
+
+// recoverArchive cleans up after an archive run which crashed, once its lock is held. Staging files are removed,
+// as each is rewritten from the start, except for the segments of months with a checkpoint, which resume.
+// Segments of months without one can't be resumed and are removed too.
+func recoverArchive(archiveDir string, config ArchiveConfig) error {
+	dirs := []string{archiveDir}
+	if len(config.Encryption.Recipients) > 0 {
+		encryptedDir := config.Encryption.Dir
+		if encryptedDir == "" {
+			encryptedDir = filepath.Clean(archiveDir) + "-encrypted"
+		}
+		dirs = append(dirs, encryptedDir)
+	}
+	var removed int
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() || !strings.HasSuffix(path, ".tmp") {
+				return nil
+			}
+			// Route partitions are a directory below the month, which holds the checkpoint
+			if segmentPattern.MatchString(path) && dir == archiveDir &&
+				(fileExists(filepath.Join(filepath.Dir(path), archiveCheckpointName)) ||
+					fileExists(filepath.Join(filepath.Dir(filepath.Dir(path)), archiveCheckpointName))) {
+				return nil
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			removed++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if removed > 0 {
+		config.log().Warn("Removed staging files left by an interrupted archive run", "files", removed)
+	}
+	return nil
+}
+
+// recoverStatic removes partial downloads left by an interrupted static run. Feeds are downloaded again in full,
+// as the one on the server may have changed since.
+func recoverStatic(staticDir string) error {
+	partial, err := filepath.Glob(filepath.Join(staticDir, "*"+partialDownloadSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range partial {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		slog.Warn("Removed partial static download", "path", path)
+	}
+	return nil
+}
+
+// recoverReplication removes the staging files of a snapshot interrupted before it was uploaded.
+// The generation it would have started never had a snapshot, so the next one is started from scratch anyway.
+func recoverReplication(dbPath string) error {
+	for _, path := range []string{dbPath + ".snapshot", dbPath + ".snapshot.tmp", dbPath + ".snapshot.gz"} {
+		if err := os.Remove(path); err == nil {
+			slog.Warn("Removed interrupted replica snapshot", "path", path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeLock writes a lock file as if taken by a process on this host.
+func writeLock(t *testing.T, path string, pid int) {
+	t.Helper()
+	host, _ := os.Hostname()
+	contents, err := json.Marshal(lockInfo{PID: pid, Host: host, Command: "archive", Started: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// exitedPID returns the PID of a process which has already exited.
+func exitedPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestRecoverInterruptedArchive(t *testing.T) {
+	dataDir := t.TempDir()
+	config := Config{DataDir: dataDir, FeedId: "test"}
+	archiveDir := feedArchiveDir(config)
+	lockPath := filepath.Clean(archiveDir) + ".lock"
+	partitionPath := filepath.Join(monthDir(archiveDir, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)), "vehicle_positions.parquet")
+	db, err := createDatabase(filepath.Join(dataDir, "realtime.db"), config.FeedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := addVehiclePositions(positionsFeed(1709280000, "trip-1", "bus-1"), db, config.FeedId, nil, time.UTC, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := archivePartitions(db, archiveDir, config.Archive, provenanceOf(config)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A run which crashed left its lock, a half-written staging file and a segment without a checkpoint
+	writeLock(t, lockPath, exitedPID(t))
+	leftovers := []string{partitionPath + ".tmp", partitionPath + ".0.tmp"}
+	for _, path := range leftovers {
+		if err := os.WriteFile(path, []byte("interrupted"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := addVehiclePositions(positionsFeed(1709280030, "trip-1", "bus-1"), db, config.FeedId, nil, time.UTC, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := archivePartitions(db, archiveDir, config.Archive, provenanceOf(config)); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range append(leftovers, lockPath) {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left after recovering: %v", filepath.Base(path), err)
+		}
+	}
+	if n := archivedRowCount(t, archiveDir); n != 2 {
+		t.Errorf("archived %d rows after recovering, want 2", n)
+	}
+
+	// A lock held by a running process isn't taken over
+	writeLock(t, lockPath, os.Getpid())
+	var lockErr *LockError
+	if err := archivePartitions(db, archiveDir, config.Archive, provenanceOf(config)); !errors.As(err, &lockErr) {
+		t.Errorf("archived while locked by a running process: %v", err)
+	}
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Errorf("removed a held lock: %v", err)
+	}
+}
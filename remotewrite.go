@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RemoteWriteConfig pushes series derived from each poll to a Prometheus remote-write endpoint,
+// e.g. Mimir, Thanos or VictoriaMetrics, for operational history without running the analyze commands.
+type RemoteWriteConfig struct {
+	// URL of the remote-write endpoint. Series aren't pushed if empty.
+	URL string
+	// Username and Password for basic auth, if set.
+	Username string
+	Password string
+	// IncludeDelay adds the average delay of vehicles stopped at stops against the latest static GTFS.
+	// Its stop times are loaded once per run, so restart a daemon after the static command.
+	IncludeDelay bool
+}
+
+const remoteWriteTimeout = 10 * time.Second
+
+type remoteWriteSample struct {
+	// Sorted by name, including __name__
+	labels [][2]string
+	value  float64
+}
+
+// appendTimeSeries encodes a prometheus.TimeSeries with one sample, as field 1 of a prometheus.WriteRequest.
+func appendTimeSeries(b []byte, sample remoteWriteSample, timestamp time.Time) []byte {
+	var series []byte
+	for _, label := range sample.labels {
+		var l []byte
+		l = protowire.AppendTag(l, 1, protowire.BytesType)
+		l = protowire.AppendString(l, label[0])
+		l = protowire.AppendTag(l, 2, protowire.BytesType)
+		l = protowire.AppendString(l, label[1])
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, l)
+	}
+	var s []byte
+	s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+	s = protowire.AppendFixed64(s, math.Float64bits(sample.value))
+	s = protowire.AppendTag(s, 2, protowire.VarintType)
+	s = protowire.AppendVarint(s, uint64(timestamp.UnixMilli()))
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, s)
+
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, series)
+}
+
+// derivedSeries computes the active vehicles and, if static is given, the average delay per route in a feed.
+func derivedSeries(feed *gtfs.FeedMessage, feedId string, location *time.Location, static *staticGTFS) []remoteWriteSample {
+	vehicles := make(map[string]map[string]bool)
+	delaySums := make(map[string]float64)
+	delayCounts := make(map[string]int)
+	for _, entity := range feed.Entity {
+		if entity.Vehicle == nil {
+			continue
+		}
+		var vp VehiclePosition
+		// Skipped as it is when stored, where addVehiclePositions warns about it
+		if err := vp.fromFeedEntity(entity.Vehicle, location); err != nil {
+			continue
+		}
+		route := valueOf(vp.RouteId)
+		if vp.VehicleId != "" {
+			if vehicles[route] == nil {
+				vehicles[route] = make(map[string]bool)
+			}
+			vehicles[route][vp.VehicleId] = true
+		}
+		if static == nil || valueOf(vp.CurrentStatus) != stoppedAtStatus {
+			continue
+		}
+		if _, scheduled, found := scheduledArrival(&vp, static); found {
+			if delay := vp.Timestamp.Sub(scheduled); delay <= maxPlausibleDelay && delay >= -maxPlausibleDelay {
+				delaySums[route] += delay.Seconds()
+				delayCounts[route]++
+			}
+		}
+	}
+
+	var samples []remoteWriteSample
+	for route, ids := range vehicles {
+		samples = append(samples, remoteWriteSample{
+			labels: seriesLabels("gtfs_active_vehicles", feedId, route),
+			value:  float64(len(ids)),
+		})
+	}
+	for route, count := range delayCounts {
+		samples = append(samples, remoteWriteSample{
+			labels: seriesLabels("gtfs_average_delay_seconds", feedId, route),
+			value:  delaySums[route] / float64(count),
+		})
+	}
+	sort.Slice(samples, func(i, j int) bool { return fmt.Sprint(samples[i].labels) < fmt.Sprint(samples[j].labels) })
+	return samples
+}
+
+// seriesLabels returns the labels of a derived series. Positions without a route get no route_id,
+// which Prometheus treats the same as an empty one.
+func seriesLabels(name, feedId, route string) [][2]string {
+	labels := [][2]string{{"__name__", name}, {"feed_id", feedId}}
+	if route != "" {
+		labels = append(labels, [2]string{"route_id", route})
+	}
+	return labels
+}
+
+// setupRemoteWrite loads the stop times of the latest static GTFS if the average delay is pushed, or else returns nil.
+// Like setupTripUpdatePolling, it's done once per process.
+func setupRemoteWrite(config Config) (*staticGTFS, error) {
+	if config.RemoteWrite.URL == "" || !config.RemoteWrite.IncludeDelay {
+		return nil, nil
+	}
+	staticFile, err := latestStaticFile(feedStaticDir(config))
+	if err != nil {
+		return nil, err
+	}
+	return loadStaticGTFS(staticFile, "stop_times.txt")
+}
+
+// pushDerivedSeries sends the series derived from a poll to the remote-write endpoint, timestamped now.
+// The average delay is derived from static, as loaded by setupRemoteWrite.
+func pushDerivedSeries(config Config, feed *gtfs.FeedMessage, location *time.Location, static *staticGTFS) error {
+	remote := config.RemoteWrite
+	if remote.URL == "" {
+		return nil
+	}
+	samples := derivedSeries(feed, config.FeedId, location, static)
+	if len(samples) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	var writeRequest []byte
+	for _, sample := range samples {
+		writeRequest = appendTimeSeries(writeRequest, sample, now)
+	}
+	req, err := http.NewRequest(http.MethodPost, remote.URL, bytes.NewReader(snappy.Encode(nil, writeRequest)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if remote.Username != "" {
+		req.SetBasicAuth(remote.Username, remote.Password)
+	}
+	client := &http.Client{Timeout: remoteWriteTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("remote write returned %s: %s", resp.Status, body)
+	}
+	config.log().Debug("Pushed derived series", "series", len(samples))
+	return nil
+}
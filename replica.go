@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultReplicaRefresh = 5 * time.Minute
+
+// archiveReplica is a read-only database rebuilt from a synced copy of the archive, so serve can answer queries
+// on another host than the scraper's. Each build is a new file, as open connections keep reading the one they
+// opened until the build replacing it is swapped in.
+type archiveReplica struct {
+	archiveDir string
+	dir        string
+	config     Config
+	// Update time of the manifest the served build was made from
+	updated time.Time
+	path    string
+}
+
+func newArchiveReplica(config Config, archiveDir string) (*archiveReplica, error) {
+	r := &archiveReplica{archiveDir: archiveDir, dir: filepath.Join(config.DataDir, "replica"), config: config}
+	// Builds from earlier runs are out of date, if not incomplete
+	if err := os.RemoveAll(r.dir); err != nil {
+		return nil, err
+	}
+	return r, os.MkdirAll(r.dir, 0775)
+}
+
+// build makes a database from the archive if its manifest has changed since the last build, returning nil if it hasn't.
+// The archive must verify against its manifest, so files still being synced aren't served.
+func (r *archiveReplica) build() (*sqlx.DB, error) {
+	manifest, _, err := readManifest(r.archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Updated.Equal(r.updated) {
+		return nil, nil
+	}
+	if err := verifyArchive(r.archiveDir, r.config.Archive); err != nil {
+		return nil, fmt.Errorf("not serving the archive updated at %s, as it doesn't verify: %w", manifest.Updated.Format(time.RFC3339), err)
+	}
+	path := filepath.Join(r.dir, fmt.Sprintf("realtime-%d.db", manifest.Updated.UnixNano()))
+	if err := restoreFromArchive(path, r.archiveDir, time.Time{}, r.config.Archive, r.config.FeedId); err != nil {
+		return nil, err
+	}
+	// Builds are never written again, so they're switched out of WAL mode to be opened read-only without a WAL
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.ExecContext(context.Background(), "PRAGMA journal_mode=DELETE")
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if db, err = sqlx.Open("sqlite3", readOnlyURI(path)); err != nil {
+		return nil, err
+	}
+	r.updated, r.path = manifest.Updated, path
+	return db, nil
+}
+
+// refresh rebuilds the replica every interval while the archive changes, swapping each build into the server.
+// Failed builds are logged and retried at the next interval, leaving the last build in service.
+func (r *archiveReplica) refresh(ctx context.Context, s *apiServer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		oldPath := r.path
+		db, err := r.build()
+		if err != nil {
+			slog.Error("Failed to build the archive database", "err", err)
+			continue
+		}
+		if db == nil {
+			continue
+		}
+		// Close waits for queries in progress, after which the previous build can go
+		if err := s.db.Swap(db).Close(); err != nil {
+			slog.Warn("Failed to close the previous archive database", "err", err)
+		}
+		if err := removeDatabase(oldPath); err != nil {
+			slog.Warn("Failed to remove the previous archive database", "err", err)
+		}
+		slog.Info("Serving the archive", "updated", r.updated.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ReplicationConfig continuously copies realtime.db to object storage, so rows which aren't archived yet survive
+// the loss of the disk. It's done by the daemon, or by `db replicate` alongside scheduled commands.
+//
+// Each generation is a snapshot of the database followed by segments of its WAL, shipped as they're committed.
+// `db restore --from-replica` rebuilds the database from the latest generation.
+type ReplicationConfig struct {
+	// Storage is where generations are kept, under Prefix. Replication is off without a Bucket.
+	Storage S3Config
+	// IntervalSeconds between WAL shipments, defaulting to 10, which is about as much as a disk failure loses.
+	IntervalSeconds int
+	// SnapshotHours starts a new generation with a fresh snapshot this often, defaulting to 24,
+	// which bounds the WAL segments a restore replays.
+	SnapshotHours int
+	// RetainGenerations is how many generations are kept, defaulting to 2.
+	RetainGenerations int
+}
+
+const (
+	defaultReplicationInterval = 10 * time.Second
+	defaultSnapshotInterval    = 24 * time.Hour
+	defaultRetainGenerations   = 2
+
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+	// Generation names sort by when they were started
+	generationLayout = "20060102T150405.000000Z"
+	generationsDir   = "generations/"
+	snapshotName     = "snapshot.db.gz"
+)
+
+func (c ReplicationConfig) enabled() bool {
+	return c.Storage.Bucket != ""
+}
+
+// walHeader is the header of a SQLite WAL file. Frames only belong to the WAL if they carry its salts
+// and continue the checksums from its header.
+type walHeader struct {
+	raw []byte
+	// The checksums are of big-endian words, rather than little-endian
+	bigEndian bool
+	pageSize  int
+	// Incremented each time the WAL is reset
+	checkpointSeq uint32
+	salt          [2]uint32
+	checksum      [2]uint32
+}
+
+func parseWALHeader(b []byte) (walHeader, error) {
+	if len(b) < walHeaderSize {
+		return walHeader{}, errors.New("WAL header is truncated")
+	}
+	magic := binary.BigEndian.Uint32(b)
+	if magic != 0x377f0682 && magic != 0x377f0683 {
+		return walHeader{}, errors.New("not a WAL file")
+	}
+	h := walHeader{
+		raw:           append([]byte(nil), b[:walHeaderSize]...),
+		bigEndian:     magic&1 == 1,
+		pageSize:      int(binary.BigEndian.Uint32(b[8:])),
+		checkpointSeq: binary.BigEndian.Uint32(b[12:]),
+		salt:          [2]uint32{binary.BigEndian.Uint32(b[16:]), binary.BigEndian.Uint32(b[20:])},
+		checksum:      [2]uint32{binary.BigEndian.Uint32(b[24:]), binary.BigEndian.Uint32(b[28:])},
+	}
+	if h.pageSize == 1 {
+		h.pageSize = 65536
+	}
+	if s0, s1 := walChecksum(h.bigEndian, b[:24], 0, 0); s0 != h.checksum[0] || s1 != h.checksum[1] {
+		return walHeader{}, errors.New("WAL header checksum doesn't match")
+	}
+	return h, nil
+}
+
+// walChecksum continues SQLite's WAL checksum over data, whose length is a multiple of 8.
+func walChecksum(bigEndian bool, data []byte, s0, s1 uint32) (uint32, uint32) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	for i := 0; i+8 <= len(data); i += 8 {
+		s0 += order.Uint32(data[i:]) + s1
+		s1 += order.Uint32(data[i+4:]) + s0
+	}
+	return s0, s1
+}
+
+// walPosition is the end of the last frame shipped from a WAL, with the checksums the next frame continues.
+type walPosition struct {
+	header   walHeader
+	offset   int64
+	checksum [2]uint32
+}
+
+func walStart(header walHeader) walPosition {
+	return walPosition{header: header, offset: walHeaderSize, checksum: header.checksum}
+}
+
+// committedFrames reads the frames of whole transactions following a position in a WAL, returning them with
+// the position after the last commit. It stops at the first frame which isn't part of the WAL, such as a frame
+// left over from before the WAL was last reset.
+func committedFrames(f io.ReaderAt, pos walPosition) ([]byte, walPosition, error) {
+	frameSize := walFrameHeaderSize + pos.header.pageSize
+	var frames []byte
+	committed, next := pos, pos
+	frame := make([]byte, frameSize)
+	for {
+		if n, err := f.ReadAt(frame, next.offset); n < frameSize {
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, pos, err
+			}
+			break
+		}
+		if binary.BigEndian.Uint32(frame[8:]) != pos.header.salt[0] || binary.BigEndian.Uint32(frame[12:]) != pos.header.salt[1] {
+			break
+		}
+		s0, s1 := walChecksum(pos.header.bigEndian, frame[:8], next.checksum[0], next.checksum[1])
+		s0, s1 = walChecksum(pos.header.bigEndian, frame[walFrameHeaderSize:], s0, s1)
+		if s0 != binary.BigEndian.Uint32(frame[16:]) || s1 != binary.BigEndian.Uint32(frame[20:]) {
+			break
+		}
+		frames = append(frames, frame...)
+		next.offset += int64(frameSize)
+		next.checksum = [2]uint32{s0, s1}
+		// Commit frames record the database size in pages
+		if binary.BigEndian.Uint32(frame[4:]) != 0 {
+			committed = next
+		}
+	}
+	return frames[:committed.offset-pos.offset], committed, nil
+}
+
+// replicator ships a database's WAL to object storage.
+//
+// SQLite only resets the WAL once every frame is checkpointed and no reader is using it, so the replicator
+// always holds a read transaction, which keeps frames it hasn't shipped from being overwritten. Each cycle it
+// blocks writers briefly, reads the frames committed since the last cycle, checkpoints them and renews the
+// read transaction before letting writers continue, so a WAL only changes under it after it's fully shipped.
+type replicator struct {
+	config     ReplicationConfig
+	dbPath     string
+	store      *objectStore
+	db         *sqlx.DB
+	reader     *sql.Conn
+	generation string
+	started    time.Time
+	segment    int
+	// nil ships the whole current WAL next, as at the start of a generation
+	pos *walPosition
+	// unlock releases the lock keeping a second replicator off the database
+	unlock func()
+	// Replication runs alongside polls, so it logs with its own context
+	logger *slog.Logger
+}
+
+func newReplicator(config ReplicationConfig, dbPath string) (*replicator, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, err
+	}
+	store, err := newObjectStore(config.Storage)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := acquireLock(dbPath+".replicate.lock", "replicate")
+	if err != nil {
+		return nil, err
+	}
+	if err := recoverReplication(dbPath); err != nil {
+		unlock()
+		return nil, err
+	}
+	db, err := sqlx.Open("sqlite3", dbPath)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	logger := slog.Default().With("command", "replicate", "db", dbPath)
+	return &replicator{config: config, dbPath: dbPath, store: store, db: db, unlock: unlock, logger: logger}, nil
+}
+
+// hold starts the read transaction keeping the WAL from being reset, if it isn't held already.
+func (r *replicator) hold(ctx context.Context) error {
+	if r.reader != nil {
+		return nil
+	}
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	var tables int
+	// Transactions only start reading at their first statement
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master").Scan(&tables); err != nil {
+		conn.ExecContext(ctx, "ROLLBACK")
+		conn.Close()
+		return err
+	}
+	r.reader = conn
+	return nil
+}
+
+func (r *replicator) release() error {
+	if r.reader == nil {
+		return nil
+	}
+	_, err := r.reader.ExecContext(context.Background(), "COMMIT")
+	r.reader.Close()
+	r.reader = nil
+	return err
+}
+
+func (r *replicator) close() error {
+	defer r.unlock()
+	r.release()
+	return r.db.Close()
+}
+
+// snapshot starts a new generation with a copy of the database. The read transaction is held first, so every
+// commit the copy misses is still in the WAL, which the generation ships from its start. Replaying frames the
+// copy already has only rewrites pages with what the copy has or what later frames replace.
+func (r *replicator) snapshot(ctx context.Context) error {
+	if err := r.hold(ctx); err != nil {
+		return err
+	}
+	generation := time.Now().UTC().Format(generationLayout)
+	stagingPath := r.dbPath + ".snapshot"
+	if err := backupDatabase(r.dbPath, stagingPath); err != nil {
+		return err
+	}
+	defer os.Remove(stagingPath)
+	compressedPath := stagingPath + ".gz"
+	size, err := gzipFile(stagingPath, compressedPath)
+	defer os.Remove(compressedPath)
+	if err != nil {
+		return err
+	}
+	if err := r.store.putFile(ctx, generationsDir+generation+"/"+snapshotName, compressedPath); err != nil {
+		return err
+	}
+	r.generation, r.started, r.segment, r.pos = generation, time.Now(), 0, nil
+	r.logger.Info("Started replica generation", "generation", generation, "snapshot_bytes", size)
+	return r.pruneGenerations(ctx)
+}
+
+// pruneGenerations deletes all but the latest RetainGenerations generations.
+func (r *replicator) pruneGenerations(ctx context.Context) error {
+	retain := r.config.RetainGenerations
+	if retain <= 0 {
+		retain = defaultRetainGenerations
+	}
+	keys, err := r.store.list(ctx, generationsDir)
+	if err != nil {
+		return err
+	}
+	generations := replicaGenerations(keys)
+	if len(generations) <= retain {
+		return nil
+	}
+	expired := make(map[string]bool)
+	for _, generation := range generations[:len(generations)-retain] {
+		expired[generation] = true
+	}
+	for _, key := range keys {
+		if generation, _, _ := strings.Cut(strings.TrimPrefix(key, generationsDir), "/"); expired[generation] {
+			if err := r.store.remove(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+	r.logger.Info("Deleted old replica generations", "generations", len(expired))
+	return nil
+}
+
+// replicaGenerations lists the generations with a snapshot among keys, oldest first.
+func replicaGenerations(keys []string) []string {
+	var generations []string
+	for _, key := range keys {
+		generation, name, _ := strings.Cut(strings.TrimPrefix(key, generationsDir), "/")
+		if name == snapshotName {
+			generations = append(generations, generation)
+		}
+	}
+	sort.Strings(generations)
+	return generations
+}
+
+// readWAL reads the frames committed since the last cycle, as a segment starting with the WAL header.
+func (r *replicator) readWAL() ([]byte, error) {
+	f, err := os.Open(r.dbPath + "-wal")
+	if errors.Is(err, os.ErrNotExist) && r.pos == nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, walHeaderSize)
+	if n, _ := f.ReadAt(buf, 0); n < walHeaderSize {
+		if r.pos != nil {
+			return nil, errors.New("the WAL was truncated before it was shipped")
+		}
+		return nil, nil
+	}
+	header, err := parseWALHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	var pos walPosition
+	switch {
+	case r.pos == nil:
+		pos = walStart(header)
+	case header.salt == r.pos.header.salt:
+		pos = *r.pos
+	case header.checkpointSeq == r.pos.header.checkpointSeq+1:
+		// The WAL can only have been reset once it was fully shipped
+		pos = walStart(header)
+	default:
+		return nil, fmt.Errorf("the WAL was reset %d times since it was last shipped", header.checkpointSeq-r.pos.header.checkpointSeq)
+	}
+	frames, next, err := committedFrames(f, pos)
+	if err != nil {
+		return nil, err
+	}
+	r.pos = &next
+	if len(frames) == 0 {
+		return nil, nil
+	}
+	return append(header.raw, frames...), nil
+}
+
+// ship reads the frames committed since the last cycle with writes blocked, so the WAL ends on a commit,
+// then checkpoints them and renews the read transaction before writes resume.
+func (r *replicator) ship(ctx context.Context) ([]byte, error) {
+	writer, err := r.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer writer.Close()
+	if _, err := writer.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return nil, err
+	}
+	defer writer.ExecContext(context.Background(), "ROLLBACK")
+
+	segment, err := r.readWAL()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.release(); err != nil {
+		return nil, err
+	}
+	// With no reader in the way, the checkpoint can copy every frame into the database, after which the next
+	// write resets the WAL
+	if _, err := r.db.ExecContext(ctx, "PRAGMA wal_checkpoint(PASSIVE)"); err != nil {
+		return nil, err
+	}
+	return segment, r.hold(ctx)
+}
+
+// cycle ships the WAL, starting a new generation first if it's due or the last one can't be continued.
+func (r *replicator) cycle(ctx context.Context) error {
+	snapshotInterval := time.Duration(r.config.SnapshotHours) * time.Hour
+	if snapshotInterval == 0 {
+		snapshotInterval = defaultSnapshotInterval
+	}
+	if r.generation == "" || time.Since(r.started) >= snapshotInterval {
+		if err := r.snapshot(ctx); err != nil {
+			return err
+		}
+	}
+	segment, err := r.ship(ctx)
+	if err == nil && segment != nil {
+		compressed, err2 := gzipBytes(segment)
+		if err = err2; err == nil {
+			err = r.store.put(ctx, fmt.Sprintf("%s%s/wal/%08d.wal.gz", generationsDir, r.generation, r.segment), compressed)
+		}
+		r.segment++
+	}
+	if err != nil {
+		// Frames which weren't shipped may be overwritten by now, so only a new snapshot is sure to have them
+		r.generation = ""
+		return fmt.Errorf("replicating %s: %w", r.dbPath, err)
+	}
+	return nil
+}
+
+// run replicates until the context is cancelled, shipping the WAL one last time before returning.
+func (r *replicator) run(ctx context.Context) {
+	defer r.close()
+	interval := time.Duration(r.config.IntervalSeconds) * time.Second
+	if interval == 0 {
+		interval = defaultReplicationInterval
+	}
+	r.logger.Info("Replicating", "to", filepath.Join(r.config.Storage.Bucket, r.config.Storage.Prefix), "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		stopping := false
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			stopping = true
+		}
+		// The last cycle runs after cancellation, so it isn't cancelled itself
+		if err := r.cycle(context.WithoutCancel(ctx)); err != nil {
+			r.logger.Error("Replication failed", "err", err)
+		}
+		if stopping {
+			return
+		}
+	}
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// gzipFile compresses a file into another, returning its compressed size.
+func gzipFile(srcPath, destPath string) (int64, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dest, err := os.Create(destPath)
+	if err != nil {
+		return 0, err
+	}
+	defer dest.Close()
+	w := gzip.NewWriter(dest)
+	if _, err := io.Copy(w, src); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	if err := dest.Sync(); err != nil {
+		return 0, err
+	}
+	return dest.Seek(0, io.SeekCurrent)
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// replicate runs replication in the foreground until interrupted, for setups without the daemon.
+func replicate(config Config, args []string) error {
+	flags := flag.NewFlagSet("db replicate", flag.ExitOnError)
+	dbPath := flags.String("db", filepath.Join(config.DataDir, "realtime.db"), "database to replicate")
+	flags.Parse(args)
+	if !config.Replication.enabled() {
+		return errors.New("replication needs Replication.Storage.Bucket in the config")
+	}
+	r, err := newReplicator(config.Replication, *dbPath)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(runContext, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	r.run(ctx)
+	return nil
+}
+
+// applyWALSegment writes the pages of a shipped WAL segment into a database file, as a checkpoint would.
+func applyWALSegment(f *os.File, segment []byte) error {
+	header, err := parseWALHeader(segment)
+	if err != nil {
+		return err
+	}
+	frameSize := walFrameHeaderSize + header.pageSize
+	for offset := walHeaderSize; offset+frameSize <= len(segment); offset += frameSize {
+		frame := segment[offset : offset+frameSize]
+		page := int64(binary.BigEndian.Uint32(frame))
+		if _, err := f.WriteAt(frame[walFrameHeaderSize:], (page-1)*int64(header.pageSize)); err != nil {
+			return err
+		}
+		if pages := int64(binary.BigEndian.Uint32(frame[4:])); pages != 0 {
+			if err := f.Truncate(pages * int64(header.pageSize)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restoreFromReplica rebuilds a database from a replica generation, the latest if generation is empty,
+// by replaying its WAL segments over its snapshot.
+func restoreFromReplica(config ReplicationConfig, dbPath string, generation string) error {
+	if !config.enabled() {
+		return errors.New("restoring from a replica needs Replication.Storage.Bucket in the config")
+	}
+	store, err := newObjectStore(config.Storage)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	keys, err := store.list(ctx, generationsDir)
+	if err != nil {
+		return err
+	}
+	generations := replicaGenerations(keys)
+	if generation == "" {
+		if len(generations) == 0 {
+			return errors.New("the replica has no generations")
+		}
+		generation = generations[len(generations)-1]
+	} else if !contains(generations, generation) {
+		return fmt.Errorf("the replica has no generation %s", generation)
+	}
+
+	compressed, err := store.get(ctx, generationsDir+generation+"/"+snapshotName)
+	if err != nil {
+		return err
+	}
+	snapshot, err := gunzipBytes(compressed)
+	if err != nil {
+		return err
+	}
+	stagingPath := dbPath + ".tmp"
+	if err := removeDatabase(stagingPath); err != nil {
+		return err
+	}
+	f, err := os.Create(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(stagingPath)
+	defer f.Close()
+	if _, err := f.Write(snapshot); err != nil {
+		return err
+	}
+
+	// Segments are numbered in order, and one missing means later ones can't be applied
+	segmentPrefix := generationsDir + generation + "/wal/"
+	var segments []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, segmentPrefix) {
+			segments = append(segments, key)
+		}
+	}
+	sort.Strings(segments)
+	applied := 0
+	for i, key := range segments {
+		if n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(key, segmentPrefix), ".wal.gz")); err != nil || n != i {
+			slog.Warn("Segment is missing, so later ones aren't applied", "segment", i, "generation", generation)
+			break
+		}
+		compressed, err := store.get(ctx, key)
+		if err != nil {
+			return err
+		}
+		segment, err := gunzipBytes(compressed)
+		if err != nil {
+			return err
+		}
+		if err := applyWALSegment(f, segment); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		applied++
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := removeDatabase(dbPath); err != nil {
+		return err
+	}
+	slog.Info("Restored a replica", "generation", generation, "segments", applied)
+	return os.Rename(stagingPath, dbPath)
+}
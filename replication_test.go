@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// fakeBucket serves the requests objectStore makes of one bucket from memory.
+// While failing is set, writes fail as an unavailable store would.
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	failing bool
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+	switch {
+	case r.Method == http.MethodPut:
+		if b.failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.objects[key] = body
+	case r.Method == http.MethodGet && key == "":
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []struct{ Key string }
+		}
+		var keys []string
+		for k := range b.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			result.Contents = append(result.Contents, struct{ Key string }{k})
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodGet:
+		body, found := b.objects[key]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(body)
+	case r.Method == http.MethodDelete:
+		delete(b.objects, key)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (b *fakeBucket) generations() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make([]string, 0, len(b.objects))
+	for k := range b.objects {
+		keys = append(keys, k)
+	}
+	return replicaGenerations(keys)
+}
+
+func (b *fakeBucket) setFailing(failing bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failing = failing
+}
+
+// replicationFixture is a database being replicated to a fake bucket.
+type replicationFixture struct {
+	config     ReplicationConfig
+	bucket     *fakeBucket
+	db         *sqlx.DB
+	dbPath     string
+	replicator *replicator
+	positions  uint64
+}
+
+func newReplicationFixture(t *testing.T) *replicationFixture {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	bucket := &fakeBucket{objects: make(map[string][]byte)}
+	server := httptest.NewServer(bucket)
+	t.Cleanup(server.Close)
+	f := &replicationFixture{
+		config: ReplicationConfig{Storage: S3Config{Endpoint: server.URL, Bucket: "bucket"}},
+		bucket: bucket,
+		dbPath: filepath.Join(t.TempDir(), "realtime.db"),
+	}
+	var err error
+	if f.db, err = createDatabase(f.dbPath, "test"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.db.Close() })
+	if f.replicator, err = newReplicator(f.config, f.dbPath); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.replicator.close() })
+	return f
+}
+
+// write adds a position in a transaction of its own.
+func (f *replicationFixture) write(t *testing.T) {
+	t.Helper()
+	timestamp := 1709280000 + 30*f.positions
+	f.positions++
+	if _, err := addVehiclePositions(positionsFeed(timestamp, "trip-1", "bus-1"), f.db, "test", nil, time.UTC, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *replicationFixture) cycle(t *testing.T) {
+	t.Helper()
+	if err := f.replicator.cycle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkRestore restores the latest generation and compares its positions with the database's.
+func (f *replicationFixture) checkRestore(t *testing.T) {
+	t.Helper()
+	restoredPath := filepath.Join(t.TempDir(), "restored.db")
+	if err := restoreFromReplica(f.config, restoredPath, ""); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := sqlx.Open("sqlite3", restoredPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	query := "SELECT CAST(timestamp AS TEXT) FROM vehicle_positions ORDER BY timestamp"
+	var want, got []string
+	if err := f.db.Select(&want, query); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Select(&got, query); err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != int(f.positions) {
+		t.Fatalf("the database has %d positions, want %d", len(want), f.positions)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("restored positions at %v, want %v", got, want)
+	}
+}
+
+func walCheckpointSeq(t *testing.T, dbPath string) uint32 {
+	t.Helper()
+	f, err := os.Open(dbPath + "-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	header := make([]byte, walHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+	return binary.BigEndian.Uint32(header[12:])
+}
+
+func TestReplicationRoundTrip(t *testing.T) {
+	f := newReplicationFixture(t)
+	f.write(t)
+	f.cycle(t)
+	f.write(t)
+	f.cycle(t)
+	if generations := f.bucket.generations(); len(generations) != 1 {
+		t.Fatalf("replicated generations %v, want one", generations)
+	}
+	f.checkRestore(t)
+}
+
+func TestReplicationAfterWALReset(t *testing.T) {
+	f := newReplicationFixture(t)
+	f.write(t)
+	f.cycle(t)
+	shipped := f.replicator.pos.header.checkpointSeq
+	// The cycle checkpointed every frame, so the next write starts the WAL over
+	f.write(t)
+	if seq := walCheckpointSeq(t, f.dbPath); seq != shipped+1 {
+		t.Fatalf("WAL checkpoint sequence %d after a write, want %d", seq, shipped+1)
+	}
+	f.cycle(t)
+	if f.replicator.pos.header.checkpointSeq != shipped+1 {
+		t.Errorf("shipped up to checkpoint sequence %d, want %d", f.replicator.pos.header.checkpointSeq, shipped+1)
+	}
+	if generations := f.bucket.generations(); len(generations) != 1 {
+		t.Fatalf("replicated generations %v, want the reset WAL in the same one", generations)
+	}
+	f.checkRestore(t)
+}
+
+func TestReplicationFailureStartsGeneration(t *testing.T) {
+	f := newReplicationFixture(t)
+	f.write(t)
+	f.cycle(t)
+	first := f.replicator.generation
+
+	f.write(t)
+	f.bucket.setFailing(true)
+	if err := f.replicator.cycle(context.Background()); err == nil {
+		t.Fatal("shipped to a failing store")
+	}
+	if f.replicator.generation != "" {
+		t.Fatalf("continued generation %s after a failed shipment", f.replicator.generation)
+	}
+	f.bucket.setFailing(false)
+	f.write(t)
+	f.cycle(t)
+	if f.replicator.generation == first {
+		t.Fatal("didn't start a new generation after a failed shipment")
+	}
+	if generations := f.bucket.generations(); !slices.Equal(generations, []string{first, f.replicator.generation}) {
+		t.Errorf("replicated generations %v, want %s and %s", generations, first, f.replicator.generation)
+	}
+	f.checkRestore(t)
+}
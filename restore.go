@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// removeDatabase deletes a database file along with its WAL and shared memory files,
+// which would otherwise be applied to whatever replaces it.
+func removeDatabase(dbPath string) error {
+	for _, path := range []string{dbPath, dbPath + "-wal", dbPath + "-shm"} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// importArchivedMonth inserts every archived row for a month into the database.
+// A month can take longer than dbTimeout to insert, so it isn't bounded by it.
+func importArchivedMonth(db *sqlx.DB, dir string, schema *archiveSchema) (int64, error) {
+	rows, err := readArchivedMonth(dir, schema)
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareNamedContext(ctx, insertQuery())
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var inserted int64
+	var vp VehiclePosition
+	for _, row := range rows {
+		if err := schema.position(row, &vp); err != nil {
+			return 0, err
+		}
+		result, err := stmt.ExecContext(ctx, &vp)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		inserted += n
+	}
+	return inserted, tx.Commit()
+}
+
+// restoreFromArchive builds a database from the Parquet archive, starting from the given month.
+func restoreFromArchive(dbPath string, archiveDir string, since time.Time, config ArchiveConfig, feedId string) error {
+	schema, err := newArchiveSchema(config, feedId)
+	if err != nil {
+		return err
+	}
+	months, err := archivedMonths(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	stagingPath := dbPath + ".tmp"
+	if err := removeDatabase(stagingPath); err != nil {
+		return err
+	}
+	db, err := createDatabase(stagingPath, feedId)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, period := range months {
+		if period.Before(since) {
+			continue
+		}
+		n, err := importArchivedMonth(db, monthDir(archiveDir, period), schema)
+		if err != nil {
+			db.Close()
+			removeDatabase(stagingPath)
+			return fmt.Errorf("%s: %w", period.Format(yearMonthLayout), err)
+		}
+		config.log().Debug("Imported a month", "month", period.Format(yearMonthLayout), "rows", n)
+		total += n
+	}
+	// Checkpoint the WAL into the main file so only that needs to be moved into place
+	if _, err := db.ExecContext(context.Background(), "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		db.Close()
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	if err := removeDatabase(dbPath); err != nil {
+		return err
+	}
+	config.log().Info("Restored rows", "rows", total, "archive", archiveDir)
+	return os.Rename(stagingPath, dbPath)
+}
+
+// restoreDatabase rebuilds the realtime database from a backup made with `db backup`, from the replica with
+// --from-replica, or from the Parquet archive otherwise.
+// The scraper must not be running during a restore.
+func restoreDatabase(config Config, args []string) error {
+	flags := flag.NewFlagSet("db restore", flag.ExitOnError)
+	archiveDir := flags.String("archive", feedArchiveDir(config), "archive directory to import when no backup is given")
+	since := flags.String("since", "", "first archived month to import, as YYYY-MM (default: all months)")
+	force := flags.Bool("force", false, "replace an existing database")
+	fromReplica := flags.Bool("from-replica", false, "restore from the replica in Replication.Storage")
+	generation := flags.String("generation", "", "replica generation to restore with --from-replica (default: the latest)")
+	flags.Parse(args)
+
+	dbPath := filepath.Join(config.DataDir, "realtime.db")
+	if _, err := os.Stat(dbPath); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use --force to replace it", dbPath)
+	}
+
+	if *fromReplica {
+		return restoreFromReplica(config.Replication, dbPath, *generation)
+	}
+	if backupPath := flags.Arg(0); backupPath != "" {
+		if _, err := os.Stat(backupPath); err != nil {
+			return err
+		}
+		if err := removeDatabase(dbPath); err != nil {
+			return err
+		}
+		return backupDatabase(backupPath, dbPath)
+	}
+
+	var sinceMonth time.Time
+	if *since != "" {
+		var err error
+		sinceMonth, err = time.Parse(yearMonthLayout, *since)
+		if err != nil {
+			return fmt.Errorf("invalid --since: %w", err)
+		}
+	}
+	return restoreFromArchive(dbPath, *archiveDir, sinceMonth, config.Archive, config.FeedId)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Units and formats of columns whose type alone doesn't say, by column name
+var columnUnits = map[string]string{
+	"latitude":             "degrees north (WGS 84)",
+	"longitude":            "degrees east (WGS 84)",
+	"bearing":              "degrees clockwise from true north",
+	"odometer":             "meters",
+	"speed":                "meters per second",
+	"occupancy_percentage": "percent of nominal capacity",
+	"latency_ms":           "milliseconds",
+	"header_age_seconds":   "seconds",
+	"start_date":           "GTFS date (YYYYMMDD)",
+	"active_periods":       "JSON",
+	"informed_entities":    "JSON",
+}
+
+// Stored DATETIME values are Unix times, as the driver would otherwise store text
+const datetimeUnit = "seconds since the Unix epoch"
+
+// columnEnum returns the names of a column's enum values, or nil if it isn't an enum.
+func columnEnum(name string) map[int32]string {
+	if names := positionEnumNames[name]; names != nil {
+		return names
+	}
+	return otherEnumNames[name]
+}
+
+// dataDictionary describes the realtime database and the archive's Parquet columns.
+type dataDictionary struct {
+	Database []tableDescription `json:"database"`
+	Archive  archiveDescription `json:"archive"`
+}
+
+type tableDescription struct {
+	Name       string              `json:"name"`
+	PrimaryKey []string            `json:"primary_key"`
+	Columns    []columnDescription `json:"columns"`
+}
+
+type archiveDescription struct {
+	Format   string              `json:"format"`
+	FileName string              `json:"file_name"`
+	Columns  []columnDescription `json:"columns"`
+}
+
+type columnDescription struct {
+	Name string `json:"name"`
+	// Source is the column the archive column is derived from, if it was renamed
+	Source      string           `json:"source,omitempty"`
+	Type        string           `json:"type"`
+	LogicalType string           `json:"logical_type,omitempty"`
+	Required    bool             `json:"required"`
+	Unit        string           `json:"unit,omitempty"`
+	Enum        map[int32]string `json:"enum,omitempty"`
+}
+
+// describeDatabase creates the realtime database tables in memory and reads back their definitions,
+// so the description always matches the tables the scraper creates.
+func describeDatabase() ([]tableDescription, error) {
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	// Every connection has its own in-memory database
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	for _, query := range createTableQueries {
+		if _, err := db.ExecContext(ctx, query()); err != nil {
+			return nil, err
+		}
+	}
+
+	var tables []string
+	if err := db.SelectContext(ctx, &tables, "SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY rowid"); err != nil {
+		return nil, err
+	}
+	var descriptions []tableDescription
+	for _, table := range tables {
+		var info []struct {
+			Name    string `db:"name"`
+			Type    string `db:"type"`
+			NotNull bool   `db:"notnull"`
+			PK      int    `db:"pk"`
+		}
+		if err := db.SelectContext(ctx, &info, "SELECT name, type, \"notnull\", pk FROM pragma_table_info(?) ORDER BY cid", table); err != nil {
+			return nil, err
+		}
+		description := tableDescription{Name: table}
+		keyColumns := make(map[int]string)
+		for _, column := range info {
+			unit := columnUnits[column.Name]
+			if column.Type == "DATETIME" {
+				unit = datetimeUnit
+			}
+			description.Columns = append(description.Columns, columnDescription{
+				Name:     column.Name,
+				Type:     column.Type,
+				Required: column.NotNull || column.PK > 0,
+				Unit:     unit,
+				Enum:     columnEnum(column.Name),
+			})
+			if column.PK > 0 {
+				keyColumns[column.PK] = column.Name
+			}
+		}
+		for i := 1; i <= len(keyColumns); i++ {
+			description.PrimaryKey = append(description.PrimaryKey, keyColumns[i])
+		}
+		descriptions = append(descriptions, description)
+	}
+	return descriptions, nil
+}
+
+// describeArchive lists the Parquet columns written with the archive config.
+func describeArchive(config Config) (archiveDescription, error) {
+	schema, err := newArchiveSchema(config.Archive, config.FeedId)
+	if err != nil {
+		return archiveDescription{}, err
+	}
+	format := config.Archive.Format
+	if format == "" {
+		format = "parquet"
+	}
+	fileName, err := archiveFileName(config.Archive.Format)
+	if err != nil {
+		return archiveDescription{}, err
+	}
+	description := archiveDescription{Format: format, FileName: fileName}
+	sourceNames := schema.sourceNames()
+	for i, field := range schema.schema.Fields() {
+		column := columnDescription{
+			Name:     field.Name(),
+			Type:     field.Type().Kind().String(),
+			Required: field.Required(),
+			Unit:     columnUnits[sourceNames[i]],
+			Enum:     columnEnum(sourceNames[i]),
+		}
+		if sourceNames[i] != field.Name() {
+			column.Source = sourceNames[i]
+		}
+		if lt := field.Type().LogicalType(); lt != nil {
+			column.LogicalType = lt.String()
+		}
+		description.Columns = append(description.Columns, column)
+	}
+	return description, nil
+}
+
+// Frictionless Data Package (https://specs.frictionlessdata.io/) of the database tables and archive files
+type dataPackage struct {
+	Profile     string `json:"profile"`
+	Name        string `json:"name,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	// FeedId and Temporal are extensions for the archive catalog, Temporal being the time covered by every resource
+	FeedId    string                `json:"feed_id,omitempty"`
+	Created   string                `json:"created,omitempty"`
+	Licenses  []dataPackageLicense  `json:"licenses,omitempty"`
+	Sources   []dataPackageSource   `json:"sources,omitempty"`
+	Temporal  *timestampRange       `json:"temporal,omitempty"`
+	Resources []dataPackageResource `json:"resources"`
+}
+
+type dataPackageResource struct {
+	Name        string          `json:"name"`
+	Path        string          `json:"path"`
+	Format      string          `json:"format"`
+	Mediatype   string          `json:"mediatype,omitempty"`
+	Compression string          `json:"compression,omitempty"`
+	Dialect     json.RawMessage `json:"dialect,omitempty"`
+	Bytes       int64           `json:"bytes,omitempty"`
+	Hash        string          `json:"hash,omitempty"`
+	// Rows and Temporal are extensions for the archive catalog
+	Rows     *int64          `json:"rows,omitempty"`
+	Temporal *timestampRange `json:"temporal,omitempty"`
+	Schema   tableSchema     `json:"schema"`
+}
+
+type dataPackageLicense struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type dataPackageSource struct {
+	Title string `json:"title"`
+	Path  string `json:"path"`
+}
+
+type tableSchema struct {
+	Fields     []tableSchemaField `json:"fields"`
+	PrimaryKey []string           `json:"primaryKey,omitempty"`
+}
+
+type tableSchemaField struct {
+	Name        string                `json:"name"`
+	Type        string                `json:"type"`
+	Description string                `json:"description,omitempty"`
+	Constraints *tableSchemaRequired  `json:"constraints,omitempty"`
+	Categories  []tableSchemaCategory `json:"categories,omitempty"`
+}
+
+type tableSchemaRequired struct {
+	Required bool `json:"required"`
+}
+
+type tableSchemaCategory struct {
+	Value int32  `json:"value"`
+	Label string `json:"label"`
+}
+
+// frictionlessType maps a SQLite declared type or Parquet type to a Table Schema field type.
+func frictionlessType(column columnDescription) string {
+	switch {
+	case strings.HasPrefix(column.LogicalType, "TIMESTAMP"), column.Type == "INT96":
+		return "datetime"
+	case strings.HasPrefix(column.Type, "INT"), column.Type == "DATETIME":
+		return "integer"
+	case column.Type == "REAL", column.Type == "FLOAT", column.Type == "DOUBLE":
+		return "number"
+	case column.Type == "BOOLEAN":
+		return "boolean"
+	case column.LogicalType == "LIST":
+		return "array"
+	case column.Type == "GROUP":
+		return "object"
+	}
+	return "string"
+}
+
+func frictionlessSchema(columns []columnDescription, primaryKey []string) tableSchema {
+	schema := tableSchema{PrimaryKey: primaryKey}
+	for _, column := range columns {
+		field := tableSchemaField{Name: column.Name, Type: frictionlessType(column)}
+		if column.Unit != "" {
+			field.Description = "Unit: " + column.Unit
+		}
+		if column.Required {
+			field.Constraints = &tableSchemaRequired{Required: true}
+		}
+		for code, name := range column.Enum {
+			field.Categories = append(field.Categories, tableSchemaCategory{Value: code, Label: name})
+		}
+		sort.Slice(field.Categories, func(i, j int) bool { return field.Categories[i].Value < field.Categories[j].Value })
+		schema.Fields = append(schema.Fields, field)
+	}
+	return schema
+}
+
+func (d dataDictionary) dataPackage() dataPackage {
+	p := dataPackage{Profile: "tabular-data-package"}
+	for _, table := range d.Database {
+		dialect, _ := json.Marshal(map[string]any{"sql": map[string]string{"table": table.Name}})
+		p.Resources = append(p.Resources, dataPackageResource{
+			Name:    table.Name,
+			Path:    "sqlite:///realtime.db",
+			Format:  "sqlite",
+			Dialect: dialect,
+			Schema:  frictionlessSchema(table.Columns, table.PrimaryKey),
+		})
+	}
+	p.Resources = append(p.Resources, dataPackageResource{
+		Name:   "archive",
+		Path:   filepath.ToSlash(filepath.Join("archive", "year=*", "month=*", d.Archive.FileName)),
+		Format: d.Archive.Format,
+		Schema: frictionlessSchema(d.Archive.Columns, nil),
+	})
+	return p
+}
+
+// exportSchema writes a data dictionary of the database tables and archive columns, including enum values.
+func exportSchema(config Config, args []string) error {
+	flags := flag.NewFlagSet("schema export", flag.ExitOnError)
+	format := flags.String("format", "json", "json, or frictionless for a Frictionless Data Package")
+	output := flags.String("output", "", "output file (default: schema.json or datapackage.json in the data directory)")
+	flags.Parse(args)
+
+	tables, err := describeDatabase()
+	if err != nil {
+		return err
+	}
+	archive, err := describeArchive(config)
+	if err != nil {
+		return err
+	}
+	dictionary := dataDictionary{Database: tables, Archive: archive}
+
+	var document any
+	defaultOutput := "schema.json"
+	switch *format {
+	case "json":
+		document = dictionary
+	case "frictionless":
+		document = dictionary.dataPackage()
+		defaultOutput = "datapackage.json"
+	default:
+		return fmt.Errorf("unsupported schema format: %s", *format)
+	}
+	if *output == "" {
+		*output = filepath.Join(config.DataDir, defaultOutput)
+	}
+	contents, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(*output, append(contents, '\n')); err != nil {
+		return err
+	}
+	config.log().Info("Exported the schema", "tables", len(tables), "output", *output)
+	return nil
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"google.golang.org/grpc"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+	// Window of the latest vehicle positions when from isn't given
+	defaultLatestWindow = time.Hour
+)
+
+// listParams are the query parameters shared by every list endpoint. Endpoints reject the ones they don't support.
+//
+//   - feed_id: exact feed ID, for databases shared by several feeds
+//   - route, vehicle: exact route and vehicle IDs
+//   - bbox: minLon,minLat,maxLon,maxLat in WGS 84
+//   - from, to: half-open time range, as RFC 3339 or Unix seconds
+//   - limit: page size, up to 1000 (default 100)
+//   - cursor: next_cursor of the previous page
+type listParams struct {
+	feed    string
+	route   string
+	vehicle string
+	bbox    *[4]float64
+	from    *time.Time
+	to      *time.Time
+	limit   int
+	cursor  *pageCursor
+	// Bounds on the row IDs, for streaming rows as they're stored. Zero is unbounded.
+	afterRowId int64
+	maxRowId   int64
+}
+
+// pageCursor is the sort key of the last row of a page, which the next page continues after.
+// It's opaque to clients.
+type pageCursor struct {
+	Timestamp int64  `json:"t,omitempty"`
+	RowId     int64  `json:"r,omitempty"`
+	VehicleId string `json:"v,omitempty"`
+}
+
+func (c pageCursor) encode() string {
+	contents, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(contents)
+}
+
+func decodeCursor(value string) (*pageCursor, error) {
+	contents, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var c pageCursor
+	if err := json.Unmarshal(contents, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// apiError is returned for invalid requests.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string { return e.message }
+
+func badRequest(format string, args ...any) error {
+	return &apiError{status: http.StatusBadRequest, message: fmt.Sprintf(format, args...)}
+}
+
+// parseAPITime parses an RFC 3339 time or Unix seconds.
+func parseAPITime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseListParams reads the list parameters, allowing only the given filters besides limit and cursor.
+func parseListParams(r *http.Request, filters ...string) (listParams, error) {
+	query := r.URL.Query()
+	params := listParams{limit: defaultPageLimit}
+	for name := range query {
+		if name != "limit" && name != "cursor" && !contains(filters, name) {
+			return params, badRequest("parameter %s isn't supported by %s", name, r.URL.Path)
+		}
+	}
+	params.feed, params.route, params.vehicle = query.Get("feed_id"), query.Get("route"), query.Get("vehicle")
+	if value := query.Get("bbox"); value != "" {
+		var values []float64
+		for _, part := range strings.Split(value, ",") {
+			v, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				return params, badRequest("invalid bbox: %v", err)
+			}
+			values = append(values, v)
+		}
+		bbox, err := newBBox(values)
+		if err != nil {
+			return params, err
+		}
+		params.bbox = bbox
+	}
+	for name, t := range map[string]**time.Time{"from": &params.from, "to": &params.to} {
+		if value := query.Get(name); value != "" {
+			parsed, err := parseAPITime(value)
+			if err != nil {
+				return params, badRequest("invalid %s: %v", name, err)
+			}
+			*t = &parsed
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return params, badRequest("invalid limit: %v", err)
+		}
+		if err := checkLimit(limit); err != nil {
+			return params, err
+		}
+		params.limit = limit
+	}
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := decodeCursor(value)
+		if err != nil {
+			return params, badRequest("invalid cursor")
+		}
+		params.cursor = cursor
+	}
+	return params, nil
+}
+
+// newBBox checks a minLon,minLat,maxLon,maxLat bounding box.
+func newBBox(values []float64) (*[4]float64, error) {
+	if len(values) != 4 {
+		return nil, badRequest("bbox must be minLon,minLat,maxLon,maxLat")
+	}
+	bbox := [4]float64(values)
+	if bbox[0] > bbox[2] || bbox[1] > bbox[3] {
+		return nil, badRequest("bbox minimums must not exceed its maximums")
+	}
+	return &bbox, nil
+}
+
+func checkLimit(limit int) error {
+	if limit < 1 || limit > maxPageLimit {
+		return badRequest("limit must be between 1 and %d", maxPageLimit)
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// whereClause builds the conditions of a query from the list parameters.
+type whereClause struct {
+	conditions []string
+	args       []any
+}
+
+func (w *whereClause) add(condition string, args ...any) {
+	w.conditions = append(w.conditions, condition)
+	w.args = append(w.args, args...)
+}
+
+func (w *whereClause) String() string {
+	if len(w.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(w.conditions, " AND ")
+}
+
+// feedFilter adds the feed filter, which applies to every table.
+func (p listParams) feedFilter(w *whereClause) {
+	if p.feed != "" {
+		w.add("feed_id = ?", p.feed)
+	}
+}
+
+// positionFilters adds the feed, route, vehicle and bbox filters, which apply to vehicle positions.
+func (p listParams) positionFilters(w *whereClause) {
+	p.feedFilter(w)
+	if p.route != "" {
+		w.add("route_id = ?", p.route)
+	}
+	if p.vehicle != "" {
+		w.add("vehicle_id = ?", p.vehicle)
+	}
+	if p.bbox != nil {
+		w.add("longitude BETWEEN ? AND ? AND latitude BETWEEN ? AND ?", p.bbox[0], p.bbox[2], p.bbox[1], p.bbox[3])
+	}
+}
+
+// page is the envelope of every list response. Data is never null, and next_cursor is null on the last page.
+type page[T any] struct {
+	Data       []T            `json:"data"`
+	Pagination pageNavigation `json:"pagination"`
+}
+
+type pageNavigation struct {
+	Limit      int     `json:"limit"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+// newPage trims the rows to the limit. If there were more, the last row kept is the next page's cursor.
+func newPage[T any](rows []T, limit int, cursorOf func(T) pageCursor) page[T] {
+	p := page[T]{Data: rows, Pagination: pageNavigation{Limit: limit}}
+	if p.Data == nil {
+		p.Data = []T{}
+	}
+	if len(rows) > limit {
+		p.Data = rows[:limit]
+		next := cursorOf(rows[limit-1]).encode()
+		p.Pagination.NextCursor = &next
+	}
+	return p
+}
+
+// apiPosition is a vehicle position with the row ID used for paging.
+type apiPosition struct {
+	VehiclePosition
+	RowId int64 `db:"row_id" json:"-"`
+}
+
+func scanPositions(rows *sqlx.Rows) ([]apiPosition, error) {
+	defer rows.Close()
+	var positions []apiPosition
+	for rows.Next() {
+		var p apiPosition
+		if err := rows.StructScan(&p); err != nil {
+			return nil, err
+		}
+		p.StartTime = time.Unix(p.StartTimeUnix, 0).UTC()
+		p.Timestamp = time.Unix(p.TimestampUnix, 0).UTC()
+		positions = append(positions, p)
+	}
+	return positions, rows.Err()
+}
+
+type apiServer struct {
+	// Swapped for each rebuild of a replica
+	db     atomic.Pointer[sqlx.DB]
+	config Config
+	// Routes and trips for the GraphQL endpoint, and stops and shapes for the nearby endpoints
+	static *staticGTFS
+	// nil without a static GTFS
+	stopIndex  *spatialIndex
+	shapeIndex *spatialIndex
+}
+
+// queryPositions reads up to limit vehicle positions in order of time.
+func (s *apiServer) queryPositions(ctx context.Context, params listParams, limit int) ([]apiPosition, error) {
+	var w whereClause
+	params.positionFilters(&w)
+	if params.from != nil {
+		w.add("timestamp >= ?", params.from.Unix())
+	}
+	if params.to != nil {
+		w.add("timestamp < ?", params.to.Unix())
+	}
+	if c := params.cursor; c != nil {
+		w.add("(timestamp > ? OR timestamp = ? AND rowid > ?)", c.Timestamp, c.Timestamp, c.RowId)
+	}
+	if params.afterRowId != 0 {
+		w.add("rowid > ?", params.afterRowId)
+	}
+	if params.maxRowId != 0 {
+		w.add("rowid <= ?", params.maxRowId)
+	}
+	query := "SELECT rowid AS row_id, " + selectColumns(columns) + " FROM vehicle_positions" + w.String() +
+		" ORDER BY timestamp, rowid LIMIT ?"
+	rows, err := s.db.Load().QueryxContext(ctx, query, append(w.args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	return scanPositions(rows)
+}
+
+// queryLatestPositions reads the latest position of up to limit vehicles in the time range,
+// which defaults to the last hour, in order of vehicle ID. The bbox filter applies to the latest positions.
+func (s *apiServer) queryLatestPositions(ctx context.Context, params listParams, limit int) ([]apiPosition, error) {
+	from := time.Now().Add(-defaultLatestWindow)
+	if params.from != nil {
+		from = *params.from
+	}
+	var window whereClause
+	window.add("timestamp >= ?", from.Unix())
+	window.add("vehicle_id != ''")
+	if params.to != nil {
+		window.add("timestamp < ?", params.to.Unix())
+	}
+	params.feedFilter(&window)
+	if params.route != "" {
+		window.add("route_id = ?", params.route)
+	}
+	if params.vehicle != "" {
+		window.add("vehicle_id = ?", params.vehicle)
+	}
+	if c := params.cursor; c != nil {
+		window.add("vehicle_id > ?", c.VehicleId)
+	}
+	var latest whereClause
+	latest.add("rowid IN (SELECT row_id FROM (SELECT rowid AS row_id, ROW_NUMBER() OVER "+
+		"(PARTITION BY vehicle_id ORDER BY timestamp DESC, rowid DESC) AS n FROM vehicle_positions"+
+		window.String()+") WHERE n = 1)", window.args...)
+	if params.bbox != nil {
+		latest.add("longitude BETWEEN ? AND ? AND latitude BETWEEN ? AND ?", params.bbox[0], params.bbox[2], params.bbox[1], params.bbox[3])
+	}
+	query := "SELECT rowid AS row_id, " + selectColumns(columns) + " FROM vehicle_positions" + latest.String() +
+		" ORDER BY vehicle_id LIMIT ?"
+	rows, err := s.db.Load().QueryxContext(ctx, query, append(latest.args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	return scanPositions(rows)
+}
+
+// apiAlert is an alert resolved to the configured languages, with the row ID used for paging.
+type apiAlert struct {
+	ResolvedAlert
+	// The stored alert, with the text in every language
+	stored Alert
+	rowId  int64
+}
+
+// queryAlerts reads up to limit alert versions seen during the time range, in order of when they were first seen.
+// The route filter matches alerts informing that route.
+func (s *apiServer) queryAlerts(ctx context.Context, params listParams, limit int) ([]apiAlert, error) {
+	var w whereClause
+	params.feedFilter(&w)
+	if params.route != "" {
+		w.add("EXISTS (SELECT 1 FROM json_each(informed_entities) WHERE json_extract(value, '$.route_id') = ?)", params.route)
+	}
+	if params.from != nil {
+		w.add("last_seen >= ?", params.from.Unix())
+	}
+	if params.to != nil {
+		w.add("first_seen < ?", params.to.Unix())
+	}
+	if c := params.cursor; c != nil {
+		w.add("(first_seen > ? OR first_seen = ? AND rowid > ?)", c.Timestamp, c.Timestamp, c.RowId)
+	}
+	query := "SELECT rowid AS row_id, " + selectColumns(alertColumns) + " FROM alerts" + w.String() +
+		" ORDER BY first_seen, rowid LIMIT ?"
+	rows, err := s.db.Load().QueryxContext(ctx, query, append(w.args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var alerts []apiAlert
+	for rows.Next() {
+		var a struct {
+			Alert
+			RowId int64 `db:"row_id"`
+		}
+		if err := rows.StructScan(&a); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, apiAlert{ResolvedAlert: a.resolve(s.config.Alerts.Languages), stored: a.Alert, rowId: a.RowId})
+	}
+	return alerts, rows.Err()
+}
+
+// apiActiveAlert is a currently active alert, with the active period it's in.
+type apiActiveAlert struct {
+	ResolvedAlert
+	ActiveStart *int64 `json:"active_start"`
+	ActiveEnd   *int64 `json:"active_end"`
+	rowId       int64
+}
+
+// queryActiveAlerts reads up to limit of the currently active alerts, in order of when they were first seen.
+// The route filter matches alerts informing that route.
+func (s *apiServer) queryActiveAlerts(ctx context.Context, params listParams, limit int) ([]apiActiveAlert, error) {
+	var w whereClause
+	params.feedFilter(&w)
+	if params.route != "" {
+		w.add("EXISTS (SELECT 1 FROM json_each(informed_entities) WHERE json_extract(value, '$.route_id') = ?)", params.route)
+	}
+	if c := params.cursor; c != nil {
+		w.add("(first_seen > ? OR first_seen = ? AND alerts.rowid > ?)", c.Timestamp, c.Timestamp, c.RowId)
+	}
+	query := selectActiveAlertsQuery("alerts.rowid AS row_id, CAST(active_start AS INT) AS active_start, CAST(active_end AS INT) AS active_end, ")
+	for _, condition := range w.conditions {
+		query += " AND " + condition
+	}
+	args := append([]any{time.Now().Unix()}, w.args...)
+	rows, err := s.db.Load().QueryxContext(ctx, query+" ORDER BY first_seen, alerts.rowid LIMIT ?", append(args, limit)...)
+	if isMissingTable(err, "active_alerts") {
+		// Created by the first alerts poll since upgrading
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var alerts []apiActiveAlert
+	for rows.Next() {
+		var a struct {
+			Alert
+			RowId       int64  `db:"row_id"`
+			ActiveStart *int64 `db:"active_start"`
+			ActiveEnd   *int64 `db:"active_end"`
+		}
+		if err := rows.StructScan(&a); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, apiActiveAlert{
+			ResolvedAlert: a.resolve(s.config.Alerts.Languages),
+			ActiveStart:   a.ActiveStart,
+			ActiveEnd:     a.ActiveEnd,
+			rowId:         a.RowId,
+		})
+	}
+	return alerts, rows.Err()
+}
+
+// positions lists a page of vehicle positions. Like the other endpoints,
+// it queries one extra row to tell whether there's another page.
+func (s *apiServer) positions(ctx context.Context, r *http.Request) (any, error) {
+	params, err := parseListParams(r, "feed_id", "route", "vehicle", "bbox", "from", "to")
+	if err != nil {
+		return nil, err
+	}
+	positions, err := s.queryPositions(ctx, params, params.limit+1)
+	if err != nil {
+		return nil, err
+	}
+	return newPage(positions, params.limit, func(p apiPosition) pageCursor {
+		return pageCursor{Timestamp: p.TimestampUnix, RowId: p.RowId}
+	}), nil
+}
+
+// vehicles lists a page of the latest position of each vehicle.
+func (s *apiServer) vehicles(ctx context.Context, r *http.Request) (any, error) {
+	params, err := parseListParams(r, "feed_id", "route", "vehicle", "bbox", "from", "to")
+	if err != nil {
+		return nil, err
+	}
+	positions, err := s.queryLatestPositions(ctx, params, params.limit+1)
+	if err != nil {
+		return nil, err
+	}
+	return newPage(positions, params.limit, func(p apiPosition) pageCursor {
+		return pageCursor{VehicleId: p.VehicleId}
+	}), nil
+}
+
+// alerts lists a page of alert versions.
+func (s *apiServer) alerts(ctx context.Context, r *http.Request) (any, error) {
+	params, err := parseListParams(r, "feed_id", "route", "from", "to")
+	if err != nil {
+		return nil, err
+	}
+	alerts, err := s.queryAlerts(ctx, params, params.limit+1)
+	if err != nil {
+		return nil, err
+	}
+	return newPage(alerts, params.limit, func(a apiAlert) pageCursor {
+		return pageCursor{Timestamp: a.FirstSeen, RowId: a.rowId}
+	}), nil
+}
+
+// activeAlerts lists a page of the currently active alerts.
+func (s *apiServer) activeAlerts(ctx context.Context, r *http.Request) (any, error) {
+	params, err := parseListParams(r, "feed_id", "route")
+	if err != nil {
+		return nil, err
+	}
+	alerts, err := s.queryActiveAlerts(ctx, params, params.limit+1)
+	if err != nil {
+		return nil, err
+	}
+	return newPage(alerts, params.limit, func(a apiActiveAlert) pageCursor {
+		return pageCursor{Timestamp: a.FirstSeen, RowId: a.rowId}
+	}), nil
+}
+
+// handle wraps an endpoint, bounding its queries by dbTimeout and writing its result or error as JSON.
+func (s *apiServer) handle(endpoint func(ctx context.Context, r *http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet {
+			writeAPIError(w, &apiError{status: http.StatusMethodNotAllowed, message: "only GET is supported"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), dbTimeout)
+		defer cancel()
+		result, err := endpoint(ctx, r)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// errorStatus returns the status and message to respond with for an error, logging unexpected errors.
+func errorStatus(err error) (int, string) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.status, apiErr.message
+	}
+	slog.Error("Query failed", "err", err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable, "query timed out"
+	}
+	return http.StatusInternalServerError, "internal error"
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	status, message := errorStatus(err)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"status": status, "message": message}})
+}
+
+// serve runs a read-only JSON API over the realtime database.
+func serve(config Config, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	dbPath := flags.String("db", filepath.Join(config.DataDir, "realtime.db"), "realtime database")
+	addr := flags.String("addr", "localhost:8080", "address to listen on")
+	enableGraphQL := flags.Bool("graphql", false, "also serve GraphQL queries at /v1/graphql")
+	staticFile := flags.String("static", "", "static GTFS zip with the stops and shapes, and routes and trips for GraphQL (default: the latest download in the static directory)")
+	grpcAddr := flags.String("grpc-addr", "", "address to serve the gRPC query service on (default: disabled)")
+	replicaMode := flags.Bool("replica", false, "serve a copy of the database or archive on another host than the scraper (see below)")
+	archiveDir := flags.String("archive", feedArchiveDir(config), "synced archive to serve with --replica")
+	refresh := flags.Duration("refresh", defaultReplicaRefresh, "how often to check the synced archive for changes with --replica")
+	flags.Parse(args)
+
+	s := &apiServer{config: config, static: &staticGTFS{}}
+	// A replica serves the database at --db if there is one, such as a streamed copy of the scraper's,
+	// and otherwise a database built from the synced archive, which is rebuilt as the archive changes
+	if _, err := os.Stat(*dbPath); *replicaMode && errors.Is(err, fs.ErrNotExist) {
+		replica, err := newArchiveReplica(config, *archiveDir)
+		if err != nil {
+			return err
+		}
+		db, err := replica.build()
+		if err != nil {
+			return err
+		}
+		s.db.Store(db)
+		config.log().Info("Serving the archive", "updated", replica.updated.Format(time.RFC3339))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go replica.refresh(ctx, s, *refresh)
+	} else {
+		// Opened read-only, so requests never block the scraper
+		db, err := sqlx.Open("sqlite3", readOnlyURI(*dbPath))
+		if err != nil {
+			return err
+		}
+		s.db.Store(db)
+	}
+	defer func() { s.db.Load().Close() }()
+	var err error
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/positions", s.handle(s.positions))
+	mux.HandleFunc("/v1/vehicles", s.handle(s.vehicles))
+	mux.HandleFunc("/v1/alerts", s.handle(s.alerts))
+	mux.HandleFunc("/v1/alerts/active", s.handle(s.activeAlerts))
+	mux.HandleFunc("/v1/stops/near", s.handle(s.nearbyStops))
+	mux.HandleFunc("/v1/shapes/near", s.handle(s.nearbyShapes))
+	mux.HandleFunc("/v1/vehicles/near", s.handle(s.nearbyVehicles))
+
+	if *staticFile == "" {
+		*staticFile, err = latestStaticFile(feedStaticDir(config))
+	}
+	// Without a static GTFS, routes and trips only have the IDs in the realtime data,
+	// and only vehicles can be found near a point
+	tables := []string{"stops.txt"}
+	if *enableGraphQL {
+		tables = append(tables, "routes.txt", "trips.txt")
+	}
+	if err != nil {
+		slog.Warn("Serving without static GTFS", "err", err)
+	} else if s.static, err = loadStaticGTFS(*staticFile, tables...); err != nil {
+		return err
+	} else {
+		s.stopIndex = newStopIndex(s.static)
+		// Shapes are optional in GTFS
+		if shapes, err := loadStaticGTFS(*staticFile, "shapes.txt"); errors.Is(err, fs.ErrNotExist) {
+			config.log().Warn("No shapes in the static GTFS", "static", *staticFile)
+		} else if err != nil {
+			return err
+		} else {
+			s.static.shapes = shapes.shapes
+			s.shapeIndex = newShapeIndex(s.static)
+		}
+		config.log().Info("Loaded the static GTFS", "stops", len(s.static.stops), "shapes", len(s.static.shapes),
+			"routes", len(s.static.routes), "trips", len(s.static.trips), "static", *staticFile)
+	}
+	if *enableGraphQL {
+		g := s.newGraphQL()
+		mux.HandleFunc("/v1/graphql", s.serveGraphQL(g))
+		mux.HandleFunc("/v1/graphql/schema", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, g.schema())
+		})
+	}
+	// Either server stopping stops both
+	errs := make(chan error, 2)
+	if *grpcAddr != "" {
+		listener, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			return err
+		}
+		grpcServer := grpc.NewServer()
+		(&grpcService{api: s}).register(grpcServer)
+		defer grpcServer.Stop()
+		config.log().Info("Serving gRPC", "addr", *grpcAddr)
+		go func() { errs <- grpcServer.Serve(listener) }()
+	}
+	server := &http.Server{Addr: *addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	config.log().Info("Serving the API", "addr", *addr)
+	go func() { errs <- server.ListenAndServe() }()
+	return <-errs
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWhereClause(t *testing.T) {
+	var w whereClause
+	if got := w.String(); got != "" {
+		t.Errorf("empty clause is %q", got)
+	}
+	params := listParams{feed: "test", route: "99", vehicle: "bus-1", bbox: &[4]float64{-123.5, 49, -122.5, 49.5}}
+	params.positionFilters(&w)
+	want := " WHERE feed_id = ? AND route_id = ? AND vehicle_id = ? AND longitude BETWEEN ? AND ? AND latitude BETWEEN ? AND ?"
+	if got := w.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if len(w.args) != 7 || w.args[0] != "test" || w.args[1] != "99" || w.args[2] != "bus-1" || w.args[3] != -123.5 || w.args[6] != 49.5 {
+		t.Errorf("args are %v", w.args)
+	}
+}
+
+// Parameters only ever reach queries as arguments, so no value changes the query.
+func TestServeInjection(t *testing.T) {
+	db, err := createDatabase(filepath.Join(t.TempDir(), "realtime.db"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, timestamp := range []uint64{1709280000, 1709280030} {
+		feed := positionsFeed(timestamp, "trip-1", "bus-1")
+		feed.Entity = append(feed.Entity, positionsFeed(timestamp, "trip-2", "bus-2").Entity...)
+		if _, err := addVehiclePositions(feed, db, "test", nil, time.UTC, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := &apiServer{}
+	api.db.Store(db)
+	cursor := func(c pageCursor) string { return c.encode() }
+
+	tests := []struct {
+		endpoint func(ctx context.Context, r *http.Request) (any, error)
+		query    url.Values
+		// The number of rows returned, or -1 for a bad request
+		want int
+	}{
+		{api.positions, url.Values{}, 4},
+		{api.positions, url.Values{"vehicle": {"bus-1"}}, 2},
+		{api.positions, url.Values{"vehicle": {"bus-1' OR '1'='1"}}, 0},
+		{api.positions, url.Values{"vehicle": {`bus-1" OR 1=1 --`}}, 0},
+		{api.positions, url.Values{"vehicle": {"bus-1'; DROP TABLE vehicle_positions; --"}}, 0},
+		{api.positions, url.Values{"vehicle": {"bus-%"}}, 0},
+		{api.positions, url.Values{"feed_id": {"test"}}, 4},
+		{api.positions, url.Values{"feed_id": {"other"}}, 0},
+		{api.positions, url.Values{"route": {"x' OR route_id IS NULL OR '"}}, 0},
+		{api.positions, url.Values{"from": {"1709280000 OR 1=1"}}, -1},
+		{api.positions, url.Values{"bbox": {"-124,49,-122,50) OR (1=1"}}, -1},
+		{api.positions, url.Values{"limit": {"1; DROP TABLE vehicle_positions"}}, -1},
+		{api.positions, url.Values{"order": {"timestamp; DROP TABLE vehicle_positions"}}, -1},
+		{api.positions, url.Values{"cursor": {"' OR 1=1 --"}}, -1},
+		// A cursor is JSON with typed fields, so a forged one can't carry SQL in its numbers
+		{api.positions, url.Values{"cursor": {"eyJ0IjoiMSBPUiAxPTEifQ"}}, -1},
+		{api.positions, url.Values{"cursor": {cursor(pageCursor{Timestamp: 1709280000, RowId: 2})}}, 2},
+		{api.vehicles, url.Values{"from": {"1709280000"}}, 2},
+		{api.vehicles, url.Values{"from": {"1709280000"}, "cursor": {cursor(pageCursor{VehicleId: "' OR 1=1 --"})}}, 2},
+		{api.vehicles, url.Values{"from": {"1709280000"}, "cursor": {cursor(pageCursor{VehicleId: "bus-1' OR '1'='1"})}}, 1},
+		{api.vehicles, url.Values{"from": {"1709280000"}, "feed_id": {"other"}}, 0},
+		{api.vehicles, url.Values{"from": {"1709280000"}, "route": {"99' OR 1=1 --"}}, 0},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/v1/positions?"+test.query.Encode(), nil)
+		result, err := test.endpoint(context.Background(), r)
+		var apiErr *apiError
+		switch {
+		case test.want < 0 && (!errors.As(err, &apiErr) || apiErr.status != http.StatusBadRequest):
+			t.Errorf("%v: got %v, want a bad request", test.query, err)
+		case test.want >= 0 && err != nil:
+			t.Errorf("%v: %v", test.query, err)
+		case test.want >= 0:
+			if n := len(result.(page[apiPosition]).Data); n != test.want {
+				t.Errorf("%v: returned %d rows, want %d", test.query, n, test.want)
+			}
+		}
+	}
+	if n := countPositions(t, db); n != 4 {
+		t.Errorf("%d positions remain, want 4", n)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// runService only runs commands as a service on Windows. Elsewhere, service managers such as systemd run
+// the command itself and stop it with a signal.
+func runService(run func() error) (bool, error) {
+	return false, nil
+}
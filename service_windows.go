@@ -0,0 +1,135 @@
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// serviceName is the event log source of the service, which is registered once from an administrator PowerShell with
+// New-EventLog -LogName Application -Source gtfs-scraper
+const serviceName = "gtfs-scraper"
+
+// Event IDs of messages by level, so the event log can be filtered by them as well as by their type
+const (
+	eventDebug = 1
+	eventInfo  = 2
+	eventWarn  = 3
+	eventError = 4
+)
+
+// runService runs a command as a Windows service if the service manager started the process, e.g. one created with
+// sc.exe create gtfs-scraper binPath= "C:\gtfs-scraper\gtfs-scraper.exe --config C:\gtfs-scraper\config.json daemon"
+// Messages go to the Application event log, and stopping or shutting down stops the command like an interrupt.
+func runService(run func() error) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, err
+	}
+	log, err := eventlog.Open(serviceName)
+	if err != nil {
+		return true, err
+	}
+	defer log.Close()
+	serviceLog = func(options *slog.HandlerOptions) slog.Handler {
+		return newEventLogHandler(log, options)
+	}
+	slog.SetDefault(slog.New(newEventLogHandler(log, &slog.HandlerOptions{Level: logLevel})))
+	return true, svc.Run(serviceName, &service{run: run})
+}
+
+// service runs one command until it finishes, or the service manager stops it.
+type service struct {
+	run func() error
+}
+
+func (s *service) Execute(_ []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runContext = ctx
+	done := make(chan error, 1)
+	go func() { done <- s.run() }()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			changes <- svc.Status{State: svc.StopPending}
+			if err != nil {
+				code := exitCode(err)
+				slog.Error("Service failed", "err", err, "exit_code", code)
+				// A service-specific exit code, which the service manager's recovery actions can act on
+				return true, uint32(code)
+			}
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				changes <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				slog.Info("Stopping, as asked by the service manager")
+				changes <- svc.Status{State: svc.StopPending}
+				// The command finishes its poll in progress, as it would when interrupted
+				cancel()
+			}
+		}
+	}
+}
+
+// eventLogHandler writes each message to the event log as a line of key=value pairs, with an event type and ID
+// by its level.
+type eventLogHandler struct {
+	log *eventlog.Log
+	// Formats messages into buffer, shared by the handlers derived with attributes or groups
+	text   slog.Handler
+	mu     *sync.Mutex
+	buffer *bytes.Buffer
+}
+
+func newEventLogHandler(log *eventlog.Log, options *slog.HandlerOptions) *eventLogHandler {
+	buffer := new(bytes.Buffer)
+	return &eventLogHandler{log: log, text: slog.NewTextHandler(buffer, options), mu: new(sync.Mutex), buffer: buffer}
+}
+
+func (h *eventLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.text.Enabled(ctx, level)
+}
+
+func (h *eventLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buffer.Reset()
+	if err := h.text.Handle(ctx, record); err != nil {
+		return err
+	}
+	message := strings.TrimSuffix(h.buffer.String(), "\n")
+	switch {
+	case record.Level >= slog.LevelError:
+		return h.log.Error(eventError, message)
+	case record.Level >= slog.LevelWarn:
+		return h.log.Warning(eventWarn, message)
+	case record.Level >= slog.LevelInfo:
+		return h.log.Info(eventInfo, message)
+	}
+	return h.log.Info(eventDebug, message)
+}
+
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	derived := *h
+	derived.text = h.text.WithAttrs(attrs)
+	return &derived
+}
+
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	derived := *h
+	derived.text = h.text.WithGroup(name)
+	return &derived
+}
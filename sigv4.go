@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// AWSSigV4Config signs feed requests with AWS Signature Version 4, for feeds behind API Gateway or in S3.
+// It's used if Region is set.
+type AWSSigV4Config struct {
+	Region string
+	// Service defaults to "execute-api" for API Gateway. Use "s3" for buckets.
+	Service string
+	// Profile in the shared credentials file, ~/.aws/credentials or $AWS_SHARED_CREDENTIALS_FILE.
+	// Defaults to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables if set,
+	// or else $AWS_PROFILE or "default".
+	Profile string
+	// RoleARN is assumed with the profile's credentials through STS, if set.
+	RoleARN string
+}
+
+// Assumed role credentials are renewed this long before they expire
+const credentialsExpiryMargin = 5 * time.Minute
+
+var sigV4Signer = v4.NewSigner()
+
+type awsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	// Zero for long-lived credentials
+	Expiration time.Time
+}
+
+// sigV4Transport signs requests for the feed hosts.
+type sigV4Transport struct {
+	base    http.RoundTripper
+	config  AWSSigV4Config
+	hosts   map[string]bool
+	profile awsCredentials
+
+	mu          sync.Mutex
+	credentials awsCredentials
+}
+
+// loadAWSCredentials reads the credentials for a profile, or from the environment if no profile is given and
+// the environment has them.
+func loadAWSCredentials(profile string) (awsCredentials, error) {
+	if profile == "" {
+		if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+			return awsCredentials{
+				AccessKeyId:     id,
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			}, nil
+		}
+		profile = os.Getenv("AWS_PROFILE")
+		if profile == "" {
+			profile = "default"
+		}
+	}
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, err
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer f.Close()
+
+	var credentials awsCredentials
+	section := ""
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			found = found || section == profile
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			credentials.AccessKeyId = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			credentials.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			credentials.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, err
+	}
+	if !found || credentials.AccessKeyId == "" || credentials.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("no credentials for AWS profile %q in %s", profile, path)
+	}
+	return credentials, nil
+}
+
+// awsURIEncode percent-encodes everything except unreserved characters, as SigV4 requires.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// signSigV4 adds the SigV4 headers to a request with the AWS SDK's signer, reading its body to hash it.
+// S3 also needs the payload hash sent as X-Amz-Content-Sha256, and its paths aren't escaped again when signed
+// as every other service's are.
+func signSigV4(req *http.Request, credentials awsCredentials, region, service string, now time.Time) error {
+	var body []byte
+	if req.Body != nil && req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		body, err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	} else if req.Body != nil {
+		return errors.New("can't sign a request body which can't be reread")
+	}
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	if service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	return sigV4Signer.SignHTTP(req.Context(), aws.Credentials{
+		AccessKeyID:     credentials.AccessKeyId,
+		SecretAccessKey: credentials.SecretAccessKey,
+		SessionToken:    credentials.SessionToken,
+	}, req, payloadHash, service, region, now, func(options *v4.SignerOptions) {
+		options.DisableURIPathEscaping = service == "s3"
+	})
+}
+
+// assumeRole requests temporary credentials for a role from STS.
+func (t *sigV4Transport) assumeRole() (awsCredentials, error) {
+	query := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {t.config.RoleARN},
+		"RoleSessionName": {"gtfs-scraper"},
+	}
+	stsURL := "https://sts." + t.config.Region + ".amazonaws.com/?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, stsURL, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if err := signSigV4(req, t.profile, t.config.Region, "sts", time.Now()); err != nil {
+		return awsCredentials{}, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("assuming role %s: %w", t.config.RoleARN, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("assuming role %s: %w", t.config.RoleARN, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("assuming role %s: %s: %s", t.config.RoleARN, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var result struct {
+		Credentials awsCredentials `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return awsCredentials{}, fmt.Errorf("assuming role %s: %w", t.config.RoleARN, err)
+	}
+	return result.Credentials, nil
+}
+
+// currentCredentials returns the credentials to sign with, assuming the role again if its credentials expire soon.
+func (t *sigV4Transport) currentCredentials() (awsCredentials, error) {
+	if t.config.RoleARN == "" {
+		return t.profile, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.credentials.AccessKeyId == "" || time.Now().Add(credentialsExpiryMargin).After(t.credentials.Expiration) {
+		credentials, err := t.assumeRole()
+		if err != nil {
+			return awsCredentials{}, err
+		}
+		t.credentials = credentials
+	}
+	return t.credentials, nil
+}
+
+func (t *sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.hosts[req.URL.Host] {
+		return t.base.RoundTrip(req)
+	}
+	credentials, err := t.currentCredentials()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	if err := signSigV4(req, credentials, t.config.Region, t.config.Service, time.Now()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// setupSigV4 signs feed requests to the hosts of the feed URLs, if SigV4 is configured.
+func setupSigV4(config Config) error {
+	if config.AWSSigV4.Region == "" {
+		return nil
+	}
+	if config.OAuth2.TokenURL != "" {
+		return errors.New("OAuth2 and AWSSigV4 can't both be used")
+	}
+	profile, err := loadAWSCredentials(config.AWSSigV4.Profile)
+	if err != nil {
+		return err
+	}
+	hosts, err := feedHosts(config)
+	if err != nil {
+		return err
+	}
+	t := &sigV4Transport{base: feedClient.Transport, config: config.AWSSigV4, hosts: hosts, profile: profile}
+	if t.base == nil {
+		t.base = http.DefaultTransport
+	}
+	if t.config.Service == "" {
+		t.config.Service = "execute-api"
+	}
+	feedClient = &http.Client{Transport: t}
+	return nil
+}
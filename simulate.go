@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"google.golang.org/protobuf/proto"
+)
+
+// SimulationConfig sizes the built-in feed simulator, a source for load testing which doesn't poll an agency.
+// It answers the feed URLs "simulate:vehicle_positions", "simulate:trip_updates" and "simulate:alerts", e.g.
+// as a feed's VehicleUpdatesURL, with a fleet running the trips of the feed's latest static GTFS.
+type SimulationConfig struct {
+	// Vehicles is the fleet size, defaulting to 100. With more vehicles than trips, some run the same trip,
+	// whose positions the default PositionKey keeps one of, so set it to timestamp and vehicle_id.
+	Vehicles int
+	// UpdateSeconds is how often each vehicle reports, defaulting to 30. Vehicles report at staggered times,
+	// so polling more often than this gets a part of the fleet each time.
+	UpdateSeconds int
+	// Routes limits the trips run to those of these route_ids. Defaults to every route.
+	Routes []string
+	// Seed picks each vehicle's trip, delay and phase, so runs with the same seed simulate the same fleet.
+	Seed int64
+}
+
+const (
+	simulateScheme            = "simulate"
+	defaultSimulatedVehicles  = 100
+	defaultSimulatedUpdate    = 30
+	maxSimulatedDelaySeconds  = 300
+	simulatedLayoverSeconds   = 600
+	simulatedBearingLookahead = 20
+)
+
+// simulatedFeedTypes are the feed types the simulator answers, by URL.
+var simulatedFeedTypes = map[string]bool{"vehicle_positions": true, "trip_updates": true, "alerts": true}
+
+// simulatedTrip is a static trip a vehicle runs over and over, following its line at the scheduled pace.
+type simulatedTrip struct {
+	trip      Trip
+	stopTimes []StopTime
+	line      *shapeLine
+	// Distance along the line of each stop
+	alongs []float64
+	// Seconds from the first departure to the last arrival
+	duration int64
+}
+
+type simulatedVehicle struct {
+	id   string
+	trip *simulatedTrip
+	// Shifts the vehicle's runs and reports, so the fleet doesn't move in step
+	phase int64
+	// Seconds behind schedule on every run, below the layover so runs never overlap
+	delay int64
+}
+
+type feedSimulator struct {
+	location      *time.Location
+	updateSeconds int64
+	vehicles      []simulatedVehicle
+}
+
+var (
+	simulationMu sync.Mutex
+	// Configs of the feeds with simulated URLs, by FeedId
+	simulatedFeeds = make(map[string]Config)
+	// Simulators are made on a feed's first poll, as the daemon may only just have downloaded its static GTFS
+	simulators = make(map[string]*feedSimulator)
+)
+
+// setupSimulation checks the simulated feed URLs of the feeds and records their configs.
+func setupSimulation(configs []Config) error {
+	for _, c := range configs {
+		simulated := false
+		for _, command := range []string{"alerts", "tripupdates", "vehicleupdates"} {
+			for _, feedURL := range realtimeURLs(c, command) {
+				u, err := url.Parse(feedURL)
+				if err != nil || u.Scheme != simulateScheme {
+					continue
+				}
+				if !simulatedFeedTypes[u.Opaque] {
+					return fmt.Errorf("can't simulate %q, only simulate:vehicle_positions, simulate:trip_updates and simulate:alerts", feedURL)
+				}
+				simulated = true
+			}
+		}
+		if !simulated {
+			continue
+		}
+		if c.Simulation.Vehicles < 0 || c.Simulation.UpdateSeconds < 0 {
+			return errors.New("Simulation.Vehicles and Simulation.UpdateSeconds can't be negative")
+		}
+		simulatedFeeds[c.FeedId] = c
+	}
+	return nil
+}
+
+// simulateFeed returns the current state of a feed's simulated fleet as a feed of the given type.
+func simulateFeed(feedType string, feedId string) (*gtfs.FeedMessage, error) {
+	simulationMu.Lock()
+	defer simulationMu.Unlock()
+	s := simulators[feedId]
+	if s == nil {
+		config, found := simulatedFeeds[feedId]
+		if !found {
+			return nil, fmt.Errorf("feed %q isn't simulated", feedId)
+		}
+		var err error
+		if s, err = newFeedSimulator(config); err != nil {
+			return nil, err
+		}
+		simulators[feedId] = s
+	}
+
+	now := time.Now().Unix()
+	feed := &gtfs.FeedMessage{Header: &gtfs.FeedHeader{
+		GtfsRealtimeVersion: proto.String("2.0"),
+		Incrementality:      gtfs.FeedHeader_FULL_DATASET.Enum(),
+		Timestamp:           proto.Uint64(uint64(now)),
+	}}
+	switch feedType {
+	case "vehicle_positions":
+		for _, v := range s.vehicles {
+			feed.Entity = append(feed.Entity, s.vehiclePosition(v, now))
+		}
+	case "trip_updates":
+		for _, v := range s.vehicles {
+			if entity := s.tripUpdate(v, now); entity != nil {
+				feed.Entity = append(feed.Entity, entity)
+			}
+		}
+	case "alerts":
+		// An agency without disruptions, as made up alerts would only be noise
+	default:
+		return nil, fmt.Errorf("can't simulate %s", feedType)
+	}
+	return feed, nil
+}
+
+// newFeedSimulator assigns the fleet to trips with at least two timed stops from the feed's latest static GTFS.
+// Trips follow their shape if they have one, and else run straight between stops.
+func newFeedSimulator(config Config) (*feedSimulator, error) {
+	staticFile, err := latestStaticFile(feedStaticDir(config))
+	if err != nil {
+		return nil, fmt.Errorf("simulating feeds needs static GTFS, run static first: %w", err)
+	}
+	static, err := loadStaticGTFS(staticFile, "stops.txt", "trips.txt", "stop_times.txt")
+	if err != nil {
+		return nil, err
+	}
+	shapes, err := loadStaticGTFS(staticFile, "shapes.txt")
+	if errors.Is(err, fs.ErrNotExist) {
+		shapes = &staticGTFS{}
+	} else if err != nil {
+		return nil, err
+	}
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make(map[string]bool)
+	for _, route := range config.Simulation.Routes {
+		routes[route] = true
+	}
+	var trips []*simulatedTrip
+	for tripId, stopTimes := range static.stopTimes {
+		trip, found := static.trips[tripId]
+		if !found || len(stopTimes) < 2 || len(routes) > 0 && !routes[trip.RouteId] {
+			continue
+		}
+		if t := newSimulatedTrip(trip, stopTimes, static.stops, shapes.shapes[trip.ShapeId]); t != nil {
+			trips = append(trips, t)
+		}
+	}
+	if len(trips) == 0 {
+		return nil, fmt.Errorf("%s has no trips to simulate", staticFile)
+	}
+	sort.Slice(trips, func(i, j int) bool { return trips[i].trip.Id < trips[j].trip.Id })
+
+	s := &feedSimulator{location: location, updateSeconds: int64(config.Simulation.UpdateSeconds)}
+	if s.updateSeconds == 0 {
+		s.updateSeconds = defaultSimulatedUpdate
+	}
+	vehicles := config.Simulation.Vehicles
+	if vehicles == 0 {
+		vehicles = defaultSimulatedVehicles
+	}
+	// Vehicles get different trips while there are enough, as positions are told apart by trip by default
+	random := rand.New(rand.NewSource(config.Simulation.Seed))
+	random.Shuffle(len(trips), func(i, j int) { trips[i], trips[j] = trips[j], trips[i] })
+	for i := 0; i < vehicles; i++ {
+		trip := trips[i%len(trips)]
+		s.vehicles = append(s.vehicles, simulatedVehicle{
+			id:    fmt.Sprintf("sim-%d", i+1),
+			trip:  trip,
+			phase: random.Int63n(trip.duration + simulatedLayoverSeconds),
+			delay: random.Int63n(maxSimulatedDelaySeconds),
+		})
+	}
+	config.log().Info("Simulating vehicles", "vehicles", vehicles, "trips", len(trips), "static", filepath.Base(staticFile))
+	return s, nil
+}
+
+// newSimulatedTrip returns nil for trips whose stops have no coordinates or which take no time.
+func newSimulatedTrip(trip Trip, stopTimes []StopTime, stops map[string]Stop, shape []ShapePoint) *simulatedTrip {
+	points := make([]ShapePoint, len(stopTimes))
+	for i, stopTime := range stopTimes {
+		stop, found := stops[stopTime.StopId]
+		if !found || stop.Latitude == 0 && stop.Longitude == 0 {
+			return nil
+		}
+		points[i] = ShapePoint{Latitude: stop.Latitude, Longitude: stop.Longitude, Sequence: i}
+	}
+	t := &simulatedTrip{trip: trip, stopTimes: stopTimes, alongs: make([]float64, len(points))}
+	t.duration = int64(stopTimes[len(stopTimes)-1].ArrivalTime - stopTimes[0].DepartureTime)
+	if t.duration <= 0 {
+		return nil
+	}
+	if len(shape) < 2 {
+		t.line = newShapeLine(points)
+		copy(t.alongs, t.line.cumulative)
+		return t
+	}
+	t.line = newShapeLine(shape)
+	for i, point := range points {
+		t.alongs[i], _ = t.line.project(point.Latitude, point.Longitude)
+		// Stops snapped out of order on looping shapes mustn't send vehicles backwards
+		if i > 0 && t.alongs[i] < t.alongs[i-1] {
+			t.alongs[i] = t.alongs[i-1]
+		}
+	}
+	return t
+}
+
+// simulatedRun is where a vehicle was on its run at its last report.
+type simulatedRun struct {
+	reported int64
+	// Scheduled start of the run
+	start int64
+	// Scheduled seconds since the first departure, negative while waiting to leave late
+	elapsed int64
+	// Index of the stop the vehicle is at or heading to
+	stop    int
+	stopped bool
+}
+
+func (s *feedSimulator) run(v simulatedVehicle, now int64) simulatedRun {
+	r := simulatedRun{reported: now - (now+v.phase)%s.updateSeconds}
+	period := v.trip.duration + simulatedLayoverSeconds
+	r.start = r.reported - (r.reported+v.phase)%period
+	r.elapsed = r.reported - r.start - v.delay
+
+	stopTimes := v.trip.stopTimes
+	first := int64(stopTimes[0].DepartureTime)
+	r.stopped = true
+	for i, stopTime := range stopTimes {
+		r.stop = i
+		if r.elapsed < int64(stopTime.ArrivalTime)-first {
+			r.stopped = false
+			break
+		}
+		if r.elapsed < int64(stopTime.DepartureTime)-first {
+			break
+		}
+	}
+	// Waiting to leave the first stop
+	if r.elapsed <= 0 {
+		r.stop, r.stopped = 0, true
+	}
+	return r
+}
+
+func (s *feedSimulator) tripDescriptor(v simulatedVehicle, r simulatedRun) *gtfs.TripDescriptor {
+	start := time.Unix(r.start, 0).In(s.location)
+	descriptor := &gtfs.TripDescriptor{
+		TripId:    proto.String(v.trip.trip.Id),
+		RouteId:   proto.String(v.trip.trip.RouteId),
+		StartDate: proto.String(start.Format("20060102")),
+		StartTime: proto.String(start.Format("15:04:05")),
+	}
+	if v.trip.trip.DirectionId != nil {
+		descriptor.DirectionId = proto.Uint32(uint32(*v.trip.trip.DirectionId))
+	}
+	return descriptor
+}
+
+func (s *feedSimulator) vehiclePosition(v simulatedVehicle, now int64) *gtfs.FeedEntity {
+	r := s.run(v, now)
+	t := v.trip
+	position := &gtfs.Position{Speed: proto.Float32(0)}
+	along := t.alongs[r.stop]
+	status := gtfs.VehiclePosition_STOPPED_AT
+	if !r.stopped {
+		status = gtfs.VehiclePosition_IN_TRANSIT_TO
+		first := int64(t.stopTimes[0].DepartureTime)
+		from, to := t.stopTimes[r.stop-1], t.stopTimes[r.stop]
+		seconds := float64(to.ArrivalTime - from.DepartureTime)
+		fraction := float64(r.elapsed-(int64(from.DepartureTime)-first)) / seconds
+		along = t.alongs[r.stop-1] + fraction*(t.alongs[r.stop]-t.alongs[r.stop-1])
+		position.Speed = proto.Float32(float32((t.alongs[r.stop] - t.alongs[r.stop-1]) / seconds))
+	}
+	lat, lon := t.line.at(along)
+	position.Latitude, position.Longitude = proto.Float32(float32(lat)), proto.Float32(float32(lon))
+	// Heading along the line, or towards the next stop while stopped
+	if aheadLat, aheadLon := t.line.at(along + simulatedBearingLookahead); aheadLat != lat || aheadLon != lon {
+		position.Bearing = proto.Float32(float32(bearingDegrees(lat, lon, aheadLat, aheadLon)))
+	}
+	stopTime := t.stopTimes[r.stop]
+	return &gtfs.FeedEntity{
+		Id: proto.String(v.id),
+		Vehicle: &gtfs.VehiclePosition{
+			Trip:                s.tripDescriptor(v, r),
+			Vehicle:             &gtfs.VehicleDescriptor{Id: proto.String(v.id), Label: proto.String(v.id)},
+			Position:            position,
+			CurrentStopSequence: proto.Uint32(stopTime.StopSequence),
+			StopId:              proto.String(stopTime.StopId),
+			CurrentStatus:       status.Enum(),
+			Timestamp:           proto.Uint64(uint64(r.reported)),
+		},
+	}
+}
+
+// tripUpdate predicts the remaining stops of a vehicle's run at its delay, or returns nil once it's over.
+func (s *feedSimulator) tripUpdate(v simulatedVehicle, now int64) *gtfs.FeedEntity {
+	r := s.run(v, now)
+	if r.elapsed >= v.trip.duration {
+		return nil
+	}
+	first := int64(v.trip.stopTimes[0].DepartureTime)
+	update := &gtfs.TripUpdate{
+		Trip:      s.tripDescriptor(v, r),
+		Vehicle:   &gtfs.VehicleDescriptor{Id: proto.String(v.id), Label: proto.String(v.id)},
+		Timestamp: proto.Uint64(uint64(r.reported)),
+		Delay:     proto.Int32(int32(v.delay)),
+	}
+	for _, stopTime := range v.trip.stopTimes[r.stop:] {
+		update.StopTimeUpdate = append(update.StopTimeUpdate, &gtfs.TripUpdate_StopTimeUpdate{
+			StopSequence: proto.Uint32(stopTime.StopSequence),
+			StopId:       proto.String(stopTime.StopId),
+			Arrival: &gtfs.TripUpdate_StopTimeEvent{
+				Delay: proto.Int32(int32(v.delay)),
+				Time:  proto.Int64(r.start + int64(stopTime.ArrivalTime) - first + v.delay),
+			},
+			Departure: &gtfs.TripUpdate_StopTimeEvent{
+				Delay: proto.Int32(int32(v.delay)),
+				Time:  proto.Int64(r.start + int64(stopTime.DepartureTime) - first + v.delay),
+			},
+		})
+	}
+	return &gtfs.FeedEntity{Id: proto.String(v.id), TripUpdate: update}
+}
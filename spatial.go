@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	// Cells of the spatial index are this many degrees on a side, about 1 km north to south
+	spatialCellDegrees = 0.01
+	metersPerDegree    = math.Pi * earthRadiusMeters / 180
+	defaultNearRadius  = 500.0
+	// Bounds the cells a query visits
+	maxNearRadius = 10_000.0
+)
+
+type spatialEntry struct {
+	id       string
+	lat, lon float64
+}
+
+// spatialIndex is a grid of points from the static GTFS, such as stops or the points of shapes,
+// for finding those near a point without scanning them all. An ID can have many points.
+type spatialIndex struct {
+	cells map[[2]int][]spatialEntry
+}
+
+func newSpatialIndex() *spatialIndex {
+	return &spatialIndex{cells: make(map[[2]int][]spatialEntry)}
+}
+
+func spatialCell(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat / spatialCellDegrees)), int(math.Floor(lon / spatialCellDegrees))}
+}
+
+func (ix *spatialIndex) add(id string, lat, lon float64) {
+	cell := spatialCell(lat, lon)
+	ix.cells[cell] = append(ix.cells[cell], spatialEntry{id: id, lat: lat, lon: lon})
+}
+
+// spatialMatch is an ID with its closest point to a query.
+type spatialMatch struct {
+	id             string
+	lat, lon       float64
+	distanceMeters float64
+}
+
+// radiusDegrees converts a radius in meters around a point to degrees of latitude and longitude.
+func radiusDegrees(lat, radius float64) (latRadius, lonRadius float64) {
+	// Degrees of longitude shrink towards the poles
+	return radius / metersPerDegree, radius / (metersPerDegree * math.Max(math.Cos(lat*math.Pi/180), 0.01))
+}
+
+// near returns up to limit IDs with a point within radius meters of a point, closest first.
+func (ix *spatialIndex) near(lat, lon, radius float64, limit int) []spatialMatch {
+	latRadius, lonRadius := radiusDegrees(lat, radius)
+	minCell, maxCell := spatialCell(lat-latRadius, lon-lonRadius), spatialCell(lat+latRadius, lon+lonRadius)
+
+	closest := make(map[string]spatialMatch)
+	for i := minCell[0]; i <= maxCell[0]; i++ {
+		for j := minCell[1]; j <= maxCell[1]; j++ {
+			for _, e := range ix.cells[[2]int{i, j}] {
+				d := haversineMeters(lat, lon, e.lat, e.lon)
+				if best, found := closest[e.id]; d <= radius && (!found || d < best.distanceMeters) {
+					closest[e.id] = spatialMatch{id: e.id, lat: e.lat, lon: e.lon, distanceMeters: d}
+				}
+			}
+		}
+	}
+	matches := make([]spatialMatch, 0, len(closest))
+	for _, m := range closest {
+		matches = append(matches, m)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distanceMeters != matches[j].distanceMeters {
+			return matches[i].distanceMeters < matches[j].distanceMeters
+		}
+		return matches[i].id < matches[j].id
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+// newStopIndex indexes the stops with a location. Stations and entrances are indexed like any other stop.
+func newStopIndex(static *staticGTFS) *spatialIndex {
+	ix := newSpatialIndex()
+	for _, stop := range static.stops {
+		if stop.Latitude != 0 || stop.Longitude != 0 {
+			ix.add(stop.Id, stop.Latitude, stop.Longitude)
+		}
+	}
+	return ix
+}
+
+// newShapeIndex indexes the points of each shape. A shape is only found near a point if one of its points is,
+// rather than any part of a line between them, which suits shapes with points every few hundred meters at most.
+func newShapeIndex(static *staticGTFS) *spatialIndex {
+	ix := newSpatialIndex()
+	for id, points := range static.shapes {
+		for _, p := range points {
+			ix.add(id, p.Latitude, p.Longitude)
+		}
+	}
+	return ix
+}
+
+// nearParams are the query parameters of the endpoints finding things near a point.
+//
+//   - lat, lon: the point in WGS 84, or
+//   - stop: a stop ID, whose location is the point
+//   - radius: in meters, up to 10000 (default 500)
+//   - limit: up to 1000 (default 100)
+type nearParams struct {
+	lat, lon float64
+	radius   float64
+	limit    int
+}
+
+func (s *apiServer) parseNearParams(r *http.Request) (nearParams, error) {
+	query := r.URL.Query()
+	params := nearParams{radius: defaultNearRadius, limit: defaultPageLimit}
+	for name := range query {
+		if !contains([]string{"lat", "lon", "stop", "radius", "limit"}, name) {
+			return params, badRequest("parameter %s isn't supported by %s", name, r.URL.Path)
+		}
+	}
+	if id := query.Get("stop"); id != "" {
+		if query.Has("lat") || query.Has("lon") {
+			return params, badRequest("give either stop or lat and lon")
+		}
+		stop, found := s.static.stops[id]
+		if !found {
+			return params, &apiError{status: http.StatusNotFound, message: "no stop " + id + " in the static GTFS"}
+		}
+		params.lat, params.lon = stop.Latitude, stop.Longitude
+	} else {
+		var err error
+		if params.lat, err = strconv.ParseFloat(query.Get("lat"), 64); err != nil || math.Abs(params.lat) > 90 {
+			return params, badRequest("lat must be a latitude, or give stop")
+		}
+		if params.lon, err = strconv.ParseFloat(query.Get("lon"), 64); err != nil || math.Abs(params.lon) > 180 {
+			return params, badRequest("lon must be a longitude, or give stop")
+		}
+	}
+	if value := query.Get("radius"); value != "" {
+		radius, err := strconv.ParseFloat(value, 64)
+		if err != nil || radius <= 0 || radius > maxNearRadius {
+			return params, badRequest("radius must be between 0 and %.0f meters", maxNearRadius)
+		}
+		params.radius = radius
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return params, badRequest("invalid limit: %v", err)
+		}
+		if err := checkLimit(limit); err != nil {
+			return params, err
+		}
+		params.limit = limit
+	}
+	return params, nil
+}
+
+var errNoStaticGTFS = &apiError{status: http.StatusNotFound, message: "no static GTFS is loaded, pass --static or run the static command"}
+
+// apiNearbyStop is a stop with its distance from the query point.
+type apiNearbyStop struct {
+	StopId         string  `json:"stop_id"`
+	StopName       string  `json:"stop_name"`
+	Latitude       float64 `json:"latitude"`
+	Longitude      float64 `json:"longitude"`
+	DistanceMeters float64 `json:"distance_meters"`
+}
+
+// nearbyStops lists the stops within the radius, closest first.
+func (s *apiServer) nearbyStops(ctx context.Context, r *http.Request) (any, error) {
+	if s.stopIndex == nil {
+		return nil, errNoStaticGTFS
+	}
+	params, err := s.parseNearParams(r)
+	if err != nil {
+		return nil, err
+	}
+	var stops []apiNearbyStop
+	for _, m := range s.stopIndex.near(params.lat, params.lon, params.radius, params.limit) {
+		stop := s.static.stops[m.id]
+		stops = append(stops, apiNearbyStop{StopId: stop.Id, StopName: stop.Name, Latitude: stop.Latitude, Longitude: stop.Longitude, DistanceMeters: m.distanceMeters})
+	}
+	return newPage(stops, params.limit, nil), nil
+}
+
+// apiNearbyShape is a shape with the distance of its closest point from the query point.
+type apiNearbyShape struct {
+	ShapeId        string  `json:"shape_id"`
+	Latitude       float64 `json:"latitude"`
+	Longitude      float64 `json:"longitude"`
+	DistanceMeters float64 `json:"distance_meters"`
+}
+
+// nearbyShapes lists the shapes passing within the radius, closest first.
+func (s *apiServer) nearbyShapes(ctx context.Context, r *http.Request) (any, error) {
+	if s.shapeIndex == nil {
+		return nil, errNoStaticGTFS
+	}
+	params, err := s.parseNearParams(r)
+	if err != nil {
+		return nil, err
+	}
+	var shapes []apiNearbyShape
+	for _, m := range s.shapeIndex.near(params.lat, params.lon, params.radius, params.limit) {
+		shapes = append(shapes, apiNearbyShape{ShapeId: m.id, Latitude: m.lat, Longitude: m.lon, DistanceMeters: m.distanceMeters})
+	}
+	return newPage(shapes, params.limit, nil), nil
+}
+
+// apiNearbyVehicle is the latest position of a vehicle with its distance from the query point.
+type apiNearbyVehicle struct {
+	apiPosition
+	DistanceMeters float64 `json:"distance_meters"`
+}
+
+// nearbyVehicles lists the vehicles whose latest position in the last hour is within the radius, closest first.
+func (s *apiServer) nearbyVehicles(ctx context.Context, r *http.Request) (any, error) {
+	params, err := s.parseNearParams(r)
+	if err != nil {
+		return nil, err
+	}
+	// The bounding box of the radius narrows the query, and distances are checked exactly afterwards
+	latRadius, lonRadius := radiusDegrees(params.lat, params.radius)
+	bbox := [4]float64{params.lon - lonRadius, params.lat - latRadius, params.lon + lonRadius, params.lat + latRadius}
+	positions, err := s.queryLatestPositions(ctx, listParams{bbox: &bbox}, maxPageLimit)
+	if err != nil {
+		return nil, err
+	}
+	var vehicles []apiNearbyVehicle
+	for _, p := range positions {
+		if p.Latitude == nil || p.Longitude == nil {
+			continue
+		}
+		d := haversineMeters(params.lat, params.lon, float64(*p.Latitude), float64(*p.Longitude))
+		if d <= params.radius {
+			vehicles = append(vehicles, apiNearbyVehicle{apiPosition: p, DistanceMeters: d})
+		}
+	}
+	sort.SliceStable(vehicles, func(i, j int) bool { return vehicles[i].DistanceMeters < vehicles[j].DistanceMeters })
+	if len(vehicles) > params.limit {
+		vehicles = vehicles[:params.limit]
+	}
+	return newPage(vehicles, params.limit, nil), nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Consecutive positions further apart than this are treated as separate traversals
+const maxSpeedProfileGap = 5 * time.Minute
+
+// Positions can snap slightly backwards along the shape from GPS noise
+const backtrackToleranceMeters = 10
+
+// SpeedProfileSegment is the observed speed over a stretch of a shape during one time of day bucket.
+type SpeedProfileSegment struct {
+	RouteId   string `parquet:"route_id"`
+	ShapeId   string `parquet:"shape_id"`
+	TimeOfDay string `parquet:"time_of_day"`
+	// Distances along the shape in meters. shape_dist_traveled isn't used since its units vary between feeds.
+	StartMeters float64 `parquet:"start_m"`
+	EndMeters   float64 `parquet:"end_m"`
+	Traversals  int64   `parquet:"traversals"`
+	// Total distance over total time, which includes stops within the segment
+	SpeedKmh *float64 `parquet:"speed_kmh,optional"`
+	Slow     bool     `parquet:"slow"`
+}
+
+type speedSegmentKey struct {
+	shapeId   string
+	timeOfDay string
+	bucket    int
+}
+
+type speedSegment struct {
+	meters     float64
+	seconds    float64
+	traversals int64
+}
+
+// tripInstance identifies one run of a trip by a vehicle.
+type tripInstance struct {
+	vehicleId string
+	tripId    string
+	startTime int64
+}
+
+type shapePosition struct {
+	along     float64
+	timestamp time.Time
+}
+
+// analyzeSpeedProfile map-matches a route's positions to their trip's shape, and computes the observed speed
+// over each stretch of the shape by time of day.
+func analyzeSpeedProfile(config Config, args []string) error {
+	flags := flag.NewFlagSet("analyze speed-profile", flag.ExitOnError)
+	input := addAnalysisFlags(flags, config)
+	route := flags.String("route", "", "route ID to profile (required)")
+	staticFile := flags.String("static", "", "static GTFS zip (default: the latest download in the static directory)")
+	output := flags.String("output", filepath.Join(config.DataDir, "speed-profile.csv"), "output file, as Parquet if it ends in .parquet and CSV otherwise")
+	bucketSize := flags.Float64("bucket", 100, "length of each stretch of the shape in meters")
+	interval := flags.Duration("interval", time.Hour, "time of day bucket size")
+	slowSpeed := flags.Float64("slow", 15, "speed in km/h below which a stretch is flagged as slow")
+	maxOffset := flags.Float64("max-offset", 50, "positions further than this many meters from the shape are ignored")
+	flags.Parse(args)
+
+	if *route == "" {
+		return errors.New("missing --route")
+	}
+	if *bucketSize <= 0 {
+		return fmt.Errorf("invalid --bucket: %v", *bucketSize)
+	}
+	if *interval <= 0 || *interval > 24*time.Hour {
+		return fmt.Errorf("invalid --interval: %v", *interval)
+	}
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+	if *staticFile == "" {
+		if *staticFile, err = latestStaticFile(feedStaticDir(config)); err != nil {
+			return err
+		}
+	}
+	static, err := loadStaticGTFS(*staticFile, "trips.txt", "shapes.txt")
+	if err != nil {
+		return err
+	}
+
+	lines := make(map[string]*shapeLine)
+	last := make(map[tripInstance]shapePosition)
+	segments := make(map[speedSegmentKey]*speedSegment)
+	var matched, offShape int
+	err = input.forEachPosition(config, location, func(vp *VehiclePosition) {
+		trip, found := static.trips[vp.TripId]
+		if !found || trip.RouteId != *route || vp.Latitude == nil || vp.Longitude == nil {
+			return
+		}
+		points := static.shapes[trip.ShapeId]
+		if len(points) < 2 {
+			return
+		}
+		line, found := lines[trip.ShapeId]
+		if !found {
+			line = newShapeLine(points)
+			lines[trip.ShapeId] = line
+		}
+
+		instance := tripInstance{vp.VehicleId, vp.TripId, vp.StartTimeUnix}
+		along, offset := line.project(float64(*vp.Latitude), float64(*vp.Longitude))
+		if offset > *maxOffset {
+			offShape++
+			delete(last, instance)
+			return
+		}
+		matched++
+		current := shapePosition{along, vp.Timestamp}
+		previous, found := last[instance]
+		last[instance] = current
+		elapsed := current.timestamp.Sub(previous.timestamp)
+		if !found || elapsed <= 0 || elapsed > maxSpeedProfileGap || current.along < previous.along-backtrackToleranceMeters {
+			return
+		}
+
+		timeOfDay := timeOfDayBucket(previous.timestamp, location, *interval)
+		start, end := previous.along, math.Max(previous.along, current.along)
+		if end-start < 1 {
+			// Standing still, e.g. at a stop or a light
+			segment := segmentFor(segments, speedSegmentKey{trip.ShapeId, timeOfDay, int(start / *bucketSize)})
+			segment.seconds += elapsed.Seconds()
+			segment.traversals++
+			return
+		}
+		for bucket := int(start / *bucketSize); bucket <= int(end / *bucketSize); bucket++ {
+			overlap := math.Min(end, float64(bucket+1)**bucketSize) - math.Max(start, float64(bucket)**bucketSize)
+			if overlap <= 0 {
+				continue
+			}
+			segment := segmentFor(segments, speedSegmentKey{trip.ShapeId, timeOfDay, bucket})
+			segment.meters += overlap
+			segment.seconds += elapsed.Seconds() * overlap / (end - start)
+			segment.traversals++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	config.log().Info("Matched positions to shapes", "matched", matched, "off_shape", offShape)
+
+	results := make([]SpeedProfileSegment, 0, len(segments))
+	for key, segment := range segments {
+		result := SpeedProfileSegment{
+			RouteId:     *route,
+			ShapeId:     key.shapeId,
+			TimeOfDay:   key.timeOfDay,
+			StartMeters: float64(key.bucket) * *bucketSize,
+			EndMeters:   math.Min(float64(key.bucket+1)**bucketSize, lines[key.shapeId].length()),
+			Traversals:  segment.traversals,
+		}
+		if segment.seconds > 0 {
+			speed := segment.meters / segment.seconds * 3.6
+			result.SpeedKmh = &speed
+			result.Slow = speed < *slowSpeed
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.ShapeId != b.ShapeId {
+			return a.ShapeId < b.ShapeId
+		}
+		if a.TimeOfDay != b.TimeOfDay {
+			return a.TimeOfDay < b.TimeOfDay
+		}
+		return a.StartMeters < b.StartMeters
+	})
+	return writeAnalysis(*output, results)
+}
+
+func segmentFor(segments map[speedSegmentKey]*speedSegment, key speedSegmentKey) *speedSegment {
+	segment, found := segments[key]
+	if !found {
+		segment = &speedSegment{}
+		segments[key] = segment
+	}
+	return segment
+}
@@ -2,88 +2,108 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 )
 
-func downloadStatic(outputDir string, url string) {
-	resp, err := http.Get(url)
+// Partial downloads are staged with this suffix until they're complete.
+const partialDownloadSuffix = ".part"
+
+func downloadStatic(outputDir string, staticURL string, auth FeedAuthConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), staticTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, staticURL, nil)
 	if err != nil {
-		log.Panicln(err)
+		return err
+	}
+	if err := authorize(req, auth); err != nil {
+		return err
+	}
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = staticURL
+		}
+		return &FeedError{URL: staticURL, Err: err}
 	}
 	defer resp.Body.Close()
 
 	disposition := resp.Header.Get("Content-Disposition")
 	if disposition == "" {
-		return // TODO error
+		return errors.New("static GTFS response has no Content-Disposition naming the file")
 	}
 	_, params, err := mime.ParseMediaType(disposition)
 	if err != nil {
-		log.Panicln(err)
+		return err
 	}
 	filename := params["filename"]
 
-	outputFilename := filepath.Join(outputDir, filepath.Clean(filename))
-	file, err := os.OpenFile(outputFilename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
-	if err == nil {
-		nbtyes, cerr := io.Copy(file, resp.Body)
-		if cerr != nil {
-			log.Panicln(cerr)
-		}
-		if nbtyes != resp.ContentLength {
-			log.Panicf("Downloaded %d bytes but expected %d\n", nbtyes, resp.ContentLength)
-		}
+	// Only keep the base name, so the server can't write outside outputDir with ../ or a drive letter
+	outputFilename := filepath.Join(outputDir, filepath.Base(filename))
+	if _, err := os.Stat(outputFilename); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// Downloads are staged, so an interrupted one is never mistaken for a complete feed
+	stagingPath := outputFilename + partialDownloadSuffix
+	file, err := os.Create(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(stagingPath)
+	nbtyes, cerr := io.Copy(file, resp.Body)
+	if err := file.Close(); cerr == nil {
+		cerr = err
+	}
+	if cerr != nil {
+		return cerr
+	}
+	// The length is unknown (-1) for decoded compressed responses
+	if resp.ContentLength >= 0 && nbtyes != resp.ContentLength {
+		return fmt.Errorf("downloaded %d bytes but expected %d", nbtyes, resp.ContentLength)
+	}
 
-		fileEntries, err := os.ReadDir(outputDir)
+	// If there are existing files, check if file contents have changed.
+	if oldFilename, err := latestStaticFile(outputDir); err == nil {
+		oldHash, err := fileSHA1(oldFilename)
 		if err != nil {
-			log.Panicln(err)
+			return err
 		}
-		if len(fileEntries) == 0 {
-			return
-		}
-
-		// If there are existing files, check if file contents have changed.
-		var oldModTimestamp int64
-		var oldFilename string
-		for _, fileEntry := range fileEntries {
-			info, err := fileEntry.Info()
-			if err != nil {
-				log.Panicln(err)
-			}
-			modTimestamp := info.ModTime().Unix()
-			if modTimestamp > oldModTimestamp {
-				oldFilename = fileEntry.Name()
-			}
-		}
-
-		oldFile, err := os.OpenFile(filepath.Join(outputDir, oldFilename), os.O_RDONLY, 0666)
+		newHash, err := fileSHA1(stagingPath)
 		if err != nil {
-			log.Panicln(err)
-		}
-		oldHash := sha1.New()
-		_, cerr = io.Copy(oldHash, oldFile)
-		if cerr != nil {
-			log.Panicln(cerr)
-		}
-		newHash := sha1.New()
-		_, cerr = io.Copy(newHash, file)
-		if cerr != nil {
-			log.Panicln(cerr)
+			return err
 		}
-		// Clean up new file if contents are unchanged
-		if bytes.Equal(oldHash.Sum(nil), newHash.Sum(nil)) {
-			defer os.Remove(outputFilename)
-		} else {
-			log.Printf("Downloaded static GTFS data: %s\n", outputFilename)
+		if bytes.Equal(oldHash, newHash) {
+			return nil
 		}
-	} else if !errors.Is(err, os.ErrExist) {
-		log.Panicln(err)
 	}
-	defer file.Close()
+	if err := os.Rename(stagingPath, outputFilename); err != nil {
+		return err
+	}
+	slog.Info("Downloaded static GTFS data", "path", outputFilename)
+	return nil
+}
+
+func fileSHA1(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
 }
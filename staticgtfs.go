@@ -0,0 +1,271 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Stop is a row of stops.txt.
+type Stop struct {
+	Id        string
+	Name      string
+	Latitude  float64
+	Longitude float64
+}
+
+// Route is a row of routes.txt.
+type Route struct {
+	Id        string
+	ShortName string
+	LongName  string
+	Type      int
+	Color     string
+}
+
+// Trip is a row of trips.txt.
+type Trip struct {
+	Id          string
+	RouteId     string
+	Headsign    string
+	DirectionId *int32
+	ShapeId     string
+}
+
+// StopTime is a row of stop_times.txt. Times are seconds since the start of the service day,
+// which can go past 24 hours.
+type StopTime struct {
+	StopId        string
+	StopSequence  uint32
+	ArrivalTime   int
+	DepartureTime int
+}
+
+// ShapePoint is a row of shapes.txt.
+type ShapePoint struct {
+	Latitude  float64
+	Longitude float64
+	Sequence  int
+}
+
+// staticGTFS holds the tables loaded from a static GTFS zip. Only the requested tables are loaded.
+type staticGTFS struct {
+	stops  map[string]Stop
+	routes map[string]Route
+	trips  map[string]Trip
+	// Stop times of each trip, ordered by stop sequence
+	stopTimes map[string][]StopTime
+	// Points of each shape, ordered by sequence
+	shapes map[string][]ShapePoint
+}
+
+// latestStaticFile finds the most recently downloaded static GTFS zip.
+func latestStaticFile(staticDir string) (string, error) {
+	entries, err := os.ReadDir(staticDir)
+	if err != nil {
+		return "", err
+	}
+	var latest string
+	var latestModTime int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".zip") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return "", err
+		}
+		if modTime := info.ModTime().UnixNano(); latest == "" || modTime > latestModTime {
+			latest, latestModTime = entry.Name(), modTime
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no static GTFS found in %s, run the static command first", staticDir)
+	}
+	return filepath.Join(staticDir, latest), nil
+}
+
+// parseGTFSTime parses a HH:MM:SS time, which can be 24:00:00 or later for trips past midnight.
+func parseGTFSTime(value string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid GTFS time %q", value)
+	}
+	var seconds int
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, fmt.Errorf("invalid GTFS time %q", value)
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
+
+// readGTFSTable calls fn with each record of a file in the zip, keyed by column name.
+func readGTFSTable(archive *zip.ReadCloser, name string, fn func(record map[string]string) error) error {
+	f, err := archive.Open(name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.ReuseRecord = true
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	columns := make([]string, len(header))
+	for i, column := range header {
+		// Some feeds start with a UTF-8 byte order mark
+		columns[i] = strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))
+	}
+
+	record := make(map[string]string, len(columns))
+	for {
+		values, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		clear(record)
+		for i, value := range values {
+			if i < len(columns) {
+				record[columns[i]] = value
+			}
+		}
+		if err := fn(record); err != nil {
+			line, _ := reader.FieldPos(0)
+			return fmt.Errorf("%s line %d: %w", name, line, err)
+		}
+	}
+}
+
+func parseOptionalFloat(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// loadStaticGTFS reads the given tables, e.g. "stops.txt", from a static GTFS zip.
+func loadStaticGTFS(path string, tables ...string) (*staticGTFS, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	g := &staticGTFS{}
+	for _, table := range tables {
+		switch table {
+		case "stops.txt":
+			g.stops = make(map[string]Stop)
+			err = readGTFSTable(archive, table, func(record map[string]string) error {
+				lat, err := parseOptionalFloat(record["stop_lat"])
+				if err != nil {
+					return err
+				}
+				lon, err := parseOptionalFloat(record["stop_lon"])
+				if err != nil {
+					return err
+				}
+				g.stops[record["stop_id"]] = Stop{Id: record["stop_id"], Name: record["stop_name"], Latitude: lat, Longitude: lon}
+				return nil
+			})
+		case "routes.txt":
+			g.routes = make(map[string]Route)
+			err = readGTFSTable(archive, table, func(record map[string]string) error {
+				routeType, err := strconv.Atoi(record["route_type"])
+				if err != nil {
+					return err
+				}
+				g.routes[record["route_id"]] = Route{
+					Id:        record["route_id"],
+					ShortName: record["route_short_name"],
+					LongName:  record["route_long_name"],
+					Type:      routeType,
+					Color:     record["route_color"],
+				}
+				return nil
+			})
+		case "trips.txt":
+			g.trips = make(map[string]Trip)
+			err = readGTFSTable(archive, table, func(record map[string]string) error {
+				trip := Trip{Id: record["trip_id"], RouteId: record["route_id"], Headsign: record["trip_headsign"], ShapeId: record["shape_id"]}
+				if value := record["direction_id"]; value != "" {
+					direction, err := strconv.ParseInt(value, 10, 32)
+					if err != nil {
+						return err
+					}
+					d := int32(direction)
+					trip.DirectionId = &d
+				}
+				g.trips[trip.Id] = trip
+				return nil
+			})
+		case "stop_times.txt":
+			g.stopTimes = make(map[string][]StopTime)
+			err = readGTFSTable(archive, table, func(record map[string]string) error {
+				sequence, err := strconv.ParseUint(record["stop_sequence"], 10, 32)
+				if err != nil {
+					return err
+				}
+				stopTime := StopTime{StopId: record["stop_id"], StopSequence: uint32(sequence)}
+				// Untimed stops between timepoints have empty times, and are skipped
+				if record["arrival_time"] == "" || record["departure_time"] == "" {
+					return nil
+				}
+				if stopTime.ArrivalTime, err = parseGTFSTime(record["arrival_time"]); err != nil {
+					return err
+				}
+				if stopTime.DepartureTime, err = parseGTFSTime(record["departure_time"]); err != nil {
+					return err
+				}
+				tripId := record["trip_id"]
+				g.stopTimes[tripId] = append(g.stopTimes[tripId], stopTime)
+				return nil
+			})
+			for _, stopTimes := range g.stopTimes {
+				sort.Slice(stopTimes, func(i, j int) bool { return stopTimes[i].StopSequence < stopTimes[j].StopSequence })
+			}
+		case "shapes.txt":
+			g.shapes = make(map[string][]ShapePoint)
+			err = readGTFSTable(archive, table, func(record map[string]string) error {
+				lat, err := strconv.ParseFloat(record["shape_pt_lat"], 64)
+				if err != nil {
+					return err
+				}
+				lon, err := strconv.ParseFloat(record["shape_pt_lon"], 64)
+				if err != nil {
+					return err
+				}
+				sequence, err := strconv.Atoi(record["shape_pt_sequence"])
+				if err != nil {
+					return err
+				}
+				shapeId := record["shape_id"]
+				g.shapes[shapeId] = append(g.shapes[shapeId], ShapePoint{Latitude: lat, Longitude: lon, Sequence: sequence})
+				return nil
+			})
+			for _, points := range g.shapes {
+				sort.Slice(points, func(i, j int) bool { return points[i].Sequence < points[j].Sequence })
+			}
+		default:
+			return nil, fmt.Errorf("unsupported GTFS table: %s", table)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ScheduleConfig is a command run periodically by supervise.
+type ScheduleConfig struct {
+	// Command and its arguments, e.g. "vehicleupdates" or "archive"
+	Command string
+	// IntervalSeconds between the starts of runs. A run overrunning it delays the next rather than overlapping it.
+	IntervalSeconds int
+}
+
+// Commands which can't be scheduled, as they don't run against a config, would recurse or never finish
+var unschedulableCommands = map[string]bool{"supervise": true, "daemon": true, "init": true, "completion": true, "version": true}
+
+// A tenant is one of the configs run by supervise, with its own feeds, data directory and schedule.
+type tenant struct {
+	name string
+	// configPath is absolute, since commands run in the config's directory
+	configPath string
+	config     Config
+}
+
+// tenantName names a config after its file, or its directory for files named gtfs-scraper.json.
+func tenantName(configPath string) string {
+	if filepath.Base(configPath) == configFileName {
+		return filepath.Base(filepath.Dir(configPath))
+	}
+	return strings.TrimSuffix(filepath.Base(configPath), filepath.Ext(configPath))
+}
+
+// loadTenants loads the given config files and the JSON files in configDir, if set,
+// checking that their data and metrics don't overlap.
+func loadTenants(configDir string, paths []string) ([]tenant, error) {
+	if configDir != "" {
+		matches, err := filepath.Glob(filepath.Join(configDir, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("no configs to supervise, pass config files or --config-dir")
+	}
+
+	var tenants []tenant
+	names := make(map[string]string)
+	dataDirs := make(map[string]string)
+	metricGroups := make(map[string]string)
+	for _, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		config, err := loadConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		t := tenant{name: tenantName(path), configPath: path, config: config}
+		if other, ok := names[t.name]; ok {
+			return nil, fmt.Errorf("%s and %s would both be named %s, rename one", other, path, t.name)
+		}
+		names[t.name] = path
+		if len(config.Schedule) == 0 {
+			return nil, fmt.Errorf("%s: no Schedule of commands to run", path)
+		}
+		for _, entry := range config.Schedule {
+			args := strings.Fields(entry.Command)
+			if len(args) == 0 || unschedulableCommands[args[0]] {
+				return nil, fmt.Errorf("%s: can't schedule command %q", path, entry.Command)
+			}
+			if entry.IntervalSeconds <= 0 {
+				return nil, fmt.Errorf("%s: command %q needs a positive IntervalSeconds", path, entry.Command)
+			}
+		}
+
+		// The feeds of one tenant may share a data directory, but not with other tenants
+		feeds, err := feedConfigs(config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, feed := range feeds {
+			// Relative data directories are relative to the config, which is where its commands run
+			dataDir := feed.DataDir
+			if !filepath.IsAbs(dataDir) {
+				dataDir = filepath.Join(filepath.Dir(path), dataDir)
+			}
+			dataDir = filepath.Clean(dataDir)
+			if other, ok := dataDirs[dataDir]; ok && other != path {
+				return nil, fmt.Errorf("%s and %s share the data directory %s, give each its own DataDir", other, path, dataDir)
+			}
+			dataDirs[dataDir] = path
+			if config.Pushgateway.URL != "" {
+				group := strings.TrimSuffix(config.Pushgateway.URL, "/") + pushgatewayGroupPath(config.Pushgateway, feed.FeedId)
+				if other, ok := metricGroups[group]; ok && other != path {
+					return nil, fmt.Errorf("%s and %s would push metrics to the same group, set distinct Pushgateway.Labels", other, path)
+				}
+				metricGroups[group] = path
+			}
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+// linePrefixer writes complete lines with a prefix, so the output of concurrent commands can be told apart.
+type linePrefixer struct {
+	// mu is shared by all prefixers writing to out, so lines aren't interleaved
+	mu      *sync.Mutex
+	out     io.Writer
+	prefix  string
+	partial []byte
+}
+
+func (w *linePrefixer) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		end := bytes.IndexByte(w.partial, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		w.writeLine(w.partial[:end+1])
+		w.partial = w.partial[end+1:]
+	}
+}
+
+// flush writes a final line without a newline, if any.
+func (w *linePrefixer) flush() {
+	if len(w.partial) > 0 {
+		w.writeLine(append(w.partial, '\n'))
+		w.partial = nil
+	}
+}
+
+func (w *linePrefixer) writeLine(line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	io.WriteString(w.out, w.prefix)
+	w.out.Write(line)
+}
+
+// supervisor runs the scheduled commands of each tenant as child processes, so that tenants are isolated from
+// each other's failures and from settings such as feed credentials, which are kept per process.
+type supervisor struct {
+	executable string
+	// logArgs pass --log-level and --log-format on to the commands, as given to supervise
+	logArgs []string
+	// jobs limits the commands running at once across tenants
+	jobs   chan struct{}
+	output sync.Mutex
+}
+
+// runOnce runs a scheduled command, returning false if it was cancelled before starting.
+func (s *supervisor) runOnce(ctx context.Context, t tenant, entry ScheduleConfig) bool {
+	select {
+	case s.jobs <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	defer func() { <-s.jobs }()
+
+	args := append(append([]string{"--config", t.configPath}, s.logArgs...), strings.Fields(entry.Command)...)
+	// Not bound to ctx, so that runs in progress when the supervisor is stopped finish rather than being killed
+	// partway through. They're only interrupted by signals sent to them too, e.g. Ctrl+C in a terminal.
+	cmd := exec.Command(s.executable, args...)
+	cmd.Dir = filepath.Dir(t.configPath)
+	output := &linePrefixer{mu: &s.output, out: os.Stderr, prefix: "[" + t.name + "] "}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	start := time.Now()
+	err := cmd.Run()
+	output.flush()
+	if err != nil {
+		slog.Error("Task failed", "task", t.name, "command", entry.Command, "after", time.Since(start).Round(time.Millisecond), "err", err)
+	}
+	return true
+}
+
+// schedule runs a command every interval until ctx is cancelled, starting straight away.
+func (s *supervisor) schedule(ctx context.Context, t tenant, entry ScheduleConfig) {
+	ticker := time.NewTicker(time.Duration(entry.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		if !s.runOnce(ctx, t, entry) {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// supervise runs the schedules of several configs from one process until interrupted,
+// waiting for commands in progress to finish before exiting. It logs as set by --log-level and --log-format,
+// as there's no config of its own.
+func supervise(args []string, logging LoggingConfig) error {
+	flags := flag.NewFlagSet("supervise", flag.ExitOnError)
+	configDir := flags.String("config-dir", "", "directory of config files, one per tenant")
+	jobs := flags.Int("jobs", 4, "maximum commands running at once")
+	flags.Parse(args)
+	if *jobs < 1 {
+		return fmt.Errorf("--jobs must be at least 1, got %d", *jobs)
+	}
+	if err := setupLogging(logging); err != nil {
+		return fmt.Errorf("%w: %w", ErrConfig, err)
+	}
+	var logArgs []string
+	if logging.Level != "" {
+		logArgs = append(logArgs, "--log-level", logging.Level)
+	}
+	if logging.Format != "" {
+		logArgs = append(logArgs, "--log-format", logging.Format)
+	}
+
+	tenants, err := loadTenants(*configDir, flags.Args())
+	if err != nil {
+		return err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	s := &supervisor{executable: executable, logArgs: logArgs, jobs: make(chan struct{}, *jobs)}
+
+	ctx, stop := signal.NotifyContext(runContext, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var wg sync.WaitGroup
+	for _, t := range tenants {
+		for _, entry := range t.config.Schedule {
+			wg.Add(1)
+			go func(t tenant, entry ScheduleConfig) {
+				defer wg.Done()
+				s.schedule(ctx, t, entry)
+			}(t, entry)
+		}
+		slog.Info("Supervising", "task", t.name, "config", t.configPath, "scheduled_commands", len(t.config.Schedule))
+	}
+	<-ctx.Done()
+	slog.Info("Stopping, waiting for running commands to finish")
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// TrackPoint is a position along a vehicle's track, for drawing or playing back its movements.
+type TrackPoint struct {
+	VehicleId string    `parquet:"vehicle_id" json:"vehicle_id"`
+	TripId    string    `parquet:"trip_id" json:"trip_id"`
+	RouteId   *string   `parquet:"route_id,optional" json:"route_id"`
+	Timestamp time.Time `parquet:"timestamp,timestamp(millisecond)" json:"timestamp"`
+	Latitude  float64   `parquet:"latitude" json:"-"`
+	Longitude float64   `parquet:"longitude" json:"-"`
+	Bearing   *float32  `parquet:"bearing,optional" json:"bearing"`
+	Speed     *float32  `parquet:"speed,optional" json:"speed"`
+	// Synthetic points filling a gap in reporting, placed along the trip's shape
+	Interpolated bool `parquet:"interpolated" json:"interpolated"`
+}
+
+type trackState struct {
+	point TrackPoint
+	// Distance along the trip's shape, or negative if the position didn't match the shape
+	along float64
+}
+
+// exportTracks writes every position as a track point, sorted by vehicle and time.
+// With --interpolate, gaps in a trip's positions shorter than the threshold are filled with points every --step
+// along the trip's shape, assuming a constant speed between the real positions.
+func exportTracks(config Config, args []string) error {
+	flags := flag.NewFlagSet("export tracks", flag.ExitOnError)
+	input := addAnalysisFlags(flags, config)
+	staticFile := flags.String("static", "", "static GTFS zip for --interpolate (default: the latest download in the static directory)")
+	output := flags.String("output", filepath.Join(config.DataDir, "tracks.csv"), "output file, as GeoJSON if it ends in .geojson, Parquet if it ends in .parquet and CSV otherwise")
+	interpolate := flags.Duration("interpolate", 0, "fill gaps between positions up to this long with interpolated points (default: off)")
+	step := flags.Duration("step", 30*time.Second, "interval between interpolated points")
+	maxOffset := flags.Float64("max-offset", 50, "only interpolate between positions within this many meters of the shape")
+	flags.Parse(args)
+
+	if *interpolate < 0 {
+		return fmt.Errorf("invalid --interpolate: %v", *interpolate)
+	}
+	if *step <= 0 {
+		return fmt.Errorf("invalid --step: %v", *step)
+	}
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return err
+	}
+	var static *staticGTFS
+	if *interpolate > 0 {
+		if *staticFile == "" {
+			if *staticFile, err = latestStaticFile(feedStaticDir(config)); err != nil {
+				return err
+			}
+		}
+		if static, err = loadStaticGTFS(*staticFile, "trips.txt", "shapes.txt"); err != nil {
+			return err
+		}
+	} else if *staticFile != "" {
+		return errors.New("--static is only used with --interpolate")
+	}
+
+	lines := make(map[string]*shapeLine)
+	last := make(map[tripInstance]trackState)
+	var points []TrackPoint
+	interpolated := 0
+	err = input.forEachPosition(config, location, func(vp *VehiclePosition) {
+		if vp.Latitude == nil || vp.Longitude == nil {
+			return
+		}
+		current := trackState{
+			point: TrackPoint{
+				VehicleId: vp.VehicleId,
+				TripId:    vp.TripId,
+				RouteId:   copyOptional(vp.RouteId),
+				Timestamp: vp.Timestamp,
+				Latitude:  float64(*vp.Latitude),
+				Longitude: float64(*vp.Longitude),
+				Bearing:   copyOptional(vp.Bearing),
+				Speed:     copyOptional(vp.Speed),
+			},
+			along: -1,
+		}
+		points = append(points, current.point)
+		if static == nil || vp.TripId == "" {
+			return
+		}
+		trip, found := static.trips[vp.TripId]
+		if !found || len(static.shapes[trip.ShapeId]) < 2 {
+			return
+		}
+		line, found := lines[trip.ShapeId]
+		if !found {
+			line = newShapeLine(static.shapes[trip.ShapeId])
+			lines[trip.ShapeId] = line
+		}
+		if along, offset := line.project(current.point.Latitude, current.point.Longitude); offset <= *maxOffset {
+			current.along = along
+		}
+
+		instance := tripInstance{vp.VehicleId, vp.TripId, vp.StartTimeUnix}
+		previous, found := last[instance]
+		last[instance] = current
+		gap := current.point.Timestamp.Sub(previous.point.Timestamp)
+		// Only fill forward movement along the shape, since anything else can't be placed on it
+		if !found || previous.along < 0 || current.along < previous.along || gap <= *step || gap > *interpolate {
+			return
+		}
+		for t := previous.point.Timestamp.Add(*step); t.Before(current.point.Timestamp); t = t.Add(*step) {
+			fraction := float64(t.Sub(previous.point.Timestamp)) / float64(gap)
+			lat, lon := line.at(previous.along + fraction*(current.along-previous.along))
+			points = append(points, TrackPoint{
+				VehicleId:    vp.VehicleId,
+				TripId:       vp.TripId,
+				RouteId:      copyOptional(vp.RouteId),
+				Timestamp:    t,
+				Latitude:     lat,
+				Longitude:    lon,
+				Interpolated: true,
+			})
+			interpolated++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if static != nil {
+		config.log().Debug("Interpolated points", "points", interpolated)
+	}
+
+	sort.SliceStable(points, func(i, j int) bool {
+		if points[i].VehicleId != points[j].VehicleId {
+			return points[i].VehicleId < points[j].VehicleId
+		}
+		return points[i].Timestamp.Before(points[j].Timestamp)
+	})
+	if filepath.Ext(*output) == ".geojson" {
+		return writeTrackGeoJSON(*output, points)
+	}
+	return writeAnalysis(*output, points)
+}
+
+// writeTrackGeoJSON writes a point feature for each track point, with its time and whether it was interpolated.
+func writeTrackGeoJSON(output string, points []TrackPoint) error {
+	collection := struct {
+		Type     string           `json:"type"`
+		Features []geoJSONFeature `json:"features"`
+	}{Type: "FeatureCollection", Features: make([]geoJSONFeature, 0, len(points))}
+	for _, point := range points {
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONPoint{Type: "Point", Coordinates: [2]float64{point.Longitude, point.Latitude}},
+			Properties: point,
+		})
+	}
+	contents, err := json.Marshal(collection)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(output, contents); err != nil {
+		return err
+	}
+	slog.Info("Wrote features", "features", len(collection.Features), "output", output)
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/jmoiron/sqlx"
+)
+
+// Each row links a trip_id as stored on a service date to the trip's identity across static GTFS versions, its route,
+// direction and scheduled start time, for agencies which regenerate trip_ids with each release. Join on
+// (feed_id, trip_id, service_date) and group by (route_id, direction_id, start_time, service_date) to follow
+// a scheduled trip from one release to the next.
+var tripIdentityColumns = []ColumnInfo{
+	{Name: "feed_id", Type: "TEXT NOT NULL"},
+	{Name: "trip_id", Type: "TEXT NOT NULL"},
+	// The start_date of the realtime trip, or the local date the trip started otherwise, as YYYYMMDD
+	{Name: "service_date", Type: "TEXT NOT NULL"},
+	{Name: "route_id", Type: "TEXT NOT NULL"},
+	{Name: "direction_id", Type: "INTEGER"},
+	// The first departure of the trip as HH:MM:SS since the start of the service day, which can be past 24:00:00
+	{Name: "start_time", Type: "TEXT NOT NULL"},
+	// The static GTFS file the trip was found in, or NULL for trips only described by the realtime feed
+	{Name: "static_version", Type: "TEXT"},
+}
+
+func createTripIdentitiesTableQuery() string {
+	return createTableIfNotExistsQuery("trip_identities", tripIdentityColumns, "feed_id, trip_id, service_date")
+}
+
+// TripIdentity is a row of trip_identities.
+type TripIdentity struct {
+	FeedId        string  `db:"feed_id"`
+	TripId        string  `db:"trip_id"`
+	ServiceDate   string  `db:"service_date"`
+	RouteId       string  `db:"route_id"`
+	DirectionId   *int32  `db:"direction_id"`
+	StartTime     string  `db:"start_time"`
+	StaticVersion *string `db:"static_version"`
+}
+
+// scheduledTrip is what identifies a trip of the static GTFS across versions.
+type scheduledTrip struct {
+	routeId     string
+	directionId *int32
+	// Seconds since the start of the service day
+	firstDeparture int
+}
+
+// tripIdentityIndex holds the scheduled trips of a static GTFS version.
+type tripIdentityIndex struct {
+	version string
+	trips   map[string]scheduledTrip
+}
+
+var (
+	tripIdentityMu sync.Mutex
+	// Loaded on first use for each feed, from the static GTFS latest then
+	tripIdentityIndexes = make(map[string]*tripIdentityIndex)
+)
+
+// loadTripIdentityIndex reads the scheduled trips of a feed's latest static GTFS.
+func loadTripIdentityIndex(config Config) (*tripIdentityIndex, error) {
+	staticFile, err := latestStaticFile(feedStaticDir(config))
+	if err != nil {
+		return nil, err
+	}
+	static, err := loadStaticGTFS(staticFile, "trips.txt", "stop_times.txt")
+	if err != nil {
+		return nil, err
+	}
+	index := &tripIdentityIndex{version: filepath.Base(staticFile), trips: make(map[string]scheduledTrip, len(static.trips))}
+	for id, trip := range static.trips {
+		stopTimes := static.stopTimes[id]
+		if len(stopTimes) == 0 {
+			continue
+		}
+		index.trips[id] = scheduledTrip{routeId: trip.RouteId, directionId: trip.DirectionId, firstDeparture: stopTimes[0].DepartureTime}
+	}
+	config.log().Info("Identifying trips by route, direction and start time", "version", index.version)
+	return index, nil
+}
+
+// formatGTFSTime formats seconds since the start of a service day as HH:MM:SS.
+func formatGTFSTime(seconds int) string {
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// tripIdentity identifies the trip of a realtime trip descriptor, using the realtime route, direction and start
+// time where the static GTFS doesn't have the trip, e.g. for added trips. Without a start date, the service date is
+// taken to be the local date of the update's timestamp less the trip's start time, give or take 12 hours, so trips
+// running past midnight keep the service date they started on. It returns nil for trips it can't identify.
+func (index *tripIdentityIndex) tripIdentity(feedId string, trip *gtfs.TripDescriptor, timestamp int64, location *time.Location) *TripIdentity {
+	if trip.GetTripId() == "" {
+		return nil
+	}
+	identity := &TripIdentity{FeedId: feedId, TripId: trip.GetTripId(), ServiceDate: trip.GetStartDate()}
+	scheduled, found := index.trips[trip.GetTripId()]
+	if found {
+		identity.RouteId, identity.DirectionId = scheduled.routeId, scheduled.directionId
+		identity.StartTime = formatGTFSTime(scheduled.firstDeparture)
+		identity.StaticVersion = &index.version
+	} else {
+		identity.RouteId, identity.DirectionId = trip.GetRouteId(), optionalInt32(trip.DirectionId)
+	}
+	// Frequency-based trips have the start time of each run in the realtime feed
+	if trip.GetStartTime() != "" {
+		seconds, err := parseGTFSTime(trip.GetStartTime())
+		if err != nil {
+			return nil
+		}
+		scheduled.firstDeparture = seconds
+		identity.StartTime = formatGTFSTime(seconds)
+	}
+	if identity.RouteId == "" || identity.StartTime == "" {
+		return nil
+	}
+	if identity.ServiceDate == "" {
+		if timestamp == 0 {
+			return nil
+		}
+		start := time.Unix(timestamp-int64(scheduled.firstDeparture)+12*60*60, 0).In(location)
+		identity.ServiceDate = start.Format(serviceDateLayout)
+	}
+	return identity
+}
+
+// recordTripIdentities stores the identities of the trips in a feed, if enabled for it. Trips already identified
+// on their service date are kept as they were first identified.
+func recordTripIdentities(db *sqlx.DB, config Config, feed *gtfs.FeedMessage, location *time.Location) error {
+	if !config.TripIdentities {
+		return nil
+	}
+	tripIdentityMu.Lock()
+	index := tripIdentityIndexes[config.FeedId]
+	if index == nil {
+		var err error
+		if index, err = loadTripIdentityIndex(config); err != nil {
+			tripIdentityMu.Unlock()
+			return err
+		}
+		tripIdentityIndexes[config.FeedId] = index
+	}
+	tripIdentityMu.Unlock()
+
+	identities := make(map[[2]string]*TripIdentity)
+	for _, entity := range feed.Entity {
+		var trip *gtfs.TripDescriptor
+		var timestamp uint64
+		if entity.Vehicle != nil {
+			trip, timestamp = entity.Vehicle.Trip, entity.Vehicle.GetTimestamp()
+		} else if entity.TripUpdate != nil {
+			trip, timestamp = entity.TripUpdate.Trip, entity.TripUpdate.GetTimestamp()
+		} else {
+			continue
+		}
+		if timestamp == 0 {
+			timestamp = feed.GetHeader().GetTimestamp()
+		}
+		if identity := index.tripIdentity(config.FeedId, trip, int64(timestamp), location); identity != nil {
+			identities[[2]string{identity.TripId, identity.ServiceDate}] = identity
+		}
+	}
+	if len(identities) == 0 {
+		return nil
+	}
+
+	ctx, cancel := dbContext()
+	defer cancel()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareNamedContext(ctx, "INSERT OR IGNORE INTO trip_identities (feed_id, trip_id, service_date, route_id, direction_id, start_time, static_version) "+
+		"VALUES (:feed_id, :trip_id, :service_date, :route_id, :direction_id, :start_time, :static_version)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, identity := range identities {
+		if _, err := stmt.ExecContext(ctx, identity); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Trip updates are archived in Parquet under trip_updates/ in the archive directory, in the same monthly partitions
+// as vehicle positions. Each row is a trip update with its stop time updates nested in a list, in the order published.
+// The archive's column settings (ExcludeColumns, RenameColumns, TimestampUnit and so on) only apply to vehicle
+// positions; trip update timestamps are always in milliseconds.
+const (
+	tripUpdatesArchiveDir  = "trip_updates"
+	tripUpdatesArchiveFile = "trip_updates.parquet"
+)
+
+type archivedStopTimeUpdate struct {
+	StopSequence *uint32 `parquet:"stop_sequence"`
+	StopId       *string `parquet:"stop_id,dict"`
+	ArrivalDelay *int32  `parquet:"arrival_delay"`
+	// Arrival and departure times are Unix times, as published
+	ArrivalTime          *int64 `parquet:"arrival_time"`
+	ArrivalUncertainty   *int32 `parquet:"arrival_uncertainty"`
+	DepartureDelay       *int32 `parquet:"departure_delay"`
+	DepartureTime        *int64 `parquet:"departure_time"`
+	DepartureUncertainty *int32 `parquet:"departure_uncertainty"`
+	ScheduleRelationship *int32 `parquet:"schedule_relationship"`
+	Derived              bool   `parquet:"derived"`
+}
+
+type archivedTripUpdate struct {
+	FeedId               string                   `parquet:"feed_id,dict"`
+	TripId               string                   `parquet:"trip_id"`
+	RouteId              *string                  `parquet:"route_id,dict"`
+	DirectionId          *int32                   `parquet:"direction_id"`
+	StartTime            time.Time                `parquet:"start_time,timestamp(millisecond)"`
+	StartDate            *string                  `parquet:"start_date,dict"`
+	ScheduleRelationship *int32                   `parquet:"schedule_relationship"`
+	Timestamp            time.Time                `parquet:"timestamp,timestamp(millisecond),delta"`
+	Delay                *int32                   `parquet:"delay"`
+	VehicleId            *string                  `parquet:"vehicle_id,dict"`
+	VehicleLabel         *string                  `parquet:"vehicle_label,dict"`
+	LicensePlate         *string                  `parquet:"license_plate,dict"`
+	WheelchairAccessible *int32                   `parquet:"wheelchair_accessible"`
+	AgencyId             *string                  `parquet:"agency_id,dict"`
+	StopTimeUpdates      []archivedStopTimeUpdate `parquet:"stop_time_updates,list"`
+	// Only used for partitioning
+	Year  int `parquet:"year"`
+	Month int `parquet:"month"`
+}
+
+// tripUpdateSeries identifies a trip's updates, which dedup tracks the latest of.
+func tripUpdateSeries(feedId, tripId string, startTime time.Time) string {
+	return feedId + "\x00" + tripId + "\x00" + startTime.UTC().Format(time.RFC3339)
+}
+
+// archiveRow converts a stored trip update and its stop time updates to an archived row.
+func (tu *TripUpdate) archiveRow(stops []StopTimeUpdate, period time.Time) archivedTripUpdate {
+	row := archivedTripUpdate{
+		FeedId:               tu.FeedId,
+		TripId:               tu.TripId,
+		RouteId:              tu.RouteId,
+		DirectionId:          tu.DirectionId,
+		StartTime:            time.Unix(tu.StartTimeUnix, 0).UTC(),
+		StartDate:            tu.StartDate,
+		ScheduleRelationship: tu.ScheduleRelationship,
+		Timestamp:            time.Unix(tu.TimestampUnix, 0).UTC(),
+		Delay:                tu.Delay,
+		VehicleId:            tu.VehicleId,
+		VehicleLabel:         tu.VehicleLabel,
+		LicensePlate:         tu.LicensePlate,
+		WheelchairAccessible: tu.WheelchairAccessible,
+		AgencyId:             tu.AgencyId,
+		StopTimeUpdates:      make([]archivedStopTimeUpdate, len(stops)),
+		Year:                 period.Year(),
+		Month:                int(period.Month()),
+	}
+	for i, s := range stops {
+		row.StopTimeUpdates[i] = archivedStopTimeUpdate{
+			StopSequence:         s.StopSequence,
+			StopId:               s.StopId,
+			ArrivalDelay:         s.ArrivalDelay,
+			ArrivalTime:          s.ArrivalTime,
+			ArrivalUncertainty:   s.ArrivalUncertainty,
+			DepartureDelay:       s.DepartureDelay,
+			DepartureTime:        s.DepartureTime,
+			DepartureUncertainty: s.DepartureUncertainty,
+			ScheduleRelationship: s.ScheduleRelationship,
+			Derived:              s.Derived,
+		}
+	}
+	return row
+}
+
+// tripUpdatePartitionCondition restricts the trip_updates table, aliased t, to a month's partition
+// with a timestamp from startTime onwards, as queryPartition does for vehicle positions.
+func tripUpdatePartitionCondition(config ArchiveConfig, period time.Time, startTime time.Time) (string, []any) {
+	start, end := partitionMonth(config, period)
+	feed, feedArgs := feedCondition(config, "t")
+	if config.PartitionBy == "service_date" {
+		return "t.timestamp >= ? AND (t.start_date >= ? AND t.start_date < ? OR t.start_date IS NULL AND t.timestamp >= ? AND t.timestamp < ?)" + feed,
+			append([]any{startTime.Unix(), period.Format(serviceDateLayout), period.AddDate(0, 1, 0).Format(serviceDateLayout), start.Unix(), end.Unix()}, feedArgs...)
+	}
+	return "t.timestamp >= ? AND t.timestamp < ?" + feed, append([]any{startTime.Unix(), end.Unix()}, feedArgs...)
+}
+
+const tripUpdateOrder = " ORDER BY t.feed_id, t.trip_id, t.start_time, t.timestamp"
+
+// readArchivedTripUpdates reads every row of an archived trip updates file, passing them to fn in batches.
+func readArchivedTripUpdates(path string, fn func(rows []archivedTripUpdate) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	file, err := openParquetFile(f)
+	if err != nil {
+		return err
+	}
+	reader := parquet.NewGenericReader[archivedTripUpdate](file)
+	defer reader.Close()
+	rows := make([]archivedTripUpdate, 1_000)
+	for {
+		n, err := reader.Read(rows)
+		if n > 0 {
+			if err := fn(rows[:n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// writeTripUpdatePartition appends a month's new trip updates to its archived file, skipping updates no newer
+// than the file's latest update of the same trip, like the default Dedup of vehicle positions.
+func (a *archiver) writeTripUpdatePartition(period time.Time, urls []string) (err error) {
+	ym := period.Format(yearMonthLayout)
+	logger := a.config.log().With("month", ym, "table", "trip_updates")
+	dir := monthDir(filepath.Join(a.dir, tripUpdatesArchiveDir), period)
+	if err = os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, tripUpdatesArchiveFile)
+
+	lastUpdates := make(map[string]time.Time)
+	var oldRows int64
+	var timestamps timestampRange
+	err = readArchivedTripUpdates(path, func(rows []archivedTripUpdate) error {
+		for _, row := range rows {
+			series := tripUpdateSeries(row.FeedId, row.TripId, row.StartTime)
+			if row.Timestamp.After(lastUpdates[series]) {
+				lastUpdates[series] = row.Timestamp
+			}
+			timestamps.add(row.Timestamp)
+		}
+		oldRows += int64(len(rows))
+		return nil
+	})
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// Rows older than every trip's last archived update can't be new
+	startTime := partitionStart(a.config, period)
+	if exists {
+		logger.Debug("Found rows in the existing file", "rows", oldRows, "trips", len(lastUpdates))
+		var minUpdate time.Time
+		for _, t := range lastUpdates {
+			if minUpdate.IsZero() || t.Before(minUpdate) {
+				minUpdate = t
+			}
+		}
+		if minUpdate.After(startTime) {
+			startTime = minUpdate
+		}
+	}
+
+	stagingPath := path + ".tmp"
+	f, err := os.Create(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(stagingPath)
+		}
+	}()
+	writer := parquet.NewGenericWriter[archivedTripUpdate](f, a.writerConfig)
+	if urlsJSON, err := json.Marshal(urls); err == nil {
+		writer.SetKeyValueMetadata(feedURLsMetadataKey, string(urlsJSON))
+	}
+	if exists {
+		if err = readArchivedTripUpdates(path, func(rows []archivedTripUpdate) error {
+			_, err := writer.Write(rows)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	var nNew, nSkipped int
+	err = readStoredTripUpdates(a.db, a.config, period, startTime, func(rows []archivedTripUpdate) error {
+		batch := rows[:0]
+		for _, row := range rows {
+			if lastUpdate, found := lastUpdates[tripUpdateSeries(row.FeedId, row.TripId, row.StartTime)]; found && !row.Timestamp.After(lastUpdate) {
+				nSkipped++
+				continue
+			}
+			nNew++
+			timestamps.add(row.Timestamp)
+			batch = append(batch, row)
+		}
+		_, err := writer.Write(batch)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !exists && nNew == 0 {
+		// Don't leave an empty file for a month without trip updates
+		writer.Close()
+		f.Close()
+		return os.Remove(stagingPath)
+	}
+
+	setContentMetadata(writer, oldRows+int64(nNew), timestamps)
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	logger.Info("Wrote partition file", "new_rows", nNew, "skipped_rows", nSkipped)
+	if err = os.Rename(stagingPath, path); err != nil {
+		return err
+	}
+	if a.encryptor != nil {
+		return a.encryptor.encryptFile(path)
+	}
+	return nil
+}
+
+// readStoredTripUpdates reads a month's trip updates in the database with a timestamp from startTime onwards,
+// passing them to fn in batches as archived rows with their stop time updates, in tripUpdateOrder.
+func readStoredTripUpdates(db *sqlx.DB, config ArchiveConfig, period time.Time, startTime time.Time, fn func(rows []archivedTripUpdate) error) error {
+	// Trip updates are read a page at a time with their stop time updates, so only one query is open at once,
+	// since the daemon's database has only one connection
+	condition, args := tripUpdatePartitionCondition(config, period, startTime)
+	var after *TripUpdate
+	for {
+		pageCondition, pageArgs := condition, args
+		if after != nil {
+			pageCondition += " AND (t.feed_id, t.trip_id, t.start_time, t.timestamp) > (?, ?, ?, ?)"
+			pageArgs = append(append([]any(nil), args...), after.FeedId, after.TripId, after.StartTimeUnix, after.TimestampUnix)
+		}
+		var trips []TripUpdate
+		if err := db.SelectContext(context.Background(), &trips,
+			"SELECT "+selectColumns(tripUpdateColumns)+" FROM trip_updates t WHERE "+pageCondition+tripUpdateOrder+" LIMIT ?",
+			append(pageArgs, writeBatchSize)...); err != nil {
+			return err
+		}
+		if len(trips) == 0 {
+			return nil
+		}
+		last := trips[len(trips)-1]
+		var stops []StopTimeUpdate
+		if err := db.SelectContext(context.Background(), &stops,
+			"SELECT "+selectColumns(stopTimeUpdateColumns)+" FROM stop_time_updates WHERE (feed_id, trip_id, start_time, timestamp) IN"+
+				" (SELECT feed_id, trip_id, start_time, timestamp FROM trip_updates t WHERE "+pageCondition+
+				" AND (t.feed_id, t.trip_id, t.start_time, t.timestamp) <= (?, ?, ?, ?))"+
+				" ORDER BY feed_id, trip_id, start_time, timestamp, update_index",
+			append(pageArgs, last.FeedId, last.TripId, last.StartTimeUnix, last.TimestampUnix)...); err != nil {
+			return err
+		}
+
+		// Stop time updates are merged with their trip updates, as both are in the same order
+		rows := make([]archivedTripUpdate, 0, len(trips))
+		for i := range trips {
+			tu := &trips[i]
+			n := 0
+			for n < len(stops) && stops[n].FeedId == tu.FeedId && stops[n].TripId == tu.TripId &&
+				stops[n].StartTimeUnix == tu.StartTimeUnix && stops[n].TimestampUnix == tu.TimestampUnix {
+				n++
+			}
+			rows = append(rows, tu.archiveRow(stops[:n], period))
+			stops = stops[n:]
+		}
+		if err := fn(rows); err != nil {
+			return err
+		}
+		after = &last
+	}
+}
+
+// findTripUpdateRange finds the months with trip updates, or returns zero times if there are none,
+// including in databases from before trip updates were stored.
+func findTripUpdateRange(db *sqlx.DB, config ArchiveConfig) (startMonth time.Time, endMonth time.Time, err error) {
+	startMonth, endMonth, err = findTableRange(db, config, "trip_updates")
+	if isMissingTable(err, "trip_updates") {
+		return time.Time{}, time.Time{}, nil
+	}
+	return startMonth, endMonth, err
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/jmoiron/sqlx"
+)
+
+// Trip updates are stored like vehicle positions, one row per trip and timestamp, with their stop time updates
+// in a child table. Republished updates with an unchanged timestamp are ignored.
+var tripUpdateColumns = []ColumnInfo{
+	{Name: "feed_id", Type: "TEXT NOT NULL"},
+	{Name: "trip_id", Type: "TEXT"},
+	{Name: "route_id", Type: "TEXT"},
+	{Name: "direction_id", Type: "INT8"},
+	{Name: "start_time", Type: "DATETIME"},
+	{Name: "start_date", Type: "TEXT"},
+	{Name: "schedule_relationship", Type: "INT8"},
+	{Name: "timestamp", Type: "DATETIME"},
+	{Name: "delay", Type: "INTEGER"},
+	{Name: "vehicle_id", Type: "TEXT"},
+	{Name: "vehicle_label", Type: "TEXT"},
+	{Name: "license_plate", Type: "TEXT"},
+	{Name: "wheelchair_accessible", Type: "INT8"},
+	{Name: "agency_id", Type: "TEXT"},
+}
+
+// Each row is a stop time update of the trip update with the same feed_id, trip_id, start_time and timestamp,
+// in the order published.
+var stopTimeUpdateColumns = []ColumnInfo{
+	{Name: "feed_id", Type: "TEXT NOT NULL"},
+	{Name: "trip_id", Type: "TEXT"},
+	{Name: "start_time", Type: "DATETIME"},
+	{Name: "timestamp", Type: "DATETIME"},
+	{Name: "update_index", Type: "INTEGER NOT NULL"},
+	{Name: "stop_sequence", Type: "INTEGER"},
+	{Name: "stop_id", Type: "TEXT"},
+	{Name: "arrival_delay", Type: "INTEGER"},
+	{Name: "arrival_time", Type: "DATETIME"},
+	{Name: "arrival_uncertainty", Type: "INTEGER"},
+	{Name: "departure_delay", Type: "INTEGER"},
+	{Name: "departure_time", Type: "DATETIME"},
+	{Name: "departure_uncertainty", Type: "INTEGER"},
+	{Name: "schedule_relationship", Type: "INT8"},
+	// Derived updates were added by TripUpdates.PropagateDelays rather than published
+	{Name: "derived", Type: "BOOLEAN NOT NULL"},
+}
+
+func createTripUpdatesTableQuery() string {
+	return createTableIfNotExistsQuery("trip_updates", tripUpdateColumns, "feed_id, trip_id, start_time, timestamp")
+}
+
+func createStopTimeUpdatesTableQuery() string {
+	return createTableIfNotExistsQuery("stop_time_updates", stopTimeUpdateColumns, "feed_id, trip_id, start_time, timestamp, update_index")
+}
+
+// TripUpdate is a flattened GTFS-RT TripUpdate, without its stop time updates.
+// Optional fields are pointers so that missing values are stored as NULLs rather than zeros.
+type TripUpdate struct {
+	FeedId               string    `db:"feed_id" json:"feed_id"`
+	TripId               string    `db:"trip_id" json:"trip_id"`
+	RouteId              *string   `db:"route_id" json:"route_id"`
+	DirectionId          *int32    `db:"direction_id" json:"direction_id"`
+	StartTime            time.Time `db:"-" json:"start_time"`
+	StartTimeUnix        int64     `db:"start_time" json:"-"`
+	StartDate            *string   `db:"start_date" json:"start_date"`
+	ScheduleRelationship *int32    `db:"schedule_relationship" json:"schedule_relationship"`
+	// Timestamp is when the update was measured, or the feed's timestamp if it doesn't say
+	Timestamp     time.Time `db:"-" json:"timestamp"`
+	TimestampUnix int64     `db:"timestamp" json:"-"`
+	// Delay of the whole trip in seconds, which stop time updates take precedence over
+	Delay                *int32  `db:"delay" json:"delay"`
+	VehicleId            *string `db:"vehicle_id" json:"vehicle_id"`
+	VehicleLabel         *string `db:"vehicle_label" json:"vehicle_label"`
+	LicensePlate         *string `db:"license_plate" json:"license_plate"`
+	WheelchairAccessible *int32  `db:"wheelchair_accessible" json:"wheelchair_accessible"`
+	AgencyId             *string `db:"agency_id" json:"agency_id"`
+}
+
+// StopTimeUpdate is a flattened GTFS-RT StopTimeUpdate, keyed by its trip update.
+// Arrival and departure times are Unix times.
+type StopTimeUpdate struct {
+	FeedId               string  `db:"feed_id" json:"feed_id"`
+	TripId               string  `db:"trip_id" json:"trip_id"`
+	StartTimeUnix        int64   `db:"start_time" json:"-"`
+	TimestampUnix        int64   `db:"timestamp" json:"-"`
+	UpdateIndex          int     `db:"update_index" json:"update_index"`
+	StopSequence         *uint32 `db:"stop_sequence" json:"stop_sequence"`
+	StopId               *string `db:"stop_id" json:"stop_id"`
+	ArrivalDelay         *int32  `db:"arrival_delay" json:"arrival_delay"`
+	ArrivalTime          *int64  `db:"arrival_time" json:"arrival_time"`
+	ArrivalUncertainty   *int32  `db:"arrival_uncertainty" json:"arrival_uncertainty"`
+	DepartureDelay       *int32  `db:"departure_delay" json:"departure_delay"`
+	DepartureTime        *int64  `db:"departure_time" json:"departure_time"`
+	DepartureUncertainty *int32  `db:"departure_uncertainty" json:"departure_uncertainty"`
+	ScheduleRelationship *int32  `db:"schedule_relationship" json:"schedule_relationship"`
+	Derived              bool    `db:"derived" json:"derived"`
+}
+
+// fromFeedEntity reads a ProtoBuf TripUpdate into a package-local TripUpdate and its StopTimeUpdates.
+// Updates without a timestamp are given the feed's, feedTimestamp. Updates in derived are flagged as such.
+func (tu *TripUpdate) fromFeedEntity(update *gtfs.TripUpdate, feedTimestamp int64, location *time.Location,
+	derived map[*gtfs.TripUpdate_StopTimeUpdate]bool) ([]StopTimeUpdate, error) {
+	trip := update.GetTrip()
+	startTime, err := tripStartTime(trip, location)
+	if err != nil {
+		return nil, err
+	}
+	tu.TripId = trip.GetTripId()
+	tu.StartTimeUnix = startTime.Unix()
+	tu.StartTime = startTime.UTC()
+	if trip.GetStartDate() != "" {
+		tu.StartDate = copyOptional(trip.StartDate)
+	}
+	tu.RouteId = copyOptional(trip.RouteId)
+	tu.DirectionId = optionalInt32(trip.DirectionId)
+	tu.ScheduleRelationship = optionalInt32(trip.ScheduleRelationship)
+	tu.TimestampUnix = int64(update.GetTimestamp())
+	if tu.TimestampUnix == 0 {
+		tu.TimestampUnix = feedTimestamp
+	}
+	tu.Timestamp = time.Unix(tu.TimestampUnix, 0).UTC()
+	tu.Delay = copyOptional(update.Delay)
+	if vehicle := update.GetVehicle(); vehicle != nil {
+		tu.VehicleId = copyOptional(vehicle.Id)
+		tu.VehicleLabel = copyOptional(vehicle.Label)
+		tu.LicensePlate = copyOptional(vehicle.LicensePlate)
+		tu.WheelchairAccessible = unknownEnum(vehicle, vehicleDescriptorWheelchairAccessible)
+	}
+
+	stopTimeUpdates := make([]StopTimeUpdate, len(update.StopTimeUpdate))
+	for i, u := range update.StopTimeUpdate {
+		stopTimeUpdates[i] = StopTimeUpdate{
+			FeedId:               tu.FeedId,
+			TripId:               tu.TripId,
+			StartTimeUnix:        tu.StartTimeUnix,
+			TimestampUnix:        tu.TimestampUnix,
+			UpdateIndex:          i,
+			StopSequence:         copyOptional(u.StopSequence),
+			StopId:               copyOptional(u.StopId),
+			ScheduleRelationship: optionalInt32(u.ScheduleRelationship),
+			Derived:              derived[u],
+		}
+		if arrival := u.GetArrival(); arrival != nil {
+			stopTimeUpdates[i].ArrivalDelay = copyOptional(arrival.Delay)
+			stopTimeUpdates[i].ArrivalTime = copyOptional(arrival.Time)
+			stopTimeUpdates[i].ArrivalUncertainty = copyOptional(arrival.Uncertainty)
+		}
+		if departure := u.GetDeparture(); departure != nil {
+			stopTimeUpdates[i].DepartureDelay = copyOptional(departure.Delay)
+			stopTimeUpdates[i].DepartureTime = copyOptional(departure.Time)
+			stopTimeUpdates[i].DepartureUncertainty = copyOptional(departure.Uncertainty)
+		}
+	}
+	return stopTimeUpdates, nil
+}
+
+// addTripUpdates inserts the trip updates in a feed along with their stop time updates.
+// Timestamps from the feed are localized to the specified location.
+// Returns the number of trip updates and stop time updates which were not already present in the database.
+func addTripUpdates(feed *gtfs.FeedMessage, db *sqlx.DB, feedId string, agencyId *string, location *time.Location,
+	derived map[*gtfs.TripUpdate_StopTimeUpdate]bool) (int, int, error) {
+	feedTimestamp := int64(feed.GetHeader().GetTimestamp())
+	if feedTimestamp == 0 {
+		feedTimestamp = time.Now().Unix()
+	}
+
+	c, err := beginChunkedTx(db, insertIntoQuery("trip_updates", tripUpdateColumns), insertIntoQuery("stop_time_updates", stopTimeUpdateColumns))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer c.rollback()
+
+	var trips, stops int
+	for _, entity := range feed.Entity {
+		if entity.TripUpdate == nil {
+			continue
+		}
+		tu := TripUpdate{FeedId: feedId, AgencyId: agencyId}
+		stopTimeUpdates, err := tu.fromFeedEntity(entity.TripUpdate, feedTimestamp, location, derived)
+		if err != nil {
+			// One malformed trip shouldn't lose the rest of the feed
+			slog.Warn("Skipping trip update", "entity", entity.GetId(), "err", err)
+			continue
+		}
+		normalizeVehicle(feedId, &tu.VehicleLabel, &tu.LicensePlate)
+		result, err := c.stmts[0].ExecContext(c.ctx, &tu)
+		if err != nil {
+			return 0, 0, err
+		}
+		// An unchanged update republished in a later poll is already stored, stop time updates and all
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+		trips++
+		for i := range stopTimeUpdates {
+			if _, err := c.stmts[1].ExecContext(c.ctx, &stopTimeUpdates[i]); err != nil {
+				return 0, 0, err
+			}
+		}
+		stops += len(stopTimeUpdates)
+		// A trip update is committed with its stop time updates, as it wouldn't be stored again without them
+		if err := c.added(1 + len(stopTimeUpdates)); err != nil {
+			return 0, 0, err
+		}
+	}
+	return trips, stops, c.commit()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/jmoiron/sqlx"
+	"google.golang.org/protobuf/proto"
+)
+
+// tripUpdatesFixture has updates of two trips, one without a timestamp of its own, a trip with a malformed
+// start time and a vehicle position. The last stop time update of trip-1 is returned as derived.
+func tripUpdatesFixture(timestamp uint64) (*gtfs.FeedMessage, map[*gtfs.TripUpdate_StopTimeUpdate]bool) {
+	trip := func(tripId, startTime string) *gtfs.TripDescriptor {
+		return &gtfs.TripDescriptor{TripId: proto.String(tripId), RouteId: proto.String("99"),
+			StartDate: proto.String("20240301"), StartTime: proto.String(startTime)}
+	}
+	stop := func(sequence uint32, arrival int64) *gtfs.TripUpdate_StopTimeUpdate {
+		return &gtfs.TripUpdate_StopTimeUpdate{StopSequence: proto.Uint32(sequence), Arrival: &gtfs.TripUpdate_StopTimeEvent{Time: proto.Int64(arrival)}}
+	}
+	derived := stop(3, int64(timestamp)+300)
+	feed := &gtfs.FeedMessage{
+		Header: &gtfs.FeedHeader{GtfsRealtimeVersion: proto.String("2.0"), Timestamp: proto.Uint64(timestamp + 10)},
+		Entity: []*gtfs.FeedEntity{
+			{Id: proto.String("trip-1"), TripUpdate: &gtfs.TripUpdate{
+				Trip:           trip("trip-1", "08:00:00"),
+				Timestamp:      proto.Uint64(timestamp),
+				StopTimeUpdate: []*gtfs.TripUpdate_StopTimeUpdate{stop(1, int64(timestamp)+60), stop(2, int64(timestamp)+180), derived},
+			}},
+			{Id: proto.String("trip-2"), TripUpdate: &gtfs.TripUpdate{
+				Trip:           trip("trip-2", "08:30:00"),
+				Vehicle:        &gtfs.VehicleDescriptor{Id: proto.String("bus-2")},
+				Delay:          proto.Int32(120),
+				StopTimeUpdate: []*gtfs.TripUpdate_StopTimeUpdate{stop(5, int64(timestamp)+600)},
+			}},
+			{Id: proto.String("trip-3"), TripUpdate: &gtfs.TripUpdate{Trip: trip("trip-3", "2x:00:00"), Timestamp: proto.Uint64(timestamp)}},
+			{Id: proto.String("bus-1"), Vehicle: &gtfs.VehiclePosition{
+				Trip:      trip("trip-1", "08:00:00"),
+				Vehicle:   &gtfs.VehicleDescriptor{Id: proto.String("bus-1")},
+				Timestamp: proto.Uint64(timestamp),
+			}},
+		},
+	}
+	return feed, map[*gtfs.TripUpdate_StopTimeUpdate]bool{derived: true}
+}
+
+func createTripUpdatesDatabase(t *testing.T) (*sqlx.DB, Config) {
+	t.Helper()
+	dataDir := t.TempDir()
+	config := Config{DataDir: dataDir, FeedId: "test"}
+	db, err := createDatabase(filepath.Join(dataDir, "realtime.db"), config.FeedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, config
+}
+
+func TestAddTripUpdates(t *testing.T) {
+	db, config := createTripUpdatesDatabase(t)
+	feed, derived := tripUpdatesFixture(1709280000)
+	trips, stops, err := addTripUpdates(feed, db, config.FeedId, nil, time.UTC, derived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trips != 2 || stops != 4 {
+		t.Errorf("added %d trip updates and %d stop time updates, want 2 and 4", trips, stops)
+	}
+	// A republished feed adds nothing
+	if trips, stops, err = addTripUpdates(feed, db, config.FeedId, nil, time.UTC, derived); err != nil {
+		t.Fatal(err)
+	} else if trips != 0 || stops != 0 {
+		t.Errorf("added %d trip updates and %d stop time updates again", trips, stops)
+	}
+
+	var updates []TripUpdate
+	if err := db.Select(&updates, "SELECT "+selectColumns(tripUpdateColumns)+" FROM trip_updates ORDER BY trip_id"); err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 {
+		t.Fatalf("stored %d trip updates, want 2", len(updates))
+	}
+	if tu := updates[0]; tu.TripId != "trip-1" || tu.TimestampUnix != 1709280000 || tu.StartTimeUnix != 1709280000 {
+		t.Errorf("stored trip-1 as %+v", tu)
+	}
+	// Without a timestamp of its own, an update gets the feed's
+	if tu := updates[1]; tu.TripId != "trip-2" || tu.TimestampUnix != 1709280010 || tu.Delay == nil || *tu.Delay != 120 ||
+		tu.VehicleId == nil || *tu.VehicleId != "bus-2" {
+		t.Errorf("stored trip-2 as %+v", tu)
+	}
+
+	var stored []StopTimeUpdate
+	if err := db.Select(&stored, "SELECT "+selectColumns(stopTimeUpdateColumns)+" FROM stop_time_updates WHERE trip_id = 'trip-1' ORDER BY update_index"); err != nil {
+		t.Fatal(err)
+	}
+	type stop struct {
+		sequence uint32
+		arrival  int64
+		derived  bool
+	}
+	var got []stop
+	for _, s := range stored {
+		got = append(got, stop{*s.StopSequence, *s.ArrivalTime, s.Derived})
+	}
+	want := []stop{{1, 1709280060, false}, {2, 1709280180, false}, {3, 1709280300, true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stored stop time updates of trip-1 %+v, want %+v", got, want)
+	}
+}
+
+func TestArchiveTripUpdates(t *testing.T) {
+	db, config := createTripUpdatesDatabase(t)
+	archiveDir := feedArchiveDir(config)
+	path := filepath.Join(monthDir(filepath.Join(archiveDir, tripUpdatesArchiveDir), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)), tripUpdatesArchiveFile)
+	// A later update of trip-1 is appended to the archived file, and the rest of the feed, still in the database,
+	// isn't archived again
+	for _, timestamp := range []uint64{1709280000, 1709280060} {
+		feed, derived := tripUpdatesFixture(timestamp)
+		if _, _, err := addTripUpdates(feed, db, config.FeedId, nil, time.UTC, derived); err != nil {
+			t.Fatal(err)
+		}
+		if err := archivePartitions(db, archiveDir, config.Archive, provenanceOf(config)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rows []archivedTripUpdate
+	if err := readArchivedTripUpdates(path, func(batch []archivedTripUpdate) error {
+		rows = append(rows, batch...)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	type update struct {
+		tripId    string
+		timestamp int64
+		stops     []uint32
+	}
+	var got []update
+	for _, row := range rows {
+		u := update{tripId: row.TripId, timestamp: row.Timestamp.Unix()}
+		for _, s := range row.StopTimeUpdates {
+			u.stops = append(u.stops, *s.StopSequence)
+		}
+		got = append(got, u)
+		if row.FeedId != config.FeedId || row.Year != 2024 || row.Month != 3 {
+			t.Errorf("archived %s at %s in feed %q and partition %d-%d", row.TripId, row.Timestamp, row.FeedId, row.Year, row.Month)
+		}
+	}
+	want := []update{
+		{"trip-1", 1709280000, []uint32{1, 2, 3}},
+		{"trip-2", 1709280010, []uint32{5}},
+		{"trip-1", 1709280060, []uint32{1, 2, 3}},
+		{"trip-2", 1709280070, []uint32{5}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("archived %+v, want %+v", got, want)
+	}
+	if derived := rows[0].StopTimeUpdates[2]; !derived.Derived || *derived.ArrivalTime != 1709280300 {
+		t.Errorf("archived the derived stop time update of trip-1 as %+v", derived)
+	}
+}
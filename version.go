@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Set at build time with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+// The commit and date otherwise fall back to the VCS information embedded by the Go toolchain.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+const bindingsModule = "github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+
+// versionString describes the build, e.g. "gtfs-scraper dev (commit abc123, built 2024-07-01T00:00:00Z, gtfs-realtime-bindings v1.0.0)".
+func versionString() string {
+	buildCommit, date, bindings := commit, buildDate, "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && buildCommit == "":
+				buildCommit = setting.Value
+			case setting.Key == "vcs.time" && date == "":
+				date = setting.Value
+			}
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == bindingsModule {
+				bindings = dep.Version
+			}
+		}
+	}
+	if buildCommit == "" {
+		buildCommit = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return fmt.Sprintf("gtfs-scraper %s (commit %s, built %s, gtfs-realtime-bindings %s)", version, buildCommit, date, bindings)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type WebhookConfig struct {
+	URL string
+	// Secret is used to sign the request body with HMAC-SHA256. Requests are unsigned if empty.
+	Secret string
+	// MaxRetries is how many times a failed delivery is retried, defaulting to 3. Zero delivers once only.
+	// Retries stop once the delivery's deadline of 10 seconds has passed.
+	MaxRetries *int
+}
+
+const (
+	defaultWebhookRetries = 3
+	webhookTimeout        = 30 * time.Second
+	signatureHeader       = "X-Gtfs-Scraper-Signature"
+	timestampHeader       = "X-Gtfs-Scraper-Timestamp"
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// webhookDeadline bounds each poll's deliveries, including retries, well under a poll interval,
+// so an unreachable endpoint doesn't hold up the polls after it.
+var webhookDeadline = 10 * time.Second
+
+// checkWebhooks validates the webhooks of each feed.
+func checkWebhooks(configs []Config) error {
+	for _, c := range configs {
+		for _, webhook := range c.Webhooks {
+			if webhook.MaxRetries != nil && *webhook.MaxRetries < 0 {
+				return fmt.Errorf("webhook %s: MaxRetries can't be negative", webhook.URL)
+			}
+		}
+	}
+	return nil
+}
+
+// signPayload computes the hex-encoded HMAC-SHA256 of a timestamp and request body.
+// Including the timestamp lets receivers reject replayed deliveries.
+func signPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook delivers a single payload to a webhook, retrying with exponential backoff
+// on network errors, rate limiting and server errors until ctx is done.
+func postWebhook(ctx context.Context, webhook WebhookConfig, body []byte) error {
+	retries := defaultWebhookRetries
+	if webhook.MaxRetries != nil {
+		retries = *webhook.MaxRetries
+	}
+
+	backoff := time.Second
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return fmt.Errorf("webhook %s: gave up after %d attempts: %w", webhook.URL, attempt, err)
+			}
+			backoff *= 2
+		}
+
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(timestampHeader, timestamp)
+		if webhook.Secret != "" {
+			req.Header.Set(signatureHeader, signPayload(webhook.Secret, timestamp, body))
+		}
+
+		var resp *http.Response
+		resp, err = webhookClient.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("webhook %s returned %s", webhook.URL, resp.Status)
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			// Client errors other than rate limiting won't succeed on retry
+			return err
+		}
+	}
+	return err
+}
+
+// deliverWebhooks POSTs newly inserted vehicle positions as a JSON array to every configured webhook at once,
+// giving up on those not delivered within webhookDeadline. Empty batches are not delivered.
+func deliverWebhooks(webhooks []WebhookConfig, positions []VehiclePosition, logger *slog.Logger) error {
+	if len(webhooks) == 0 || len(positions) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(positions)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookDeadline)
+	defer cancel()
+	errs := make([]error, len(webhooks))
+	var wg sync.WaitGroup
+	for i, webhook := range webhooks {
+		wg.Add(1)
+		go func(i int, webhook WebhookConfig) {
+			defer wg.Done()
+			if errs[i] = postWebhook(ctx, webhook, body); errs[i] == nil {
+				logger.Debug("Delivered positions to a webhook", "positions", len(positions), "url", webhook.URL)
+			}
+		}(i, webhook)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
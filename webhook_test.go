@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostWebhookRetries(t *testing.T) {
+	retries := func(n int) *int { return &n }
+	tests := []struct {
+		name       string
+		maxRetries *int
+		status     int
+		want       int
+	}{
+		{"no retries", retries(0), http.StatusServiceUnavailable, 1},
+		{"one retry", retries(1), http.StatusServiceUnavailable, 2},
+		{"client error", nil, http.StatusBadRequest, 1},
+		{"success", retries(0), http.StatusNoContent, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if got := r.Header.Get(signatureHeader); got != signPayload("secret", r.Header.Get(timestampHeader), []byte("[]")) {
+					t.Errorf("got signature %q", got)
+				}
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+			err := postWebhook(context.Background(), WebhookConfig{URL: server.URL, Secret: "secret", MaxRetries: test.maxRetries}, []byte("[]"))
+			if (err == nil) != (test.status < 300) {
+				t.Errorf("got error %v for status %d", err, test.status)
+			}
+			if attempts != test.want {
+				t.Errorf("got %d attempts, want %d", attempts, test.want)
+			}
+		})
+	}
+}
+
+// An endpoint that doesn't answer is given up on at the deadline, without holding up delivery to the others.
+func TestDeliverWebhooksDeadline(t *testing.T) {
+	defer func(deadline time.Duration) { webhookDeadline = deadline }(webhookDeadline)
+	webhookDeadline = 200 * time.Millisecond
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+	delivered := 0
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered++
+	}))
+	defer working.Close()
+
+	start := time.Now()
+	err := deliverWebhooks([]WebhookConfig{{URL: hung.URL}, {URL: working.URL}}, []VehiclePosition{{VehicleId: "bus-1"}}, slog.Default())
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("delivery took %v", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), hung.URL) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want the hung webhook's deadline", err)
+	}
+	if delivered != 1 {
+		t.Errorf("delivered %d times to the working webhook, want 1", delivered)
+	}
+}
+
+func TestCheckWebhooks(t *testing.T) {
+	retries := func(n int) *int { return &n }
+	for _, test := range []struct {
+		maxRetries *int
+		valid      bool
+	}{{nil, true}, {retries(0), true}, {retries(5), true}, {retries(-1), false}} {
+		err := checkWebhooks([]Config{{Webhooks: []WebhookConfig{{URL: "http://example.com/", MaxRetries: test.maxRetries}}}})
+		if (err == nil) != test.valid {
+			t.Errorf("MaxRetries %v: got error %v", test.maxRetries, err)
+		}
+	}
+}